@@ -0,0 +1,25 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+dud commit
+
+# Nothing is logged unless enabled.
+test ! -e .dud/audit.log
+
+echo 'audit-log: true' >> .dud/config.yaml
+
+rm foo.txt
+echo 'bar' > foo.txt
+dud commit
+rm foo.txt
+dud checkout --copy
+
+test "$(wc -l < .dud/audit.log)" -eq 2
+grep '"operation":"commit"' .dud/audit.log | grep -q '"path":"foo.txt"'
+grep '"operation":"checkout"' .dud/audit.log | grep -q '"strategy":"copy"'
@@ -0,0 +1,34 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init --bare ../bare
+
+dud init
+
+echo "remote: $(cd ../bare && pwd)" >> .dud/config.yaml
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > data/bar.txt
+
+dud stage gen -o data > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+dud push
+
+if dud init --bare ../bare; then
+    echo 1>&2 'expected failure due to non-empty directory'
+    exit 1
+fi
+
+rm -rf .dud/cache data
+
+dud fetch
+
+dud checkout
+
+diff <(echo 'foo') data/foo.txt
+diff <(echo 'bar') data/bar.txt
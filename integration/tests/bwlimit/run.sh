@@ -0,0 +1,38 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init --bare ../bare
+
+dud init
+
+echo "remote: $(cd ../bare && pwd)" >> .dud/config.yaml
+
+head -c 200000 /dev/urandom > data.bin
+
+dud stage gen -o data.bin > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+if dud push --bwlimit fast; then
+    echo 1>&2 'expected failure due to invalid bandwidth limit'
+    exit 1
+fi
+
+# 200KB at 100KB/s takes at least a second.
+start=$(date +%s%N)
+dud push --bwlimit 100KB
+elapsed_ms=$(( ($(date +%s%N) - start) / 1000000 ))
+test "$elapsed_ms" -ge 900
+
+rm -rf .dud/cache data.bin
+
+echo 'bwlimit: 100KB' >> .dud/config.yaml
+
+start=$(date +%s%N)
+dud pull
+elapsed_ms=$(( ($(date +%s%N) - start) / 1000000 ))
+test "$elapsed_ms" -ge 900
+
+test "$(wc -c < data.bin)" -eq 200000
@@ -0,0 +1,32 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+dud commit
+
+diff <(echo '0 orphaned objects (0 B)') <(dud cache orphans)
+
+old_blob="$(dud path foo.txt)"
+old_checksum="$(basename "$(dirname "$old_blob")")$(basename "$old_blob")"
+
+rm foo.txt
+echo 'foobar' > foo.txt
+dud commit
+
+diff <(dud cache orphans) - <<EOS
+$old_checksum  4
+1 orphaned objects (4 B)
+EOS
+
+# Listing orphans never removes them.
+test -f "$old_blob"
+
+# Objects linked from the workspace aren't orphans with --verify-links.
+ln -s "$old_blob" old.txt
+diff <(echo '0 orphaned objects (0 B)') <(dud cache orphans --verify-links)
+dud cache orphans | grep -q "^$old_checksum"
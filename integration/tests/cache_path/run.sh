@@ -0,0 +1,29 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > data/bar.txt
+
+dud stage gen -o data > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+manifest="$(dud path data)"
+test -f "$manifest"
+grep -q '"foo.txt"' "$manifest"
+
+dud path --children data > children.txt
+test "$(wc -l < children.txt)" -eq 2
+while read -r blob; do
+    test -f "$blob"
+done < children.txt
+
+if dud path --children data/foo.txt; then
+    echo 1>&2 'expected failure for a file that is not a stage output'
+    exit 1
+fi
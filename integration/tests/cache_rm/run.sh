@@ -0,0 +1,39 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+
+dud stage gen -o foo.txt -o bar.txt > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+foo_blob="$(dud path foo.txt)"
+foo_checksum="$(basename "$(dirname "$foo_blob")")$(basename "$foo_blob")"
+
+if dud cache rm "$foo_checksum"; then
+    echo 1>&2 'expected failure due to workspace link'
+    exit 1
+fi
+test -f "$foo_blob"
+
+rm foo.txt
+dud checkout --copy
+
+dud cache rm "$foo_checksum" 2> stderr.txt
+grep -q 'still referenced by the index' stderr.txt
+test ! -e "$foo_blob"
+
+if dud cache rm "$foo_checksum"; then
+    echo 1>&2 'expected failure due to missing object'
+    exit 1
+fi
+
+if dud cache rm not/a/checksum; then
+    echo 1>&2 'expected failure due to invalid checksum'
+    exit 1
+fi
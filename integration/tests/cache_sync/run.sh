@@ -0,0 +1,36 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -o bar.txt > bar.yaml
+
+dud stage add foo.yaml bar.yaml
+
+dud commit foo.yaml
+
+dud cache sync .dud/cache backup | grep -q 'Copied 1 objects'
+
+dud commit bar.yaml
+
+# Only the new object is copied.
+diff <(echo 'Copied 1 objects.') <(dud cache sync --verify .dud/cache backup)
+
+test "$(find backup -type f | wc -l)" -eq 2
+
+rm -rf .dud/cache
+dud cache sync backup .dud/cache
+
+dud status --format porcelain --no-lock-check > status.txt
+diff <(printf '   bar.txt\n   foo.txt\n') status.txt
+
+# Remove bar.txt from the workspace and cache, then prune the backup.
+rm bar.txt
+rm "$(dud path bar.txt)"
+diff <(printf 'Copied 0 objects.\nDeleted 1 objects.\n') \
+    <(dud cache sync --delete .dud/cache backup)
+test "$(find backup -type f | wc -l)" -eq 1
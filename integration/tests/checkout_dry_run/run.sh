@@ -0,0 +1,41 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > bar.txt
+echo 'baz' > baz.txt
+
+dud stage gen -o data > data.yaml
+dud stage gen -o bar.txt -o baz.txt > bar.yaml
+
+dud stage add data.yaml bar.yaml
+
+dud commit
+
+rm data/foo.txt bar.txt
+echo 'modified' > baz.txt.new
+rm baz.txt
+mv baz.txt.new baz.txt
+
+expected='create    bar.txt
+conflict  baz.txt
+update    data'
+diff <(echo "$expected") <(dud checkout --dry-run)
+
+expected='create     bar.txt
+overwrite  baz.txt
+overwrite  data'
+diff <(echo "$expected") <(dud checkout --dry-run --hard)
+
+# The dry runs didn't touch the workspace.
+test ! -e bar.txt
+test ! -e data/foo.txt
+diff <(echo 'modified') baz.txt
+
+dud checkout --hard --force
+
+expected='skip  data'
+diff <(echo "$expected") <(dud checkout --dry-run data.yaml)
@@ -0,0 +1,34 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > data/bar.txt
+
+dud stage gen -o data > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+rm data/foo.txt
+echo 'modified' > data/foo.txt
+echo 'junk' > data/junk.txt
+mkdir data/junk_dir
+
+# Confirmation is required, and standard input isn't a terminal.
+if dud checkout --hard < /dev/null; then
+    echo 1>&2 'expected failure without --force'
+    exit 1
+fi
+
+test -f data/junk.txt
+
+dud checkout --hard --force
+
+test ! -e data/junk.txt
+test ! -e data/junk_dir
+test -L data/foo.txt
+diff <(echo '   data') <(dud status --format porcelain --no-lock-check)
@@ -0,0 +1,35 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'a' > data/a.txt
+echo 'b' > data/sub/b.txt
+echo 'c' > data/sub/c.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+dud commit
+
+rm -rf data
+
+dud checkout data/sub/b.txt
+
+test -L data/sub/b.txt
+diff <(echo 'b') data/sub/b.txt
+test ! -e data/a.txt
+test ! -e data/sub/c.txt
+
+# The rest of the directory is reported as missing, not as an error.
+dud status
+
+# Checking out the whole stage fills in the rest.
+dud checkout data.yaml
+test -L data/a.txt
+test -L data/sub/c.txt
+
+if dud checkout data/missing.txt; then
+  echo 'expected checkout of a missing file to fail' >&2
+  exit 1
+fi
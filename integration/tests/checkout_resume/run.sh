@@ -0,0 +1,29 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+for i in $(seq 1 20); do echo "$i" > "data/$i.txt"; done
+dud stage gen -o data/ > data.yaml
+dud stage add data.yaml
+dud commit --copy
+
+# Simulate an interrupted copy checkout: some files are missing, one was only
+# partially written.
+rm data/1*.txt
+mv data/2.txt data/.2.txt.dud-partial
+: > data/.2.txt.dud-partial
+
+dud checkout --copy
+test ! -e data/.2.txt.dud-partial
+for i in $(seq 1 20); do test "$(cat "data/$i.txt")" = "$i"; done
+test "$(dud status --format porcelain)" = "$(printf '   data.yaml\n   data')"
+
+# A modified copy is still not overwritten without --hard.
+echo 'changed' > data/3.txt
+if dud checkout --copy; then
+    echo "expected checkout to fail" >&2
+    exit 1
+fi
+test "$(cat data/3.txt)" = 'changed'
@@ -0,0 +1,23 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+head -c 300000 /dev/urandom > data.bin
+dud stage gen -o data.bin > data.yaml
+dud stage add data.yaml
+dud commit --copy
+default_checksum="$(grep -A1 'data.bin:' data.yaml | grep checksum)"
+
+# The buffer size doesn't change checksums.
+echo 'checksum-buffer-size: 4KB' >> .dud/config.yaml
+dud status | grep 'data.bin *up-to-date'
+dud commit --copy
+test "$(grep -A1 'data.bin:' data.yaml | grep checksum)" = "$default_checksum"
+
+sed -i 's/^checksum-buffer-size: .*/checksum-buffer-size: lots/' .dud/config.yaml
+if dud status 2> err.txt; then
+    echo "expected an invalid buffer size to fail" >&2
+    exit 1
+fi
+grep 'invalid checksum buffer size' err.txt
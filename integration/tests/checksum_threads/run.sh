@@ -0,0 +1,31 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+seq 1 100000 > log.txt
+
+cat > log.yaml <<EOS
+outputs:
+  log.txt:
+    chunked: true
+EOS
+
+dud stage add log.yaml
+
+dud commit --threads 4
+checksum="$(grep 'checksum:' log.yaml | tail -n 1)"
+diff <(echo '   log.txt') <(dud status --format porcelain --no-lock-check --threads 4)
+
+# The number of threads never affects the checksum.
+echo 'checksum-threads: 2' >> .dud/config.yaml
+dud commit
+diff <(echo "$checksum") <(grep 'checksum:' log.yaml | tail -n 1)
+
+echo 'more' >> log.txt
+diff <(echo ' M log.txt') <(dud status --format porcelain --no-lock-check)
+
+if dud status --threads -1; then
+  echo 'expected negative threads to fail' >&2
+  exit 1
+fi
@@ -0,0 +1,41 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init --bare ../bare
+
+dud init
+
+echo "remote: $(cd ../bare && pwd)" >> .dud/config.yaml
+
+echo 'line 1' > log.txt
+
+cat > log.yaml <<EOS
+outputs:
+  log.txt:
+    chunked: true
+EOS
+
+dud stage add log.yaml
+
+dud commit
+
+# Chunked artifacts stay in the workspace as regular files.
+test -f log.txt
+test ! -L log.txt
+diff <(echo '   log.txt') <(dud status --format porcelain --no-lock-check)
+
+echo 'line 2' >> log.txt
+diff <(echo ' M log.txt') <(dud status --format porcelain --no-lock-check)
+
+dud commit
+diff <(echo '   log.txt') <(dud status --format porcelain --no-lock-check)
+
+dud push
+
+rm -rf .dud/cache log.txt
+
+dud fetch
+
+dud checkout
+
+diff <(printf 'line 1\nline 2\n') log.txt
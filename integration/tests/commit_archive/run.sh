@@ -0,0 +1,49 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p src/sub
+echo 'foo' > src/a.txt
+echo 'bar' > src/sub/b.txt
+tar -czf data.tar.gz -C src .
+(cd src && python3 -m zipfile -c ../data.zip a.txt sub)
+
+cat > data.yaml <<EOS
+outputs:
+  data:
+    is-dir: true
+EOS
+dud stage add data.yaml
+
+dud commit-archive data.tar.gz data
+# The workspace is left untouched.
+test ! -e data
+dud status data.yaml | grep 'data.yaml *stage definition up-to-date'
+dud checkout
+diff -r src data
+checksum="$(grep -A 1 'data:' data.yaml)"
+
+# The same files give the same checksum, whatever the archive format.
+rm -r data
+dud commit-archive data.zip data
+diff <(echo "$checksum") <(grep -A 1 'data:' data.yaml)
+
+# ...and the same checksum as committing the extracted directory.
+cp -r src data
+dud commit --force
+diff <(echo "$checksum") <(grep -A 1 'data:' data.yaml)
+
+if dud commit-archive data.tar.gz missing 2> err.txt; then
+    echo 1>&2 'expected failure due to unknown artifact'
+    exit 1
+fi
+grep -q 'not the output of any stage' err.txt
+
+ln -s a.txt src/link
+tar -cf bad.tar -C src .
+if dud commit-archive bad.tar data 2> err.txt; then
+    echo 1>&2 'expected failure due to symlink in archive'
+    exit 1
+fi
+grep -q 'not a regular file or directory' err.txt
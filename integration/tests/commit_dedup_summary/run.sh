@@ -0,0 +1,24 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/a.txt
+echo 'foo' > data/b.txt
+echo 'bar' > data/c.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+
+dud commit | grep 'committed' > summary.txt
+
+diff summary.txt - <<EOS
+committed 3 files, 1 already in the cache (deduplication saved 4 B)
+EOS
+
+# Nothing is committed when everything is up-to-date.
+if dud commit | grep 'committed'; then
+    echo 1>&2 'expected no summary'
+    exit 1
+fi
@@ -0,0 +1,34 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -i foo.txt -o bar.txt -- cp foo.txt bar.txt > bar.yaml
+cp foo.txt bar.txt
+dud stage add foo.yaml bar.yaml
+dud commit
+
+# Freeze the upstream stage and change its output. Freezing a stage doesn't
+# modify its definition.
+echo 'frozen: true' >> foo.yaml
+frozen="$(cat foo.yaml)"
+rm foo.txt
+echo 'new foo' > foo.txt
+
+dud commit | tee commit.txt
+grep 'skipping frozen stage foo.yaml' commit.txt
+test "$(cat foo.yaml)" = "$frozen"
+dud status foo.yaml | grep 'foo.yaml *stage definition up-to-date (frozen)'
+diff <(dud status --format porcelain --no-lock-check foo.yaml) - <<EOS
+ M foo.txt
+EOS
+
+# Thawing commits the frozen stage like any other and keeps the field.
+dud commit --thaw foo.yaml
+grep 'frozen: true' foo.yaml
+diff <(dud status --format porcelain foo.yaml) - <<EOS
+   foo.yaml
+   foo.txt
+EOS
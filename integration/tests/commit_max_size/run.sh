@@ -0,0 +1,28 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+head -c 2048 /dev/zero > big.bin
+echo 'small' > small.bin
+
+dud stage gen -o big.bin > big.yaml
+dud stage gen -o small.bin > small.yaml
+
+dud stage add big.yaml small.yaml
+
+if dud commit --max-size 1KB big.yaml; then
+    echo 'expected commit of big.bin to fail' >&2
+    exit 1
+fi
+
+# The file is left untouched and nothing is added to the cache.
+test -f big.bin
+test ! -L big.bin
+test -z "$(find .dud/cache -type f)"
+
+dud commit --max-size 1KB small.yaml
+test -L small.bin
+
+dud commit --max-size 2KB big.yaml
+test -L big.bin
@@ -0,0 +1,21 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+dud commit --copy
+
+# Edit the stage definition without changing its output.
+sed -i 's/^working-dir: \(.*\)/working-dir: \1\ncommand: cat bar.txt/' foo.yaml
+dud status | grep 'foo.yaml *stage definition modified'
+
+old_checksum="$(grep -m1 '^checksum:' foo.yaml)"
+dud commit --copy
+test "$(grep -m1 '^checksum:' foo.yaml)" != "$old_checksum"
+
+dud status | grep 'foo.yaml *stage definition up-to-date'
+dud status | grep 'foo.txt *up-to-date'
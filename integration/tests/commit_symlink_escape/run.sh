@@ -0,0 +1,16 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/foo.txt
+ln -s /etc data/etc
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+
+if dud commit 2> err.txt; then
+    exit 1
+fi
+grep 'data/etc: refusing to commit symlink to /etc, which is outside of the project' err.txt
@@ -0,0 +1,32 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+for i in $(seq 1 20); do
+    seq 1 "$((i * 1000))" > "data/$i.txt"
+    seq 1 "$i" > "data/sub/$i.txt"
+done
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+
+dud commit --copy --threads-io 1 --threads-cpu 1
+checksum="$(grep -A 1 'data:' data.yaml)"
+diff <(echo '   data') <(dud status --format porcelain | grep ' data$')
+
+# The number of threads never affects the checksum.
+cat >> .dud/config.yaml <<EOS
+threads-io: 4
+threads-cpu: 2
+EOS
+dud commit --copy --force
+diff <(echo "$checksum") <(grep -A 1 'data:' data.yaml)
+
+dud commit --copy --force --threads-io 64 --threads-cpu 8
+diff <(echo "$checksum") <(grep -A 1 'data:' data.yaml)
+
+if dud commit --threads-cpu -1; then
+  echo 'expected negative threads to fail' >&2
+  exit 1
+fi
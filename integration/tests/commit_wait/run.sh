@@ -0,0 +1,23 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+rm foo.txt
+
+if dud commit --wait 200ms 2> err.txt; then
+    echo 1>&2 'expected failure due to missing output'
+    exit 1
+fi
+grep -q 'still missing after waiting 200ms' err.txt
+
+(sleep 1 && echo 'foo' > foo.tmp && mv foo.tmp foo.txt) &
+
+dud commit --wait 30s
+
+wait
+
+diff <(echo '   foo.txt') <(dud status --format porcelain | grep foo.txt)
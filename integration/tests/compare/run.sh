@@ -0,0 +1,38 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p v1/data v2/data
+for v in v1 v2; do
+    echo 'same' > $v/data/same.txt
+    echo 'same' > $v/model.bin
+done
+echo 'old' > v1/data/changed.txt
+echo 'new' > v2/data/changed.txt
+echo 'extra' > v2/data/extra.txt
+
+cat > v1.yaml <<EOS
+working-dir: v1
+outputs:
+  v1/data: {is-dir: true}
+  v1/model.bin: {}
+EOS
+sed 's/v1/v2/g' v1.yaml > v2.yaml
+dud stage add v1.yaml v2.yaml
+dud commit
+
+# Outputs are matched by their paths relative to each stage's working dir.
+if dud compare v1.yaml v2.yaml > compare.txt; then
+    exit 1
+fi
+diff compare.txt - <<EOS
+data  differs
+  data/changed.txt
+  data/extra.txt
+model.bin  matches
+EOS
+
+# Stages compared need not be in the index.
+cp v1.yaml copy.yaml
+dud compare v1.yaml copy.yaml
@@ -0,0 +1,29 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'content-defined-chunking: true' >> .dud/config.yaml
+
+seq 1 200000 > log.txt
+
+cat > log.yaml <<EOS
+outputs:
+  log.txt:
+    chunked: true
+EOS
+
+dud stage add log.yaml
+
+dud commit
+test ! -L log.txt
+diff <(echo '   log.txt') <(dud status --format porcelain --no-lock-check)
+
+echo 'more' >> log.txt
+diff <(echo ' M log.txt') <(dud status --format porcelain --no-lock-check)
+
+dud commit
+cp log.txt expected.txt
+rm log.txt
+dud checkout
+diff expected.txt log.txt
@@ -0,0 +1,23 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+echo 'detect-content-types: true' >> .dud/config.yaml
+
+echo 'a,b,c' > table.csv
+mkdir pages
+echo '<html><body>hi</body></html>' > pages/index.html
+
+dud stage gen -o table.csv -o pages > data.yaml
+dud stage add data.yaml
+dud commit
+
+grep -A3 'table.csv:' data.yaml | grep 'content-type: text/plain; charset=utf-8'
+dud status --format json | grep -q '"content-type":"text/html; charset=utf-8"'
+
+# Content types don't affect the stage checksum, so editing one by hand
+# leaves the stage up-to-date, and committing keeps the edit.
+sed -i 's|content-type: text/plain; charset=utf-8|content-type: text/csv|' data.yaml
+test -z "$(dud status --stale --format porcelain)"
+dud commit
+grep 'content-type: text/csv' data.yaml
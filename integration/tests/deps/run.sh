@@ -0,0 +1,28 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir raw
+echo 'data' > raw/data.csv
+
+dud stage gen -o raw > raw.yaml
+dud stage gen -i raw/data.csv -o clean.csv -- cp raw/data.csv clean.csv > clean.yaml
+dud stage gen -i clean.csv -o model.pkl -- cp clean.csv model.pkl > train.yaml
+dud stage gen -i clean.csv -i model.pkl -o report.html -- cat clean.csv model.pkl '>' report.html > report.yaml
+
+dud stage add raw.yaml clean.yaml train.yaml report.yaml
+
+expected='clean.yaml
+train.yaml
+report.yaml'
+diff <(echo "$expected") <(dud deps raw/data.csv)
+diff <(echo "$expected") <(dud deps raw.yaml)
+
+# Paths are relative to the working directory.
+cd raw
+diff <(echo "$expected") <(dud deps data.csv)
+cd ..
+
+diff <(echo 'report.yaml') <(dud deps model.pkl)
+diff /dev/null <(dud deps report.html)
@@ -0,0 +1,21 @@
+#!/bin/bash
+set -euo pipefail
+
+mkdir project
+dud -C project init
+
+echo 'foo' > project/foo.txt
+dud -C project stage gen -o foo.txt > project/foo.yaml
+dud --dir project stage add foo.yaml
+dud -C project commit
+
+# Nothing was created outside the project.
+test ! -e .dud
+
+test -L project/foo.txt
+diff <(echo '   foo.txt') <(dud -C project status --format porcelain --no-lock-check)
+
+# A missing directory is an error.
+if dud -C nowhere status; then
+    exit 1
+fi
@@ -0,0 +1,56 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'a' > data/a.parquet
+echo 'b' > data/sub/b.parquet
+echo 'notes' > data/notes.txt
+echo 'tmp' > data/_tmp_c.parquet
+
+cat > data.yaml <<EOS
+outputs:
+  data:
+    is-dir: true
+    include: ['*.parquet']
+    exclude: ['_tmp_*']
+EOS
+
+dud stage add data.yaml
+
+dud commit
+
+diff <(printf '   data.yaml\n   data\n') <(dud status --format porcelain)
+
+# Ignored files don't affect the status.
+echo 'more notes' >> data/notes.txt
+diff <(printf '   data.yaml\n   data\n') <(dud status --format porcelain)
+
+# Ignored files aren't linked to the cache.
+test -L data/a.parquet
+test -L data/sub/b.parquet
+test ! -L data/notes.txt
+test ! -L data/_tmp_c.parquet
+
+# A hard reset leaves ignored files alone.
+rm data/a.parquet
+dud checkout --hard --force
+test -L data/a.parquet
+test -f data/notes.txt
+test -f data/_tmp_c.parquet
+
+# New files matching the patterns are detected.
+echo 'd' > data/d.parquet
+diff <(printf '   data.yaml\n M data\n') <(dud status --format porcelain)
+
+cat > bad.yaml <<EOS
+outputs:
+  bad.txt:
+    include: ['*.txt']
+EOS
+
+if dud stage add bad.yaml; then
+    echo 1>&2 'expected failure due to patterns on a file artifact'
+    exit 1
+fi
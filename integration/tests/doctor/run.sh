@@ -0,0 +1,74 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+mkdir data
+echo 'bar' > data/bar.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -o data > data.yaml
+
+dud stage add foo.yaml data.yaml
+
+dud commit --atomic-manifest
+
+expected='ok    project is unlocked
+ok    cache directory is writable
+ok    stages load without conflicts
+ok    workspace links point into the cache
+ok    committed manifests are intact
+ok    cache objects are referenced'
+diff <(echo "$expected") <(dud doctor)
+
+# Re-committing leaves the old version in the cache.
+rm foo.txt
+echo 'new foo' > foo.txt
+dud commit foo.yaml
+dud doctor > doctor.txt
+grep -q '^warn  cache objects are referenced' doctor.txt
+
+# A link pointing outside the cache fails the check.
+rm data/bar.txt
+ln -s "$(pwd)/foo.txt" data/bar.txt
+if dud doctor > doctor.txt; then
+    echo 1>&2 'expected failure due to bad link'
+    exit 1
+fi
+grep -q '^FAIL  workspace links point into the cache' doctor.txt
+grep -q 'data/bar.txt links outside the cache' doctor.txt
+dud checkout --relink
+
+# A missing stage file fails the check, and skips the orphan check.
+mv data.yaml data.yaml.bak
+if dud doctor > doctor.txt; then
+    echo 1>&2 'expected failure due to missing stage file'
+    exit 1
+fi
+grep -q '^FAIL  stages load without conflicts' doctor.txt
+grep -q '^skip  cache objects are referenced' doctor.txt
+mv data.yaml.bak data.yaml
+
+# A truncated directory manifest fails the check, and skips the orphan check.
+checksum="$(grep -A1 '^  data:' data.yaml | grep checksum | awk '{print $2}')"
+manifest=".dud/cache/${checksum:0:2}/${checksum:2}"
+cp "$manifest" manifest.bak
+chmod u+w "$manifest"
+echo '{"Contents": {' > "$manifest"
+if dud doctor > doctor.txt; then
+    echo 1>&2 'expected failure due to corrupt manifest'
+    exit 1
+fi
+grep -q '^FAIL  committed manifests are intact' doctor.txt
+grep -q "data has a corrupt manifest $checksum" doctor.txt
+grep -q '^skip  cache objects are referenced' doctor.txt
+cp manifest.bak "$manifest"
+rm manifest.bak
+
+touch .dud/lock
+if dud doctor > doctor.txt; then
+    echo 1>&2 'expected failure due to lock file'
+    exit 1
+fi
+grep -q '^FAIL  project is unlocked' doctor.txt
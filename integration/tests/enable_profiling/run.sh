@@ -5,24 +5,40 @@ dud init
 
 dud --profile stage gen -o foo.txt
 
-if ! test -s dud.pprof; then
-    echo 'profiling output does not exist or is empty' 1>&2
-    exit 1
-fi
+for f in cpu.pprof heap.pprof; do
+    if ! test -s "$f"; then
+        echo "profiling output $f does not exist or is empty" 1>&2
+        exit 1
+    fi
+done
+
+rm cpu.pprof heap.pprof
 
 # Commands that fail should still generate profiling output.
 dud --profile stage add foo.yaml || true
 
-if ! test -s dud.pprof; then
-    echo 'profiling output does not exist or is empty' 1>&2
-    exit 1
-fi
+for f in cpu.pprof heap.pprof; do
+    if ! test -s "$f"; then
+        echo "profiling output $f does not exist or is empty" 1>&2
+        exit 1
+    fi
+done
+
+# Profiles can be written to a different directory.
+dud --profile=profiles stage gen -o foo.txt
+
+for f in profiles/cpu.pprof profiles/heap.pprof; do
+    if ! test -s "$f"; then
+        echo "profiling output $f does not exist or is empty" 1>&2
+        exit 1
+    fi
+done
 
 # Commands that fail in cobra should still generate profiling output.
 dud --profile
 
-if ! test -s dud.pprof; then
-    echo 'tracing output does not exist or is empty' 1>&2
+if ! test -s cpu.pprof; then
+    echo 'profiling output does not exist or is empty' 1>&2
     exit 1
 fi
 
@@ -0,0 +1,51 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'foo' > data/foo.txt
+echo 'bar' > data/sub/bar.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+dud commit
+
+dud export data data.tar.gz
+dud export data/sub sub.tar.gz
+
+# The archives can be extracted without Dud.
+mkdir extracted
+tar -xzf data.tar.gz -C extracted
+diff -r data extracted/data
+tar -xzf sub.tar.gz -C extracted
+diff -r data/sub extracted/sub
+
+# Paths can be rewritten as they're exported.
+dud export --strip-components 1 --prefix datasets/v2 data rewritten.tar.gz
+mkdir rewritten
+tar -xzf rewritten.tar.gz -C rewritten
+diff -r data rewritten/datasets/v2
+if dud export --prefix ../up data bad.tar.gz; then
+    echo 1>&2 'expected failure due to prefix outside the archive'
+    exit 1
+fi
+test ! -e bad.tar.gz
+
+dud import data.tar.gz imported
+
+diff -r data imported
+test -L imported/foo.txt
+grep -q 'imported.dud' .dud/index
+diff <(echo '   imported') <(dud status --format porcelain --no-lock-check imported.dud)
+
+if dud import data.tar.gz imported; then
+    echo 1>&2 'expected failure due to existing stage'
+    exit 1
+fi
+
+if dud import sub.tar.gz data/sub/again; then
+    echo 1>&2 'expected failure due to ownership conflict'
+    exit 1
+fi
+test ! -e data/sub/again
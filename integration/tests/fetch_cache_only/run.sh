@@ -0,0 +1,47 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init --bare ../bare
+
+dud init
+
+echo "remote: $(cd ../bare && pwd)" >> .dud/config.yaml
+
+mkdir -p data/sub
+echo 'foo' > data/foo.txt
+echo 'bar' > data/sub/bar.txt
+
+dud stage gen -o data > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+dud push
+
+rm -rf .dud/cache data
+
+dud fetch
+
+if [ -e data ]; then
+    echo 1>&2 'expected fetch to leave the workspace untouched'
+    exit 1
+fi
+
+# Checkout must work without the remote.
+mv ../bare ../bare.offline
+
+dud checkout
+
+diff <(echo 'foo') data/foo.txt
+diff <(echo 'bar') data/sub/bar.txt
+
+# Fetching an object the remote doesn't have is an error.
+mv ../bare.offline ../bare
+rm -rf .dud/cache data
+find ../bare -mindepth 2 -type f | head -n 1 | xargs rm -f
+
+if dud fetch; then
+    echo 1>&2 'expected fetch to fail with an object missing from the remote'
+    exit 1
+fi
@@ -0,0 +1,18 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'force-copy: true' >> .dud/config.yaml
+
+echo 'foo' > foo.txt
+ino_before=$(stat -c %i foo.txt)
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+dud commit
+
+# The file was copied to the cache rather than moved there.
+test -L foo.txt
+test "$(stat -c %i "$(dud path foo.txt)")" -ne "$ino_before"
+diff <(echo 'foo') foo.txt
@@ -0,0 +1,21 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+echo 'index-history: true' >> .dud/config.yaml
+
+echo 'foo' > foo.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+with_foo="$(dud index log | head -n 1 | cut -d ' ' -f 1)"
+
+dud stage remove foo.yaml
+test "$(dud index log | wc -l)" -eq 2
+test ! -s .dud/index
+
+# Versions of the index in the log survive pruning the cache.
+dud prune --cached
+
+dud index restore "${with_foo:0:8}"
+grep -x 'foo.yaml' .dud/index
+dud index log | head -n 1 | grep "^$with_foo .*1 stages (current)"
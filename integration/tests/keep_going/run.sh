@@ -0,0 +1,36 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -o missing.txt > missing.yaml
+
+dud stage add foo.yaml missing.yaml
+
+if dud commit --keep-going missing.yaml foo.yaml; then
+    echo 1>&2 'expected commit to fail due to missing output'
+    exit 1
+fi
+
+# The stage that succeeded was still committed.
+grep -q 'checksum:' foo.yaml
+test -L foo.txt
+
+if dud status --keep-going unknown.yaml foo.yaml > status.txt; then
+    echo 1>&2 'expected status to fail due to unknown stage'
+    exit 1
+fi
+
+grep -q 'foo.txt  up-to-date' status.txt
+
+rm foo.txt
+
+if dud checkout --keep-going unknown.yaml foo.yaml; then
+    echo 1>&2 'expected checkout to fail due to unknown stage'
+    exit 1
+fi
+
+test -L foo.txt
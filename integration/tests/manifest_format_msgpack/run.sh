@@ -0,0 +1,43 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'foo' > data/foo.txt
+echo 'bar' > data/sub/bar.txt
+
+dud stage gen -o data > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+json_checksum="$(grep -A 1 'data:' data.yaml)"
+
+echo 'manifest-format: msgpack' >> .dud/config.yaml
+
+# Committed directories are up-to-date, so force their manifests to be
+# re-encoded.
+dud commit --force
+
+msgpack_checksum="$(grep -A 1 'data:' data.yaml)"
+
+if [ "$json_checksum" == "$msgpack_checksum" ]; then
+    echo 1>&2 'expected the manifest format to change the checksum'
+    exit 1
+fi
+
+diff <(printf '   data.yaml\n   data\n') <(dud status --format porcelain)
+
+rm -rf data
+
+dud checkout
+
+diff <(echo 'foo') data/foo.txt
+diff <(echo 'bar') data/sub/bar.txt
+
+# Manifests in either format can be read.
+sed -i '/manifest-format/d' .dud/config.yaml
+
+diff <(printf '   data.yaml\n   data\n') <(dud status --format porcelain)
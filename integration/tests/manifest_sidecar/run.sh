@@ -0,0 +1,31 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'manifest-sidecar: true' >> .dud/config.yaml
+
+mkdir -p data/sub
+echo 'foo' > data/foo.txt
+echo 'bar' > data/sub/bar.txt
+
+dud stage gen -o data > data.dud
+
+dud stage add data.dud
+
+dud commit
+
+grep -q '"foo.txt"' data.dud.manifest
+grep -q '"sub/bar.txt"' data.dud.manifest
+
+# Status must not be affected by the sidecar.
+grep -q 'up-to-date' <<< "$(dud status)"
+
+rm data/sub/bar.txt
+
+dud commit
+
+if grep -q '"sub/bar.txt"' data.dud.manifest; then
+    echo 1>&2 'expected sidecar to be updated on commit'
+    exit 1
+fi
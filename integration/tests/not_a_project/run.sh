@@ -0,0 +1,15 @@
+#!/bin/bash
+set -euo pipefail
+
+outside="$(mktemp -d)"
+trap 'rm -rf "$outside"' EXIT
+cd "$outside"
+
+for args in status commit checkout 'stage add foo.yaml'; do
+    # shellcheck disable=SC2086
+    if dud $args 2> stderr.txt; then
+        echo "dud $args succeeded outside of a project" >&2
+        exit 1
+    fi
+    grep -F "not a dud repository (or any parent up to /); run 'dud init'" stderr.txt
+done
@@ -0,0 +1,25 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/foo.txt
+ln data/foo.txt data/bar.txt
+echo 'foo' > data/copy.txt
+
+dud stage gen -o data > stage.yaml
+# Add 'preserve-hardlinks: true' to the directory artifact.
+sed -i 's/is-dir: true/&\n    preserve-hardlinks: true/' stage.yaml
+dud stage add stage.yaml
+dud commit
+
+rm -rf data
+dud checkout --copy stage.yaml
+
+test "$(stat -c %i data/foo.txt)" = "$(stat -c %i data/bar.txt)"
+test "$(stat -c %i data/foo.txt)" != "$(stat -c %i data/copy.txt)"
+diff <(dud status --format porcelain) - <<EOS
+   stage.yaml
+   data
+EOS
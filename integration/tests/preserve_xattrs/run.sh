@@ -0,0 +1,27 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'preserve-xattrs: true' >> .dud/config.yaml
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > bar.txt
+python3 -c "import os; os.setxattr('data/foo.txt', 'user.origin', b'foo.example.com')"
+python3 -c "import os; os.setxattr('bar.txt', 'user.origin', b'bar.example.com')"
+
+dud stage gen -o data > data.yaml
+dud stage gen -o bar.txt > bar.yaml
+dud stage add data.yaml bar.yaml
+dud commit 2>&1 | grep "extended attributes aren't preserved on linked files"
+
+grep -A1 'xattrs:' bar.yaml | grep "user.origin: $(echo -n bar.example.com | base64)"
+
+rm -rf data bar.txt
+dud checkout --copy
+
+test ! -L bar.txt
+test ! -L data/foo.txt
+test "$(python3 -c "import os; print(os.getxattr('bar.txt', 'user.origin').decode())")" = bar.example.com
+test "$(python3 -c "import os; print(os.getxattr('data/foo.txt', 'user.origin').decode())")" = foo.example.com
@@ -0,0 +1,41 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -o bar.txt > bar.yaml
+dud stage add foo.yaml bar.yaml
+dud commit
+
+bar_blob="$(dud path bar.txt)"
+foo_blob="$(dud path foo.txt)"
+
+rm bar.yaml
+
+if dud status; then
+    echo 1>&2 'expected failure due to missing stage file'
+    exit 1
+fi
+
+dud prune | grep -q 'Removed bar.yaml from the index.'
+diff <(echo 'foo.yaml') .dud/index
+test -f "$bar_blob"
+
+dud status
+
+# The workspace still links to the object of the pruned stage.
+dud prune --cached --verify-links | grep -q 'Removed 0 objects'
+test -f "$bar_blob"
+cat bar.txt
+
+rm bar.txt
+
+# Nothing left to prune, but unreferenced objects are removed.
+dud prune --cached | grep -q 'Removed 1 objects'
+test ! -e "$bar_blob"
+test -f "$foo_blob"
+diff <(echo 'foo.yaml') .dud/index
@@ -0,0 +1,44 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+mkdir data
+echo 'bar' > data/bar.txt
+
+dud stage gen -o foo.txt -o data > stage.yaml
+dud stage add stage.yaml
+dud commit --copy
+
+# Change the outputs outside of Dud, then refresh the recorded checksums.
+echo 'new foo' > foo.txt
+echo 'new bar' > data/bar.txt
+old_checksum="$(grep -A1 'foo.txt:' stage.yaml | grep checksum)"
+dud refresh stage.yaml
+test "$(grep -A1 'foo.txt:' stage.yaml | grep checksum)" != "$old_checksum"
+
+dud status | tee status.txt
+grep 'foo.txt *matches checksum, missing from cache' status.txt
+grep 'data *1x directory, 1x missing from cache' status.txt
+# The directory's manifest is cached, but its files aren't.
+diff <(dud status --format porcelain --no-lock-check) - <<EOS
+ M data
+ C foo.txt
+EOS
+
+# Committing adds the files to the cache without changing the checksums.
+refreshed="$(cat stage.yaml)"
+dud commit --copy
+test "$(cat stage.yaml)" = "$refreshed"
+diff <(dud status --format porcelain --no-lock-check) - <<EOS
+   data
+   foo.txt
+EOS
+
+# Refreshing a stage that was never committed checksums its definition.
+echo 'baz' > baz.txt
+dud stage gen -o baz.txt > baz.yaml
+dud stage add baz.yaml
+dud refresh baz.yaml
+dud status baz.yaml | grep 'baz.yaml *stage definition up-to-date'
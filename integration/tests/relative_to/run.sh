@@ -0,0 +1,34 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data
+echo 'foo' > data/foo.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+
+# Generate the outputs somewhere else and commit them from there.
+mkdir -p ../scratch/data
+echo 'bar' > ../scratch/data/foo.txt
+
+dud commit --copy --relative-to ../scratch
+
+diff <(printf '   data.yaml\n   data\n') \
+    <(dud status --format porcelain --relative-to ../scratch)
+
+# The project's own workspace doesn't match what was committed.
+diff <(echo 'foo') data/foo.txt
+diff <(printf '   data.yaml\n M data\n') <(dud status --format porcelain)
+
+# Checking out elsewhere leaves the project's workspace alone.
+dud checkout --copy --relative-to ../elsewhere
+diff <(echo 'bar') ../elsewhere/data/foo.txt
+diff <(echo 'foo') data/foo.txt
+
+if dud status --watch --relative-to ../scratch 2> err.txt; then
+    echo 1>&2 'expected failure due to --watch'
+    exit 1
+fi
+grep -q 'cannot use --relative-to with --watch' err.txt
@@ -0,0 +1,56 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init --bare ../bare
+
+dud init
+
+echo "remote: $(cd ../bare && pwd)" >> .dud/config.yaml
+echo 'cache-type: remote' >> .dud/config.yaml
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > data/bar.txt
+echo 'baz' > baz.txt
+
+dud stage gen -o data -o baz.txt > data.yaml
+
+dud stage add data.yaml
+
+dud commit
+
+# Committed files are checked out as copies, not links.
+test ! -L baz.txt
+test ! -L data/foo.txt
+
+# Only the directory manifest is left in the local cache.
+test "$(find .dud/cache -type f | wc -l)" -eq 1
+
+# Status doesn't re-hash files missing from the local cache. Unchanged files
+# still match their fingerprints, but files in directories have none.
+diff <(printf ' C baz.txt\n M data\n') \
+    <(dud status --format porcelain --no-lock-check)
+
+rm -rf data baz.txt
+
+dud checkout
+
+diff <(echo 'foo') data/foo.txt
+diff <(echo 'bar') data/bar.txt
+diff <(echo 'baz') baz.txt
+test "$(find .dud/cache -type f | wc -l)" -eq 1
+
+# Checking out a single file of a directory artifact also fetches on demand.
+rm data/bar.txt
+
+dud checkout data/bar.txt
+
+diff <(echo 'bar') data/bar.txt
+test "$(find .dud/cache -type f | wc -l)" -eq 1
+
+echo 'cache-type: bogus' >> .dud/config.yaml
+
+if dud status; then
+    echo 1>&2 'expected failure due to invalid cache type'
+    exit 1
+fi
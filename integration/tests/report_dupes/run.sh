@@ -0,0 +1,21 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'foo' > data/a.txt
+echo 'foo' > data/b.txt
+echo 'bar' > data/c.txt
+echo 'bar' > data/sub/c.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+
+dud commit --report-dupes | grep -A2 'data: identical files' > dupes.txt
+
+diff dupes.txt - <<EOS
+  data: identical files:
+    data/a.txt
+    data/b.txt
+EOS
@@ -0,0 +1,32 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+cat > gen.yaml <<'YAML'
+command: seq 1 1000
+outputs:
+  numbers.txt:
+    capture: stdout
+YAML
+dud stage add gen.yaml
+
+dud run
+
+# The output is linked to the cache and its checksum is already recorded.
+test -L numbers.txt
+test "$(wc -l < numbers.txt)" -eq 1000
+grep -A2 'numbers.txt:' gen.yaml | grep -q 'checksum:'
+
+dud commit
+dud status | grep 'numbers.txt *up-to-date'
+
+# A failing command leaves the previous output in place.
+sed -i 's/^command: .*/command: echo partial; false/' gen.yaml
+old_checksum="$(grep -A2 'numbers.txt:' gen.yaml | grep checksum)"
+if dud run; then
+    echo "expected run to fail" >&2
+    exit 1
+fi
+test "$(wc -l < numbers.txt)" -eq 1000
+test "$(grep -A2 'numbers.txt:' gen.yaml | grep checksum)" = "$old_checksum"
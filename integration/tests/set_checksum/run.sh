@@ -0,0 +1,50 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+expected="$(dud checksum foo.txt | cut -d ' ' -f 1)"
+mv foo.txt foo.txt.bak
+
+dud stage gen -o foo.txt > foo.yaml
+
+dud stage add foo.yaml
+
+if dud stage set-checksum --checksum 'not a checksum' foo.yaml foo.txt; then
+    echo 1>&2 'expected failure due to invalid checksum'
+    exit 1
+fi
+
+dud stage set-checksum --checksum "$expected" foo.yaml foo.txt
+
+grep -q "$expected" foo.yaml
+
+grep -q 'missing from cache and workspace' <<< "$(dud status)"
+
+echo 'bar' > foo.txt
+
+grep 'foo.txt' <<< "$(dud status)" | grep -qv 'matches checksum'
+
+mv foo.txt.bak foo.txt
+
+grep -q 'matches checksum, missing from cache' <<< "$(dud status)"
+
+dud commit
+
+grep -q 'up-to-date (link)' <<< "$(dud status)"
+
+# Setting the checksum of a committed copy discards its fingerprint, so status
+# compares the file with the new checksum.
+rm foo.txt
+echo 'foo' > foo.txt
+touch -d '1 hour ago' foo.txt
+dud commit --copy
+grep -q 'fingerprint:' foo.yaml
+bar="$(echo 'bar' | dud checksum | cut -d ' ' -f 1)"
+dud stage set-checksum --checksum "$bar" foo.yaml foo.txt
+if grep -q 'fingerprint:' foo.yaml; then
+    echo 1>&2 'expected fingerprint to be removed'
+    exit 1
+fi
+grep 'foo.txt' <<< "$(dud status)" | grep -qv 'matches checksum'
@@ -0,0 +1,16 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+cat > greet.yaml <<'EOS'
+command: echo "$GREETING, $NAME" > greeting.txt
+env:
+  NAME: ${USER_NAME}
+  GREETING: hello
+outputs:
+  greeting.txt: {}
+EOS
+dud stage add greet.yaml
+USER_NAME=world dud run
+test "$(cat greeting.txt)" = 'hello, world'
@@ -0,0 +1,35 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+
+cat > foo.json <<EOS
+{"outputs": {"foo.txt": {}}}
+EOS
+cat > bar.toml <<EOS
+command = "cat foo.txt > bar.txt"
+
+[inputs."foo.txt"]
+
+[outputs."bar.txt"]
+EOS
+
+dud stage add foo.json bar.toml
+dud commit
+
+# Stage files are written back in their original formats.
+jq -e '.outputs["foo.txt"].checksum' foo.json
+grep '^checksum = ' bar.toml
+grep -A1 "^\\[outputs.'bar.txt'\\]" bar.toml | grep '^checksum = '
+
+diff <(dud status --format porcelain --no-lock-check) - <<EOS
+   bar.txt
+   foo.txt
+EOS
+diff <(dud status --format porcelain | grep -v txt) - <<EOS
+   bar.toml
+   foo.json
+EOS
@@ -0,0 +1,40 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir shards
+for i in 1 2 3; do
+    echo "$i" > "shards/$i.csv"
+done
+echo 'notes' > shards/README
+
+# Each matched file becomes an artifact of its own.
+dud stage gen -o 'shards/*.csv' > shards.yaml
+cat shards.yaml
+for i in 1 2 3; do
+    grep -q "shards/$i.csv:" shards.yaml
+done
+if grep -q 'README' shards.yaml; then
+    echo 1>&2 'expected README not to match'
+    exit 1
+fi
+
+dud stage add shards.yaml
+dud commit
+diff <(dud status --format porcelain --no-lock-check) - <<EOS
+   shards/1.csv
+   shards/2.csv
+   shards/3.csv
+EOS
+
+# Each file is restored from its own object in the cache.
+rm shards/2.csv
+dud checkout shards.yaml
+test "$(cat shards/2.csv)" = 2
+
+if dud stage gen -o 'missing/*.csv' 2> err.txt; then
+    echo 1>&2 'expected a pattern with no matches to fail'
+    exit 1
+fi
+grep 'matched no files' err.txt
@@ -0,0 +1,33 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+
+dud stage new bar --dep foo.txt --out bar.txt --cmd 'cp foo.txt bar.txt' --add
+
+test -f bar.dud
+
+grep -q 'bar.dud' .dud/index
+
+dud run
+
+diff foo.txt bar.txt
+
+if dud stage new bar --out baz.txt; then
+    echo 1>&2 'expected failure due to existing stage file'
+    exit 1
+fi
+
+if dud stage new other --out bar.txt; then
+    echo 1>&2 'expected failure due to output owned by another stage'
+    exit 1
+fi
+
+if dud stage new other --out baz.txt --work-dir does_not_exist; then
+    echo 1>&2 'expected failure due to missing working directory'
+    exit 1
+fi
+
+test ! -e other.dud
@@ -0,0 +1,35 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+echo 'baz' > baz.txt
+mkdir data
+echo 'qux' > data/qux.txt
+
+dud stage gen -o foo.txt -o bar.txt > files.yaml
+dud stage gen -o data > data.yaml
+dud stage gen -i foo.txt -o baz.txt -o missing.txt > baz.yaml
+dud stage add files.yaml data.yaml baz.yaml
+dud commit files.yaml data.yaml
+
+# Modify bar.txt, and add an untracked file to data.
+rm bar.txt
+echo 'bar, modified' > bar.txt
+echo 'quux' > data/quux.txt
+
+diff <(dud status --only-cached --format porcelain --no-lock-check) - <<EOS
+   foo.txt
+EOS
+
+diff <(dud status --not-cached --format porcelain --no-lock-check) - <<EOS
+?? baz.txt
+ M bar.txt
+ M data
+EOS
+
+if dud status --only-cached --not-cached; then
+    exit 1
+fi
@@ -0,0 +1,31 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'v1' > foo.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+dud commit --copy
+cp foo.yaml old.yaml
+
+echo 'v2' > foo.txt
+dud commit --copy
+
+dud status | grep 'foo.txt *up-to-date'
+dud status --lock old.yaml foo.yaml | tee status.txt
+grep 'foo.txt *modified' status.txt
+if grep 'stage definition' status.txt; then
+    echo "expected stage definitions not to be checked" >&2
+    exit 1
+fi
+
+# Restoring the old contents matches the old stage file, but not the current one.
+echo 'v1' > foo.txt
+dud status --lock old.yaml foo.yaml | grep 'foo.txt *up-to-date'
+dud status | grep 'foo.txt *modified'
+
+if dud status --lock old.yaml; then
+    echo "expected --lock without a stage to fail" >&2
+    exit 1
+fi
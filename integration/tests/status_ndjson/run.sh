@@ -0,0 +1,20 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -i foo.txt -o bar.txt > bar.yaml
+
+dud stage add foo.yaml bar.yaml
+
+dud status --format ndjson > status.ndjson
+
+# Expect exactly one line per stage.
+test "$(wc -l < status.ndjson)" -eq 2
+
+grep -q '^{"Path":"bar.yaml",' status.ndjson
+grep -q '^{"Path":"foo.yaml",' status.ndjson
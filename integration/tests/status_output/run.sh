@@ -0,0 +1,32 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+
+dud stage gen -o foo.txt > foo.yaml
+
+dud stage add foo.yaml
+
+mkdir sub
+cd sub
+
+echo 'stale results' > status.txt
+
+dud status --output status.txt
+
+# The output path is relative to the working directory, not the project root.
+test ! -e ../status.txt
+test ! -e status.txt.partial
+
+if grep -q 'stale results' status.txt; then
+    echo 1>&2 'expected status.txt to be truncated'
+    exit 1
+fi
+
+grep -q 'foo.txt  not committed' status.txt
+
+dud status -o status.json
+
+grep -q '"foo.yaml":' status.json
@@ -0,0 +1,38 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -i foo.txt -o bar.txt > bar.yaml
+
+dud stage add foo.yaml bar.yaml
+
+expected="?? bar.yaml
+?? bar.txt
+?? foo.yaml
+?? foo.txt"
+
+diff <(echo "$expected") <(dud status --format porcelain)
+
+dud commit
+
+echo 'modified' > bar.txt.new
+rm bar.txt
+mv bar.txt.new bar.txt
+
+expected="   bar.yaml
+ M bar.txt
+   foo.yaml
+   foo.txt"
+
+diff <(echo "$expected") <(dud status --format porcelain)
+
+rm foo.txt
+
+expected="!! foo.txt"
+
+diff <(echo "$expected") <(dud status --format porcelain --no-lock-check foo.yaml)
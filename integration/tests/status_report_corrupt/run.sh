@@ -0,0 +1,36 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > bar.txt
+
+dud stage gen -o data > data.yaml
+dud stage gen -o bar.txt > bar.yaml
+dud stage add data.yaml bar.yaml
+dud commit --copy
+
+# Truncate the directory manifest.
+checksum="$(grep -A1 '^  data:' data.yaml | grep checksum | awk '{print $2}')"
+manifest=".dud/cache/${checksum:0:2}/${checksum:2}"
+chmod u+w "$manifest"
+echo '{"Contents": {' > "$manifest"
+
+if dud status; then
+    exit 1
+fi
+
+diff <(dud status --report-corrupt --format porcelain --no-lock-check) - <<EOS
+   bar.txt
+XX data
+EOS
+dud status --report-corrupt 2>&1 | grep 'data has a corrupt directory manifest'
+
+# Committing again repairs the manifest.
+dud commit --copy
+diff <(dud status --format porcelain --no-lock-check) - <<EOS
+   bar.txt
+   data
+EOS
@@ -0,0 +1,30 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+echo 'baz' > baz.txt
+
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -i foo.txt -i baz.txt -o bar.txt > bar.yaml
+
+dud stage add foo.yaml bar.yaml
+
+dud commit
+
+rm foo.txt
+echo 'new foo' > foo.txt
+
+# foo.txt is an input of bar.yaml, but it is owned by foo.yaml.
+diff <(printf '   bar.txt\n M foo.txt\n') \
+    <(dud status --format porcelain --no-lock-check --outputs-only)
+
+diff <(printf '   baz.txt\n M foo.txt\n') \
+    <(dud status --format porcelain --no-lock-check --deps-only bar.yaml)
+
+if dud status --outputs-only --deps-only; then
+    echo 'expected --outputs-only with --deps-only to fail' >&2
+    exit 1
+fi
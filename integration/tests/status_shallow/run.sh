@@ -0,0 +1,32 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'foo' > data/foo.txt
+echo 'bar' > data/sub/bar.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+dud commit --copy
+
+dud status --shallow | grep 'data *entries unchanged (shallow, approximate)'
+
+# Modified contents aren't noticed, only added and removed entries.
+echo 'changed' > data/sub/bar.txt
+dud status --shallow | grep 'data *entries unchanged (shallow, approximate)'
+dud status | grep 'data .*modified'
+
+rm data/foo.txt
+touch data/new.txt
+dud status --shallow | grep 'data *1x added, 1x removed (shallow, approximate)'
+diff <(dud status --shallow --format porcelain --no-lock-check) - <<EOS
+ M data
+EOS
+
+if dud status --shallow --only-cached 2> err.txt; then
+    echo 1>&2 'expected --shallow with --only-cached to fail'
+    exit 1
+fi
+grep 'cannot use --shallow' err.txt
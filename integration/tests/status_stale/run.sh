@@ -0,0 +1,31 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'foo' > foo.txt
+echo 'bar' > bar.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage gen -o bar.txt > bar.yaml
+dud stage add foo.yaml bar.yaml
+dud commit
+
+# Nothing is stale right after a commit.
+test -z "$(dud status --stale)"
+
+sed -i 's/^working-dir: \(.*\)/working-dir: \1\ncommand: echo bar/' bar.yaml
+
+dud status --stale | tee status.txt
+grep 'bar.yaml *stage definition modified' status.txt
+grep 'bar.txt *up-to-date' status.txt
+if grep foo status.txt; then
+    echo "expected foo.yaml to be omitted" >&2
+    exit 1
+fi
+
+test "$(dud status --stale --format porcelain)" = "$(printf ' M bar.yaml\n   bar.txt')"
+
+if dud status --stale --no-lock-check; then
+    echo "expected --stale with --no-lock-check to fail" >&2
+    exit 1
+fi
@@ -0,0 +1,27 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+mkdir -p data/sub
+echo 'a' > data/a.txt
+echo 'b' > data/sub/b.txt
+echo 'c' > data/sub/c.txt
+
+dud stage gen -o data > stage.yaml
+dud stage add stage.yaml
+dud commit
+
+rm data/a.txt
+rm data/sub/c.txt
+echo 'new c' > data/sub/c.txt
+
+diff <(dud status --format tree --no-lock-check) - <<EOS
+stage.yaml
+  data           2x directory, 1x missing from workspace, 1x modified, 1x up-to-date (link)
+  ├── a.txt      missing from workspace
+  └── sub        1x directory, 1x modified, 1x up-to-date (link)
+      ├── b.txt  up-to-date (link)
+      └── c.txt  modified
+
+EOS
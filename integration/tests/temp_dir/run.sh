@@ -0,0 +1,22 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+echo 'force-copy: true' >> .dud/config.yaml
+echo 'temp-dir: scratch' >> .dud/config.yaml
+
+mkdir data
+echo 'foo' > data/foo.txt
+echo 'bar' > data/bar.txt
+
+dud stage gen -o data > data.yaml
+dud stage add data.yaml
+dud commit
+
+# Temporary files were cleaned up, and the cache holds only objects.
+test -d scratch
+test "$(find scratch -type f | wc -l)" -eq 0
+test "$(find .dud/cache -maxdepth 1 -type f | wc -l)" -eq 0
+
+diff <(echo '   data') <(dud status --format porcelain --no-lock-check)
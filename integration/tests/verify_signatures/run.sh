@@ -0,0 +1,69 @@
+#!/bin/bash
+set -euo pipefail
+
+dud init
+
+openssl genpkey -algorithm ed25519 -out dud.key
+openssl pkey -in dud.key -pubout -out dud.pub
+openssl genpkey -algorithm ed25519 -out other.key
+openssl pkey -in other.key -pubout -out other.pub
+
+echo 'foo' > foo.txt
+dud stage gen -o foo.txt > foo.yaml
+dud stage add foo.yaml
+
+# Unsigned stages fail to verify.
+dud commit
+if dud verify-signatures --public-key dud.pub 2> err.txt; then
+    echo 1>&2 'expected failure due to unsigned stage'
+    exit 1
+fi
+grep -q 'stage is not signed' err.txt
+
+echo 'signing-key: dud.key' >> .dud/config.yaml
+echo 'signing-public-key: dud.pub' >> .dud/config.yaml
+dud commit
+grep -q 'signature:' foo.yaml
+dud verify-signatures
+dud verify-signatures foo.yaml
+
+if dud verify-signatures --public-key other.pub 2> err.txt; then
+    echo 1>&2 'expected failure due to wrong key'
+    exit 1
+fi
+grep -q 'signature is invalid' err.txt
+
+# Tamper with the recorded checksum of foo.txt.
+cp foo.yaml foo.yaml.orig
+sed -i 's/^\(    checksum: \).*/\1deadbeef/' foo.yaml
+if dud verify-signatures 2> err.txt; then
+    echo 1>&2 'expected failure due to tampered stage file'
+    exit 1
+fi
+grep -q 'signature is invalid' err.txt
+
+mv foo.yaml.orig foo.yaml
+dud verify-signatures
+
+# Pinning a checksum signs the stage again.
+bar="$(echo 'bar' | dud checksum | cut -d ' ' -f 1)"
+dud stage set-checksum --checksum "$bar" foo.yaml foo.txt
+dud verify-signatures
+
+# Imported stages are signed too.
+mkdir bar
+echo 'bar' > bar/bar.txt
+tar -czf bar.tar.gz bar
+rm -r bar
+dud import bar.tar.gz bar
+grep -q 'signature:' bar.dud
+dud verify-signatures bar.dud
+dud verify-signatures
+
+# Without a signing key, the stale signature is removed.
+sed -i '/^signing-key:/d' .dud/config.yaml
+dud stage set-checksum --checksum "$bar" foo.yaml foo.txt
+if grep -q 'signature:' foo.yaml; then
+    echo 1>&2 'expected signature to be removed'
+    exit 1
+fi
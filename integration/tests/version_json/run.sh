@@ -0,0 +1,13 @@
+#!/bin/bash
+set -euo pipefail
+
+# Version works outside of a project.
+dud version
+
+dud version --json > version.json
+
+for field in version commit build-date go-version; do
+  grep -q "^  \"$field\": \"" version.json
+done
+grep -q '^  "cache-format-version": [0-9]' version.json
+grep -q '^  "stage-schema-version": [0-9]' version.json
@@ -7,11 +7,17 @@ import (
 	"github.com/kevin-hanselman/dud/src/cmd"
 )
 
-// Version string set by goreleaser.
-var version string = "NONE"
+// Version, commit, and build date strings set by goreleaser.
+var (
+	version string = "NONE"
+	commit  string
+	date    string
+)
 
 func main() {
 	cmd.Version = version
+	cmd.Commit = commit
+	cmd.BuildDate = date
 	if os.Geteuid() == 0 {
 		fmt.Printf(`WARNING: Running as root.
 The root user does not respect read-only files. You can (and eventually will)
@@ -3,6 +3,7 @@ package artifact
 import (
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -11,31 +12,92 @@ import (
 	"github.com/kevin-hanselman/dud/src/fsutil"
 )
 
+// CaptureStdout is the value of Artifact.Capture for Artifacts that capture
+// the standard output of their Stage's command.
+const CaptureStdout = "stdout"
+
 // An Artifact is a file or directory that is tracked by Dud.
 type Artifact struct {
 	// Checksum is the hex digest Artifact's hashed contents. It is used to
 	// locate the Artifact in a Cache.
-	Checksum string `yaml:",omitempty" json:"checksum,omitempty"`
+	Checksum string `yaml:",omitempty" json:"checksum,omitempty" toml:"checksum,omitempty"`
 	// Path is the file path to the Artifact in the workspace. It is always
 	// relative to the project root directory.
-	Path string `yaml:",omitempty" json:"path,omitempty"`
+	Path string `yaml:",omitempty" json:"path,omitempty" toml:"path,omitempty"`
 	// If IsDir is true then the Artifact is a directory.
-	IsDir bool `yaml:"is-dir,omitempty" json:"is-dir,omitempty"`
+	IsDir bool `yaml:"is-dir,omitempty" json:"is-dir,omitempty" toml:"is-dir,omitempty"`
 	// If DisableRecursion is true then the Artifact does not recurse
 	// sub-directories.
-	DisableRecursion bool `yaml:"disable-recursion,omitempty" json:"disable-recursion,omitempty"`
+	DisableRecursion bool `yaml:"disable-recursion,omitempty" json:"disable-recursion,omitempty" toml:"disable-recursion,omitempty"`
 	// If SkipCache is true then the Artifact is not stored in the Cache. When
 	// the Artifact is committed, its checksum is updated, but the Artifact is
 	// not moved to the Cache. The checkout operation is a no-op.
-	SkipCache bool `yaml:"skip-cache,omitempty" json:"skip-cache,omitempty"`
+	SkipCache bool `yaml:"skip-cache,omitempty" json:"skip-cache,omitempty" toml:"skip-cache,omitempty"`
+	// If Ordered is true then the directory manifest of the Artifact records
+	// the natural order of the directory's entries (e.g. "shard-2" before
+	// "shard-10"). This also applies to all sub-directories.
+	Ordered bool `yaml:",omitempty" json:"ordered,omitempty" toml:"ordered,omitempty"`
+	// If PreserveHardlinks is true then the directory manifest of the
+	// Artifact records which of the directory's files are hard links to the
+	// same file, and checking out the Artifact as copies links them again.
+	// This also applies to all sub-directories, but only links between files
+	// in the same directory are recorded.
+	PreserveHardlinks bool `yaml:"preserve-hardlinks,omitempty" json:"preserve-hardlinks,omitempty" toml:"preserve-hardlinks,omitempty"`
+	// If Chunked is true then the file Artifact is split into fixed-size
+	// chunks, which are stored in the Cache individually. When the file is
+	// changed, such as by appending to it, only the changed chunks are added
+	// to the Cache. Checksum is then the checksum of the list of chunks.
+	Chunked bool `yaml:",omitempty" json:"chunked,omitempty" toml:"chunked,omitempty"`
+	// Include holds glob patterns for the files tracked by the directory
+	// Artifact. If it is not empty, files whose names match none of the
+	// patterns are ignored. Sub-directories are always tracked, unless they
+	// match Exclude. This also applies to all sub-directories.
+	Include []string `yaml:",omitempty" json:"include,omitempty" toml:"include,omitempty"`
+	// Exclude holds glob patterns for the files and sub-directories ignored by
+	// the directory Artifact. Exclude takes precedence over Include. This also
+	// applies to all sub-directories.
+	Exclude []string `yaml:",omitempty" json:"exclude,omitempty" toml:"exclude,omitempty"`
+	// Fingerprint records the size and modification time of the workspace
+	// file as of its last commit, along with the start of the Checksum it was
+	// committed with. It is only set for file Artifacts that are left as
+	// regular files in the workspace. While the workspace file's size and
+	// modification time and the Artifact's Checksum still match, the file's
+	// contents are assumed to match Checksum, and the Cache can report its
+	// status without reading it.
+	Fingerprint string `yaml:",omitempty" json:"fingerprint,omitempty" toml:"fingerprint,omitempty"`
+	// Xattrs holds the extended attributes of the workspace file as of its
+	// last commit, mapped to their base64-encoded values. It is only set for
+	// file Artifacts committed with extended attribute preservation enabled,
+	// and the attributes are restored when the Artifact is checked out as a
+	// copy.
+	Xattrs map[string]string `yaml:",omitempty" json:"xattrs,omitempty" toml:"xattrs,omitempty"`
+	// Capture names an output stream of the owning Stage's command, which is
+	// committed as the file Artifact while the Stage runs instead of being
+	// written to the workspace and read back. The only supported value is
+	// "stdout".
+	Capture string `yaml:",omitempty" json:"capture,omitempty" toml:"capture,omitempty"`
+	// ContentType is a MIME type (e.g. "text/csv") or other format hint for
+	// the file Artifact. It is either set by the user or detected when the
+	// file is committed. It is purely informational, and doesn't affect any
+	// checksums.
+	ContentType string `yaml:"content-type,omitempty" json:"content-type,omitempty" toml:"content-type,omitempty"`
 }
 
 type oldArtifact struct {
-	Checksum         string
-	Path             string
-	IsDir            bool
-	DisableRecursion bool
-	SkipCache        bool
+	Checksum          string
+	Path              string
+	IsDir             bool
+	DisableRecursion  bool
+	SkipCache         bool
+	Ordered           bool
+	PreserveHardlinks bool
+	Chunked           bool
+	Include           []string
+	Exclude           []string
+	Fingerprint       string
+	Xattrs            map[string]string
+	Capture           string
+	ContentType       string
 }
 
 // UnmarshalJSON enables backwards-compatibility with the original Artifact
@@ -65,6 +127,38 @@ func (a *Artifact) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Tracks returns true if the directory Artifact tracks the entry with the
+// given name, according to its Include and Exclude patterns. Patterns are
+// matched against the entry's name using filepath.Match.
+func (a Artifact) Tracks(name string, isDir bool) bool {
+	if matchesAny(a.Exclude, name) {
+		return false
+	}
+	return isDir || len(a.Include) == 0 || matchesAny(a.Include, name)
+}
+
+// ValidatePatterns returns an error if any of the Artifact's Include or
+// Exclude patterns are malformed.
+func (a Artifact) ValidatePatterns() error {
+	for _, pattern := range append(append([]string{}, a.Include...), a.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %#v", pattern)
+		}
+	}
+	return nil
+}
+
+// matchesAny returns true if name matches any of the patterns. Malformed
+// patterns never match; see ValidatePatterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
 // Status captures an Artifact's status as it pertains to a Cache and a workspace.
 type Status struct {
 	Artifact
@@ -73,6 +167,20 @@ type Status struct {
 	// HasChecksum is true if the Artifact has a valid Checksum field, false otherwise.
 	// TODO: Might be able to get rid of this if we have the Artifact in question.
 	HasChecksum bool
+	// ChecksumMalformed is true if the Artifact has a Checksum field that is
+	// not empty but is not a valid checksum. This usually means the Stage file
+	// or directory manifest holding the Artifact was corrupted.
+	ChecksumMalformed bool
+	// ManifestCorrupt is true if the Artifact is a directory whose manifest in
+	// the cache couldn't be decoded. The directory should be re-committed.
+	// ChildrenStatus is empty in this case.
+	ManifestCorrupt bool
+	// Shallow is true if the Artifact is a directory whose entries were only
+	// compared by name and file type with the entries in its manifest. The
+	// contents of its files and sub-directories weren't checked, so
+	// ContentsMatch is approximate, and ChildrenStatus only holds the entries
+	// that were added, removed, or changed type.
+	Shallow bool
 	// ChecksumInCache is true if a cache entry exists for the given checksum, false otherwise.
 	ChecksumInCache bool
 	// ContentsMatch is true if the workspace and cache files are identical; it
@@ -85,6 +193,28 @@ type Status struct {
 	ChildrenStatus map[string]*Status
 }
 
+// MissingChildren returns the paths of all committed descendants of a
+// directory Artifact whose objects are missing from the cache, for example due
+// to a partially deleted cache. The paths are relative to the directory
+// Artifact and sorted. Missing children are usually restored with a fetch
+// rather than a commit.
+func (stat Status) MissingChildren() []string {
+	missing := []string{}
+	stat.collectMissingChildren("", &missing)
+	sort.Strings(missing)
+	return missing
+}
+
+func (stat Status) collectMissingChildren(prefix string, missing *[]string) {
+	for _, childStatus := range stat.ChildrenStatus {
+		childPath := filepath.Join(prefix, childStatus.Path)
+		if childStatus.HasChecksum && !childStatus.ChecksumInCache && !childStatus.SkipCache {
+			*missing = append(*missing, childPath)
+		}
+		childStatus.collectMissingChildren(childPath, missing)
+	}
+}
+
 func (stat Status) dirStatusCounts(counts map[string]int) {
 	// len(nil map) returns 0
 	if len(stat.ChildrenStatus) == 0 {
@@ -101,6 +231,35 @@ func (stat Status) dirStatusCounts(counts map[string]int) {
 	}
 }
 
+// shallowString describes a Shallow directory Status by how many of its
+// entries were added, removed, or changed type.
+func (stat Status) shallowString() string {
+	var added, removed, retyped int
+	for _, childStatus := range stat.ChildrenStatus {
+		switch {
+		case !childStatus.HasChecksum && !childStatus.ChecksumMalformed:
+			added++
+		case childStatus.WorkspaceFileStatus == fsutil.StatusAbsent:
+			removed++
+		default:
+			retyped++
+		}
+	}
+	if added+removed+retyped == 0 {
+		return "entries unchanged (shallow, approximate)"
+	}
+	var parts []string
+	for _, part := range []struct {
+		count int
+		name  string
+	}{{added, "added"}, {removed, "removed"}, {retyped, "changed type"}} {
+		if part.count > 0 {
+			parts = append(parts, fmt.Sprintf("%dx %s", part.count, part.name))
+		}
+	}
+	return strings.Join(parts, ", ") + " (shallow, approximate)"
+}
+
 func sortCounts(counts map[string]int) []string {
 	keys := make([]string, len(counts))
 	i := 0
@@ -124,12 +283,142 @@ func sortCounts(counts map[string]int) []string {
 	return keys
 }
 
+// Recoverable returns true if the Artifact is committed to the cache and
+// matches its workspace copy, so the workspace copy can be deleted and later
+// restored by a checkout without losing any data. Artifacts that skip the
+// cache are never recoverable. A directory is only recoverable if it has no
+// modified or untracked contents.
+func (stat Status) Recoverable() bool {
+	return !stat.SkipCache &&
+		!stat.ChecksumMalformed &&
+		!stat.ManifestCorrupt &&
+		stat.HasChecksum &&
+		stat.ChecksumInCache &&
+		stat.ContentsMatch
+}
+
+// PorcelainCode returns a two-character code summarizing the Status. Unlike
+// String, the codes are guaranteed not to change between versions of Dud, so
+// they are safe to parse in scripts. The codes are:
+//
+//	"  " up-to-date
+//	" M" modified
+//	"??" not committed
+//	"!!" missing from the workspace
+//	" C" committed, but missing from the cache
+//	" T" incorrect file type
+//	"XX" malformed checksum or corrupt directory manifest
+func (stat Status) PorcelainCode() string {
+	if stat.ChecksumMalformed || stat.ManifestCorrupt {
+		return "XX"
+	}
+	isDir := stat.WorkspaceFileStatus == fsutil.StatusDirectory
+	switch stat.WorkspaceFileStatus {
+	case fsutil.StatusAbsent:
+		return "!!"
+	case fsutil.StatusOther:
+		return " T"
+	}
+	if stat.IsDir != isDir {
+		return " T"
+	}
+	if stat.SkipCache && stat.WorkspaceFileStatus != fsutil.StatusRegularFile {
+		return " T"
+	}
+	if !stat.HasChecksum {
+		return "??"
+	}
+	if !stat.ChecksumInCache && !stat.SkipCache {
+		return " C"
+	}
+	if !stat.ContentsMatch {
+		return " M"
+	}
+	return "  "
+}
+
+// CheckoutAction returns the action checkout would take to make the
+// workspace match the Status's Artifact. relink and hardReset correspond to
+// the checkout options of the same names. The actions are:
+//
+//	"skip"        already up-to-date, or not stored in the cache
+//	"create"      missing from the workspace
+//	"update"      a directory missing some of its committed contents
+//	"relink"      a link pointing to the wrong object in the cache
+//	"overwrite"   locally modified, and discarded by a hard reset
+//	"conflict"    locally modified; checkout would fail
+//	"missing"     missing from the cache; checkout would fail
+//	"uncommitted" not committed; checkout would fail
+//	"malformed"   has a malformed checksum or a corrupt directory manifest;
+//	              checkout would fail
+func (stat Status) CheckoutAction(relink, hardReset bool) string {
+	if stat.SkipCache {
+		return "skip"
+	}
+	if stat.ChecksumMalformed || stat.ManifestCorrupt {
+		return "malformed"
+	}
+	if !stat.HasChecksum {
+		return "uncommitted"
+	}
+	if !stat.ChecksumInCache {
+		return "missing"
+	}
+	if stat.ContentsMatch {
+		return "skip"
+	}
+	switch stat.WorkspaceFileStatus {
+	case fsutil.StatusAbsent:
+		return "create"
+	case fsutil.StatusLink:
+		if !stat.IsDir && (relink || hardReset) {
+			return "relink"
+		}
+	case fsutil.StatusDirectory:
+		if stat.IsDir && !hardReset {
+			return stat.dirCheckoutAction(relink)
+		}
+	}
+	if hardReset {
+		return "overwrite"
+	}
+	return "conflict"
+}
+
+// dirCheckoutAction returns the action checkout would take for a modified
+// directory without a hard reset. Checkout fills in the directory's missing
+// contents and leaves untracked files alone, so the action depends on what
+// checkout would do with each committed child.
+func (stat Status) dirCheckoutAction(relink bool) string {
+	action := "skip"
+	for _, childStatus := range stat.ChildrenStatus {
+		// Untracked children are left alone.
+		if !childStatus.HasChecksum && !childStatus.ChecksumMalformed {
+			continue
+		}
+		switch childAction := childStatus.CheckoutAction(relink, false); childAction {
+		case "skip":
+		case "create", "update", "relink":
+			action = "update"
+		default:
+			return childAction
+		}
+	}
+	return action
+}
+
 func (stat Status) String() string {
 	isDir := stat.WorkspaceFileStatus == fsutil.StatusDirectory
 	isAbsent := stat.WorkspaceFileStatus == fsutil.StatusAbsent
 	if (stat.IsDir != isDir) && !isAbsent {
 		return fmt.Sprintf("incorrect file type: %s", stat.WorkspaceFileStatus)
 	}
+	if stat.ChecksumMalformed {
+		return fmt.Sprintf("malformed checksum %#v", stat.Checksum)
+	}
+	if stat.ManifestCorrupt {
+		return "manifest corrupt"
+	}
 	isRegularFile := stat.WorkspaceFileStatus == fsutil.StatusRegularFile
 	if stat.SkipCache && !isRegularFile {
 		return fmt.Sprintf("incorrect file type: %s (not cached)", stat.WorkspaceFileStatus)
@@ -153,6 +442,8 @@ func (stat Status) String() string {
 				} else {
 					out.WriteString("modified")
 				}
+			} else if stat.ContentsMatch {
+				out.WriteString("matches checksum, missing from cache")
 			} else {
 				out.WriteString("missing from cache")
 			}
@@ -180,6 +471,10 @@ func (stat Status) String() string {
 		return "invalid file type"
 	}
 
+	if stat.IsDir && stat.Shallow {
+		return stat.shallowString()
+	}
+
 	if stat.IsDir {
 		counts := make(map[string]int)
 		stat.dirStatusCounts(counts)
@@ -1,6 +1,7 @@
 package artifact
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -25,6 +26,55 @@ func TestArtifactStatusString(t *testing.T) {
 		}
 	})
 
+	t.Run("regular file matches checksum but missing from cache", func(t *testing.T) {
+		status := Status{
+			Artifact:            Artifact{SkipCache: false, IsDir: false},
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			HasChecksum:         true,
+			ChecksumInCache:     false,
+			ContentsMatch:       true,
+		}
+
+		want := "matches checksum, missing from cache"
+
+		got := status.String()
+		if got != want {
+			t.Fatalf("Status.String() got %#v, want %#v", got, want)
+		}
+	})
+
+	t.Run("regular file with malformed checksum", func(t *testing.T) {
+		status := Status{
+			Artifact:            Artifact{Checksum: "ab"},
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			ChecksumMalformed:   true,
+		}
+
+		want := `malformed checksum "ab"`
+
+		got := status.String()
+		if got != want {
+			t.Fatalf("Status.String() got %#v, want %#v", got, want)
+		}
+	})
+
+	t.Run("directory with corrupt manifest", func(t *testing.T) {
+		status := Status{
+			Artifact:            Artifact{IsDir: true},
+			WorkspaceFileStatus: fsutil.StatusDirectory,
+			HasChecksum:         true,
+			ChecksumInCache:     true,
+			ManifestCorrupt:     true,
+		}
+
+		want := "manifest corrupt"
+
+		got := status.String()
+		if got != want {
+			t.Fatalf("Status.String() got %#v, want %#v", got, want)
+		}
+	})
+
 	t.Run("regular file not cached up-to-date", func(t *testing.T) {
 		status := Status{
 			Artifact:            Artifact{SkipCache: true, IsDir: false},
@@ -240,6 +290,48 @@ func TestArtifactStatusString(t *testing.T) {
 		}
 	})
 
+	t.Run("shallow directory", func(t *testing.T) {
+		status := Status{
+			Artifact:            Artifact{IsDir: true},
+			WorkspaceFileStatus: fsutil.StatusDirectory,
+			HasChecksum:         true,
+			ChecksumInCache:     true,
+			ContentsMatch:       true,
+			Shallow:             true,
+		}
+		if diff := cmp.Diff("entries unchanged (shallow, approximate)", status.String()); diff != "" {
+			t.Fatalf("Status.String() -want +got:\n%s", diff)
+		}
+
+		status.ContentsMatch = false
+		status.ChildrenStatus = map[string]*Status{
+			"new.txt": {
+				Artifact:            Artifact{Path: "new.txt"},
+				WorkspaceFileStatus: fsutil.StatusRegularFile,
+			},
+			"new": {
+				Artifact:            Artifact{Path: "new", IsDir: true},
+				WorkspaceFileStatus: fsutil.StatusDirectory,
+			},
+			"gone.txt": {
+				Artifact:            Artifact{Path: "gone.txt"},
+				WorkspaceFileStatus: fsutil.StatusAbsent,
+				HasChecksum:         true,
+				ChecksumInCache:     true,
+			},
+			"was-dir": {
+				Artifact:            Artifact{Path: "was-dir", IsDir: true},
+				WorkspaceFileStatus: fsutil.StatusRegularFile,
+				HasChecksum:         true,
+				ChecksumInCache:     true,
+			},
+		}
+		want := "2x added, 1x removed, 1x changed type (shallow, approximate)"
+		if diff := cmp.Diff(want, status.String()); diff != "" {
+			t.Fatalf("Status.String() -want +got:\n%s", diff)
+		}
+	})
+
 	t.Run("directory but SkipCache true", func(t *testing.T) {
 		status := Status{
 			Artifact:            Artifact{SkipCache: true, IsDir: true},
@@ -257,3 +349,182 @@ func TestArtifactStatusString(t *testing.T) {
 		}
 	})
 }
+
+func TestArtifactStatusPorcelainCode(t *testing.T) {
+	tests := map[string]Status{
+		"  ": {
+			WorkspaceFileStatus: fsutil.StatusLink,
+			HasChecksum:         true,
+			ChecksumInCache:     true,
+			ContentsMatch:       true,
+		},
+		" M": {
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			HasChecksum:         true,
+			ChecksumInCache:     true,
+		},
+		"??": {
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+		},
+		"!!": {
+			WorkspaceFileStatus: fsutil.StatusAbsent,
+			HasChecksum:         true,
+			ChecksumInCache:     true,
+		},
+		" C": {
+			WorkspaceFileStatus: fsutil.StatusLink,
+			HasChecksum:         true,
+		},
+		" T": {
+			Artifact:            Artifact{IsDir: true},
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+		},
+		"XX": {
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			ChecksumMalformed:   true,
+		},
+	}
+	for want, status := range tests {
+		if got := status.PorcelainCode(); got != want {
+			t.Errorf("%#v.PorcelainCode() = %#v, want %#v", status, got, want)
+		}
+	}
+
+	t.Run("skip cache", func(t *testing.T) {
+		status := Status{
+			Artifact:            Artifact{SkipCache: true},
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			HasChecksum:         true,
+			ContentsMatch:       true,
+		}
+		if got := status.PorcelainCode(); got != "  " {
+			t.Fatalf("PorcelainCode() = %#v, want %#v", got, "  ")
+		}
+	})
+}
+
+func TestArtifactTracks(t *testing.T) {
+	art := Artifact{
+		IsDir:   true,
+		Include: []string{"*.parquet"},
+		Exclude: []string{"_tmp_*"},
+	}
+	tests := []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{"data.parquet", false, true},
+		{"data.csv", false, false},
+		{"_tmp_data.parquet", false, false},
+		{"shards", true, true},
+		{"_tmp_shards", true, false},
+	}
+	for _, test := range tests {
+		if got := art.Tracks(test.name, test.isDir); got != test.want {
+			t.Errorf("Tracks(%#v, %v) = %v, want %v", test.name, test.isDir, got, test.want)
+		}
+	}
+
+	if !(Artifact{}).Tracks("anything", false) {
+		t.Error("expected Artifact without patterns to track everything")
+	}
+
+	if err := (Artifact{Exclude: []string{"[a-"}}).ValidatePatterns(); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
+
+func TestRecoverable(t *testing.T) {
+	upToDate := Status{
+		WorkspaceFileStatus: fsutil.StatusLink,
+		HasChecksum:         true,
+		ChecksumInCache:     true,
+		ContentsMatch:       true,
+	}
+	tests := map[string]struct {
+		status Status
+		want   bool
+	}{
+		"up-to-date": {upToDate, true},
+		"modified": {
+			Status{WorkspaceFileStatus: fsutil.StatusRegularFile, HasChecksum: true, ChecksumInCache: true},
+			false,
+		},
+		"missing from cache": {
+			Status{WorkspaceFileStatus: fsutil.StatusRegularFile, HasChecksum: true, ContentsMatch: true},
+			false,
+		},
+		"not committed": {Status{WorkspaceFileStatus: fsutil.StatusRegularFile}, false},
+		"skip cache": {
+			Status{
+				Artifact:            Artifact{SkipCache: true},
+				WorkspaceFileStatus: fsutil.StatusRegularFile,
+				HasChecksum:         true,
+				ContentsMatch:       true,
+			},
+			false,
+		},
+	}
+	for name, test := range tests {
+		if got := test.status.Recoverable(); got != test.want {
+			t.Errorf("%s: Recoverable() = %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestCheckoutAction(t *testing.T) {
+	committed := func(status Status) Status {
+		status.HasChecksum = true
+		status.ChecksumInCache = true
+		return status
+	}
+	upToDate := committed(Status{WorkspaceFileStatus: fsutil.StatusLink, ContentsMatch: true})
+	absent := committed(Status{WorkspaceFileStatus: fsutil.StatusAbsent})
+	staleLink := committed(Status{WorkspaceFileStatus: fsutil.StatusLink})
+	modified := committed(Status{WorkspaceFileStatus: fsutil.StatusRegularFile})
+	untracked := Status{WorkspaceFileStatus: fsutil.StatusRegularFile}
+	dir := func(children ...Status) Status {
+		status := committed(Status{
+			Artifact:            Artifact{IsDir: true},
+			WorkspaceFileStatus: fsutil.StatusDirectory,
+			ChildrenStatus:      make(map[string]*Status),
+		})
+		for i := range children {
+			status.ChildrenStatus[fmt.Sprint(i)] = &children[i]
+		}
+		return status
+	}
+
+	tests := map[string]struct {
+		status            Status
+		relink, hardReset bool
+		want              string
+	}{
+		"up-to-date":               {upToDate, false, false, "skip"},
+		"skip cache":               {Status{Artifact: Artifact{SkipCache: true}}, false, false, "skip"},
+		"absent":                   {absent, false, false, "create"},
+		"stale link":               {staleLink, false, false, "conflict"},
+		"stale link with relink":   {staleLink, true, false, "relink"},
+		"modified":                 {modified, true, false, "conflict"},
+		"modified with hard":       {modified, false, true, "overwrite"},
+		"missing from cache":       {Status{HasChecksum: true}, false, true, "missing"},
+		"not committed":            {untracked, false, true, "uncommitted"},
+		"malformed":                {Status{ChecksumMalformed: true}, false, true, "malformed"},
+		"corrupt manifest":         {Status{HasChecksum: true, ChecksumInCache: true, ManifestCorrupt: true}, false, true, "malformed"},
+		"dir with untracked files": {dir(upToDate, untracked), false, false, "skip"},
+		"dir with missing files":   {dir(upToDate, absent, untracked), false, false, "update"},
+		"dir with stale link":      {dir(absent, staleLink), false, false, "conflict"},
+		"dir with relink":          {dir(absent, staleLink), true, false, "update"},
+		"dir with hard":            {dir(upToDate, untracked), false, true, "overwrite"},
+		"nested dir":               {dir(dir(absent)), false, false, "update"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := test.status.CheckoutAction(test.relink, test.hardReset)
+			if got != test.want {
+				t.Fatalf("CheckoutAction(%v, %v) = %#v, want %#v", test.relink, test.hardReset, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/pkg/errors"
+)
+
+// UnsupportedArchiveError is returned by CommitArchive for archives it can't
+// read, or that have members it can't represent as a directory Artifact.
+type UnsupportedArchiveError struct {
+	reason string
+}
+
+func (e UnsupportedArchiveError) Error() string {
+	return "unsupported archive: " + e.reason
+}
+
+// archiveDir is a directory in the tree of an archive's members.
+type archiveDir struct {
+	files map[string]*artifact.Artifact
+	dirs  map[string]*archiveDir
+}
+
+func newArchiveDir() *archiveDir {
+	return &archiveDir{
+		files: make(map[string]*artifact.Artifact),
+		dirs:  make(map[string]*archiveDir),
+	}
+}
+
+// mkdirAll returns the directory at the slash-separated path in the tree,
+// creating it and its parents as needed.
+func (dir *archiveDir) mkdirAll(dirPath string) (*archiveDir, error) {
+	if dirPath == "." {
+		return dir, nil
+	}
+	for _, name := range strings.Split(dirPath, "/") {
+		if _, ok := dir.files[name]; ok {
+			return nil, UnsupportedArchiveError{fmt.Sprintf("%s is both a file and a directory", dirPath)}
+		}
+		child, ok := dir.dirs[name]
+		if !ok {
+			child = newArchiveDir()
+			dir.dirs[name] = child
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// CommitArchive commits the members of a tar, gzipped tar, or zip archive as
+// the contents of the directory Artifact, without extracting the archive. The
+// archive's format is determined by its extension (.tar, .tar.gz, .tgz, or
+// .zip). Each regular file in the archive is streamed into the Cache, and the
+// directory manifests are built from the archive's tree, so checking out the
+// Artifact afterward creates the files as if the archive had been extracted
+// to the Artifact's path. Members that are neither regular files nor
+// directories, such as symlinks, are rejected, as are members whose paths
+// leave the archive's root. The workspace is left untouched.
+func (ch LocalCache) CommitArchive(archivePath string, art *artifact.Artifact) (result CommitResult, err error) {
+	errPrefix := "commit archive " + archivePath
+	if !art.IsDir || art.SkipCache {
+		return result, errors.Errorf("%s: %s must be a directory artifact stored in the cache", errPrefix, art.Path)
+	}
+	if len(art.Include) > 0 || len(art.Exclude) > 0 || art.PreserveHardlinks {
+		return result, errors.Errorf(
+			"%s: %s: include/exclude patterns and hard link preservation aren't supported for archives",
+			errPrefix,
+			art.Path,
+		)
+	}
+	if err := os.MkdirAll(ch.dir, 0o755); err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+	ch.tempDirRenames, err = ch.prepareTempDir()
+	if err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+	ch.tally = new(commitTally)
+
+	root := newArchiveDir()
+	addMember := func(name string, isDir bool, reader io.Reader) error {
+		memberPath := path.Clean(strings.TrimPrefix(name, "./"))
+		if path.IsAbs(memberPath) || memberPath == ".." || strings.HasPrefix(memberPath, "../") {
+			return UnsupportedArchiveError{fmt.Sprintf("member %s is outside of the archive root", name)}
+		}
+		if art.DisableRecursion && strings.Contains(memberPath, "/") {
+			return nil
+		}
+		if isDir {
+			_, err := root.mkdirAll(memberPath)
+			return err
+		}
+		parent, err := root.mkdirAll(path.Dir(memberPath))
+		if err != nil {
+			return err
+		}
+		base := path.Base(memberPath)
+		if _, ok := parent.dirs[base]; ok {
+			return UnsupportedArchiveError{fmt.Sprintf("%s is both a file and a directory", memberPath)}
+		}
+		childArt, err := ch.commitArchiveMember(reader)
+		if err != nil {
+			return errors.Wrap(err, memberPath)
+		}
+		childArt.Path = base
+		// Later members replace earlier ones with the same path, as they would
+		// when extracting the archive.
+		parent.files[base] = childArt
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(archivePath, ".zip"):
+		err = walkZip(archivePath, addMember)
+	case strings.HasSuffix(archivePath, ".tar"):
+		err = walkTar(archivePath, false, addMember)
+	case strings.HasSuffix(archivePath, ".tar.gz"), strings.HasSuffix(archivePath, ".tgz"):
+		err = walkTar(archivePath, true, addMember)
+	default:
+		err = UnsupportedArchiveError{"expected a .tar, .tar.gz, .tgz, or .zip file"}
+	}
+	if err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+
+	oldChecksum := art.Checksum
+	art.Checksum, err = commitArchiveDir(ch, root, art.Ordered)
+	if err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+	art.Fingerprint = ""
+	result.Checksum = art.Checksum
+	result.Changed = art.Checksum != oldChecksum
+	ch.tally.addTo(&result)
+	ch.totals.add(ch.tally)
+	err = ch.recordAudit(AuditRecord{
+		Operation: "commit",
+		Path:      art.Path,
+		Checksum:  art.Checksum,
+		Bytes:     result.BytesWritten,
+	})
+	return result, errors.Wrap(err, errPrefix)
+}
+
+// commitArchiveMember commits the contents of a file in an archive, and
+// returns an Artifact for it without a path.
+func (ch LocalCache) commitArchiveMember(reader io.Reader) (*artifact.Artifact, error) {
+	counter := &countingReader{r: reader}
+	reader = counter
+	if ch.maxFileSize > 0 {
+		reader = &sizeLimitReader{r: reader, limit: ch.maxFileSize}
+	}
+	sniffer := &sniffReader{r: reader}
+	cksum, existed, err := ch.commitBytes(sniffer, "")
+	if err != nil {
+		return nil, err
+	}
+	ch.tally.addFile(counter.n, existed)
+	childArt := &artifact.Artifact{Checksum: cksum}
+	if ch.detectContentTypes {
+		childArt.ContentType = sniffer.contentType()
+	}
+	return childArt, nil
+}
+
+// commitArchiveDir commits the manifests of dir and all of its
+// sub-directories, and returns the checksum of dir's manifest.
+func commitArchiveDir(ch LocalCache, dir *archiveDir, ordered bool) (string, error) {
+	manifest := &directoryManifest{
+		Contents: make(map[string]*artifact.Artifact, len(dir.files)+len(dir.dirs)),
+	}
+	for name, childArt := range dir.files {
+		manifest.Contents[name] = childArt
+	}
+	for name, childDir := range dir.dirs {
+		cksum, err := commitArchiveDir(ch, childDir, ordered)
+		if err != nil {
+			return "", err
+		}
+		manifest.Contents[name] = &artifact.Artifact{
+			Path:     name,
+			Checksum: cksum,
+			IsDir:    true,
+			Ordered:  ordered,
+		}
+	}
+	if ordered {
+		manifest.Order = make([]string, 0, len(manifest.Contents))
+		for name := range manifest.Contents {
+			manifest.Order = append(manifest.Order, name)
+		}
+		sort.Slice(manifest.Order, func(i, j int) bool {
+			return naturalLess(manifest.Order[i], manifest.Order[j])
+		})
+	}
+	return commitDirManifest(ch, manifest)
+}
+
+// walkTar calls fn for each member of the tar archive at archivePath, reading
+// the archive once from start to end.
+func walkTar(
+	archivePath string,
+	gzipped bool,
+	fn func(name string, isDir bool, reader io.Reader) error,
+) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if gzipped {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			err = fn(header.Name, false, tarReader)
+		case tar.TypeDir:
+			err = fn(header.Name, true, nil)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			err = UnsupportedArchiveError{
+				fmt.Sprintf("member %s is not a regular file or directory", header.Name),
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// walkZip calls fn for each member of the zip archive at archivePath.
+func walkZip(archivePath string, fn func(name string, isDir bool, reader io.Reader) error) error {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+	for _, member := range zipReader.File {
+		mode := member.Mode()
+		if mode.IsDir() {
+			if err := fn(member.Name, true, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			return UnsupportedArchiveError{
+				fmt.Sprintf("member %s is not a regular file or directory", member.Name),
+			}
+		}
+		memberReader, err := member.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(member.Name, false, memberReader)
+		memberReader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
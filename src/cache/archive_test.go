@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+// archiveMember is a file or directory in a test archive.
+type archiveMember struct {
+	name     string
+	contents string
+	typeflag byte
+}
+
+var testArchiveMembers = []archiveMember{
+	{name: "data/", typeflag: tar.TypeDir},
+	{name: "data/a.txt", contents: "foo"},
+	{name: "data/sub/b.txt", contents: "bar"},
+	{name: "data/sub/c.txt", contents: "foo"},
+	{name: "data/empty/", typeflag: tar.TypeDir},
+}
+
+func writeTestTar(t *testing.T, path string, gzipped bool, members []archiveMember) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var writer io.Writer = file
+	if gzipped {
+		gzipWriter := gzip.NewWriter(file)
+		defer gzipWriter.Close()
+		writer = gzipWriter
+	}
+	tarWriter := tar.NewWriter(writer)
+	defer tarWriter.Close()
+	for _, member := range members {
+		header := &tar.Header{
+			Name:     member.name,
+			Typeflag: member.typeflag,
+			Mode:     0o644,
+			Size:     int64(len(member.contents)),
+		}
+		if member.typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if member.typeflag == tar.TypeSymlink {
+			header.Linkname = member.contents
+			header.Size = 0
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := io.WriteString(tarWriter, member.contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func writeTestZip(t *testing.T, path string, members []archiveMember) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zipWriter := zip.NewWriter(file)
+	defer zipWriter.Close()
+	for _, member := range members {
+		writer, err := zipWriter.Create(member.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if member.typeflag != tar.TypeDir {
+			if _, err := io.WriteString(writer, member.contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCommitArchive(t *testing.T) {
+	// The checksum of the extracted archive, committed as usual.
+	wantDir := t.TempDir()
+	for _, member := range testArchiveMembers {
+		path := filepath.Join(wantDir, member.name)
+		if member.typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(member.contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantCache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArt := artifact.Artifact{Path: "data", IsDir: true}
+	_, err = wantCache.Commit(wantDir, &wantArt, strategy.CopyStrategy, agglog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The archives nest everything under data/, so commit their contents from
+	// the tree's root.
+	writers := map[string]func(t *testing.T, path string){
+		"data.tar": func(t *testing.T, path string) {
+			writeTestTar(t, path, false, testArchiveMembers)
+		},
+		"data.tar.gz": func(t *testing.T, path string) {
+			writeTestTar(t, path, true, testArchiveMembers)
+		},
+		"data.zip": func(t *testing.T, path string) {
+			writeTestZip(t, path, testArchiveMembers)
+		},
+	}
+	for name, write := range writers {
+		t.Run(name, func(t *testing.T) {
+			cache, err := NewLocalCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			archivePath := filepath.Join(t.TempDir(), name)
+			write(t, archivePath)
+
+			art := artifact.Artifact{Path: "out", IsDir: true}
+			result, err := cache.CommitArchive(archivePath, &art)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FilesAdded != 2 || result.FilesDeduplicated != 1 {
+				t.Fatalf("got %d files added, %d deduplicated, want 2 and 1", result.FilesAdded, result.FilesDeduplicated)
+			}
+
+			// Check out the archive's root and compare its data directory
+			// with the one committed from disk.
+			workDir := t.TempDir()
+			if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+				t.Fatal(err)
+			}
+			dataArt := artifact.Artifact{Path: "out/data", IsDir: true}
+			_, err = cache.Commit(workDir, &dataArt, strategy.CopyStrategy, agglog.NewNullLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dataArt.Checksum != wantArt.Checksum {
+				t.Fatalf("got checksum %s, want %s", dataArt.Checksum, wantArt.Checksum)
+			}
+		})
+	}
+
+	t.Run("rejects bad members", func(t *testing.T) {
+		for name, members := range map[string][]archiveMember{
+			"symlink":       {{name: "link", contents: "target", typeflag: tar.TypeSymlink}},
+			"parent path":   {{name: "../escape.txt", contents: "foo"}},
+			"absolute path": {{name: "/etc/escape.txt", contents: "foo"}},
+			"file and dir":  {{name: "a", contents: "foo"}, {name: "a/b", contents: "bar"}},
+			"dir and file":  {{name: "a/b", contents: "bar"}, {name: "a", contents: "foo"}},
+		} {
+			cache, err := NewLocalCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			archivePath := filepath.Join(t.TempDir(), "bad.tar")
+			writeTestTar(t, archivePath, false, members)
+			art := artifact.Artifact{Path: "out", IsDir: true}
+			_, err = cache.CommitArchive(archivePath, &art)
+			var unsupportedErr UnsupportedArchiveError
+			if !errors.As(err, &unsupportedErr) {
+				t.Fatalf("%s: got error %v, want UnsupportedArchiveError", name, err)
+			}
+			if art.Checksum != "" {
+				t.Fatalf("%s: checksum set to %s", name, art.Checksum)
+			}
+		}
+	})
+
+	t.Run("rejects unknown extensions", func(t *testing.T) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: "out", IsDir: true}
+		_, err = cache.CommitArchive("data.rar", &art)
+		var unsupportedErr UnsupportedArchiveError
+		if !errors.As(err, &unsupportedErr) {
+			t.Fatalf("got error %v, want UnsupportedArchiveError", err)
+		}
+	})
+
+	t.Run("rejects file artifacts", func(t *testing.T) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: "out"}
+		if _, err := cache.CommitArchive("data.tar", &art); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
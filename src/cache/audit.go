@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+// AuditRecord describes one change made to the Cache. Records are written to
+// the audit log, if enabled, as one JSON object per line.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Operation is one of "commit", "checkout", "fetch", or "remove".
+	Operation string `json:"operation"`
+	// Path is the path of the Artifact involved, relative to the workspace.
+	// Objects fetched or removed on their own have no path.
+	Path     string `json:"path,omitempty"`
+	Checksum string `json:"checksum"`
+	// Bytes is the number of bytes added to or removed from the Cache.
+	Bytes int64 `json:"bytes,omitempty"`
+	// Strategy is the checkout strategy used by commit and checkout: "link"
+	// or "copy".
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// auditLog appends AuditRecords to a file. Copies of the LocalCache share the
+// same auditLog.
+type auditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// EnableAuditLog makes the Cache append an AuditRecord to the file at path
+// for every Artifact committed or checked out and every object fetched or
+// removed. The file is created if it doesn't exist.
+func (ch *LocalCache) EnableAuditLog(path string) {
+	ch.audit = &auditLog{path: path}
+}
+
+// recordAudit appends rec to the audit log, if enabled. The current time is
+// filled in.
+func (ch LocalCache) recordAudit(rec AuditRecord) error {
+	if ch.audit == nil {
+		return nil
+	}
+	rec.Time = time.Now().UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	ch.audit.mu.Lock()
+	defer ch.audit.mu.Unlock()
+	file, err := os.OpenFile(ch.audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// auditStrategy returns the name of strat as recorded in the audit log.
+func auditStrategy(strat strategy.CheckoutStrategy) string {
+	if strat == strategy.CopyStrategy {
+		return "copy"
+	}
+	return "link"
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestAuditLog(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	cache.EnableAuditLog(logPath)
+	workDir := t.TempDir()
+	workPath := filepath.Join(workDir, "foo.txt")
+	if err := os.WriteFile(workPath, []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	art := artifact.Artifact{Path: "foo.txt"}
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(workPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.RemoveBlob(art.Checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Time.IsZero() {
+			t.Fatalf("record %v has no time", rec)
+		}
+		got = append(got, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AuditRecord{
+		{Operation: "commit", Path: "foo.txt", Checksum: art.Checksum, Bytes: 3, Strategy: "link"},
+		{Operation: "checkout", Path: "foo.txt", Checksum: art.Checksum, Strategy: "copy"},
+		{Operation: "remove", Checksum: art.Checksum, Bytes: 3},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(AuditRecord{}, "Time")); diff != "" {
+		t.Fatalf("audit log -want +got:\n%s", diff)
+	}
+}
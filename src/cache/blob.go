@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/checksum"
+	"github.com/pkg/errors"
+)
+
+// BlobPath returns the absolute path of the object with the given checksum in
+// the Cache, whether or not the object exists.
+func (ch LocalCache) BlobPath(checksum string) (string, error) {
+	cachePath, err := ch.PathForChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(ch.dir, cachePath), nil
+}
+
+// RemoveBlob removes the object with the given checksum from the Cache. Like
+// os.Remove, it fails if the object doesn't exist.
+func (ch LocalCache) RemoveBlob(checksum string) error {
+	path, err := ch.BlobPath(checksum)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	// Commit must not assume the object is still in the cache.
+	if ch.committed != nil {
+		ch.committed.Delete(checksum)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return ch.recordAudit(AuditRecord{
+		Operation: "remove",
+		Checksum:  checksum,
+		Bytes:     info.Size(),
+	})
+}
+
+// CommitBlob adds the bytes read from reader to the Cache as a single object
+// and returns its checksum. Unlike Commit, it doesn't involve an Artifact or
+// the workspace. If reading fails, nothing is added to the Cache.
+func (ch LocalCache) CommitBlob(reader io.Reader) (string, error) {
+	if err := os.MkdirAll(ch.dir, 0o755); err != nil {
+		return "", errors.Wrap(err, "commit blob")
+	}
+	cksum, _, err := ch.commitBytes(reader, "")
+	return cksum, errors.Wrap(err, "commit blob")
+}
+
+// LeafBlobPaths returns the absolute paths of the objects for all files in the
+// given directory Artifact, including files in sub-directories, in sorted
+// order. Files with identical contents share an object, so each path is only
+// listed once. The directory manifests must be in the Cache, but the file
+// objects themselves need not exist.
+func (ch LocalCache) LeafBlobPaths(art artifact.Artifact) ([]string, error) {
+	errPrefix := "leaf blob paths " + art.Path
+	if !art.IsDir {
+		return nil, errors.Errorf("%s: not a directory artifact", errPrefix)
+	}
+	files := make(map[string]string)
+	if err := ch.flattenDirManifest(art.Checksum, "", files); err != nil {
+		return nil, errors.Wrap(err, errPrefix)
+	}
+	pathSet := make(map[string]bool, len(files))
+	for _, checksum := range files {
+		blobPath, err := ch.BlobPath(checksum)
+		if err != nil {
+			return nil, errors.Wrap(err, errPrefix)
+		}
+		pathSet[blobPath] = true
+	}
+	paths := make([]string, 0, len(pathSet))
+	for path := range pathSet {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// ReferencedBlobs returns the checksums of all objects in the Cache referenced
+// by the given Artifacts: the objects of files, the manifests of directories
+// and chunked files, and everything listed in those manifests, recursively.
+// Artifacts that skip the cache or aren't committed reference nothing.
+// Manifests missing from the Cache are included, but can't be expanded, so
+// nothing they list is included.
+func (ch LocalCache) ReferencedBlobs(arts []*artifact.Artifact) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, art := range arts {
+		if err := ch.addReferencedBlobs(*art, referenced); err != nil {
+			return nil, errors.Wrapf(err, "referenced blobs %s", art.Path)
+		}
+	}
+	return referenced, nil
+}
+
+func (ch LocalCache) addReferencedBlobs(art artifact.Artifact, referenced map[string]bool) error {
+	if art.SkipCache || art.Checksum == "" || referenced[art.Checksum] {
+		return nil
+	}
+	referenced[art.Checksum] = true
+	if !art.IsDir && !art.Chunked {
+		return nil
+	}
+	manifestPath, err := ch.BlobPath(art.Checksum)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+		return nil
+	}
+	if art.Chunked {
+		man, err := readChunkManifest(manifestPath)
+		if err != nil {
+			return err
+		}
+		for _, cksum := range man.Chunks {
+			referenced[cksum] = true
+		}
+		return nil
+	}
+	man, err := readDirManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	for _, childArt := range man.Contents {
+		if err := ch.addReferencedBlobs(*childArt, referenced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CorruptManifests returns the given Artifacts, and the Artifacts in their
+// directories, whose manifests are in the Cache but don't match their
+// checksums or can't be decoded. This happens if a commit was interrupted
+// before a manifest reached the disk. Manifests missing from the Cache aren't
+// reported, and nothing they list is checked. The returned Artifacts' paths
+// are relative to the workspace, and they are sorted by path.
+func (ch LocalCache) CorruptManifests(arts []*artifact.Artifact) ([]artifact.Artifact, error) {
+	var corrupt []artifact.Artifact
+	for _, art := range arts {
+		if err := ch.addCorruptManifests(*art, art.Path, &corrupt); err != nil {
+			return nil, errors.Wrapf(err, "corrupt manifests %s", art.Path)
+		}
+	}
+	sort.Slice(corrupt, func(i, j int) bool { return corrupt[i].Path < corrupt[j].Path })
+	return corrupt, nil
+}
+
+func (ch LocalCache) addCorruptManifests(
+	art artifact.Artifact,
+	path string,
+	corrupt *[]artifact.Artifact,
+) error {
+	if art.SkipCache || art.Checksum == "" || (!art.IsDir && !art.Chunked) {
+		return nil
+	}
+	art.Path = path
+	manifestPath, err := ch.BlobPath(art.Checksum)
+	if err != nil {
+		return err
+	}
+	matches, err := matchesChecksum(ch, manifestPath, art.Checksum)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !matches {
+		*corrupt = append(*corrupt, art)
+		return nil
+	}
+	if art.Chunked {
+		if _, err := readChunkManifest(manifestPath); err != nil {
+			*corrupt = append(*corrupt, art)
+		}
+		return nil
+	}
+	man, err := readDirManifest(manifestPath)
+	if errors.As(err, &CorruptManifestError{}) {
+		*corrupt = append(*corrupt, art)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, childArt := range man.Contents {
+		err := ch.addCorruptManifests(*childArt, filepath.Join(path, childArt.Path), corrupt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkBlobs calls fn for each object in the Cache, in order of checksum, with
+// the object's checksum, its absolute path, and its file info. Files in the
+// cache directory that aren't objects, such as temporary files left by an
+// interrupted commit, are skipped. If fn returns an error, WalkBlobs stops and
+// returns the error. A missing cache directory has no objects.
+func (ch LocalCache) WalkBlobs(fn func(checksum string, path string, info os.FileInfo) error) error {
+	errPrefix := "walk blobs in " + ch.dir
+	shards, err := os.ReadDir(ch.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	for _, shard := range shards {
+		// See PathForChecksum for the layout of the cache.
+		if !shard.IsDir() || len(shard.Name()) != 2 {
+			continue
+		}
+		shardDir := filepath.Join(ch.dir, shard.Name())
+		entries, err := os.ReadDir(shardDir)
+		if err != nil {
+			return errors.Wrap(err, errPrefix)
+		}
+		for _, entry := range entries {
+			cksum := shard.Name() + entry.Name()
+			if !entry.Type().IsRegular() || !checksum.IsValid(cksum) {
+				continue
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return errors.Wrap(err, errPrefix)
+			}
+			if err := fn(cksum, filepath.Join(shardDir, entry.Name()), info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/checksum"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestLeafBlobPaths(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger := agglog.NewNullLogger()
+
+	dirs, art, cache := setupDirTest(t)
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := cache.LeafBlobPaths(art)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory has ten files, but 4.txt and 5.txt have the same
+	// contents as bar/4.txt and bar/5.txt.
+	if len(paths) != 8 {
+		t.Fatalf("got %d paths, want 8: %v", len(paths), paths)
+	}
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			t.Fatalf("expected absolute path, got %s", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	art.IsDir = false
+	if _, err := cache.LeafBlobPaths(art); err == nil {
+		t.Fatal("expected error for file artifact")
+	}
+}
+
+func TestWalkBlobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger := agglog.NewNullLogger()
+
+	dirs, art, cache := setupDirTest(t)
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	// Leave some clutter that isn't an object.
+	if err := os.WriteFile(filepath.Join(dirs.CacheDir, "tmp123"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dirs.CacheDir, ".fetch-123"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	leafPaths, err := cache.LeafBlobPaths(art)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("visits every object", func(t *testing.T) {
+		visited := make(map[string]bool)
+		err := cache.WalkBlobs(func(cksum, path string, info os.FileInfo) error {
+			wantPath, err := cache.BlobPath(cksum)
+			if err != nil {
+				return err
+			}
+			if path != wantPath {
+				t.Fatalf("got path %s for checksum %s, want %s", path, cksum, wantPath)
+			}
+			if !info.Mode().IsRegular() {
+				t.Fatalf("%s is not a regular file", path)
+			}
+			visited[path] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range leafPaths {
+			if !visited[path] {
+				t.Fatalf("object %s not visited", path)
+			}
+		}
+		// The files plus the manifests of the directory and its
+		// sub-directory.
+		if want := len(leafPaths) + 2; len(visited) != want {
+			t.Fatalf("visited %d objects, want %d", len(visited), want)
+		}
+	})
+
+	t.Run("stops on error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		calls := 0
+		err := cache.WalkBlobs(func(cksum, path string, info os.FileInfo) error {
+			calls++
+			return errStop
+		})
+		if err != errStop {
+			t.Fatalf("got error %v, want %v", err, errStop)
+		}
+		if calls != 1 {
+			t.Fatalf("got %d calls, want 1", calls)
+		}
+	})
+}
+
+func TestReferencedBlobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger := agglog.NewNullLogger()
+
+	dirs, art, cache := setupDirTest(t)
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	countUnreferenced := func(t *testing.T, arts ...*artifact.Artifact) (count int) {
+		referenced, err := cache.ReferencedBlobs(arts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cache.WalkBlobs(func(cksum, _ string, _ os.FileInfo) error {
+			if !referenced[cksum] {
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	uncommitted := &artifact.Artifact{Path: "new.txt"}
+	if got := countUnreferenced(t, &art, uncommitted); got != 0 {
+		t.Fatalf("got %d unreferenced objects, want 0", got)
+	}
+
+	// Replace a file in the sub-directory and commit again. The old file and
+	// the old manifests of the directory and sub-directory are unreferenced.
+	file := filepath.Join(dirs.WorkDir, "foo", "bar", "8.txt")
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("new contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	if got := countUnreferenced(t, &art); got != 3 {
+		t.Fatalf("got %d unreferenced objects, want 3", got)
+	}
+}
+
+func TestCorruptManifests(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger := agglog.NewNullLogger()
+
+	dirs, art, cache := setupDirTest(t)
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+
+	cache.EnableSyncedCommits()
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptPaths := func(t *testing.T) (paths []string) {
+		corrupt, err := cache.CorruptManifests([]*artifact.Artifact{&art})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, art := range corrupt {
+			paths = append(paths, art.Path)
+		}
+		return
+	}
+
+	if got := corruptPaths(t); len(got) != 0 {
+		t.Fatalf("got corrupt manifests %v, want none", got)
+	}
+
+	manifestPath, err := cache.BlobPath(art.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man, err := readDirManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subManifestPath, err := cache.BlobPath(man.Contents["bar"].Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash that left the sub-directory's manifest truncated.
+	if err := os.Chmod(subManifestPath, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(subManifestPath, 10); err != nil {
+		t.Fatal(err)
+	}
+	if got := corruptPaths(t); len(got) != 1 || got[0] != filepath.Join("foo", "bar") {
+		t.Fatalf("got corrupt manifests %v, want [foo/bar]", got)
+	}
+
+	// Missing manifests aren't corrupt.
+	if err := os.Remove(subManifestPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := corruptPaths(t); len(got) != 0 {
+		t.Fatalf("got corrupt manifests %v, want none", got)
+	}
+}
+
+func TestCommitBlob(t *testing.T) {
+	cache, err := NewLocalCache(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cksum, err := cache.CommitBlob(strings.NewReader("foo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := checksum.Checksum(strings.NewReader("foo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cksum != want {
+		t.Fatalf("checksum = %s, want %s", cksum, want)
+	}
+	blobPath, err := cache.BlobPath(cksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "foo\n" {
+		t.Fatalf("object contents = %#v, want %#v", string(got), "foo\n")
+	}
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A bandwidthLimiter caps the combined rate of all reads through the readers
+// it wraps, no matter how many goroutines are reading concurrently. A nil
+// bandwidthLimiter doesn't limit anything.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	mutex          sync.Mutex
+	// next is the earliest time the next read may proceed.
+	next time.Time
+}
+
+// newBandwidthLimiter returns a bandwidthLimiter for the given rate, or nil if
+// the rate isn't positive.
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait blocks until transferring n more bytes keeps the combined transfer
+// rate at or below the limit. The time to transfer the n bytes is charged to
+// the caller that comes next, so each read proceeds without delay when the
+// limiter is idle.
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+// reader wraps r so that reads from it count towards the limit.
+func (l *bandwidthLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: l}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.limiter.wait(n)
+	return n, err
+}
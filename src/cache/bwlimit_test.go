@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	t.Run("nil limiter doesn't wrap readers", func(t *testing.T) {
+		var limiter *bandwidthLimiter = newBandwidthLimiter(0)
+		r := bytes.NewReader(nil)
+		if limiter.reader(r) != r {
+			t.Fatal("expected reader to be returned as-is")
+		}
+	})
+
+	t.Run("limit applies across concurrent readers", func(t *testing.T) {
+		limiter := newBandwidthLimiter(10000)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := limiter.reader(bytes.NewReader(make([]byte, 1000)))
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		// The first read proceeds immediately, and each of the remaining two
+		// waits for the 1000 bytes before it: 2 * 1000 / 10000 = 0.2s.
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("3000 bytes at 10000 B/s took %v, want at least 200ms", elapsed)
+		}
+	})
+}
@@ -1,21 +1,38 @@
 package cache
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/kevin-hanselman/dud/src/agglog"
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/checksum"
 	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/mattn/go-isatty"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/sync/semaphore"
 )
 
+// FormatVersion is the version of the cache format: the layout of objects in
+// a cache directory, and the schemas of the directory and chunk manifests
+// stored there. Dud can only share caches and remotes with versions of Dud
+// that have the same FormatVersion. It changes whenever a cache written by
+// Dud can't be read by older versions.
+const FormatVersion = 1
+
 const (
 	cacheFilePerms = 0o444
 
@@ -33,6 +50,10 @@ const (
 	progressTemplateSkipCommit pb.ProgressBarTemplate = `  {{string . "prefix"}}  up-to-date; skipping commit`
 
 	progressTemplateCount pb.ProgressBarTemplate = `{{string . "prefix"}} {{counters .}}`
+
+	// How often to log the progress of a transfer when stderr isn't a
+	// terminal.
+	transferLogInterval = 10 * time.Second
 )
 
 // These are somewhat arbitrary numbers. We need to profile more.
@@ -54,6 +75,12 @@ type Cache interface {
 		art *artifact.Artifact,
 		s strategy.CheckoutStrategy,
 		l *agglog.AggLogger,
+	) (CommitResult, error)
+	CommitStream(
+		workDir string,
+		art *artifact.Artifact,
+		r io.Reader,
+		s strategy.CheckoutStrategy,
 	) error
 	Checkout(
 		workDir string,
@@ -69,6 +96,108 @@ type Cache interface {
 // A LocalCache is a Cache that uses a directory on a local filesystem.
 type LocalCache struct {
 	dir string
+	// If set, objects missing from the cache are fetched from this remote
+	// during checkout.
+	autoFetchRemote string
+	// If true, Checkout replaces workspace links that don't point to the
+	// expected object in the cache.
+	relink bool
+	// If true, Checkout discards all local modifications to Artifacts.
+	hardReset bool
+	// If set, bounds the number of files Commit has open at once, across all
+	// levels of a directory Artifact. Copies of the LocalCache share the same
+	// limit.
+	openFiles *semaphore.Weighted
+	// If positive, Commit fails for any file larger than this many bytes.
+	maxFileSize int64
+	// If positive, Commit waits up to this long for a missing Artifact to
+	// appear in the workspace.
+	waitTimeout time.Duration
+	// If positive, Commit reads directories this many entries at a time.
+	dirBatchSize int
+	// The encoding of the directory manifests Commit adds to the cache. The
+	// default is ManifestFormatJSON.
+	manifestFormat string
+	// committed holds the checksums of the objects Commit has put in the
+	// cache, so committing the same contents again needn't touch the cache.
+	// Copies of the LocalCache share the same set.
+	committed *sync.Map
+	// If set, counts the files and bytes Commit adds to the cache. Each call
+	// to Commit sets its own tally.
+	tally *commitTally
+	// totals sums the tallies of all calls to Commit. Copies of the
+	// LocalCache share the same totals.
+	totals *commitTally
+	// If true, Commit always copies files to the cache, even when they could
+	// be moved.
+	forceCopy bool
+	// If positive, caps the combined rate of all transfers to and from
+	// remotes, in bytes per second.
+	bwLimit int64
+	// If greater than one, the number of chunks of a chunked file Artifact to
+	// hash at once.
+	checksumThreads int
+	// If positive, the number of workers Commit shares between all levels of
+	// a directory Artifact to read files. Otherwise maxSharedWorkers is used.
+	ioThreads int
+	// If positive, the number of blocks of file data Commit hashes at once.
+	// Otherwise runtime.NumCPU is used.
+	cpuThreads int
+	// If set, hashes file data for Commit, separately from the workers reading
+	// the files. Commit sets this for the duration of each call.
+	hashPool *checksum.Pool
+	// If set, the buffers used to read files while hashing them, instead of
+	// the default buffers of the checksum package.
+	checksumBuffers *sync.Pool
+	// If true, Commit splits chunked file Artifacts into content-defined
+	// chunks instead of fixed-size chunks.
+	contentDefinedChunks bool
+	// canonicalDirs caches workspace directories with their symlinks
+	// resolved, keyed by the unresolved path. Copies of the LocalCache share
+	// the same map.
+	canonicalDirs *sync.Map
+	// If set, Commit creates its temporary copies of files in this directory
+	// instead of the cache directory.
+	tempDir string
+	// If true, files in tempDir can be renamed into the cache directory.
+	// Commit sets this for the duration of each call.
+	tempDirRenames bool
+	// If set, changes to the cache are recorded in this audit log.
+	audit *auditLog
+	// If true, Commit reports files with identical contents in directory
+	// Artifacts.
+	reportDuplicates bool
+	// If set, collects the duplicate files found by Commit. Each call to
+	// Commit sets its own collection.
+	duplicates *duplicateSets
+	// If true, Status reports directory Artifacts whose manifests are corrupt
+	// instead of failing.
+	reportCorruptManifests bool
+	// If true, Commit only records checksums, without adding the contents of
+	// files to the cache.
+	checksumOnly bool
+	// If true, Commit re-hashes every file and replaces objects already in
+	// the cache.
+	forceCommit bool
+	// If true, Status only compares the entries of directory Artifacts with
+	// their manifests by name and file type.
+	shallowStatus bool
+	// If true, Commit records the extended attributes of files, and Checkout
+	// restores them on files it copies.
+	preserveXattrs bool
+	// If true, Commit syncs each object it adds to the cache to disk before
+	// returning.
+	syncCommits bool
+	// If true, Commit records the detected content type of each file it adds
+	// to the cache.
+	detectContentTypes bool
+	// If set, Commit and Checkout send a ProgressEvent here for each file
+	// they finish with.
+	progressEvents chan<- ProgressEvent
+	// commitRoot is the absolute workspace directory of the current call to
+	// Commit, with its symlinks resolved. Commit sets this for the duration
+	// of each call.
+	commitRoot string
 }
 
 // NewLocalCache initializes a LocalCache with a valid cache directory.
@@ -77,24 +206,489 @@ func NewLocalCache(dir string) (ch LocalCache, err error) {
 		return ch, errors.New("cache directory path must be set")
 	}
 	ch.dir, err = filepath.Abs(dir)
+	ch.committed = new(sync.Map)
+	ch.canonicalDirs = new(sync.Map)
+	ch.totals = new(commitTally)
 	return
 }
 
+// Dir returns the absolute path of the cache directory.
+func (ch LocalCache) Dir() string {
+	return ch.dir
+}
+
+// EnableAutoFetch makes Checkout download objects missing from the cache from
+// the given remote instead of failing. For directory Artifacts, the directory
+// manifest is fetched first, then its children are fetched as the directory is
+// checked out.
+func (ch *LocalCache) EnableAutoFetch(remote string) {
+	ch.autoFetchRemote = remote
+}
+
+// EnableRelink makes Checkout replace workspace links that point to the wrong
+// object in the cache (e.g. after a stage was re-committed without being
+// checked out) or to nothing at all. Without this, Checkout fails on such
+// links. Only links are replaced; regular files are never overwritten.
+func (ch *LocalCache) EnableRelink() {
+	ch.relink = true
+}
+
+// EnableCorruptManifestStatus makes Status report a directory Artifact whose
+// manifest in the cache can't be decoded by setting ManifestCorrupt in its
+// Status, rather than by returning a CorruptManifestError. This lets callers
+// report the status of all other Artifacts.
+func (ch *LocalCache) EnableCorruptManifestStatus() {
+	ch.reportCorruptManifests = true
+}
+
+// EnableChecksumOnly makes Commit record the checksums of Artifacts without
+// adding the contents of their files to the cache. The manifests of directory
+// and chunked file Artifacts are still added, so Status can report on their
+// contents; their files are reported as missing from the cache. Workspace
+// files are left in place, so Commit must be called with CopyStrategy.
+func (ch *LocalCache) EnableChecksumOnly() {
+	ch.checksumOnly = true
+}
+
+// EnableForceCommit makes Commit re-hash and re-store every file of an
+// Artifact, even if it looks up-to-date, replacing any objects already in the
+// cache with their workspace copies. Workspace files that are already linked
+// to the cache are the objects themselves, so they're only re-hashed, and
+// Commit fails with an IntegrityError if they no longer match their
+// checksums. This is slower than a normal commit, but it repairs objects
+// that were corrupted or truncated in the cache.
+func (ch *LocalCache) EnableForceCommit() {
+	ch.forceCommit = true
+}
+
+// EnableShallowStatus makes Status compare only the top-level entries of
+// directory Artifacts with their manifests, by name and file type, without
+// checking the contents of any files or sub-directories. The resulting Status
+// has Shallow set. Directories that aren't committed, or whose manifests
+// aren't in the cache, get a full Status.
+func (ch *LocalCache) EnableShallowStatus() {
+	ch.shallowStatus = true
+}
+
+// EnableForceCopy makes Commit always copy files to the cache instead of
+// moving them there, even when the workspace and the cache appear to be on the
+// same filesystem. This is slower, but more reliable on network filesystems
+// whose rename semantics differ from local filesystems.
+func (ch *LocalCache) EnableForceCopy() {
+	ch.forceCopy = true
+}
+
+// EnableSyncedCommits makes Commit and Fetch sync every object they add to the
+// cache to disk before renaming it into place, and the directory holding it
+// after. The
+// objects an Artifact references are then durable before its checksum is
+// recorded anywhere, and a power loss can't leave a partial object in the
+// cache, at the cost of slower commits.
+func (ch *LocalCache) EnableSyncedCommits() {
+	ch.syncCommits = true
+}
+
+// EnableHardReset makes Checkout discard all local modifications to Artifacts,
+// so the workspace exactly matches the committed state. Anything that doesn't
+// match the committed Artifact is removed before checking it out, and files and
+// directories in directory Artifacts that aren't in the directory manifest are
+// removed entirely. This is destructive; uncommitted changes are lost.
+func (ch *LocalCache) EnableHardReset() {
+	ch.hardReset = true
+}
+
+// minOpenFiles is the smallest limit accepted by SetMaxOpenFiles. Committing
+// a file that can't be moved into the cache takes two open files: the file
+// itself and its copy in the cache.
+const minOpenFiles = 2
+
+// SetMaxOpenFiles limits the number of files Commit opens at once to n. The
+// limit is shared by all workers committing a directory Artifact, including
+// those committing sub-directories, so very wide and deep directories can be
+// committed without running out of file descriptors. If n is zero, there is no
+// limit.
+func (ch *LocalCache) SetMaxOpenFiles(n int) error {
+	if n == 0 {
+		ch.openFiles = nil
+		return nil
+	}
+	if n < minOpenFiles {
+		return fmt.Errorf("max open files must be at least %d, got %d", minOpenFiles, n)
+	}
+	ch.openFiles = semaphore.NewWeighted(int64(n))
+	return nil
+}
+
+// SetDirBatchSize makes Commit read the entries of directory Artifacts n at a
+// time, committing each batch of entries as it's read, instead of reading all
+// entries of a directory before committing any of them. This bounds the memory
+// used for directory entries when committing directories with millions of
+// files, though the directory manifest still lists every file. Directories
+// that preserve hard links are always read at once. Each directory being read
+// in batches stays open while it's committed, without counting against the
+// limit set by SetMaxOpenFiles. If n is zero, directories are read at once.
+func (ch *LocalCache) SetDirBatchSize(n int) error {
+	if n < 0 {
+		return fmt.Errorf("directory batch size must not be negative, got %d", n)
+	}
+	ch.dirBatchSize = n
+	return nil
+}
+
+// SetManifestFormat sets the encoding of the directory manifests Commit adds
+// to the cache, either ManifestFormatJSON (the default) or
+// ManifestFormatMsgpack. MessagePack manifests are smaller and faster to
+// decode, which matters for directories with millions of files. Manifests of
+// either format are read regardless of this setting, but the checksum of a
+// directory Artifact depends on the format its manifest was committed in. If
+// format is empty, the default is used.
+func (ch *LocalCache) SetManifestFormat(format string) error {
+	switch format {
+	case "", ManifestFormatJSON, ManifestFormatMsgpack:
+		ch.manifestFormat = format
+		return nil
+	}
+	return fmt.Errorf(
+		"manifest format must be %#v or %#v, got %#v",
+		ManifestFormatJSON,
+		ManifestFormatMsgpack,
+		format,
+	)
+}
+
+// EnableContentDefinedChunking makes Commit split chunked file Artifacts into
+// chunks whose boundaries depend on the file's contents, instead of into
+// fixed-size chunks. Chunks are then shared between files (or versions of a
+// file) that have regions in common, even if those regions are at different
+// offsets, so the Cache only stores the common regions once. This has no
+// effect on Artifacts that aren't chunked, or on Artifacts that were already
+// committed.
+func (ch *LocalCache) EnableContentDefinedChunking() {
+	ch.contentDefinedChunks = true
+}
+
+// SetTempDir makes Commit create its temporary copies of files in dir instead
+// of the cache directory, e.g. to keep them on a faster disk. The copies are
+// renamed into the cache when dir and the cache are on the same filesystem,
+// and copied into the cache otherwise. An empty dir restores the default.
+func (ch *LocalCache) SetTempDir(dir string) error {
+	if dir == "" {
+		ch.tempDir = ""
+		return nil
+	}
+	var err error
+	ch.tempDir, err = filepath.Abs(dir)
+	return err
+}
+
+// SetChecksumThreads makes the Cache hash up to n chunks of a chunked file
+// Artifact at once, both when committing the Artifact and when checking its
+// status. This speeds up hashing a single large file when hashing is CPU-bound.
+// Chunk boundaries don't depend on n, so neither do checksums. If n is zero,
+// chunks are hashed one at a time.
+func (ch *LocalCache) SetChecksumThreads(n int) error {
+	if n < 0 {
+		return fmt.Errorf("checksum threads must not be negative, got %d", n)
+	}
+	ch.checksumThreads = n
+	return nil
+}
+
+// SetIOThreads makes Commit read the files of a directory Artifact on n workers
+// shared with all of its sub-directories, plus one dedicated worker per
+// directory. Raise it when reading files is the bottleneck, such as on network
+// filesystems with high latency. If n is zero, a default suited to local disks
+// is used.
+func (ch *LocalCache) SetIOThreads(n int) error {
+	if n < 0 {
+		return fmt.Errorf("IO threads must not be negative, got %d", n)
+	}
+	ch.ioThreads = n
+	return nil
+}
+
+// SetCPUThreads makes Commit hash up to n blocks of file data at once, no
+// matter how many files it reads at once (see SetIOThreads). Hashing happens
+// on its own goroutines, so each file's next block is read while the previous
+// one is hashed. If n is zero, the number of CPUs is used.
+func (ch *LocalCache) SetCPUThreads(n int) error {
+	if n < 0 {
+		return fmt.Errorf("CPU threads must not be negative, got %d", n)
+	}
+	ch.cpuThreads = n
+	return nil
+}
+
+// SetChecksumBufferSize makes the Cache read files through a buffer of n bytes
+// while hashing them. Larger buffers need fewer reads, which can improve the
+// throughput of storage with high latency, such as network mounts. The buffer
+// size doesn't affect checksums. If n is zero, the default buffer size of the
+// checksum package is used.
+func (ch *LocalCache) SetChecksumBufferSize(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("checksum buffer size must not be negative, got %d", n)
+	}
+	if n == 0 {
+		ch.checksumBuffers = nil
+		return nil
+	}
+	ch.checksumBuffers = &sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, n)
+			return &buffer
+		},
+	}
+	return nil
+}
+
+// checksumReader returns the checksum of the bytes from reader, reading them
+// through a buffer of the size set by SetChecksumBufferSize. If the LocalCache
+// has a hash pool, the bytes are hashed on it.
+func (ch LocalCache) checksumReader(reader io.Reader) (string, error) {
+	if ch.hashPool != nil {
+		if ch.checksumBuffers == nil {
+			return ch.hashPool.Checksum(reader)
+		}
+		first := ch.checksumBuffers.Get().(*[]byte)
+		defer ch.checksumBuffers.Put(first)
+		second := ch.checksumBuffers.Get().(*[]byte)
+		defer ch.checksumBuffers.Put(second)
+		return ch.hashPool.ChecksumBuffers(reader, *first, *second)
+	}
+	if ch.checksumBuffers == nil {
+		return checksum.Checksum(reader)
+	}
+	buffer := ch.checksumBuffers.Get().(*[]byte)
+	defer ch.checksumBuffers.Put(buffer)
+	return checksum.ChecksumBuffer(reader, *buffer)
+}
+
+// SetWaitTimeout makes Commit wait up to d for an Artifact that's missing from
+// the workspace to appear, checking for it periodically, instead of failing
+// right away. If the Artifact is still missing after d, Commit fails as
+// usual. If d is zero, Commit doesn't wait.
+func (ch *LocalCache) SetWaitTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("wait timeout must not be negative, got %s", d)
+	}
+	ch.waitTimeout = d
+	return nil
+}
+
+// SetMaxFileSize makes Commit fail for any file larger than n bytes, before
+// the file is moved to the cache. If n is zero, there is no limit.
+func (ch *LocalCache) SetMaxFileSize(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("max file size must not be negative, got %d", n)
+	}
+	ch.maxFileSize = n
+	return nil
+}
+
+// SetBandwidthLimit caps the combined transfer rate of Push, Fetch, and
+// auto-fetching Checkouts at n bytes per second, no matter how many files are
+// transferred concurrently. If n is zero, there is no limit.
+func (ch *LocalCache) SetBandwidthLimit(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("bandwidth limit must not be negative, got %d", n)
+	}
+	ch.bwLimit = n
+	return nil
+}
+
+// wasCommitted returns true if Commit put the object with the given checksum
+// in the cache earlier in the life of the LocalCache.
+func (ch LocalCache) wasCommitted(cksum string) bool {
+	if ch.committed == nil {
+		return false
+	}
+	_, ok := ch.committed.Load(cksum)
+	return ok
+}
+
+// canonicalDir returns the workspace directory dir with all symlinks
+// resolved. Links to the cache are made relative to their parent directory, so
+// they must be made from the directory's real location to resolve correctly
+// (e.g. for projects under /var on macOS, which is a link to /private/var). If
+// dir can't be resolved, such as when it doesn't exist, it is returned as is.
+func (ch LocalCache) canonicalDir(dir string) string {
+	if ch.canonicalDirs != nil {
+		if resolved, ok := ch.canonicalDirs.Load(dir); ok {
+			return resolved.(string)
+		}
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return dir
+	}
+	if ch.canonicalDirs != nil {
+		ch.canonicalDirs.Store(dir, resolved)
+	}
+	return resolved
+}
+
+func (ch LocalCache) markCommitted(cksum string) {
+	if ch.committed != nil {
+		ch.committed.Store(cksum, struct{}{})
+	}
+}
+
+// acquireOpenFiles blocks until n more files may be opened, then returns a
+// function to call once the files are closed.
+func (ch LocalCache) acquireOpenFiles(n int64) (release func()) {
+	if ch.openFiles == nil {
+		return func() {}
+	}
+	// Acquire can only fail if the context is cancelled.
+	_ = ch.openFiles.Acquire(context.Background(), n)
+	return func() { ch.openFiles.Release(n) }
+}
+
 // PathForChecksum returns the expected location of an object with the
 // given checksum in the cache. If the checksum has an invalid (e.g. empty)
 // checksum value, this function returns an error.
 func (ch LocalCache) PathForChecksum(checksum string) (string, error) {
-	if len(checksum) < 3 {
+	// Checksums with path elements could resolve to a location outside of the
+	// cache.
+	if len(checksum) < 3 || strings.ContainsAny(checksum, `/\.`) {
 		return "", InvalidChecksumError{checksum: checksum}
 	}
 	return filepath.Join(checksum[:2], checksum[2:]), nil
 }
 
 type directoryManifest struct {
-	Path     string                        `json:"path,"`
+	// Path is only set in manifests committed by older versions of Dud. It is
+	// no longer recorded, so that the checksum of a directory Artifact
+	// doesn't depend on where the directory lives, and identical directories
+	// share a manifest in the cache.
+	Path     string                        `json:"path,omitempty"`
 	Contents map[string]*artifact.Artifact `json:"contents,"`
+	// Order lists the keys of Contents in natural order. It is only set for
+	// ordered directory Artifacts. (See artifact.Artifact.Ordered.)
+	Order []string `json:"order,omitempty"`
+	// Hardlinks lists groups of keys of Contents whose files were hard links
+	// to the same file when committed. It is only set for directory Artifacts
+	// that preserve hard links. (See artifact.Artifact.PreserveHardlinks.)
+	Hardlinks [][]string `json:"hardlinks,omitempty"`
 }
 
+// EncodeMsgpack implements msgpack.CustomEncoder. It encodes the manifest
+// like the default struct encoding, except that Contents is always sorted by
+// key, so that identical directories have identical manifests.
+func (man directoryManifest) EncodeMsgpack(enc *msgpack.Encoder) error {
+	numFields := 1
+	if man.Path != "" {
+		numFields++
+	}
+	if len(man.Order) > 0 {
+		numFields++
+	}
+	if len(man.Hardlinks) > 0 {
+		numFields++
+	}
+	if err := enc.EncodeMapLen(numFields); err != nil {
+		return err
+	}
+	if man.Path != "" {
+		if err := enc.EncodeString("path"); err != nil {
+			return err
+		}
+		if err := enc.EncodeString(man.Path); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeString("contents"); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(man.Contents))
+	for key := range man.Contents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if err := enc.EncodeMapLen(len(keys)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := enc.EncodeString(key); err != nil {
+			return err
+		}
+		if err := enc.Encode(man.Contents[key]); err != nil {
+			return err
+		}
+	}
+	if len(man.Order) > 0 {
+		if err := enc.EncodeString("order"); err != nil {
+			return err
+		}
+		if err := enc.Encode(man.Order); err != nil {
+			return err
+		}
+	}
+	if len(man.Hardlinks) > 0 {
+		if err := enc.EncodeString("hardlinks"); err != nil {
+			return err
+		}
+		if err := enc.Encode(man.Hardlinks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// naturalLess reports whether a sorts before b in natural order, where runs
+// of digits are compared by their numeric value (e.g. "shard-2" < "shard-10").
+// If two strings are equal in natural order (e.g. "01" and "1"), they are
+// compared byte-wise so the order is total and deterministic.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			// Find the ends of the digit runs and strip leading zeros.
+			iEnd, jEnd := i, j
+			for iEnd < len(a) && isDigit(a[iEnd]) {
+				iEnd++
+			}
+			for jEnd < len(b) && isDigit(b[jEnd]) {
+				jEnd++
+			}
+			aNum := strings.TrimLeft(a[i:iEnd], "0")
+			bNum := strings.TrimLeft(b[j:jEnd], "0")
+			if len(aNum) != len(bNum) {
+				return len(aNum) < len(bNum)
+			}
+			if aNum != bNum {
+				return aNum < bNum
+			}
+			i, j = iEnd, jEnd
+			continue
+		}
+		if a[i] != b[j] {
+			return a[i] < b[j]
+		}
+		i++
+		j++
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// Manifest formats accepted by SetManifestFormat.
+const (
+	ManifestFormatJSON    = "json"
+	ManifestFormatMsgpack = "msgpack"
+)
+
+// msgpackManifestMagic starts every directory manifest encoded as
+// MessagePack. JSON manifests always start with '{', so readDirManifest can
+// tell the formats apart.
+var msgpackManifestMagic = []byte("\x00dud-msgpack\n")
+
 func readDirManifest(path string) (man directoryManifest, err error) {
 	var f *os.File
 	f, err = os.Open(path)
@@ -102,7 +696,24 @@ func readDirManifest(path string) (man directoryManifest, err error) {
 		return
 	}
 	defer f.Close()
-	err = json.NewDecoder(f).Decode(&man)
+	r := bufio.NewReader(f)
+	magic, peekErr := r.Peek(len(msgpackManifestMagic))
+	if peekErr == nil && bytes.Equal(magic, msgpackManifestMagic) {
+		_, err = r.Discard(len(magic))
+		if err == nil {
+			dec := msgpack.NewDecoder(r)
+			dec.SetCustomStructTag("json")
+			err = dec.Decode(&man)
+		}
+	} else {
+		err = json.NewDecoder(r).Decode(&man)
+	}
+	// Errors reading the file are reported as they are. Anything else means
+	// the file's contents couldn't be decoded.
+	var pathErr *os.PathError
+	if err != nil && !errors.As(err, &pathErr) {
+		err = CorruptManifestError{path: path, err: err}
+	}
 	return
 }
 
@@ -129,6 +740,78 @@ func (err MissingFromCacheError) Error() string {
 	return fmt.Sprintf("checksum missing from cache: %#v", err.checksum)
 }
 
+// CorruptManifestError is an error case where a directory manifest in the
+// cache exists but can't be decoded, for example because the object was
+// truncated or overwritten.
+type CorruptManifestError struct {
+	path string
+	err  error
+}
+
+func (err CorruptManifestError) Error() string {
+	return fmt.Sprintf("corrupt directory manifest %s: %v", err.path, err.err)
+}
+
+// SymlinkEscapeError is an error case where a directory Artifact holds a
+// symlink that points outside of the workspace and the cache. Such links are
+// never committed, so data from elsewhere on the system can't be captured by
+// accident.
+type SymlinkEscapeError struct {
+	path, target string
+}
+
+func (err SymlinkEscapeError) Error() string {
+	return fmt.Sprintf(
+		"%s: refusing to commit symlink to %s, which is outside of the project",
+		err.path,
+		err.target,
+	)
+}
+
+// ArtifactInCacheError is an error case where an Artifact's path resolves to
+// a location inside of the cache directory or a project's metadata directory,
+// for example through a symlink.
+type ArtifactInCacheError struct {
+	path, resolved, dir string
+}
+
+func (err ArtifactInCacheError) Error() string {
+	return fmt.Sprintf(
+		"%s resolves to %s, which is inside of %s",
+		err.path,
+		err.resolved,
+		err.dir,
+	)
+}
+
+// FileTooLargeError is an error case where a file exceeds the size limit set
+// with SetMaxFileSize.
+type FileTooLargeError struct {
+	limit int64
+}
+
+func (err FileTooLargeError) Error() string {
+	return fmt.Sprintf("file larger than max size of %s", datasize.ByteSize(err.limit).HR())
+}
+
+// sizeLimitReader reads from r until more than limit bytes have been read,
+// at which point it returns a FileTooLargeError. Unlike io.LimitReader, the
+// contents are never silently truncated.
+type sizeLimitReader struct {
+	r         io.Reader
+	limit     int64
+	bytesRead int64
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.bytesRead += int64(n)
+	if lr.bytesRead > lr.limit {
+		return n, FileTooLargeError{lr.limit}
+	}
+	return n, err
+}
+
 func newHiddenProgress() *pb.ProgressBar {
 	return pb.New(0).SetRefreshRate(time.Hour).SetWriter(io.Discard)
 }
@@ -150,3 +833,64 @@ func newProgress(template pb.ProgressBarTemplate, initialValue int, prefix strin
 	}
 	return
 }
+
+// newTransferProgress returns a progress report for a transfer of total bytes.
+// If stderr is a terminal, the report is rendered as a progress bar with the
+// transfer rate and ETA. Otherwise, the same information is logged to stderr
+// periodically. The returned function must be called once the transfer is
+// complete. Like all progress reports, it is safe for concurrent use.
+func newTransferProgress(total int64, prefix string) (*pb.ProgressBar, func()) {
+	progress := newProgress(progressTemplateDefault, 0, prefix)
+	progress.SetTotal(total)
+	progress.Set(pb.Bytes, true)
+	progress.Start()
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		return progress, func() { progress.Finish() }
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		start := time.Now()
+		ticker := time.NewTicker(transferLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Fprintln(
+					os.Stderr,
+					transferLogLine(prefix, progress.Current(), total, time.Since(start)),
+				)
+			}
+		}
+	}()
+	return progress, func() {
+		close(done)
+		<-stopped
+		progress.Finish()
+	}
+}
+
+// transferLogLine describes the progress of a transfer in a single line.
+func transferLogLine(prefix string, current, total int64, elapsed time.Duration) string {
+	line := fmt.Sprintf(
+		"%s: %s / %s",
+		prefix,
+		datasize.ByteSize(current).HR(),
+		datasize.ByteSize(total).HR(),
+	)
+	if current <= 0 || elapsed <= 0 {
+		return line
+	}
+	rate := float64(current) / elapsed.Seconds()
+	eta := time.Duration(float64(total-current) / rate * float64(time.Second))
+	return fmt.Sprintf(
+		"%s, %s/s, ETA %s",
+		line,
+		datasize.ByteSize(rate).HR(),
+		eta.Round(time.Second),
+	)
+}
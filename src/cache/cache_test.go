@@ -1,8 +1,15 @@
 package cache
 
 import (
+	"bytes"
+	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/artifact"
 )
 
 func TestPathForChecksum(t *testing.T) {
@@ -31,6 +38,20 @@ func TestPathForChecksum(t *testing.T) {
 		}
 	})
 
+	t.Run("reject checksums with path elements", func(t *testing.T) {
+		ch, err := NewLocalCache("/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, checksum := range []string{"../../etc/passwd", "ab/cdef", "abc.def"} {
+			_, err = ch.PathForChecksum(checksum)
+			if _, ok := err.(InvalidChecksumError); !ok {
+				t.Fatalf("expected InvalidChecksumError for cache.PathForChecksum(%#v), got %v", checksum, err)
+			}
+		}
+	})
+
 	t.Run("reject empty paths", func(t *testing.T) {
 		_, err := NewLocalCache("")
 		if err == nil {
@@ -38,3 +59,135 @@ func TestPathForChecksum(t *testing.T) {
 		}
 	})
 }
+
+func TestManifestFormats(t *testing.T) {
+	manifest := directoryManifest{
+		Contents: map[string]*artifact.Artifact{
+			"b.txt": {Checksum: "bbb", Path: "b.txt"},
+			"a.txt": {Checksum: "aaa", Path: "a.txt", Xattrs: map[string]string{"user.x": "eQ=="}},
+			"sub":   {Checksum: "ccc", Path: "sub", IsDir: true, Ordered: true},
+		},
+		Order:     []string{"a.txt", "b.txt", "sub"},
+		Hardlinks: [][]string{{"a.txt", "b.txt"}},
+	}
+
+	commitAndRead := func(format string) (string, []byte, directoryManifest) {
+		ch, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.SetManifestFormat(format); err != nil {
+			t.Fatal(err)
+		}
+		cksum, err := commitDirManifest(ch, &manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Encoding must be deterministic.
+		again, err := commitDirManifest(ch, &manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != cksum {
+			t.Fatalf("%s: checksums of identical manifests differ: %s vs. %s", format, cksum, again)
+		}
+		cachePath, err := ch.PathForChecksum(cksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.ReadFile(filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readDirManifest(filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cksum, contents, got
+	}
+
+	jsonCksum, jsonContents, jsonManifest := commitAndRead(ManifestFormatJSON)
+	if jsonContents[0] != '{' {
+		t.Fatalf("expected JSON manifest, got %q", jsonContents)
+	}
+	if diff := cmp.Diff(manifest, jsonManifest); diff != "" {
+		t.Fatalf("JSON manifest -want +got:\n%s", diff)
+	}
+
+	msgpackCksum, msgpackContents, msgpackManifest := commitAndRead(ManifestFormatMsgpack)
+	if !bytes.HasPrefix(msgpackContents, msgpackManifestMagic) {
+		t.Fatalf("expected msgpack manifest, got %q", msgpackContents)
+	}
+	if diff := cmp.Diff(manifest, msgpackManifest); diff != "" {
+		t.Fatalf("msgpack manifest -want +got:\n%s", diff)
+	}
+	if len(msgpackContents) >= len(jsonContents) {
+		t.Fatalf(
+			"expected msgpack manifest (%d bytes) to be smaller than JSON manifest (%d bytes)",
+			len(msgpackContents),
+			len(jsonContents),
+		)
+	}
+	if msgpackCksum == jsonCksum {
+		t.Fatal("expected manifest formats to have different checksums")
+	}
+
+	ch, err := NewLocalCache("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.SetManifestFormat("xml"); err == nil {
+		t.Fatal("expected error for unknown manifest format")
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	want := []string{
+		"01",
+		"1",
+		"2",
+		"10",
+		"a",
+		"shard-1.bin",
+		"shard-2",
+		"shard-2.bin",
+		"shard-010.bin",
+		"shard-10.bin",
+		"shard-100.bin",
+	}
+	got := []string{
+		"shard-100.bin",
+		"shard-10.bin",
+		"a",
+		"10",
+		"shard-2.bin",
+		"2",
+		"shard-010.bin",
+		"01",
+		"shard-2",
+		"1",
+		"shard-1.bin",
+	}
+	sort.Slice(got, func(i, j int) bool { return naturalLess(got[i], got[j]) })
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("natural order -want +got:\n%s", diff)
+	}
+}
+
+func TestTransferLogLine(t *testing.T) {
+	t.Run("no progress yet", func(t *testing.T) {
+		got := transferLogLine("Copying files", 0, 4096, 0)
+		want := "Copying files: 0 B / 4.0 KB"
+		if got != want {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	})
+
+	t.Run("with rate and ETA", func(t *testing.T) {
+		got := transferLogLine("Copying files", 2048, 8192, time.Second)
+		want := "Copying files: 2.0 KB / 8.0 KB, 2.0 KB/s, ETA 3s"
+		if got != want {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	})
+}
@@ -6,10 +6,11 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/kevin-hanselman/dud/src/artifact"
-	"github.com/kevin-hanselman/dud/src/checksum"
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/pkg/errors"
@@ -46,14 +47,103 @@ func (cache LocalCache) Checkout(
 	} else {
 		// Setting the total here avoids locking the progress bar in the hot path
 		// (checkoutFile, which is called from checkoutDir).
-		if strat == strategy.LinkStrategy {
+		if strat == strategy.LinkStrategy && !art.Chunked {
 			progress.SetTotal(1)
 		}
 		err = checkoutFile(cache, workspaceDir, art, strat, progress)
+		if err == nil {
+			cache.emitProgress(PhaseCheckout, workspaceDir, art.Path, progress)
+		}
+	}
+	if err == nil {
+		err = cache.recordAudit(AuditRecord{
+			Operation: "checkout",
+			Path:      art.Path,
+			Checksum:  art.Checksum,
+			Strategy:  auditStrategy(strat),
+		})
 	}
 	return errors.Wrapf(err, "checkout %s", art.Path)
 }
 
+// CheckoutChild checks out only the file or directory at childPath within the
+// directory Artifact art, creating its parent directories in the workspace as
+// needed. childPath is relative to art.Path. The rest of the directory
+// Artifact is left as is, so a single file can be checked out without
+// checking out the whole directory.
+func (cache LocalCache) CheckoutChild(
+	workspaceDir string,
+	art artifact.Artifact,
+	childPath string,
+	strat strategy.CheckoutStrategy,
+	progress *pb.ProgressBar,
+) error {
+	child, err := cache.ChildArtifact(workspaceDir, art, childPath)
+	if err != nil {
+		return errors.Wrap(err, "checkout")
+	}
+	return cache.Checkout(workspaceDir, child, strat, progress)
+}
+
+// ChildArtifact returns the Artifact at childPath within the directory
+// Artifact art, as checked out by CheckoutChild. childPath is relative to
+// art.Path, and the returned Artifact's path is relative to workspaceDir.
+func (cache LocalCache) ChildArtifact(
+	workspaceDir string,
+	art artifact.Artifact,
+	childPath string,
+) (artifact.Artifact, error) {
+	child, err := findChildArtifact(cache, workspaceDir, art, childPath)
+	return child, errors.Wrap(err, filepath.Join(art.Path, childPath))
+}
+
+// findChildArtifact looks up the Artifact at childPath within the directory
+// Artifact art in the directory manifests in the cache, fetching them first if
+// auto-fetch is enabled. The returned Artifact's path is relative to
+// workspaceDir, like art's.
+func findChildArtifact(
+	ch LocalCache,
+	workspaceDir string,
+	art artifact.Artifact,
+	childPath string,
+) (artifact.Artifact, error) {
+	childPath = filepath.Clean(childPath)
+	if childPath == "." ||
+		childPath == ".." ||
+		filepath.IsAbs(childPath) ||
+		strings.HasPrefix(childPath, ".."+string(filepath.Separator)) {
+		return art, errors.Errorf("invalid path %#v within directory artifact", childPath)
+	}
+	current := art
+	for _, name := range strings.Split(childPath, string(filepath.Separator)) {
+		if !current.IsDir {
+			return art, errors.Errorf("%s is not a directory artifact", current.Path)
+		}
+		status, cachePath, _, err := autoFetchStatus(ch, workspaceDir, current)
+		if err != nil {
+			return art, err
+		}
+		if !status.HasChecksum {
+			return art, InvalidChecksumError{current.Checksum}
+		}
+		if !status.ChecksumInCache {
+			return art, MissingFromCacheError{current.Checksum}
+		}
+		man, err := readDirManifest(filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			return art, err
+		}
+		child, ok := man.Contents[name]
+		if !ok {
+			return art, errors.Errorf("%s not found in directory artifact %s", name, current.Path)
+		}
+		next := *child
+		next.Path = filepath.Join(current.Path, name)
+		current = next
+	}
+	return current, nil
+}
+
 func checkoutFile(
 	ch LocalCache,
 	workspaceDir string,
@@ -61,7 +151,7 @@ func checkoutFile(
 	strat strategy.CheckoutStrategy,
 	progress *pb.ProgressBar,
 ) error {
-	status, cachePath, workPath, err := quickStatus(ch, workspaceDir, art)
+	status, cachePath, workPath, err := autoFetchStatus(ch, workspaceDir, art)
 	if err != nil {
 		return err
 	}
@@ -71,50 +161,47 @@ func checkoutFile(
 	if !status.ChecksumInCache {
 		return MissingFromCacheError{art.Checksum}
 	}
-	if err := os.MkdirAll(filepath.Dir(workPath), 0o755); err != nil {
+	if art.Chunked {
+		err := checkoutChunkedFile(
+			ch,
+			art,
+			status,
+			filepath.Join(ch.dir, cachePath),
+			workPath,
+			progress,
+		)
+		if err == nil && ch.preserveXattrs {
+			err = writeArtifactXattrs(workPath, art.Xattrs)
+		}
 		return err
 	}
 	cachePath = filepath.Join(ch.dir, cachePath)
-	switch strat {
-	case strategy.CopyStrategy:
-		srcInfo, err := os.Lstat(cachePath)
+	// A copy left by an earlier checkout, such as one interrupted part-way
+	// through a directory, is kept if it matches the cache.
+	if strat == strategy.CopyStrategy && status.WorkspaceFileStatus == fsutil.StatusRegularFile {
+		match, err := fsutil.SameContents(workPath, cachePath)
 		if err != nil {
 			return err
 		}
-		progress.AddTotal(srcInfo.Size())
-
-		srcFile, err := os.Open(cachePath)
-		if err != nil {
-			return err
-		}
-		defer srcFile.Close()
-
-		// ContentsMatch is set true in quickStatus only when the workspace
-		// file is a link to the correct file in the cache. In this case, we
-		// can safely remove the link to allow the copy checkout to proceed.
-		// Otherwise, it's best to let os.OpenFile fail below to make the user
-		// fix the issue.
-		if status.ContentsMatch {
-			if err := os.Remove(workPath); err != nil {
-				return err
+		if match {
+			if ch.preserveXattrs {
+				return writeArtifactXattrs(workPath, art.Xattrs)
 			}
+			return nil
 		}
-
-		dstFile, err := os.OpenFile(workPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
-		if err != nil {
-			return err
-		}
-		defer dstFile.Close()
-
-		// Might as well checksum the file while we copy to check data integrity.
-		srcReader := io.TeeReader(progress.NewProxyReader(srcFile), dstFile)
-		checksum, err := checksum.Checksum(srcReader)
-		if err != nil {
+	}
+	if ch.hardReset && !status.ContentsMatch && status.WorkspaceFileStatus != fsutil.StatusAbsent {
+		if err := os.RemoveAll(workPath); err != nil {
 			return err
 		}
-		if checksum != art.Checksum {
-			return fmt.Errorf("found checksum %#v, expected %#v", checksum, art.Checksum)
-		}
+		status.WorkspaceFileStatus = fsutil.StatusAbsent
+	}
+	if err := os.MkdirAll(filepath.Dir(workPath), 0o755); err != nil {
+		return err
+	}
+	switch strat {
+	case strategy.CopyStrategy:
+		return copyFileFromCache(ch, art, status, cachePath, workPath, progress)
 	case strategy.LinkStrategy:
 		// Increment the count of files linked. We avoid adjusting the bar's
 		// total here to reduce the overhead in the hot path. For files that are
@@ -127,6 +214,12 @@ func checkoutFile(
 		if status.ContentsMatch {
 			return nil
 		}
+		if ch.relink && status.WorkspaceFileStatus == fsutil.StatusLink {
+			if err := os.Remove(workPath); err != nil {
+				return err
+			}
+			status.WorkspaceFileStatus = fsutil.StatusAbsent
+		}
 		// Make the symlink target relative to the parent directory of the
 		// workspace file. For cache locations defined relative to the project
 		// root (including the default location), this allows the project root
@@ -143,13 +236,117 @@ func checkoutFile(
 		if err != nil {
 			return err
 		}
-		if err := os.Symlink(linkPath, workPath); err != nil {
+		if err := createSymlink(linkPath, workPath); err != nil {
+			if !symlinksUnsupported(err) {
+				return err
+			}
+			// Some filesystems, such as FAT, don't support symlinks at all.
+			// Rather than failing, fall back to a copy. The progress bar
+			// counts files here, so the copy's bytes aren't added to it.
+			return copyFileFromCache(ch, art, status, cachePath, workPath, nil)
+		}
+	}
+	return nil
+}
+
+// createSymlink creates symlinks. It is a variable so tests can simulate
+// filesystems that don't support symlinks.
+var createSymlink = os.Symlink
+
+// symlinksUnsupported returns true if err means the filesystem doesn't allow
+// creating symlinks, as opposed to the symlink itself being invalid.
+func symlinksUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// copyFileFromCache checks out the file Artifact by copying its object at
+// cachePath to workPath. The bytes copied are added to progress, if it isn't
+// nil.
+func copyFileFromCache(
+	ch LocalCache,
+	art artifact.Artifact,
+	status artifact.Status,
+	cachePath, workPath string,
+	progress *pb.ProgressBar,
+) error {
+	srcInfo, err := os.Lstat(cachePath)
+	if err != nil {
+		return err
+	}
+
+	srcFile, err := os.Open(cachePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	var srcReader io.Reader = srcFile
+	if progress != nil {
+		progress.AddTotal(srcInfo.Size())
+		srcReader = progress.NewProxyReader(srcFile)
+	}
+
+	// ContentsMatch is set true in quickStatus only when the workspace
+	// file is a link to the correct file in the cache. In this case, we
+	// can safely remove the link to allow the copy checkout to proceed.
+	// Otherwise, it's best to fail to make the user fix the issue.
+	if status.ContentsMatch {
+		if err := os.Remove(workPath); err != nil {
+			return err
+		}
+	} else if status.WorkspaceFileStatus != fsutil.StatusAbsent {
+		return &os.PathError{Op: "checkout", Path: workPath, Err: os.ErrExist}
+	}
+
+	// Copy to a partial file first, so an interrupted checkout never
+	// leaves a truncated file at workPath.
+	partialPath := partialCheckoutPath(workPath)
+	dstFile, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(partialPath)
+		}
+	}()
+
+	// Might as well checksum the file while we copy to check data integrity.
+	// Blocks of zeros are skipped so sparse files stay sparse.
+	dstWriter := fsutil.NewSparseWriter(dstFile)
+	srcReader = io.TeeReader(srcReader, dstWriter)
+	cksum, err := ch.checksumReader(srcReader)
+	if err != nil {
+		return err
+	}
+	if err := dstWriter.Finish(); err != nil {
+		return err
+	}
+	if cksum != art.Checksum {
+		return fmt.Errorf("found checksum %#v, expected %#v", cksum, art.Checksum)
+	}
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partialPath, workPath); err != nil {
+		return err
+	}
+	renamed = true
+	if ch.preserveXattrs {
+		if err := writeArtifactXattrs(workPath, art.Xattrs); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// partialCheckoutPath returns the path a copy of the file at workPath is
+// written to before it's moved into place.
+func partialCheckoutPath(workPath string) string {
+	return filepath.Join(filepath.Dir(workPath), "."+filepath.Base(workPath)+".dud-partial")
+}
+
 func checkoutDir(
 	ctx context.Context,
 	ch LocalCache,
@@ -159,7 +356,7 @@ func checkoutDir(
 	activeSharedWorkers chan struct{},
 	progress *pb.ProgressBar,
 ) error {
-	status, cachePath, workPath, err := quickStatus(ch, workspaceDir, art)
+	status, cachePath, workPath, err := autoFetchStatus(ch, workspaceDir, art)
 	if err != nil {
 		return err
 	}
@@ -170,6 +367,13 @@ func checkoutDir(
 	if !status.ChecksumInCache {
 		return MissingFromCacheError{art.Checksum}
 	}
+	if ch.hardReset && !(status.WorkspaceFileStatus == fsutil.StatusAbsent ||
+		status.WorkspaceFileStatus == fsutil.StatusDirectory) {
+		if err := os.RemoveAll(workPath); err != nil {
+			return err
+		}
+		status.WorkspaceFileStatus = fsutil.StatusAbsent
+	}
 	if !(status.WorkspaceFileStatus == fsutil.StatusAbsent ||
 		status.WorkspaceFileStatus == fsutil.StatusDirectory) {
 		return fmt.Errorf(
@@ -186,6 +390,16 @@ func checkoutDir(
 		return err
 	}
 
+	if ch.hardReset && status.WorkspaceFileStatus == fsutil.StatusDirectory {
+		if err := removeUntracked(ch, workPath, art, man); err != nil {
+			return err
+		}
+	}
+
+	if err := autoFetchChildren(ch, man); err != nil {
+		return err
+	}
+
 	// When linking, the progress report counts files linked. Add all of the
 	// files we know about here to the total, and let checkoutFile handle
 	// updating the report. (When copying, checkoutFile handles updating the
@@ -200,11 +414,25 @@ func checkoutDir(
 		progress.AddTotal(fileCount)
 	}
 
+	// When copying, hard links are recreated after the rest of the directory
+	// is checked out, rather than copying the same contents again.
+	var hardlinks [][]string
+	if strat == strategy.CopyStrategy {
+		hardlinks = man.Hardlinks
+	}
+	linked := linkedHardlinks(hardlinks)
+	toCheckout := make([]*artifact.Artifact, 0, len(man.Contents))
+	for name, childArt := range man.Contents {
+		if !linked[name] {
+			toCheckout = append(toCheckout, childArt)
+		}
+	}
+
 	// Start a goroutine to feed artifacts to workers.
 	errGroup, groupCtx := errgroup.WithContext(ctx)
 	childArtifacts := make(chan *artifact.Artifact)
 	errGroup.Go(func() error {
-		for _, childArt := range man.Contents {
+		for _, childArt := range toCheckout {
 			select {
 			case childArtifacts <- childArt:
 			case <-groupCtx.Done():
@@ -220,7 +448,7 @@ func checkoutDir(
 		errGroup,
 		ch,
 		workPath,
-		len(man.Contents),
+		len(toCheckout),
 		childArtifacts,
 		strat,
 		activeSharedWorkers,
@@ -228,7 +456,10 @@ func checkoutDir(
 	)
 
 	// Wait for all goroutines to exit and collect the group error.
-	return errGroup.Wait()
+	if err := errGroup.Wait(); err != nil {
+		return err
+	}
+	return checkoutHardlinks(ch, workPath, hardlinks)
 }
 
 func startCheckoutWorkers(
@@ -305,6 +536,9 @@ func checkoutWorker(
 				)
 			} else {
 				err = checkoutFile(ch, workPath, *childArt, strat, progress)
+				if err == nil {
+					ch.emitProgress(PhaseCheckout, workPath, childArt.Path, progress)
+				}
 			}
 			if err != nil {
 				return err
@@ -314,3 +548,73 @@ func checkoutWorker(
 		}
 	}
 }
+
+// removeUntracked removes everything in the workspace directory that isn't in
+// the directory manifest. Entries the directory Artifact doesn't track, such as
+// sub-directories when recursion is disabled, are left alone.
+func removeUntracked(ch LocalCache, workPath string, art artifact.Artifact, man directoryManifest) error {
+	entries, err := readDir(ch, workPath, art)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := man.Contents[entry.Name()]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(workPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// autoFetchStatus is like quickStatus, but if auto-fetch is enabled and the
+// Artifact is missing from the cache, it first fetches the Artifact from the
+// remote.
+func autoFetchStatus(
+	ch LocalCache,
+	workspaceDir string,
+	art artifact.Artifact,
+) (status artifact.Status, cachePath, workPath string, err error) {
+	status, cachePath, workPath, err = quickStatus(ch, workspaceDir, art)
+	if err != nil || ch.autoFetchRemote == "" {
+		return
+	}
+	if !status.HasChecksum || status.ChecksumInCache {
+		return
+	}
+	err = fetchVerified(ch, ch.autoFetchRemote, map[string]struct{}{cachePath: {}})
+	if err != nil {
+		err = errors.Wrap(err, "auto-fetch")
+		return
+	}
+	// Refresh the status now that the object is (hopefully) in the cache.
+	return quickStatus(ch, workspaceDir, art)
+}
+
+// autoFetchChildren fetches all of the files in a directory manifest that are
+// missing from the cache in a single transfer, rather than leaving each file
+// to be fetched one at a time. Sub-directories are left to fetch their own
+// manifests and children as they are checked out.
+func autoFetchChildren(ch LocalCache, man directoryManifest) error {
+	if ch.autoFetchRemote == "" {
+		return nil
+	}
+	fetchFiles := make(map[string]struct{})
+	for _, child := range man.Contents {
+		if child.IsDir || child.SkipCache {
+			continue
+		}
+		status, cachePath, _, err := checksumStatus(ch, *child)
+		if err != nil {
+			return err
+		}
+		if status.HasChecksum && !status.ChecksumInCache {
+			fetchFiles[cachePath] = struct{}{}
+		}
+	}
+	if len(fetchFiles) == 0 {
+		return nil
+	}
+	return errors.Wrap(fetchVerified(ch, ch.autoFetchRemote, fetchFiles), "auto-fetch")
+}
@@ -3,8 +3,12 @@ package cache
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 
+	"github.com/kevin-hanselman/dud/src/agglog"
 	"github.com/kevin-hanselman/dud/src/artifact"
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/strategy"
@@ -18,6 +22,7 @@ import (
 type testInput struct {
 	Status           artifact.Status
 	CheckoutStrategy strategy.CheckoutStrategy
+	Relink           bool
 }
 
 type testExpectedOutput struct {
@@ -196,6 +201,47 @@ func TestFileCheckoutIntegration(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("relink", func(t *testing.T) {
+		t.Run("incorrect link", func(t *testing.T) {
+			in := testInput{
+				Status: artifact.Status{
+					WorkspaceFileStatus: fsutil.StatusLink,
+					HasChecksum:         true,
+					ChecksumInCache:     true,
+				},
+				CheckoutStrategy: strategy.LinkStrategy,
+				Relink:           true,
+			}
+			out := testExpectedOutput{
+				Status: artifact.Status{
+					WorkspaceFileStatus: fsutil.StatusLink,
+					HasChecksum:         true,
+					ChecksumInCache:     true,
+					ContentsMatch:       true,
+				},
+			}
+			testFileCheckoutIntegration(in, out, t)
+		})
+
+		t.Run("regular file is not replaced", func(t *testing.T) {
+			status := artifact.Status{
+				WorkspaceFileStatus: fsutil.StatusRegularFile,
+				HasChecksum:         true,
+				ChecksumInCache:     true,
+			}
+			in := testInput{
+				Status:           status,
+				CheckoutStrategy: strategy.LinkStrategy,
+				Relink:           true,
+			}
+			out := testExpectedOutput{
+				Status: status,
+				Error:  os.ErrExist,
+			}
+			testFileCheckoutIntegration(in, out, t)
+		})
+	})
 }
 
 func testFileCheckoutIntegration(in testInput, expectedOut testExpectedOutput, t *testing.T) {
@@ -209,6 +255,9 @@ func testFileCheckoutIntegration(in testInput, expectedOut testExpectedOutput, t
 	if err != nil {
 		t.Fatal(err)
 	}
+	if in.Relink {
+		cache.EnableRelink()
+	}
 
 	checkoutErr := cache.Checkout(dirs.WorkDir, art, in.CheckoutStrategy, nil)
 
@@ -249,3 +298,220 @@ func assertErrorMatches(t *testing.T, want, got error) {
 		}
 	}
 }
+
+func TestCheckoutAutoFetch(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger := agglog.NewNullLogger()
+
+	remoteCopyOrig := remoteCopy
+	defer func() { remoteCopy = remoteCopyOrig }()
+
+	var mu sync.Mutex
+	remoteCopyCalls := 0
+	remoteCopy = func(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
+		mu.Lock()
+		remoteCopyCalls++
+		mu.Unlock()
+		return mockRemoteCopy(src, dst, fileSet, bwLimit)
+	}
+
+	// Commit the Artifact, then move the cache to act as the remote and empty
+	// the workspace.
+	setup := func(t *testing.T, art *artifact.Artifact, dirs testutil.TempDirs) (LocalCache, string) {
+		ch, err := NewLocalCache(dirs.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ch.Commit(dirs.WorkDir, art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+		fakeRemote := filepath.Join(dirs.WorkDir, "fake_remote")
+		if err := os.Rename(dirs.CacheDir, fakeRemote); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(filepath.Join(dirs.WorkDir, art.Path)); err != nil {
+			t.Fatal(err)
+		}
+		remoteCopyCalls = 0
+		ch.EnableAutoFetch(fakeRemote)
+		return ch, fakeRemote
+	}
+
+	assertUpToDate := func(t *testing.T, ch LocalCache, workDir string, art artifact.Artifact) {
+		status, err := ch.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected artifact to be up-to-date, got %s", status)
+		}
+	}
+
+	t.Run("file artifact", func(t *testing.T) {
+		dirs, err := testutil.CreateTempDirs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+		art := artifact.Artifact{Path: "foo.txt"}
+		if err := os.WriteFile(filepath.Join(dirs.WorkDir, art.Path), []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		ch, fakeRemote := setup(t, &art, dirs)
+
+		if err := ch.Checkout(dirs.WorkDir, art, strategy.LinkStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		assertUpToDate(t, ch, dirs.WorkDir, art)
+		assertCacheDirsEqual(dirs.CacheDir, fakeRemote, t)
+		if remoteCopyCalls != 1 {
+			t.Fatalf("remoteCopy called %d times, want 1", remoteCopyCalls)
+		}
+	})
+
+	t.Run("directory artifact", func(t *testing.T) {
+		dirs, art, _ := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		ch, fakeRemote := setup(t, &art, dirs)
+
+		if err := ch.Checkout(dirs.WorkDir, art, strategy.LinkStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		assertUpToDate(t, ch, dirs.WorkDir, art)
+		assertCacheDirsEqual(dirs.CacheDir, fakeRemote, t)
+		// One call each for the two manifests, and one call each for the
+		// files in the two directories.
+		if remoteCopyCalls != 4 {
+			t.Fatalf("remoteCopy called %d times, want 4", remoteCopyCalls)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		dirs, art, _ := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		ch, _ := setup(t, &art, dirs)
+		ch.EnableAutoFetch("")
+
+		err := ch.Checkout(dirs.WorkDir, art, strategy.LinkStrategy, nil)
+		var missingErr MissingFromCacheError
+		if !errors.As(err, &missingErr) {
+			t.Fatalf("expected MissingFromCacheError, got %v", err)
+		}
+		if remoteCopyCalls != 0 {
+			t.Fatalf("remoteCopy called %d times, want 0", remoteCopyCalls)
+		}
+	})
+}
+
+func TestCheckoutSymlinkedWorkspace(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// The workspace is reached through a link in the same directory as the
+	// cache, but it really lives elsewhere. A link to the cache made relative
+	// to the unresolved workspace path would point to the wrong place.
+	linkDir, realDir := t.TempDir(), t.TempDir()
+	workDir := filepath.Join(linkDir, "workspace")
+	if err := os.Symlink(realDir, workDir); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewLocalCache(filepath.Join(linkDir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "foo.txt"}
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := cache.Status(workDir, art, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ContentsMatch || status.WorkspaceFileStatus != fsutil.StatusLink {
+		t.Fatalf("expected up-to-date link, got %s", status)
+	}
+	contents, err := os.ReadFile(filepath.Join(realDir, "foo.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "foo" {
+		t.Fatalf("got contents %#v, want %#v", string(contents), "foo")
+	}
+}
+
+func TestCheckoutSymlinksUnsupported(t *testing.T) {
+	createSymlinkOrig := createSymlink
+	symlinkErr := syscall.EPERM
+	createSymlink = func(_, newname string) error {
+		return &os.LinkError{Op: "symlink", New: newname, Err: symlinkErr}
+	}
+	defer func() { createSymlink = createSymlinkOrig }()
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workDir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"foo.txt", "data/bar.txt"} {
+		if err := os.WriteFile(filepath.Join(workDir, path), []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := agglog.NewNullLogger()
+
+	// Committing moves files into the cache before linking them, so the
+	// fallback is what keeps them in the workspace.
+	fileArt := artifact.Artifact{Path: "foo.txt"}
+	dirArt := artifact.Artifact{Path: "data", IsDir: true}
+	for _, art := range []*artifact.Artifact{&fileArt, &dirArt} {
+		if _, err := cache.Commit(workDir, art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+		status, err := cache.Status(workDir, *art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date copy, got %s", status)
+		}
+	}
+	for _, path := range []string{"foo.txt", "data/bar.txt"} {
+		fileStatus, err := fsutil.FileStatusFromPath(filepath.Join(workDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileStatus != fsutil.StatusRegularFile {
+			t.Fatalf("%s: got %s, want a regular file", path, fileStatus)
+		}
+	}
+
+	// Other errors aren't hidden by the fallback.
+	symlinkErr = syscall.ENOSPC
+	if err := os.Remove(filepath.Join(workDir, "foo.txt")); err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Checkout(workDir, fileArt, strategy.LinkStrategy, nil)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("got error %v, want ENOSPC", err)
+	}
+}
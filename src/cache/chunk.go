@@ -0,0 +1,466 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// chunkSize is the size of each chunk of a chunked file Artifact, except for
+// the last chunk, which may be smaller. Chunk manifests record the size they
+// were split with, so changing this only affects new commits.
+var chunkSize = int64(64 * datasize.MB)
+
+// contentChunkSize is the typical size of each chunk of a chunked file
+// Artifact when content-defined chunking is enabled. It must be a power of
+// two. Chunks are at least a quarter and at most four times this size. Chunk
+// manifests record the size of each chunk, so changing this only affects new
+// commits.
+var contentChunkSize = int64(8 * datasize.MB)
+
+// A chunkManifest lists the chunks of a chunked file Artifact, in order. The
+// checksum of a chunked Artifact is the checksum of its chunkManifest.
+type chunkManifest struct {
+	// Size is the size of the whole file.
+	Size int64 `json:"size"`
+	// ChunkSize is the size of every chunk but the last. For content-defined
+	// chunks, it is the typical size of a chunk instead.
+	ChunkSize int64 `json:"chunk-size"`
+	// Chunks holds the checksum of each chunk.
+	Chunks []string `json:"chunks"`
+	// Sizes holds the size of each chunk when the chunks are content-defined.
+	// It is empty for fixed-size chunks.
+	Sizes []int64 `json:"sizes,omitempty"`
+	// offsets holds the offset of each content-defined chunk in the file.
+	offsets []int64
+}
+
+func readChunkManifest(path string) (man chunkManifest, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&man); err != nil {
+		return
+	}
+	if man.ChunkSize <= 0 {
+		err = fmt.Errorf("%s: invalid chunk size %d", path, man.ChunkSize)
+		return
+	}
+	if len(man.Sizes) == 0 {
+		return
+	}
+	sizes := man.Sizes
+	if len(sizes) != len(man.Chunks) {
+		err = fmt.Errorf("%s: got %d chunk sizes for %d chunks", path, len(sizes), len(man.Chunks))
+		return
+	}
+	man.setSizes(sizes)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if total != man.Size {
+		err = fmt.Errorf("%s: chunk sizes add up to %d, expected %d", path, total, man.Size)
+	}
+	return
+}
+
+// setSizes records the sizes of content-defined chunks in the manifest.
+func (man *chunkManifest) setSizes(sizes []int64) {
+	man.Sizes = sizes
+	man.offsets = make([]int64, len(sizes))
+	var offset int64
+	for i, size := range sizes {
+		man.offsets[i] = offset
+		offset += size
+	}
+}
+
+// chunkSection returns a reader for the i-th chunk of file.
+func (man chunkManifest) chunkSection(file io.ReaderAt, i int) *io.SectionReader {
+	if len(man.Sizes) > 0 {
+		return io.NewSectionReader(file, man.offsets[i], man.Sizes[i])
+	}
+	offset := int64(i) * man.ChunkSize
+	length := man.ChunkSize
+	if offset+length > man.Size {
+		length = man.Size - offset
+	}
+	return io.NewSectionReader(file, offset, length)
+}
+
+// gearTable maps each byte to a pseudo-random value for the rolling hash used
+// by contentChunkSizes. It is generated with splitmix64 from a fixed seed, so
+// it never changes.
+var gearTable = func() (table [256]uint64) {
+	state := uint64(0x2545f4914f6cdd1d)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// contentChunkSizes splits the contents of reader into content-defined chunks
+// and returns their sizes. A chunk ends where a rolling hash of the last 64
+// bytes has its top bits clear, so boundaries depend only on nearby contents.
+// Inserting or removing data therefore only changes the chunks around the
+// edit, and files that share regions share most of their chunks. Chunks are
+// about typicalSize bytes, which must be a power of two.
+func contentChunkSizes(reader io.Reader, typicalSize int64) ([]int64, error) {
+	minSize, maxSize := typicalSize/4, typicalSize*4
+	mask := ^uint64(0) << (64 - (bits.Len64(uint64(typicalSize)) - 1))
+	buffered := bufio.NewReader(reader)
+	var (
+		sizes []int64
+		size  int64
+		hash  uint64
+	)
+	for {
+		b, err := buffered.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size++
+		hash = hash<<1 + gearTable[b]
+		if (size >= minSize && hash&mask == 0) || size >= maxSize {
+			sizes = append(sizes, size)
+			size, hash = 0, 0
+		}
+	}
+	if size > 0 {
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// commitChunkedFile splits the file into chunks and adds any chunks missing
+// from the cache, followed by the chunk manifest. The chunks are fixed-size,
+// unless content-defined chunking is enabled. Chunks already in the cache
+// are only read to calculate their checksums, so committing a file that was
+// appended to only writes the chunks that changed. It returns the checksum of
+// the chunk manifest, and whether the manifest was already in the cache (i.e.
+// the file's contents were already committed).
+func commitChunkedFile(
+	ch LocalCache,
+	file *os.File,
+	size int64,
+	progress *pb.ProgressBar,
+) (string, bool, error) {
+	man := chunkManifest{Size: size, ChunkSize: chunkSize}
+	if ch.contentDefinedChunks {
+		sizes, err := contentChunkSizes(io.NewSectionReader(file, 0, size), contentChunkSize)
+		if err != nil {
+			return "", false, err
+		}
+		man.ChunkSize = contentChunkSize
+		man.setSizes(sizes)
+		man.Chunks = make([]string, len(sizes))
+	} else {
+		numChunks := int((size + chunkSize - 1) / chunkSize)
+		man.Chunks = make([]string, numChunks)
+	}
+	if err := checksumChunks(ch, file, man, progress, nil); err != nil {
+		return "", false, err
+	}
+	// Write the missing chunks one at a time, so committing a chunked file
+	// never holds more than one temporary file open.
+	for i, cksum := range man.Chunks {
+		// Checksum-only commits leave the chunks out of the cache.
+		if ch.checksumOnly {
+			break
+		}
+		section := man.chunkSection(file, i)
+		cached, err := chunkInCache(ch, cksum, section.Size())
+		if err != nil {
+			return "", false, err
+		}
+		if cached {
+			continue
+		}
+		written, _, err := ch.commitBytes(section, "")
+		if err != nil {
+			return "", false, err
+		}
+		if written != cksum {
+			return "", false, errors.Errorf(
+				"%s: chunk %d changed while committing",
+				file.Name(),
+				i,
+			)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(man); err != nil {
+		return "", false, err
+	}
+	return ch.commitBytes(buf, "")
+}
+
+// errChunkMismatch is returned by checksumChunks when a chunk doesn't have the
+// expected checksum.
+var errChunkMismatch = errors.New("chunk checksum mismatch")
+
+// checksumChunks calculates the checksum of each chunk of file, hashing up to
+// the Cache's checksum threads chunks at once, and stores them in man.Chunks. If expected is not
+// nil, checksumChunks instead compares each checksum to the corresponding
+// entry of expected, and it stops with errChunkMismatch at the first chunk
+// that doesn't match. progress may be nil.
+func checksumChunks(
+	ch LocalCache,
+	file io.ReaderAt,
+	man chunkManifest,
+	progress *pb.ProgressBar,
+	expected []string,
+) error {
+	group, ctx := errgroup.WithContext(context.Background())
+	threads := ch.checksumThreads
+	if threads < 1 {
+		threads = 1
+	}
+	group.SetLimit(threads)
+	for i := range man.Chunks {
+		i := i
+		if ctx.Err() != nil {
+			break
+		}
+		group.Go(func() error {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var reader io.Reader = man.chunkSection(file, i)
+			if progress != nil {
+				reader = progress.NewProxyReader(reader)
+			}
+			cksum, err := ch.checksumReader(reader)
+			if err != nil {
+				return err
+			}
+			if expected == nil {
+				man.Chunks[i] = cksum
+			} else if cksum != expected[i] {
+				return errChunkMismatch
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+// chunkInCache returns true if a chunk with the given checksum and size is
+// in the cache. See blobExists for why checking the size is sufficient.
+func chunkInCache(ch LocalCache, cksum string, size int64) (bool, error) {
+	if ch.wasCommitted(cksum) {
+		return true, nil
+	}
+	if ch.forceCommit {
+		return false, nil
+	}
+	cachePath, err := ch.BlobPath(cksum)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Lstat(cachePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular() && info.Size() == size, nil
+}
+
+// chunksMatch returns true if the file at path has the contents listed in the
+// chunk manifest. It hashes up to the Cache's checksum threads chunks at once,
+// and it stops reading once it finds a chunk that doesn't match.
+func chunksMatch(ch LocalCache, path string, man chunkManifest) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != man.Size {
+		return false, nil
+	}
+	err = checksumChunks(ch, file, man, nil, man.Chunks)
+	if err == errChunkMismatch {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// chunkedContentsMatch returns true if the workspace file has the contents of
+// the chunked Artifact whose chunk manifest is at manifestPath.
+func chunkedContentsMatch(ch LocalCache, workPath, manifestPath string) (bool, error) {
+	man, err := readChunkManifest(manifestPath)
+	if err != nil {
+		return false, err
+	}
+	return chunksMatch(ch, workPath, man)
+}
+
+// checkoutChunkedFile reassembles a chunked file Artifact from its chunks in
+// the cache. Chunked Artifacts span many objects in the cache, so they can't
+// be linked; they are always copied, regardless of the checkout strategy. A
+// workspace file that already has the committed contents is left alone.
+func checkoutChunkedFile(
+	ch LocalCache,
+	art artifact.Artifact,
+	status artifact.Status,
+	manifestPath string,
+	workPath string,
+	progress *pb.ProgressBar,
+) error {
+	man, err := readChunkManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	switch status.WorkspaceFileStatus {
+	case fsutil.StatusAbsent:
+	case fsutil.StatusRegularFile:
+		match, err := chunksMatch(ch, workPath, man)
+		if err != nil {
+			return err
+		}
+		if match {
+			return nil
+		}
+		if ch.hardReset {
+			if err := os.Remove(workPath); err != nil {
+				return err
+			}
+		}
+	case fsutil.StatusLink:
+		// A link can't be the reassembled file, so it must be left over from
+		// checking out the Artifact before it was chunked.
+		if ch.relink || ch.hardReset {
+			if err := os.Remove(workPath); err != nil {
+				return err
+			}
+		}
+	default:
+		if ch.hardReset {
+			if err := os.RemoveAll(workPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := autoFetchChunks(ch, man); err != nil {
+		return err
+	}
+	chunkPaths := make([]string, len(man.Chunks))
+	for i, cksum := range man.Chunks {
+		chunkPaths[i], err = ch.BlobPath(cksum)
+		if err != nil {
+			return err
+		}
+		exists, err := fsutil.Exists(chunkPaths[i], false)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return MissingFromCacheError{cksum}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(workPath), 0o755); err != nil {
+		return err
+	}
+	// Let os.OpenFile fail if the workspace file is still there, as with any
+	// other copy checkout.
+	dstFile, err := os.OpenFile(workPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	progress.AddTotal(man.Size)
+	dstWriter := fsutil.NewSparseWriter(dstFile)
+	for i, chunkPath := range chunkPaths {
+		if err := copyChunk(ch, chunkPath, man.Chunks[i], dstWriter, progress); err != nil {
+			return errors.Wrapf(err, "%s: chunk %d", art.Path, i)
+		}
+	}
+	return dstWriter.Finish()
+}
+
+// copyChunk copies the chunk at chunkPath to writer, checking its integrity in
+// the process.
+func copyChunk(ch LocalCache, chunkPath, expected string, writer io.Writer, progress *pb.ProgressBar) error {
+	chunkFile, err := os.Open(chunkPath)
+	if err != nil {
+		return err
+	}
+	defer chunkFile.Close()
+	cksum, err := ch.checksumReader(io.TeeReader(progress.NewProxyReader(chunkFile), writer))
+	if err != nil {
+		return err
+	}
+	if cksum != expected {
+		return fmt.Errorf("found checksum %#v, expected %#v", cksum, expected)
+	}
+	return nil
+}
+
+// chunkCachePaths returns the cache paths of all chunks in the chunk manifest
+// at manifestPath, relative to the cache directory.
+func chunkCachePaths(ch LocalCache, manifestPath string) ([]string, error) {
+	man, err := readChunkManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(man.Chunks))
+	for i, cksum := range man.Chunks {
+		if paths[i], err = ch.PathForChecksum(cksum); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// autoFetchChunks fetches all chunks in the chunk manifest that are missing
+// from the cache in a single transfer.
+func autoFetchChunks(ch LocalCache, man chunkManifest) error {
+	if ch.autoFetchRemote == "" {
+		return nil
+	}
+	fetchFiles := make(map[string]struct{})
+	for _, cksum := range man.Chunks {
+		status, cachePath, _, err := checksumStatus(ch, artifact.Artifact{Checksum: cksum})
+		if err != nil {
+			return err
+		}
+		if status.HasChecksum && !status.ChecksumInCache {
+			fetchFiles[cachePath] = struct{}{}
+		}
+	}
+	if len(fetchFiles) == 0 {
+		return nil
+	}
+	return errors.Wrap(fetchVerified(ch, ch.autoFetchRemote, fetchFiles), "auto-fetch")
+}
@@ -0,0 +1,303 @@
+package cache
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/strategy"
+	"github.com/kevin-hanselman/dud/src/testutil"
+)
+
+func TestChunkedFileIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	defer func(size int64) { chunkSize = size }(chunkSize)
+	chunkSize = 4
+
+	logger := agglog.NewNullLogger()
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workPath := filepath.Join(dirs.WorkDir, "log.txt")
+	contents := []byte("0123456789")
+	if err := os.WriteFile(workPath, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "log.txt", Chunked: true}
+
+	countObjects := func(t *testing.T) (count int) {
+		err := cache.WalkBlobs(func(string, string, os.FileInfo) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	assertUpToDate := func(t *testing.T) {
+		status, err := cache.Status(dirs.WorkDir, art, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date status, got %v", status)
+		}
+	}
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("commit leaves a regular file", func(t *testing.T) {
+		fileStatus, err := fsutil.FileStatusFromPath(workPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileStatus != fsutil.StatusRegularFile {
+			t.Fatalf("got workspace file status %v, want %v", fileStatus, fsutil.StatusRegularFile)
+		}
+		// Three chunks plus the chunk manifest.
+		if got := countObjects(t); got != 4 {
+			t.Fatalf("got %d objects in cache, want 4", got)
+		}
+		assertUpToDate(t)
+	})
+
+	t.Run("status detects modifications", func(t *testing.T) {
+		modified := []byte("0123x56789")
+		if err := os.WriteFile(workPath, modified, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		status, err := cache.Status(dirs.WorkDir, art, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.ContentsMatch {
+			t.Fatal("expected out-of-date status")
+		}
+		if err := os.WriteFile(workPath, contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("commit only adds new chunks", func(t *testing.T) {
+		appended := append(contents, []byte("abcd")...)
+		if err := os.WriteFile(workPath, appended, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		oldChecksum := art.Checksum
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+		if art.Checksum == oldChecksum {
+			t.Fatal("expected checksum to change")
+		}
+		// The first two chunks are shared. The third chunk, "89", becomes
+		// "89ab", and "cd" is a new chunk. There is also a new manifest.
+		if got := countObjects(t); got != 7 {
+			t.Fatalf("got %d objects in cache, want 7", got)
+		}
+		assertUpToDate(t)
+		contents = appended
+	})
+
+	t.Run("checkout reassembles the file", func(t *testing.T) {
+		if err := os.Remove(workPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Checkout(dirs.WorkDir, art, strategy.LinkStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(workPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Fatalf("got contents %#v, want %#v", string(got), string(contents))
+		}
+		assertUpToDate(t)
+
+		// Checking out again leaves the up-to-date file alone.
+		if err := cache.Checkout(dirs.WorkDir, art, strategy.CopyStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("checkout fails on missing chunks", func(t *testing.T) {
+		if err := os.Remove(workPath); err != nil {
+			t.Fatal(err)
+		}
+		manifestPath, err := cache.BlobPath(art.Checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		man, err := readChunkManifest(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkPath, err := cache.BlobPath(man.Chunks[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(chunkPath); err != nil {
+			t.Fatal(err)
+		}
+		err = cache.Checkout(dirs.WorkDir, art, strategy.CopyStrategy, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		exists, err := fsutil.Exists(workPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected no workspace file")
+		}
+	})
+}
+
+func TestContentChunkSizes(t *testing.T) {
+	contents := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+	typicalSize := int64(1024)
+
+	sizes, err := contentChunkSizes(bytes.NewReader(contents), typicalSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for i, size := range sizes {
+		total += size
+		if size > typicalSize*4 {
+			t.Fatalf("chunk %d is %d bytes, larger than the maximum", i, size)
+		}
+		if size < typicalSize/4 && i < len(sizes)-1 {
+			t.Fatalf("chunk %d is %d bytes, smaller than the minimum", i, size)
+		}
+	}
+	if total != int64(len(contents)) {
+		t.Fatalf("chunk sizes add up to %d, want %d", total, len(contents))
+	}
+	if len(sizes) < 16 || len(sizes) > 128 {
+		t.Fatalf("got %d chunks, expected about 64", len(sizes))
+	}
+
+	t.Run("boundaries survive an insertion", func(t *testing.T) {
+		middle := len(contents) / 2
+		edited := append(append(append([]byte{}, contents[:middle]...), "inserted"...), contents[middle:]...)
+		editedSizes, err := contentChunkSizes(bytes.NewReader(edited), typicalSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := func(contents []byte, sizes []int64) map[string]bool {
+			out := make(map[string]bool)
+			for _, size := range sizes {
+				out[string(contents[:size])] = true
+				contents = contents[size:]
+			}
+			return out
+		}
+		original := chunks(contents, sizes)
+		shared := 0
+		for chunk := range chunks(edited, editedSizes) {
+			if original[chunk] {
+				shared++
+			}
+		}
+		if shared < len(sizes)-3 {
+			t.Fatalf("only %d of %d chunks are shared after the insertion", shared, len(sizes))
+		}
+	})
+}
+
+func TestContentDefinedChunkingIntegration(t *testing.T) {
+	defer func(size int64) { contentChunkSize = size }(contentChunkSize)
+	contentChunkSize = 256
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableContentDefinedChunking()
+	workDir := t.TempDir()
+
+	contents := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+	middle := len(contents) / 2
+	edited := append(append(append([]byte{}, contents[:middle]...), "inserted"...), contents[middle:]...)
+
+	countObjects := func(t *testing.T) (count int) {
+		err := cache.WalkBlobs(func(string, string, os.FileInfo) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	commit := func(t *testing.T, name string, contents []byte) artifact.Artifact {
+		if err := os.WriteFile(filepath.Join(workDir, name), contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: name, Chunked: true}
+		_, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return art
+	}
+
+	commit(t, "v1.bin", contents)
+	firstCount := countObjects(t)
+	art := commit(t, "v2.bin", edited)
+	// A handful of new chunks around the insertion, plus the new manifest.
+	if added := countObjects(t) - firstCount; added > 4 {
+		t.Fatalf("second version added %d objects, expected at most 4", added)
+	}
+
+	t.Run("status and checkout use the recorded chunk sizes", func(t *testing.T) {
+		status, err := cache.Status(workDir, art, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date status, got %v", status)
+		}
+		workPath := filepath.Join(workDir, art.Path)
+		if err := os.Remove(workPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(workPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, edited) {
+			t.Fatal("checked out file doesn't match")
+		}
+	})
+}
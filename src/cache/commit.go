@@ -7,6 +7,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/kevin-hanselman/dud/src/agglog"
@@ -15,32 +21,139 @@ import (
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
 	"golang.org/x/sync/errgroup"
 )
 
+// CommitResult describes the outcome of committing an Artifact.
+type CommitResult struct {
+	// Changed is true if the Artifact's checksum changed.
+	Changed bool
+	// Checksum is the Artifact's checksum after the commit.
+	Checksum string
+	// BytesWritten is the total size of the objects added to the cache. It is
+	// zero if the Artifact's contents were already in the cache, or if the
+	// Artifact skips the cache.
+	BytesWritten int64
+	// FilesAdded is the number of files whose contents Commit added to the
+	// cache.
+	FilesAdded int64
+	// FilesDeduplicated is the number of files Commit read whose contents
+	// were already in the cache, such as copies of other files. Their
+	// contents weren't written again.
+	FilesDeduplicated int64
+	// BytesDeduplicated is the total size of the files counted by
+	// FilesDeduplicated.
+	BytesDeduplicated int64
+	// Duplicates holds the sets of files in a directory Artifact whose
+	// contents are identical, with paths relative to the workspace. Files are
+	// only compared with others in the same directory. It is only set if the
+	// Cache was configured with EnableDuplicateReport.
+	Duplicates [][]string
+}
+
+// commitTally counts the outcomes of committing files. Its counters are safe
+// for concurrent use.
+type commitTally struct {
+	bytesAdded, filesAdded, filesDeduplicated, bytesDeduplicated atomic.Int64
+}
+
+// addFile counts a file of the given size, depending on whether its contents
+// existed in the cache before it was committed.
+func (tally *commitTally) addFile(size int64, existed bool) {
+	if tally == nil {
+		return
+	}
+	if existed {
+		tally.filesDeduplicated.Add(1)
+		tally.bytesDeduplicated.Add(size)
+	} else {
+		tally.filesAdded.Add(1)
+	}
+}
+
+// add adds the counts of other to tally.
+func (tally *commitTally) add(other *commitTally) {
+	if tally == nil {
+		return
+	}
+	tally.bytesAdded.Add(other.bytesAdded.Load())
+	tally.filesAdded.Add(other.filesAdded.Load())
+	tally.filesDeduplicated.Add(other.filesDeduplicated.Load())
+	tally.bytesDeduplicated.Add(other.bytesDeduplicated.Load())
+}
+
+// addTo adds the counts of tally to result.
+func (tally *commitTally) addTo(result *CommitResult) {
+	result.BytesWritten += tally.bytesAdded.Load()
+	result.FilesAdded += tally.filesAdded.Load()
+	result.FilesDeduplicated += tally.filesDeduplicated.Load()
+	result.BytesDeduplicated += tally.bytesDeduplicated.Load()
+}
+
 // Commit calculates the checksum of the artifact, moves it to the cache, then
-// performs a checkout.
+// performs a checkout. The new checksum is recorded in art as well as in the
+// returned CommitResult.
 func (ch LocalCache) Commit(
 	workspaceDir string,
 	art *artifact.Artifact,
 	strat strategy.CheckoutStrategy,
 	logger *agglog.AggLogger,
-) (err error) {
+) (result CommitResult, err error) {
+	if ch.checksumOnly && strat != strategy.CopyStrategy {
+		return result, errors.Errorf("commit %s: checksum-only commits must use the copy strategy", art.Path)
+	}
 	if err := os.MkdirAll(ch.dir, 0o755); err != nil {
-		return errors.Wrapf(err, "commit %s", art.Path)
+		return result, errors.Wrapf(err, "commit %s", art.Path)
+	}
+	if err := checkArtifactLocation(ch, workspaceDir, *art); err != nil {
+		return result, errors.Wrapf(err, "commit %s", art.Path)
+	}
+	if ch.waitTimeout > 0 {
+		err := waitForFile(filepath.Join(workspaceDir, art.Path), ch.waitTimeout)
+		if err != nil {
+			return result, errors.Wrapf(err, "commit %s", art.Path)
+		}
 	}
 	// Try to move a dummy file between the workspace and the cache. If we can
 	// move files (via rename syscall), we can avoid writing to disk
 	// for file commits, dramatically improving performance.
-	canRenameFile, err := canRenameFileBetweenDirs(workspaceDir, ch.dir)
+	canRenameFile := false
+	if !ch.forceCopy {
+		canRenameFile, err = canRenameFileBetweenDirs(workspaceDir, ch.dir)
+		if err != nil {
+			return result, errors.Wrapf(err, "commit %s", art.Path)
+		}
+	}
+	ch.tempDirRenames, err = ch.prepareTempDir()
+	if err != nil {
+		return result, errors.Wrapf(err, "commit %s", art.Path)
+	}
+	ch.commitRoot, err = filepath.Abs(ch.canonicalDir(workspaceDir))
 	if err != nil {
-		return errors.Wrapf(err, "commit %s", art.Path)
+		return result, errors.Wrapf(err, "commit %s", art.Path)
+	}
+	oldChecksum := art.Checksum
+	commitStart := time.Now()
+	cpuThreads := ch.cpuThreads
+	if cpuThreads == 0 {
+		cpuThreads = runtime.NumCPU()
+	}
+	ch.hashPool = checksum.NewPool(cpuThreads)
+	defer ch.hashPool.Close()
+	ch.tally = new(commitTally)
+	if ch.reportDuplicates {
+		ch.duplicates = new(duplicateSets)
 	}
 	progress := newProgress(progressTemplateDefault, 0, art.Path)
 	progress.Start()
 	defer progress.Finish()
 	if art.IsDir {
-		activeSharedWorkers := make(chan struct{}, maxSharedWorkers)
+		ioThreads := ch.ioThreads
+		if ioThreads == 0 {
+			ioThreads = maxSharedWorkers
+		}
+		activeSharedWorkers := make(chan struct{}, ioThreads)
 		err = commitDirArtifact(
 			context.Background(),
 			ch,
@@ -52,12 +165,156 @@ func (ch LocalCache) Commit(
 			canRenameFile,
 		)
 	} else {
+		workPath := filepath.Join(workspaceDir, art.Path)
+		before, statErr := os.Lstat(workPath)
 		err = commitFileArtifact(ch, workspaceDir, art, strat, progress, canRenameFile)
+		if err == nil {
+			ch.emitProgress(PhaseCommit, workspaceDir, art.Path, progress)
+			art.Fingerprint = ""
+			if statErr == nil {
+				art.Fingerprint, err = committedFingerprint(workPath, before, commitStart, art.Checksum)
+			}
+		}
+	}
+	if err != nil {
+		return result, errors.Wrapf(err, "commit %s", art.Path)
 	}
-	if err == nil && progress.Current() <= 0 {
+	if progress.Current() <= 0 {
 		progress.SetTemplate(progressTemplateSkipCommit)
 	}
-	return errors.Wrapf(err, "commit %s", art.Path)
+	result.Checksum = art.Checksum
+	result.Changed = art.Checksum != oldChecksum
+	ch.tally.addTo(&result)
+	ch.totals.add(ch.tally)
+	if ch.duplicates != nil && art.IsDir {
+		result.Duplicates, err = ch.duplicates.sorted(workspaceDir)
+		if err != nil {
+			return result, errors.Wrapf(err, "commit %s", art.Path)
+		}
+	}
+	err = ch.recordAudit(AuditRecord{
+		Operation: "commit",
+		Path:      art.Path,
+		Checksum:  art.Checksum,
+		Bytes:     result.BytesWritten,
+		Strategy:  auditStrategy(strat),
+	})
+	return result, errors.Wrapf(err, "commit %s", art.Path)
+}
+
+// CommitTotals returns the sums of the counts of files and bytes in the
+// CommitResults of all calls to Commit and CommitStream on the LocalCache and
+// its copies. The other fields of the returned CommitResult are unset.
+func (ch LocalCache) CommitTotals() (result CommitResult) {
+	if ch.totals != nil {
+		ch.totals.addTo(&result)
+	}
+	return
+}
+
+// CommitStream commits the bytes read from reader as the contents of the file
+// Artifact, without reading them from the workspace. Once reader is exhausted,
+// the Artifact is checked out at its path in the workspace using strat,
+// replacing any file already there. If reading fails, the Cache and the
+// workspace are left unchanged.
+func (ch LocalCache) CommitStream(
+	workspaceDir string,
+	art *artifact.Artifact,
+	reader io.Reader,
+	strat strategy.CheckoutStrategy,
+) error {
+	errPrefix := "commit " + art.Path
+	if art.IsDir || art.SkipCache || art.Chunked {
+		return errors.Errorf("%s: only regular file artifacts stored in the cache can be streamed", errPrefix)
+	}
+	if err := os.MkdirAll(ch.dir, 0o755); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if err := checkArtifactLocation(ch, workspaceDir, *art); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	var err error
+	ch.tempDirRenames, err = ch.prepareTempDir()
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	ch.tally = new(commitTally)
+	if ch.maxFileSize > 0 {
+		reader = &sizeLimitReader{r: reader, limit: ch.maxFileSize}
+	}
+	sniffer := &sniffReader{r: reader}
+	cksum, existed, err := ch.commitBytes(sniffer, "")
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	blobPath, err := ch.BlobPath(cksum)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	ch.tally.addFile(info.Size(), existed)
+	art.Checksum = cksum
+	art.Fingerprint = ""
+	art.Xattrs = nil
+	if ch.detectContentTypes {
+		art.ContentType = sniffer.contentType()
+	}
+
+	workPath := filepath.Join(workspaceDir, art.Path)
+	if err := os.Remove(workPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, errPrefix)
+	}
+	if err := os.MkdirAll(filepath.Dir(workPath), 0o755); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if err := checkoutFile(ch, workspaceDir, *art, strat, nil); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	err = ch.recordAudit(AuditRecord{
+		Operation: "commit",
+		Path:      art.Path,
+		Checksum:  art.Checksum,
+		Bytes:     ch.tally.bytesAdded.Load(),
+		Strategy:  auditStrategy(strat),
+	})
+	ch.totals.add(ch.tally)
+	return errors.Wrap(err, errPrefix)
+}
+
+// committedFingerprint returns the fingerprint to record for the file at
+// workPath after committing it with checksum cksum, given its file info from
+// before the commit. It
+// returns an empty string if the file is no longer a regular file, or if it
+// may have changed during the commit. Files modified within a second of the
+// commit starting are also left without a fingerprint, because a later write
+// in the same timestamp tick would go unnoticed.
+func committedFingerprint(workPath string, before os.FileInfo, commitStart time.Time, cksum string) (string, error) {
+	if !before.Mode().IsRegular() || !before.ModTime().Before(commitStart.Add(-time.Second)) {
+		return "", nil
+	}
+	after, err := os.Lstat(workPath)
+	if err != nil {
+		return "", err
+	}
+	if !after.Mode().IsRegular() || fileFingerprint(after, cksum) != fileFingerprint(before, cksum) {
+		return "", nil
+	}
+	return fileFingerprint(after, cksum), nil
+}
+
+// prepareTempDir creates the configured temp directory, if any, and reports
+// whether files can be renamed from it into the cache directory.
+func (ch LocalCache) prepareTempDir() (bool, error) {
+	if ch.tempDir == "" {
+		return false, nil
+	}
+	if err := os.MkdirAll(ch.tempDir, 0o755); err != nil {
+		return false, err
+	}
+	return canRenameFileBetweenDirs(ch.tempDir, ch.dir)
 }
 
 var canRenameFileBetweenDirs = func(srcDir, dstDir string) (bool, error) {
@@ -106,7 +363,15 @@ func commitFileArtifact(
 	if status.WorkspaceFileStatus == fsutil.StatusAbsent {
 		return errors.Wrap(os.ErrNotExist, workPath)
 	}
+	if status.ContentsMatch && ch.forceCommit {
+		if err := verifyLinkedFile(ch, workPath, *art); err != nil {
+			return err
+		}
+	}
 	if status.ContentsMatch {
+		if ch.detectContentTypes && art.ContentType == "" {
+			return detectUpToDateContentType(workPath, art)
+		}
 		return nil
 	}
 	if status.WorkspaceFileStatus != fsutil.StatusRegularFile {
@@ -117,15 +382,33 @@ func commitFileArtifact(
 		return err
 	}
 	progress.AddTotal(fileInfo.Size())
+	// Reserve enough files to copy the file to the cache, even if it ends up
+	// being moved instead.
+	release := ch.acquireOpenFiles(minOpenFiles)
+	defer release()
 	srcFile, err := os.Open(workPath)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
-	srcReader := progress.NewProxyReader(srcFile)
+	// Check the size up front to fail fast, and again while reading in case
+	// the file grows in the meantime.
+	if ch.maxFileSize > 0 && fileInfo.Size() > ch.maxFileSize {
+		return errors.Wrap(FileTooLargeError{ch.maxFileSize}, workPath)
+	}
+	var srcReader io.Reader = progress.NewProxyReader(srcFile)
+	if ch.maxFileSize > 0 {
+		srcReader = &sizeLimitReader{r: srcReader, limit: ch.maxFileSize}
+	}
+
+	if ch.detectContentTypes {
+		if art.ContentType, err = detectContentType(srcFile); err != nil {
+			return err
+		}
+	}
 
 	if art.SkipCache {
-		cksum, err := checksum.Checksum(srcReader)
+		cksum, err := ch.checksumReader(srcReader)
 		if err != nil {
 			return err
 		}
@@ -133,15 +416,40 @@ func commitFileArtifact(
 		return nil
 	}
 
+	art.Xattrs = nil
+	if ch.preserveXattrs {
+		if art.Xattrs, err = readArtifactXattrs(workPath); err != nil {
+			return err
+		}
+	}
+
+	// Chunked files stay in the workspace, because there's no single object
+	// in the cache to link them to.
+	if art.Chunked {
+		cksum, existed, err := commitChunkedFile(ch, srcFile, fileInfo.Size(), progress)
+		if err != nil {
+			return err
+		}
+		ch.tally.addFile(fileInfo.Size(), existed)
+		art.Checksum = cksum
+		return nil
+	}
+
+	if ch.checksumOnly {
+		art.Checksum, err = ch.checksumReader(srcReader)
+		return err
+	}
+
 	moveFile := ""
 	if canRenameFile && strat == strategy.LinkStrategy {
 		moveFile = workPath
 	}
 
-	cksum, err := ch.commitBytes(srcReader, moveFile)
+	cksum, existed, err := ch.commitBytes(srcReader, moveFile)
 	if err != nil {
 		return err
 	}
+	ch.tally.addFile(fileInfo.Size(), existed)
 
 	art.Checksum = cksum
 	// There's no need to call Checkout if using CopyStrategy; the original
@@ -161,36 +469,98 @@ func commitFileArtifact(
 	return nil
 }
 
+// verifyLinkedFile re-hashes the object that the workspace file at workPath
+// links to, and returns an IntegrityError if it doesn't match art's checksum.
+func verifyLinkedFile(ch LocalCache, workPath string, art artifact.Artifact) error {
+	release := ch.acquireOpenFiles(1)
+	defer release()
+	file, err := os.Open(workPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	cksum, err := ch.checksumReader(file)
+	if err != nil {
+		return err
+	}
+	if cksum != art.Checksum {
+		return errors.Wrap(IntegrityError{art.Checksum, cksum}, workPath)
+	}
+	return nil
+}
+
 // commitBytes checksums the bytes from reader and results in said bytes being
 // present in the cache. If moveFile is empty, commitBytes will copy from
 // reader to the cache while checksumming. If moveFile is not empty, the file
 // path it references is moved (i.e. renamed) to the cache after checksumming,
-// thus eliminating unnecessary file IO.
-func (ch LocalCache) commitBytes(reader io.Reader, moveFile string) (string, error) {
+// thus eliminating unnecessary file IO. If reading fails, nothing is added
+// to the cache. existed is true if the object was already in the cache (or was
+// added earlier in the same run), in which case nothing new was written.
+func (ch LocalCache) commitBytes(reader io.Reader, moveFile string) (cksum string, existed bool, err error) {
 	// If there's no file we can move, we need to copy the bytes from reader to
+	// the cache. Blocks of zeros are skipped so sparse files stay sparse in
 	// the cache.
+	var tempWriter *fsutil.SparseWriter
+	move := moveOrCopyFile
 	if moveFile == "" {
-		tempFile, err := os.CreateTemp(ch.dir, "")
+		tempDir := ch.dir
+		if ch.tempDir != "" {
+			tempDir = ch.tempDir
+			if !ch.tempDirRenames {
+				move = copyFileIntoPlace
+			}
+		}
+		var tempFile *os.File
+		tempFile, err = os.CreateTemp(tempDir, "")
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
 		defer tempFile.Close()
-		reader = io.TeeReader(reader, tempFile)
+		defer func() {
+			if err != nil {
+				os.Remove(tempFile.Name())
+			}
+		}()
+		tempWriter = fsutil.NewSparseWriter(tempFile)
+		reader = io.TeeReader(reader, tempWriter)
 		moveFile = tempFile.Name()
 	}
 
-	cksum, err := checksum.Checksum(reader)
+	cksum, err = ch.checksumReader(reader)
 	if err != nil {
-		return "", err
+		return "", false, err
+	}
+	if tempWriter != nil {
+		if err := tempWriter.Finish(); err != nil {
+			return "", false, err
+		}
+	}
+	// If an identical file was committed earlier in this run, the blob is
+	// already in place, so skip straight to discarding our copy of the bytes.
+	if ch.wasCommitted(cksum) {
+		return cksum, true, os.Remove(moveFile)
 	}
 	cachePath, err := ch.PathForChecksum(cksum)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	cachePath = filepath.Join(ch.dir, cachePath)
 	dstDir := filepath.Dir(cachePath)
 	if err = os.MkdirAll(dstDir, 0o755); err != nil {
-		return "", err
+		return "", false, err
+	}
+	// If the blob is already in the cache, there's no need to rename over it.
+	// Discard our copy of the bytes instead, unless forced to replace it.
+	alreadyCached := false
+	if !ch.forceCommit {
+		alreadyCached, err = ch.blobExists(cachePath, moveFile)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if alreadyCached {
+		ch.markCommitted(cksum)
+		return cksum, true, os.Remove(moveFile)
 	}
 	// This rename may race others, but luckily we don't care who wins the
 	// race. Everyone in the race is trying to put the same exact file in the
@@ -199,22 +569,149 @@ func (ch LocalCache) commitBytes(reader io.Reader, moveFile string) (string, err
 	// there's no risk of corrupting the destination file with multiple
 	// concurrent syscalls. (This is at least true for UNIX, but that's all we
 	// support. See also: https://github.com/golang/go/issues/8914)
-	if err = os.Rename(moveFile, cachePath); err != nil {
-		return "", err
+	// Syncing before the rename means a crash can't leave a partial object
+	// under the checksum's name.
+	if ch.syncCommits {
+		if err = syncFile(moveFile); err != nil {
+			return "", false, err
+		}
+	}
+	if err = move(moveFile, cachePath); err != nil {
+		// If we lost a race and the rename failed because of it, the blob is
+		// in the cache all the same.
+		if alreadyCached, _ := ch.blobExists(cachePath, moveFile); alreadyCached {
+			ch.markCommitted(cksum)
+			return cksum, true, os.Remove(moveFile)
+		}
+		return "", false, err
 	}
 	if err := os.Chmod(cachePath, cacheFilePerms); err != nil {
-		return "", err
+		return "", false, err
+	}
+	if ch.syncCommits {
+		// The move may have fallen back to copying, so sync the object itself
+		// as well as the rename.
+		if err := syncFile(cachePath); err != nil {
+			return "", false, err
+		}
+		if err := syncDir(dstDir); err != nil {
+			return "", false, err
+		}
 	}
-	return cksum, nil
+	ch.markCommitted(cksum)
+	if ch.tally != nil {
+		info, err := os.Lstat(cachePath)
+		if err != nil {
+			return "", false, err
+		}
+		ch.tally.bytesAdded.Add(info.Size())
+	}
+	return cksum, false, nil
+}
+
+// syncFile flushes the contents of the file at path to disk. It is a variable
+// so tests can check which files are synced.
+var syncFile = func(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir flushes the entries of the directory at path to disk. It is a
+// variable so tests can check which directories are synced.
+var syncDir = fsutil.SyncDir
+
+// renameFile renames files. It is a variable so tests can simulate
+// filesystems that refuse to rename files between directories.
+var renameFile = os.Rename
+
+// moveOrCopyFile renames src to dst. If the rename fails because the two paths
+// are on different devices, which some network filesystems report even within
+// a single mount, it falls back to copying src to a temporary file next to dst,
+// renaming that over dst, and then removing src. Either way, dst is replaced
+// atomically.
+func moveOrCopyFile(src, dst string) error {
+	err := renameFile(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return copyFileIntoPlace(src, dst)
+}
+
+// copyFileIntoPlace copies src to a temporary file next to dst, renames that
+// over dst, and then removes src.
+func copyFileIntoPlace(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	tempFile, err := os.CreateTemp(filepath.Dir(dst), "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err := io.Copy(tempFile, srcFile); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// blobExists returns true if cachePath exists and is a regular file with the
+// same size as srcPath, in which case srcPath doesn't need to be added to the
+// cache. The object isn't re-hashed, so that committing a duplicate doesn't
+// cost a second read of it. An object truncated by a crash has the wrong size,
+// so it is replaced; commit --force replaces every object, and doctor checks
+// their contents.
+func (ch LocalCache) blobExists(cachePath, srcPath string) (bool, error) {
+	cacheInfo, err := os.Lstat(cachePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return false, err
+	}
+	return cacheInfo.Mode().IsRegular() && cacheInfo.Size() == srcInfo.Size(), nil
 }
 
 func commitDirManifest(ch LocalCache, manifest *directoryManifest) (string, error) {
+	release := ch.acquireOpenFiles(1)
+	defer release()
 	// TODO: Consider using an io.Pipe() instead of a buffer.
 	buf := new(bytes.Buffer)
-	if err := json.NewEncoder(buf).Encode(manifest); err != nil {
+	if ch.manifestFormat == ManifestFormatMsgpack {
+		buf.Write(msgpackManifestMagic)
+		enc := msgpack.NewEncoder(buf)
+		// Reuse the JSON field names and omit the same empty fields.
+		enc.SetCustomStructTag("json")
+		// Sort the keys of Artifact.Xattrs. (directoryManifest sorts its own
+		// keys.)
+		enc.SetSortMapKeys(true)
+		if err := enc.Encode(manifest); err != nil {
+			return "", err
+		}
+	} else if err := json.NewEncoder(buf).Encode(manifest); err != nil {
 		return "", err
 	}
-	return ch.commitBytes(buf, "")
+	cksum, _, err := ch.commitBytes(buf, "")
+	return cksum, err
 }
 
 func commitDirArtifact(
@@ -235,28 +732,88 @@ func commitDirArtifact(
 	var oldManifest directoryManifest
 	if status.ChecksumInCache {
 		oldManifest, err = readDirManifest(filepath.Join(ch.dir, cachePath))
+		// The old manifest only lets us skip up-to-date children, so a
+		// corrupt one is ignored. Committing replaces it if the directory is
+		// unchanged.
+		var corruptErr CorruptManifestError
+		if errors.As(err, &corruptErr) {
+			oldManifest, err = directoryManifest{}, nil
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	entries, err := readDir(workPath, art.DisableRecursion)
-	if err != nil {
-		return err
+	// Unless the directory is read in batches, all of its entries are read
+	// up front. Hard links have to be found before any files are committed,
+	// because committing can replace them with links to the cache, so
+	// directories that preserve hard links are never read in batches.
+	streamEntries := ch.dirBatchSize > 0 && !art.PreserveHardlinks
+	var entries []os.DirEntry
+	var hardlinks [][]string
+	if !streamEntries {
+		entries, err = readDir(ch, workPath, *art)
+		if err != nil {
+			return err
+		}
+		if art.PreserveHardlinks {
+			hardlinks, err = findHardlinks(workPath, entries, oldManifest)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// Start a goroutine to feed files/sub-directories to workers.
+	// Start a goroutine to feed files/sub-directories to workers. Once all
+	// entries are fed, it reports how many there were on numEntries.
 	errGroup, groupCtx := errgroup.WithContext(ctx)
 	inputFiles := make(chan os.DirEntry)
+	feedDone := make(chan struct{})
+	numEntries := make(chan int, 1)
+	// When reading in batches, workers are started lazily: the feeder asks for
+	// another worker on moreWorkers only when no worker is idle. Otherwise a
+	// directory with few entries would claim all of the shared workers.
+	var moreWorkers chan struct{}
+	if streamEntries {
+		moreWorkers = make(chan struct{}, 1)
+	}
 	errGroup.Go(func() error {
+		defer close(feedDone)
 		defer close(inputFiles)
-		for _, entry := range entries {
-			select {
-			case inputFiles <- entry:
-			case <-groupCtx.Done():
-				return groupCtx.Err()
+		count := 0
+		feed := func(batch []os.DirEntry) error {
+			for _, entry := range batch {
+				if moreWorkers != nil {
+					select {
+					case inputFiles <- entry:
+						count++
+						continue
+					default:
+					}
+					select {
+					case moreWorkers <- struct{}{}:
+					default:
+					}
+				}
+				select {
+				case inputFiles <- entry:
+					count++
+				case <-groupCtx.Done():
+					return groupCtx.Err()
+				}
 			}
+			return nil
+		}
+		var err error
+		if streamEntries {
+			err = readDirBatches(ch, workPath, *art, ch.dirBatchSize, feed)
+		} else {
+			err = feed(entries)
+		}
+		if err != nil {
+			return err
 		}
+		numEntries <- count
 		return nil
 	})
 
@@ -266,19 +823,22 @@ func commitDirArtifact(
 	// Start a goroutine to build the directory manifest from committed
 	// artifacts.
 	newManifest := &directoryManifest{
-		Path:     art.Path,
 		Contents: make(map[string]*artifact.Artifact),
 	}
 	errGroup.Go(func() error {
-		// There should be exactly len(entries) Artifacts returned in the
-		// childArtifacts channel. This fact is critical for enabling the
-		// dynamic worker scheduling below, because that logic needs to know
-		// when to stop waiting for available worker tokens (via the
-		// manifestReady channel).
-		for i := 0; i < len(entries); i++ {
+		// There should be exactly as many Artifacts returned in the
+		// childArtifacts channel as there are entries. This fact is critical
+		// for enabling the dynamic worker scheduling below, because that
+		// logic needs to know when to stop waiting for available worker
+		// tokens (via the manifestReady channel). The number of entries is
+		// only known once they've all been fed to the workers.
+		total := -1
+		for received := 0; received != total; {
 			select {
 			case childArt := <-childArtifacts:
 				newManifest.Contents[childArt.Path] = childArt
+				received++
+			case total = <-numEntries:
 			case <-groupCtx.Done():
 				return groupCtx.Err()
 			}
@@ -287,15 +847,23 @@ func commitDirArtifact(
 		return nil
 	})
 
+	// When reading in batches, the number of entries isn't known up front.
+	totalWorkItems := len(entries)
+	if streamEntries {
+		totalWorkItems = -1
+	}
 	startCommitWorkers(
 		groupCtx,
 		errGroup,
 		ch,
 		workPath,
 		oldManifest,
+		*art,
 		strat,
-		len(entries),
+		totalWorkItems,
 		inputFiles,
+		feedDone,
+		moreWorkers,
 		childArtifacts,
 		manifestReady,
 		activeSharedWorkers,
@@ -310,6 +878,24 @@ func commitDirArtifact(
 
 	close(childArtifacts)
 
+	if ch.duplicates != nil {
+		ch.duplicates.add(workPath, newManifest)
+	}
+
+	if art.PreserveHardlinks {
+		newManifest.Hardlinks = consistentHardlinks(hardlinks, newManifest.Contents)
+	}
+
+	if art.Ordered {
+		newManifest.Order = make([]string, 0, len(newManifest.Contents))
+		for name := range newManifest.Contents {
+			newManifest.Order = append(newManifest.Order, name)
+		}
+		sort.Slice(newManifest.Order, func(i, j int) bool {
+			return naturalLess(newManifest.Order[i], newManifest.Order[j])
+		})
+	}
+
 	cksum, err := commitDirManifest(ch, newManifest)
 	if err != nil {
 		return err
@@ -320,17 +906,23 @@ func commitDirArtifact(
 
 // Start workers to commit artifacts. We spawn workers when there's free
 // space in either of the "active worker" channels. We quit when we've
-// either scheduled as many workers as files/sub-dirs, the manifest builder
-// says the manifest is ready, or the group was cancelled.
+// either scheduled as many workers as files/sub-dirs, all files/sub-dirs have
+// been fed to workers, the manifest builder says the manifest is ready, or the
+// group was cancelled. A negative totalWorkItems means the number of
+// files/sub-dirs isn't known. If moreWorkers isn't nil, each worker is only
+// spawned once a value is received from it.
 func startCommitWorkers(
 	ctx context.Context,
 	errGroup *errgroup.Group,
 	ch LocalCache,
 	workPath string,
 	oldManifest directoryManifest,
+	dirArt artifact.Artifact,
 	strat strategy.CheckoutStrategy,
 	totalWorkItems int,
 	inputFiles <-chan os.DirEntry,
+	feedDone <-chan struct{},
+	moreWorkers <-chan struct{},
 	outputArtifacts chan<- *artifact.Artifact,
 	manifestReady chan struct{},
 	activeSharedWorkers chan struct{},
@@ -338,12 +930,25 @@ func startCommitWorkers(
 	canRenameFile bool,
 ) {
 	activeDedicatedWorkers := make(chan struct{}, maxDedicatedWorkers)
-	for i := 0; i < totalWorkItems; i++ {
+	for i := 0; totalWorkItems < 0 || i < totalWorkItems; i++ {
+		if moreWorkers != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-manifestReady:
+				return
+			case <-feedDone:
+				return
+			case <-moreWorkers:
+			}
+		}
 		select {
 		case <-ctx.Done():
 			return
 		case <-manifestReady:
 			return
+		case <-feedDone:
+			return
 		case activeSharedWorkers <- struct{}{}:
 			errGroup.Go(func() error {
 				defer func() { <-activeSharedWorkers }()
@@ -352,6 +957,7 @@ func startCommitWorkers(
 					ch,
 					workPath,
 					oldManifest,
+					dirArt,
 					strat,
 					inputFiles,
 					outputArtifacts,
@@ -368,6 +974,7 @@ func startCommitWorkers(
 					ch,
 					workPath,
 					oldManifest,
+					dirArt,
 					strat,
 					inputFiles,
 					outputArtifacts,
@@ -385,6 +992,7 @@ func commitWorker(
 	ch LocalCache,
 	workPath string,
 	dirMan directoryManifest,
+	dirArt artifact.Artifact,
 	strat strategy.CheckoutStrategy,
 	inputFiles <-chan os.DirEntry,
 	outputArtifacts chan<- *artifact.Artifact,
@@ -398,6 +1006,11 @@ func commitWorker(
 			childArt *artifact.Artifact
 			err      error
 		)
+		if entry.Type()&os.ModeSymlink != 0 {
+			if err := checkSymlinkTarget(ch, filepath.Join(workPath, path)); err != nil {
+				return err
+			}
+		}
 		// See if we can recover a child artifact from an existing directory
 		// manifest. This enables skipping up-to-date artifacts.
 		childArt, ok := dirMan.Contents[path]
@@ -408,6 +1021,12 @@ func commitWorker(
 			}
 		}
 		if childArt.IsDir {
+			// Ordering, hard link preservation, and include/exclude
+			// patterns apply to all sub-directories.
+			childArt.Ordered = dirArt.Ordered
+			childArt.PreserveHardlinks = dirArt.PreserveHardlinks
+			childArt.Include = dirArt.Include
+			childArt.Exclude = dirArt.Exclude
 			err = commitDirArtifact(
 				ctx,
 				ch,
@@ -427,6 +1046,9 @@ func commitWorker(
 				progress,
 				canRenameFile,
 			)
+			if err == nil {
+				ch.emitProgress(PhaseCommit, workPath, path, progress)
+			}
 		}
 		if err != nil {
 			return err
@@ -440,26 +1062,162 @@ func commitWorker(
 	return nil
 }
 
-func readDir(path string, excludeSubDirs bool) (out []os.DirEntry, err error) {
-	dir, err := os.Open(path)
+// checkSymlinkTarget returns a SymlinkEscapeError if the symlink at linkPath
+// points outside of the workspace being committed and outside of the cache.
+// Dangling links are judged by where they would point.
+func checkSymlinkTarget(ch LocalCache, linkPath string) error {
+	target, err := filepath.EvalSymlinks(linkPath)
+	if os.IsNotExist(err) {
+		target, err = os.Readlink(linkPath)
+		if err == nil && !filepath.IsAbs(target) {
+			target = filepath.Join(ch.canonicalDir(filepath.Dir(linkPath)), target)
+		}
+	}
 	if err != nil {
-		return
+		return err
 	}
-	defer dir.Close()
-	out, err = dir.ReadDir(0)
+	target, err = filepath.Abs(target)
 	if err != nil {
-		return
+		return err
+	}
+	for _, dir := range []string{ch.commitRoot, ch.canonicalDir(ch.dir)} {
+		if isWithinDir(dir, target) {
+			return nil
+		}
 	}
+	return SymlinkEscapeError{path: linkPath, target: target}
+}
+
+// waitPollInterval is how often waitForFile checks for the file. It is a
+// variable so tests can shorten it.
+var waitPollInterval = 100 * time.Millisecond
 
-	if excludeSubDirs {
-		allOut := out // TODO: refactor to avoid this potential copy
-		out = make([]os.DirEntry, 0, len(allOut))
-		for _, entry := range allOut {
+// waitForFile returns once a file exists at path (or a symlink, even if it's
+// dangling), or an error wrapping os.ErrNotExist if none appears within
+// timeout.
+func waitForFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		exists, err := fsutil.Exists(path, false)
+		if err != nil || exists {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return errors.Wrapf(os.ErrNotExist, "%s: still missing after waiting %s", path, timeout)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// checkArtifactLocation returns an ArtifactInCacheError if the Artifact's
+// path in the workspace, with its symlinks resolved, is inside of the cache
+// directory or the project's metadata directory. Committing such a path would
+// capture the cache itself. A file Artifact may be a link into the cache (as
+// left by the link strategy), so only its parent directories are resolved.
+// Entries of directory Artifacts are guarded against this separately, by
+// readDirBatches.
+func checkArtifactLocation(ch LocalCache, workspaceDir string, art artifact.Artifact) error {
+	workPath := filepath.Join(workspaceDir, art.Path)
+	resolved := filepath.Join(ch.canonicalDir(filepath.Dir(workPath)), filepath.Base(workPath))
+	if art.IsDir {
+		resolved = ch.canonicalDir(resolved)
+	}
+	resolved, err := filepath.Abs(resolved)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{ch.dir, filepath.Join(workspaceDir, metadataDirName)} {
+		dir, err = filepath.Abs(ch.canonicalDir(dir))
+		if err != nil {
+			return err
+		}
+		if isWithinDir(dir, resolved) {
+			return ArtifactInCacheError{path: art.Path, resolved: resolved, dir: dir}
+		}
+	}
+	return nil
+}
+
+// isWithinDir returns true if path is dir or is inside of it. Both paths must
+// be absolute and clean.
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// metadataDirName is the name of the directory holding a Dud project's
+// metadata, including the default cache location.
+const metadataDirName = ".dud"
+
+// readDir returns the entries of the directory at path tracked by the
+// directory Artifact, according to its DisableRecursion option and its include
+// and exclude patterns. The cache directory and any Dud metadata directories
+// are always excluded, as tracking them would wreak havoc on the cache.
+func readDir(ch LocalCache, path string, art artifact.Artifact) (out []os.DirEntry, err error) {
+	release := ch.acquireOpenFiles(1)
+	defer release()
+	err = readDirBatches(ch, path, art, 0, func(batch []os.DirEntry) error {
+		out = append(out, batch...)
+		return nil
+	})
+	return
+}
+
+// readDirBatches is like readDir, but it reads at most batchSize entries of
+// the directory at a time and passes the tracked entries of each batch to fn,
+// so the entries of very wide directories needn't all be held in memory at
+// once. If batchSize isn't positive, all entries are read in a single batch.
+// The directory stays open until all entries have been read, without counting
+// against the Cache's limit of open files.
+func readDirBatches(
+	ch LocalCache,
+	path string,
+	art artifact.Artifact,
+	batchSize int,
+	fn func([]os.DirEntry) error,
+) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		allBatch, err := dir.ReadDir(batchSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		batch := make([]os.DirEntry, 0, len(allBatch))
+		for _, entry := range allBatch {
 			if entry.IsDir() {
+				if art.DisableRecursion || entry.Name() == metadataDirName {
+					continue
+				}
+				if filepath.Join(absPath, entry.Name()) == ch.dir {
+					continue
+				}
+			}
+			if !art.Tracks(entry.Name(), entry.IsDir()) {
 				continue
 			}
-			out = append(out, entry)
+			batch = append(batch, entry)
+		}
+		if len(batch) > 0 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+		if batchSize <= 0 {
+			return nil
 		}
 	}
-	return
 }
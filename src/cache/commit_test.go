@@ -1,9 +1,16 @@
 package cache
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/kevin-hanselman/dud/src/agglog"
 	"github.com/kevin-hanselman/dud/src/artifact"
@@ -13,6 +20,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestFileCommitIntegration(t *testing.T) {
@@ -180,7 +188,7 @@ func testCommitIntegration(in testInput, expectedOut testExpectedOutput, t *test
 		t.Fatal(err)
 	}
 
-	commitErr := cache.Commit(dirs.WorkDir, &art, in.CheckoutStrategy, logger)
+	_, commitErr := cache.Commit(dirs.WorkDir, &art, in.CheckoutStrategy, logger)
 
 	// Strip any context from the error (e.g. "commit hello.txt:").
 	commitErr = errors.Cause(commitErr)
@@ -221,3 +229,1171 @@ func assertFilePermissions(path string, want os.FileMode, t *testing.T) {
 		t.Fatalf("%#v has permissions %#o, want %#o", path, info.Mode(), want)
 	}
 }
+
+func TestCommitBytesConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("Hello, World!")
+	numCommits := 2
+	checksums := make(chan string, numCommits)
+	errGroup := new(errgroup.Group)
+	for i := 0; i < numCommits; i++ {
+		errGroup.Go(func() error {
+			cksum, _, err := cache.commitBytes(bytes.NewReader(contents), "")
+			checksums <- cksum
+			return err
+		})
+	}
+	if err := errGroup.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	close(checksums)
+
+	want := "288a86a79f20a3d6dccdca7713beaed178798296bdfa7913fa2a62d9727bf8f8"
+	for cksum := range checksums {
+		if cksum != want {
+			t.Fatalf("commitBytes() checksum = %#v, want %#v", cksum, want)
+		}
+	}
+
+	// The cache should only contain the blob's parent directory; no temporary
+	// files should be left behind.
+	entries, err := os.ReadDir(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != want[:2] {
+		t.Fatalf("unexpected cache entries: %v", entries)
+	}
+	art := artifact.Artifact{Checksum: want}
+	testCachePermissions(cache, art, t)
+}
+
+func TestCommitBytesAlreadyCached(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("Hello, World!")
+	if _, _, err := cache.commitBytes(bytes.NewReader(contents), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Committing by moving a file should consume the file even though the blob
+	// already exists in the cache.
+	moveFile := filepath.Join(dirs.WorkDir, "hello.txt")
+	if err := os.WriteFile(moveFile, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srcFile, err := os.Open(moveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcFile.Close()
+	if _, _, err := cache.commitBytes(srcFile, moveFile); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := fsutil.Exists(moveFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("expected %s to be removed", moveFile)
+	}
+}
+
+func TestCommitBytesExistingBlob(t *testing.T) {
+	contents := []byte("Hello, World!")
+
+	// commitOverBlob commits contents to a cache whose blob for them was
+	// replaced with damaged, and returns whether the blob was reported as
+	// already cached and its final contents.
+	commitOverBlob := func(t *testing.T, damaged []byte, force bool) (bool, []byte) {
+		cacheDir := t.TempDir()
+		cache, err := NewLocalCache(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cksum, _, err := cache.commitBytes(bytes.NewReader(contents), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobPath, err := cache.BlobPath(cksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(blobPath, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(blobPath, damaged, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		// A new LocalCache doesn't remember committing the blob.
+		cache, err = NewLocalCache(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if force {
+			cache.EnableForceCommit()
+		}
+		_, existed, err := cache.commitBytes(bytes.NewReader(contents), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(blobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return existed, got
+	}
+
+	t.Run("truncated blobs are replaced", func(t *testing.T) {
+		existed, got := commitOverBlob(t, contents[:5], false)
+		if existed {
+			t.Fatal("truncated blob was reported as already in the cache")
+		}
+		if !bytes.Equal(got, contents) {
+			t.Fatalf("blob contents = %q, want %q", got, contents)
+		}
+	})
+
+	t.Run("blobs of the right size aren't re-hashed", func(t *testing.T) {
+		damaged := []byte("Hello, Wordl!")
+		existed, got := commitOverBlob(t, damaged, false)
+		if !existed {
+			t.Fatal("blob wasn't reported as already in the cache")
+		}
+		if !bytes.Equal(got, damaged) {
+			t.Fatalf("blob contents = %q, want %q", got, damaged)
+		}
+	})
+
+	t.Run("force replaces blobs of the right size", func(t *testing.T) {
+		existed, got := commitOverBlob(t, []byte("Hello, Wordl!"), true)
+		if existed {
+			t.Fatal("blob was reported as already in the cache")
+		}
+		if !bytes.Equal(got, contents) {
+			t.Fatalf("blob contents = %q, want %q", got, contents)
+		}
+	})
+}
+
+func TestCommitMaxFileSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetMaxFileSize(4); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("rejects large files", func(t *testing.T) {
+		workPath := filepath.Join(dirs.WorkDir, "large.txt")
+		if err := os.WriteFile(workPath, []byte("Hello, World!"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: "large.txt"}
+
+		_, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, agglog.NewNullLogger())
+
+		if _, ok := errors.Cause(err).(FileTooLargeError); !ok {
+			t.Fatalf("expected FileTooLargeError, got %v", err)
+		}
+		if art.Checksum != "" {
+			t.Fatalf("expected no checksum, got %#v", art.Checksum)
+		}
+		assertFilePermissions(workPath, 0o644, t)
+	})
+
+	t.Run("accepts small files", func(t *testing.T) {
+		workPath := filepath.Join(dirs.WorkDir, "small.txt")
+		if err := os.WriteFile(workPath, []byte("Hi!"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: "small.txt"}
+
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("discards partial copies", func(t *testing.T) {
+		reader := &sizeLimitReader{r: bytes.NewReader([]byte("Hello, World!")), limit: 4}
+
+		_, _, err := cache.commitBytes(reader, "")
+
+		if _, ok := err.(FileTooLargeError); !ok {
+			t.Fatalf("expected FileTooLargeError, got %v", err)
+		}
+		entries, err := os.ReadDir(dirs.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				t.Fatalf("unexpected file left in cache: %s", entry.Name())
+			}
+		}
+	})
+}
+
+func TestCommitBytesSkipsCommittedBlobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("Hello, World!")
+	cksum, _, err := cache.commitBytes(bytes.NewReader(contents), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.wasCommitted(cksum) {
+		t.Fatalf("expected %s to be marked as committed", cksum)
+	}
+
+	// Remove the blob behind the cache's back. Committing the same contents
+	// again should trust that the blob is in place and not add it again.
+	blobPath, err := cache.BlobPath(cksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(blobPath); err != nil {
+		t.Fatal(err)
+	}
+	moveFile := filepath.Join(dirs.WorkDir, "hello.txt")
+	if err := os.WriteFile(moveFile, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srcFile, err := os.Open(moveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcFile.Close()
+	if _, _, err := cache.commitBytes(srcFile, moveFile); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{moveFile, blobPath} {
+		exists, err := fsutil.Exists(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatalf("expected %s not to exist", path)
+		}
+	}
+}
+
+func TestCommitResult(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("Hello, World!")
+	if err := os.WriteFile(filepath.Join(dirs.WorkDir, "hello.txt"), contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "hello.txt"}
+
+	result, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, agglog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CommitResult{
+		Changed:      true,
+		Checksum:     art.Checksum,
+		BytesWritten: int64(len(contents)),
+		FilesAdded:   1,
+	}
+	if diff := cmp.Diff(want, result); diff != "" {
+		t.Fatalf("first CommitResult -want +got:\n%s", diff)
+	}
+
+	result, err = cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, agglog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = CommitResult{Checksum: art.Checksum}
+	if diff := cmp.Diff(want, result); diff != "" {
+		t.Fatalf("second CommitResult -want +got:\n%s", diff)
+	}
+
+	// A copy of the file is deduplicated against the object already in the
+	// cache.
+	if err := os.WriteFile(filepath.Join(dirs.WorkDir, "copy.txt"), contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	copyArt := artifact.Artifact{Path: "copy.txt"}
+	result, err = cache.Commit(dirs.WorkDir, &copyArt, strategy.LinkStrategy, agglog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = CommitResult{
+		Changed:           true,
+		Checksum:          art.Checksum,
+		FilesDeduplicated: 1,
+		BytesDeduplicated: int64(len(contents)),
+	}
+	if diff := cmp.Diff(want, result); diff != "" {
+		t.Fatalf("copy CommitResult -want +got:\n%s", diff)
+	}
+
+	want = CommitResult{
+		BytesWritten:      int64(len(contents)),
+		FilesAdded:        1,
+		FilesDeduplicated: 1,
+		BytesDeduplicated: int64(len(contents)),
+	}
+	if diff := cmp.Diff(want, cache.CommitTotals()); diff != "" {
+		t.Fatalf("CommitTotals() -want +got:\n%s", diff)
+	}
+}
+
+func TestCommitStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workPath := filepath.Join(dirs.WorkDir, "hello.txt")
+	if err := os.WriteFile(workPath, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "hello.txt"}
+
+	// A failed read leaves the Artifact and the workspace untouched.
+	streamErr := errors.New("command failed")
+	reader := io.MultiReader(bytes.NewReader([]byte("Hello")), iotest.ErrReader(streamErr))
+	err = cache.CommitStream(dirs.WorkDir, &art, reader, strategy.LinkStrategy)
+	if errors.Cause(err) != streamErr {
+		t.Fatalf("CommitStream() error = %v, want %v", err, streamErr)
+	}
+	if art.Checksum != "" {
+		t.Fatalf("art.Checksum = %#v, want empty", art.Checksum)
+	}
+	got, err := os.ReadFile(workPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "stale" {
+		t.Fatalf("workspace file contents = %#v, want %#v", string(got), "stale")
+	}
+
+	contents := []byte("Hello, World!")
+	err = cache.CommitStream(dirs.WorkDir, &art, bytes.NewReader(contents), strategy.LinkStrategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := cache.Status(dirs.WorkDir, art, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.WorkspaceFileStatus != fsutil.StatusLink || !status.ContentsMatch {
+		t.Fatalf("status = %v, want an up-to-date link", status)
+	}
+
+	// The workspace file is already committed, so committing again is
+	// a no-op.
+	result, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, agglog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changed {
+		t.Fatalf("CommitResult.Changed = true, want false")
+	}
+}
+
+// TestCommitTuning checks that the settings that tune how commit reads and
+// hashes files never change checksums.
+func TestCommitTuning(t *testing.T) {
+	defer func(size int64) { chunkSize = size }(chunkSize)
+	chunkSize = 4
+
+	files := map[string]string{
+		"hello.txt":      "Hello, World!",
+		"log.txt":        "0123456789abcdefghij",
+		"data/a.txt":     "a",
+		"data/b.txt":     "b",
+		"data/sub/c.txt": "c",
+		"data/sub/d.txt": "d",
+	}
+
+	// commit commits a file, a chunked file, and a directory artifact to a
+	// new cache tuned by tune, and checks that they're up-to-date.
+	commit := func(t *testing.T, tune func(*LocalCache) error) (
+		LocalCache,
+		testutil.TempDirs,
+		map[string]*artifact.Artifact,
+	) {
+		dirs, err := testutil.CreateTempDirs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			os.RemoveAll(dirs.CacheDir)
+			os.RemoveAll(dirs.WorkDir)
+		})
+		cache, err := NewLocalCache(dirs.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tune(&cache); err != nil {
+			t.Fatal(err)
+		}
+		for path, contents := range files {
+			path = filepath.Join(dirs.WorkDir, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		arts := map[string]*artifact.Artifact{
+			"hello.txt": {Path: "hello.txt"},
+			"log.txt":   {Path: "log.txt", Chunked: true},
+			"data":      {Path: "data", IsDir: true},
+		}
+		for _, art := range arts {
+			_, err := cache.Commit(dirs.WorkDir, art, strategy.LinkStrategy, agglog.NewNullLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := cache.Status(dirs.WorkDir, *art, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !status.ContentsMatch {
+				t.Fatalf("expected %s to be up-to-date, got %v", art.Path, status)
+			}
+		}
+		return cache, dirs, arts
+	}
+
+	_, _, want := commit(t, func(*LocalCache) error { return nil })
+
+	tests := map[string]struct {
+		tune, invalid func(*LocalCache) error
+	}{
+		"checksum buffer size": {
+			tune:    func(ch *LocalCache) error { return ch.SetChecksumBufferSize(3) },
+			invalid: func(ch *LocalCache) error { return ch.SetChecksumBufferSize(-1) },
+		},
+		"checksum threads": {
+			tune:    func(ch *LocalCache) error { return ch.SetChecksumThreads(3) },
+			invalid: func(ch *LocalCache) error { return ch.SetChecksumThreads(-1) },
+		},
+		"one IO thread": {
+			tune:    func(ch *LocalCache) error { return ch.SetIOThreads(1) },
+			invalid: func(ch *LocalCache) error { return ch.SetIOThreads(-1) },
+		},
+		"one CPU thread": {
+			tune:    func(ch *LocalCache) error { return ch.SetCPUThreads(1) },
+			invalid: func(ch *LocalCache) error { return ch.SetCPUThreads(-1) },
+		},
+		"many CPU threads": {
+			tune:    func(ch *LocalCache) error { return ch.SetCPUThreads(8) },
+			invalid: func(ch *LocalCache) error { return ch.SetCPUThreads(-1) },
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache, dirs, arts := commit(t, test.tune)
+			for path, art := range arts {
+				if art.Checksum != want[path].Checksum {
+					t.Fatalf("%s: got checksum %s, want %s", path, art.Checksum, want[path].Checksum)
+				}
+			}
+
+			// Status uses the same settings to compare chunked files.
+			if err := os.WriteFile(filepath.Join(dirs.WorkDir, "log.txt"), []byte("0123456789abcdefghiX"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			status, err := cache.Status(dirs.WorkDir, *arts["log.txt"], true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.ContentsMatch {
+				t.Fatal("expected out-of-date status")
+			}
+
+			if err := test.invalid(&cache); err == nil {
+				t.Fatal("expected error for negative setting")
+			}
+		})
+	}
+}
+
+// recordSyncs makes syncFile and syncDir record the paths they sync for the
+// rest of the test.
+func recordSyncs(t *testing.T) (files, dirs map[string]bool) {
+	files, dirs = make(map[string]bool), make(map[string]bool)
+	var mutex sync.Mutex
+	syncFileOrig, syncDirOrig := syncFile, syncDir
+	syncFile = func(path string) error {
+		mutex.Lock()
+		files[path] = true
+		mutex.Unlock()
+		return syncFileOrig(path)
+	}
+	syncDir = func(path string) error {
+		mutex.Lock()
+		dirs[path] = true
+		mutex.Unlock()
+		return syncDirOrig(path)
+	}
+	t.Cleanup(func() { syncFile, syncDir = syncFileOrig, syncDirOrig })
+	return
+}
+
+func TestCommitSyncedCommits(t *testing.T) {
+	commit := func(t *testing.T, cache LocalCache, strat strategy.CheckoutStrategy) artifact.Artifact {
+		workDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: "foo.txt"}
+		if _, err := cache.Commit(workDir, &art, strat, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		status, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date status, got %v", status)
+		}
+		return art
+	}
+
+	for _, strat := range []strategy.CheckoutStrategy{strategy.LinkStrategy, strategy.CopyStrategy} {
+		t.Run(auditStrategy(strat), func(t *testing.T) {
+			cache, err := NewLocalCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache.EnableSyncedCommits()
+			files, dirs := recordSyncs(t)
+			art := commit(t, cache, strat)
+			blobPath, err := cache.BlobPath(art.Checksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !files[blobPath] {
+				t.Fatalf("object %s wasn't synced; synced files: %v", blobPath, files)
+			}
+			if !dirs[filepath.Dir(blobPath)] {
+				t.Fatalf("directory of %s wasn't synced; synced dirs: %v", blobPath, dirs)
+			}
+		})
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, dirs := recordSyncs(t)
+		commit(t, cache, strategy.CopyStrategy)
+		if len(files) > 0 || len(dirs) > 0 {
+			t.Fatalf("got synced files %v and dirs %v, want none", files, dirs)
+		}
+	})
+}
+
+func TestCommitChecksumOnly(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableChecksumOnly()
+	workDir := t.TempDir()
+	files := map[string]string{
+		"foo.txt":      "foo",
+		"data/bar.txt": "bar",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := agglog.NewNullLogger()
+
+	fileArt := artifact.Artifact{Path: "foo.txt"}
+	if _, err := cache.Commit(workDir, &fileArt, strategy.LinkStrategy, logger); err == nil {
+		t.Fatal("expected error for checksum-only commit with link strategy")
+	}
+	if _, err := cache.Commit(workDir, &fileArt, strategy.CopyStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	dirArt := artifact.Artifact{Path: "data", IsDir: true}
+	if _, err := cache.Commit(workDir, &dirArt, strategy.CopyStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the directory manifest is in the cache.
+	var blobs []string
+	err = cache.WalkBlobs(func(cksum, _ string, _ os.FileInfo) error {
+		blobs = append(blobs, cksum)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{dirArt.Checksum}, blobs); diff != "" {
+		t.Fatalf("cache objects -want +got:\n%s", diff)
+	}
+
+	status, err := cache.Status(workDir, fileArt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ContentsMatch || status.ChecksumInCache {
+		t.Fatalf("got status %v, want contents matching without cached checksum", status)
+	}
+	status, err = cache.Status(workDir, dirArt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status.MissingChildren(); len(got) != 1 || got[0] != "bar.txt" {
+		t.Fatalf("got missing children %v, want [bar.txt]", got)
+	}
+	// Files in directories have no fingerprints, so status doesn't re-hash
+	// them.
+	if status.ChildrenStatus["bar.txt"].ContentsMatch {
+		t.Fatalf("expected bar.txt not to be checked, got %v", status.ChildrenStatus["bar.txt"])
+	}
+}
+
+func TestCommitContentTypes(t *testing.T) {
+	pngHeader := "\x89PNG\r\n\x1a\n"
+	files := map[string]string{
+		"hello.txt":      "Hello, World!",
+		"data/image.png": pngHeader + "not really an image",
+		"data/page.html": "<html><body></body></html>",
+	}
+	commit := func(t *testing.T, detect bool) (LocalCache, []artifact.Artifact) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detect {
+			cache.EnableContentTypeDetection()
+		}
+		workDir := t.TempDir()
+		for path, contents := range files {
+			path = filepath.Join(workDir, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		arts := []artifact.Artifact{{Path: "hello.txt"}, {Path: "data", IsDir: true}}
+		for i := range arts {
+			_, err := cache.Commit(workDir, &arts[i], strategy.LinkStrategy, agglog.NewNullLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return cache, arts
+	}
+
+	_, plainArts := commit(t, false)
+	cache, arts := commit(t, true)
+
+	if plainArts[0].ContentType != "" {
+		t.Fatalf("got content type %#v without detection", plainArts[0].ContentType)
+	}
+	if got, want := arts[0].ContentType, "text/plain; charset=utf-8"; got != want {
+		t.Fatalf("got content type %#v, want %#v", got, want)
+	}
+	if arts[0].Checksum != plainArts[0].Checksum {
+		t.Fatal("content type detection changed the file checksum")
+	}
+
+	manifestPath, err := cache.BlobPath(arts[1].Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man, err := readDirManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for name, childArt := range man.Contents {
+		got[name] = childArt.ContentType
+	}
+	want := map[string]string{
+		"image.png": "image/png",
+		"page.html": "text/html; charset=utf-8",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("directory content types -want +got:\n%s", diff)
+	}
+
+	t.Run("streams", func(t *testing.T) {
+		workDir := t.TempDir()
+		art := artifact.Artifact{Path: "out.png"}
+		reader := strings.NewReader(pngHeader)
+		if err := cache.CommitStream(workDir, &art, reader, strategy.LinkStrategy); err != nil {
+			t.Fatal(err)
+		}
+		if art.ContentType != "image/png" {
+			t.Fatalf("got content type %#v, want %#v", art.ContentType, "image/png")
+		}
+	})
+}
+
+func TestCommitDuplicates(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableDuplicateReport()
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "foo",
+		"data/b.txt":     "bar",
+		"data/c.txt":     "foo",
+		"data/sub/a.txt": "bar",
+		"data/sub/d.txt": "baz",
+		"data/sub/e.txt": "baz",
+		"data/sub/f.txt": "baz",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	art := artifact.Artifact{Path: "data", IsDir: true}
+
+	result, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files are only compared within the same directory.
+	want := [][]string{
+		{"data/a.txt", "data/c.txt"},
+		{"data/sub/d.txt", "data/sub/e.txt", "data/sub/f.txt"},
+	}
+	if diff := cmp.Diff(want, result.Duplicates); diff != "" {
+		t.Fatalf("Duplicates -want +got:\n%s", diff)
+	}
+}
+
+func TestCommitForce(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := agglog.NewNullLogger()
+	art := artifact.Artifact{Path: "foo.txt"}
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	blobPath, err := cache.BlobPath(art.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the object without changing its size, so it looks cached.
+	corrupt := func() {
+		t.Helper()
+		if err := os.Chmod(blobPath, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(blobPath, []byte("fox"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertBlob := func(want string) {
+		t.Helper()
+		got, err := os.ReadFile(blobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("object contents = %#v, want %#v", string(got), want)
+		}
+	}
+	corrupt()
+
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	assertBlob("fox")
+
+	// Start a new run, as objects committed earlier in a run are never
+	// written again.
+	cache, err = NewLocalCache(cache.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableForceCommit()
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	assertBlob("foo")
+
+	// The workspace file is now a link to the object, so forcing a commit
+	// can only detect the corruption.
+	corrupt()
+	_, err = cache.Commit(workDir, &art, strategy.LinkStrategy, logger)
+	if !errors.As(err, &IntegrityError{}) {
+		t.Fatalf("got error %v, want IntegrityError", err)
+	}
+}
+
+func TestCommitForceCopy(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	canRenameFileBetweenDirsOrig := canRenameFileBetweenDirs
+	canRenameFileBetweenDirs = func(_, _ string) (bool, error) {
+		panic("unexpected call to canRenameFileBetweenDirs")
+	}
+	defer func() { canRenameFileBetweenDirs = canRenameFileBetweenDirsOrig }()
+
+	dirs, err := testutil.CreateTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+	cache, err := NewLocalCache(dirs.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableForceCopy()
+
+	workPath := filepath.Join(dirs.WorkDir, "foo.txt")
+	if err := os.WriteFile(workPath, []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "foo.txt"}
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := cache.Status(dirs.WorkDir, art, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ContentsMatch || status.WorkspaceFileStatus != fsutil.StatusLink {
+		t.Fatalf("expected up-to-date link, got %s", status)
+	}
+	testCachePermissions(cache, art, t)
+}
+
+func TestCommitTempDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	commit := func(t *testing.T) (cache LocalCache, tempDir string) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.EnableForceCopy()
+		tempDir = filepath.Join(t.TempDir(), "scratch")
+		if err := cache.SetTempDir(tempDir); err != nil {
+			t.Fatal(err)
+		}
+		workDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		art := artifact.Artifact{Path: "foo.txt"}
+		if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		status, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date status, got %s", status)
+		}
+		testCachePermissions(cache, art, t)
+		return
+	}
+
+	assertEmpty := func(t *testing.T, dir string) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("expected no temporary files to remain, got %v", entries)
+		}
+	}
+
+	t.Run("renames from the same filesystem", func(t *testing.T) {
+		_, tempDir := commit(t)
+		assertEmpty(t, tempDir)
+	})
+
+	t.Run("copies from a different filesystem", func(t *testing.T) {
+		canRenameFileBetweenDirsOrig := canRenameFileBetweenDirs
+		canRenameFileBetweenDirs = func(_, _ string) (bool, error) {
+			return false, nil
+		}
+		renameFileOrig := renameFile
+		renameFile = func(src, dst string) error {
+			panic("unexpected rename from the temp dir")
+		}
+		defer func() {
+			canRenameFileBetweenDirs = canRenameFileBetweenDirsOrig
+			renameFile = renameFileOrig
+		}()
+
+		_, tempDir := commit(t)
+		assertEmpty(t, tempDir)
+	})
+}
+
+func TestMoveOrCopyFile(t *testing.T) {
+	renameFileOrig := renameFile
+	defer func() { renameFile = renameFileOrig }()
+
+	setup := func(t *testing.T) (src, dst string) {
+		dir := t.TempDir()
+		src, dst = filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+		if err := os.WriteFile(src, []byte("contents"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	t.Run("copies across devices", func(t *testing.T) {
+		renameFile = func(src, dst string) error {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+		}
+		src, dst := setup(t)
+
+		if err := moveOrCopyFile(src, dst); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "contents" {
+			t.Fatalf("dst contains %#v, want %#v", string(got), "contents")
+		}
+		exists, err := fsutil.Exists(src, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected src to be removed")
+		}
+		entries, err := os.ReadDir(filepath.Dir(dst))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("expected no temporary files to remain, got %v", entries)
+		}
+	})
+
+	t.Run("returns other errors", func(t *testing.T) {
+		renameFile = func(src, dst string) error {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EACCES}
+		}
+		src, dst := setup(t)
+
+		if err := moveOrCopyFile(src, dst); !errors.Is(err, syscall.EACCES) {
+			t.Fatalf("expected EACCES, got %v", err)
+		}
+		if _, err := os.Stat(src); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCommitArtifactInCache(t *testing.T) {
+	workDir := t.TempDir()
+	cacheDir := filepath.Join(workDir, ".dud", "cache")
+	cache, err := NewLocalCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, ".dud", "config.yaml"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(cacheDir, filepath.Join(workDir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".dud", filepath.Join(workDir, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	logger := agglog.NewNullLogger()
+
+	for _, art := range []artifact.Artifact{
+		{Path: "data", IsDir: true},
+		{Path: ".dud/cache", IsDir: true},
+		{Path: "meta/config.yaml"},
+		{Path: "data/foo.txt"},
+	} {
+		_, err := cache.Commit(workDir, &art, strategy.LinkStrategy, logger)
+		if !errors.As(err, &ArtifactInCacheError{}) {
+			t.Fatalf("commit %s: got error %v, want ArtifactInCacheError", art.Path, err)
+		}
+		err = cache.CommitStream(workDir, &art, strings.NewReader("foo"), strategy.LinkStrategy)
+		if !art.IsDir && !errors.As(err, &ArtifactInCacheError{}) {
+			t.Fatalf("commit stream %s: got error %v, want ArtifactInCacheError", art.Path, err)
+		}
+	}
+
+	// A link into the cache is how a committed file is checked out.
+	if err := os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "foo.txt"}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCommitWait(t *testing.T) {
+	waitPollIntervalOrig := waitPollInterval
+	waitPollInterval = time.Millisecond
+	defer func() { waitPollInterval = waitPollIntervalOrig }()
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetWaitTimeout(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	logger := agglog.NewNullLogger()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		writeErr <- os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644)
+	}()
+	art := artifact.Artifact{Path: "foo.txt"}
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+	if art.Checksum == "" {
+		t.Fatal("expected the Artifact to be committed")
+	}
+
+	if err := cache.SetWaitTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	art = artifact.Artifact{Path: "bar.txt"}
+	start := time.Now()
+	_, err = cache.Commit(workDir, &art, strategy.CopyStrategy, logger)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got error %v, want os.ErrNotExist", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Fatalf("Commit returned after %s, want at least 10ms", elapsed)
+	}
+
+	if err := cache.SetWaitTimeout(-time.Second); err == nil {
+		t.Fatal("expected error for negative wait timeout")
+	}
+}
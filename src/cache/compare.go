@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/pkg/errors"
+)
+
+// DirDifferences returns the paths of the files that differ between two
+// committed directory Artifacts, relative to the directories and in sorted
+// order. A file differs if its checksum differs, or if it's in only one of the
+// directories. Sub-directories with identical checksums are skipped, so only
+// the manifests of the parts of the directories that differ are read. Nothing
+// is read from the workspace.
+func (ch LocalCache) DirDifferences(a, b artifact.Artifact) ([]string, error) {
+	errPrefix := "compare " + a.Path + " and " + b.Path
+	if !a.IsDir || !b.IsDir {
+		return nil, errors.Errorf("%s: not directory artifacts", errPrefix)
+	}
+	var diffs []string
+	if err := ch.addDirDifferences(a.Checksum, b.Checksum, "", &diffs); err != nil {
+		return nil, errors.Wrap(err, errPrefix)
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+func (ch LocalCache) addDirDifferences(checksumA, checksumB, prefix string, diffs *[]string) error {
+	if checksumA == checksumB {
+		return nil
+	}
+	manA, err := ch.readDirManifestForChecksum(checksumA)
+	if err != nil {
+		return err
+	}
+	manB, err := ch.readDirManifestForChecksum(checksumB)
+	if err != nil {
+		return err
+	}
+	for name, childA := range manA.Contents {
+		childPath := filepath.Join(prefix, name)
+		childB, ok := manB.Contents[name]
+		switch {
+		case ok && childA.IsDir && childB.IsDir:
+			if err := ch.addDirDifferences(childA.Checksum, childB.Checksum, childPath, diffs); err != nil {
+				return err
+			}
+		case !ok:
+			if err := ch.addAllFiles(*childA, childPath, diffs); err != nil {
+				return err
+			}
+		case childA.IsDir || childB.IsDir:
+			// A file replaced by a directory (or vice versa) differs in its
+			// entirety.
+			if err := ch.addAllFiles(*childA, childPath, diffs); err != nil {
+				return err
+			}
+			if err := ch.addAllFiles(*childB, childPath, diffs); err != nil {
+				return err
+			}
+		case childA.Checksum != childB.Checksum:
+			*diffs = append(*diffs, childPath)
+		}
+	}
+	for name, childB := range manB.Contents {
+		if _, ok := manA.Contents[name]; ok {
+			continue
+		}
+		if err := ch.addAllFiles(*childB, filepath.Join(prefix, name), diffs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAllFiles adds the path of the file Artifact, or the paths of all files
+// in the directory Artifact, to diffs.
+func (ch LocalCache) addAllFiles(art artifact.Artifact, path string, diffs *[]string) error {
+	if !art.IsDir {
+		*diffs = append(*diffs, path)
+		return nil
+	}
+	files := make(map[string]string)
+	if err := ch.flattenDirManifest(art.Checksum, "", files); err != nil {
+		return err
+	}
+	for file := range files {
+		*diffs = append(*diffs, filepath.Join(path, file))
+	}
+	return nil
+}
+
+func (ch LocalCache) readDirManifestForChecksum(checksum string) (directoryManifest, error) {
+	cachePath, err := ch.PathForChecksum(checksum)
+	if err != nil {
+		return directoryManifest{}, err
+	}
+	return readDirManifest(filepath.Join(ch.dir, cachePath))
+}
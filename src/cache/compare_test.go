@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestDirDifferences(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	files := map[string]string{
+		"a/same.txt":         "same",
+		"a/changed.txt":      "old",
+		"a/only-a.txt":       "a",
+		"a/sub/same.txt":     "same",
+		"a/kind":             "file",
+		"b/same.txt":         "same",
+		"b/changed.txt":      "new",
+		"b/sub/same.txt":     "same",
+		"b/only-b/x.txt":     "x",
+		"b/only-b/deep/y.md": "y",
+		"b/kind/z.txt":       "z",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := agglog.NewNullLogger()
+	artA := artifact.Artifact{Path: "a", IsDir: true}
+	artB := artifact.Artifact{Path: "b", IsDir: true}
+	for _, art := range []*artifact.Artifact{&artA, &artB} {
+		if _, err := cache.Commit(workDir, art, strategy.CopyStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := cache.DirDifferences(artA, artB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"changed.txt",
+		"kind",
+		"kind/z.txt",
+		"only-a.txt",
+		"only-b/deep/y.md",
+		"only-b/x.txt",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("DirDifferences -want +got:\n%s", diff)
+	}
+
+	got, err = cache.DirDifferences(artA, artA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("got differences %v comparing a directory with itself", got)
+	}
+
+	if _, err := cache.DirDifferences(artA, artifact.Artifact{Path: "a/same.txt"}); err == nil {
+		t.Fatal("expected error comparing a directory with a file")
+	}
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+)
+
+// sniffLen is the number of leading bytes of a file used to detect its
+// content type. http.DetectContentType considers at most this many.
+const sniffLen = 512
+
+// EnableContentTypeDetection makes Commit set the ContentType of every file
+// Artifact it adds to the cache to the MIME type detected from the file's
+// leading bytes, using the algorithm of http.DetectContentType. Files that are
+// already up-to-date keep their ContentType, if they have one. Content types
+// are purely informational; they never affect the checksums of files.
+func (ch *LocalCache) EnableContentTypeDetection() {
+	ch.detectContentTypes = true
+}
+
+// detectContentType returns the content type of file based on its leading
+// bytes, regardless of the file's current offset.
+func detectContentType(file *os.File) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// detectUpToDateContentType sets the ContentType of the up-to-date file
+// Artifact at workPath, which may be a link to the cache.
+func detectUpToDateContentType(workPath string, art *artifact.Artifact) error {
+	file, err := os.Open(workPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	art.ContentType, err = detectContentType(file)
+	return err
+}
+
+// sniffReader records the leading bytes read through it, so the content type
+// of a stream can be detected without reading it twice.
+type sniffReader struct {
+	r    io.Reader
+	head []byte
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if room := sniffLen - len(s.head); room > 0 {
+		if room > n {
+			room = n
+		}
+		s.head = append(s.head, p[:room]...)
+	}
+	return n, err
+}
+
+// contentType returns the content type detected from the bytes read so far.
+func (s *sniffReader) contentType() string {
+	return http.DetectContentType(s.head)
+}
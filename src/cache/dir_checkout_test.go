@@ -31,7 +31,7 @@ func TestDirectoryCheckoutIntegration(t *testing.T) {
 		defer os.RemoveAll(dirs.CacheDir)
 		defer os.RemoveAll(dirs.WorkDir)
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -126,7 +126,7 @@ func TestDirectoryCheckoutIntegration(t *testing.T) {
 
 		art := artifact.Artifact{Path: "foo", IsDir: true}
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -148,4 +148,223 @@ func TestDirectoryCheckoutIntegration(t *testing.T) {
 			t.Fatalf("expected %s to be a directory, got %s", artFullPath, fileInfo)
 		}
 	})
+
+	t.Run("hard reset discards local modifications", func(t *testing.T) {
+		dirs, art, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		artPath := filepath.Join(dirs.WorkDir, art.Path)
+		// Replace a linked file with a modified copy.
+		modifiedPath := filepath.Join(artPath, "1.txt")
+		if err := os.Remove(modifiedPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(modifiedPath, []byte("modified"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Replace a file with a directory.
+		replacedPath := filepath.Join(artPath, "bar", "4.txt")
+		if err := os.Remove(replacedPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(replacedPath, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		// Add untracked files and directories.
+		if err := os.WriteFile(filepath.Join(artPath, "junk.txt"), []byte("junk"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(artPath, "bar", "junk", "deep"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		// Without a hard reset, checkout refuses to overwrite the workspace.
+		if err := cache.Checkout(dirs.WorkDir, art, strategy.LinkStrategy, nil); err == nil {
+			t.Fatal("expected error without hard reset")
+		}
+
+		cache.EnableHardReset()
+		if err := cache.Checkout(dirs.WorkDir, art, strategy.LinkStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date directory, got %s", status)
+		}
+		for _, path := range []string{"junk.txt", filepath.Join("bar", "junk")} {
+			exists, err := fsutil.Exists(filepath.Join(artPath, path), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists {
+				t.Fatalf("expected %s to be removed", path)
+			}
+		}
+	})
+}
+
+func TestCheckoutChild(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "a",
+		"data/sub/b.txt": "b",
+		"data/sub/c.txt": "c",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	art := artifact.Artifact{Path: "data", IsDir: true}
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(workDir, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.CheckoutChild(workDir, art, "sub/b.txt", strategy.CopyStrategy, nil); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(filepath.Join(workDir, "data/sub/b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "b" {
+		t.Fatalf("got contents %#v, want %#v", string(contents), "b")
+	}
+	for _, path := range []string{"data/a.txt", "data/sub/c.txt"} {
+		exists, err := fsutil.Exists(filepath.Join(workDir, path), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatalf("expected %s not to be checked out", path)
+		}
+	}
+
+	t.Run("status reports the rest as missing", func(t *testing.T) {
+		status, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.ContentsMatch {
+			t.Fatal("expected directory to be out-of-date")
+		}
+		sub := status.ChildrenStatus["sub"]
+		if sub == nil || !sub.ChildrenStatus["b.txt"].ContentsMatch {
+			t.Fatalf("expected sub/b.txt to be up-to-date, got %v", status)
+		}
+	})
+
+	t.Run("checks out sub-directories", func(t *testing.T) {
+		if err := os.RemoveAll(filepath.Join(workDir, "data/sub")); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.CheckoutChild(workDir, art, "sub", strategy.CopyStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, "data/sub/c.txt")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("fails for unknown paths", func(t *testing.T) {
+		for _, childPath := range []string{"missing.txt", "a.txt/nested", "../a.txt", "."} {
+			if err := cache.CheckoutChild(workDir, art, childPath, strategy.LinkStrategy, nil); err == nil {
+				t.Fatalf("expected error for %#v", childPath)
+			}
+		}
+	})
+}
+
+func TestCheckoutResumesPartialCopy(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "a",
+		"data/sub/b.txt": "b",
+		"data/sub/c.txt": "c",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	art := artifact.Artifact{Path: "data", IsDir: true}
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an interrupted checkout: a.txt was copied, c.txt was only
+	// partially copied, and b.txt wasn't reached.
+	if err := os.Remove(filepath.Join(workDir, "data/sub/b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	partialPath := partialCheckoutPath(filepath.Join(workDir, "data/sub/c.txt"))
+	if err := os.Rename(filepath.Join(workDir, "data/sub/c.txt"), partialPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(partialPath, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range files {
+		got, err := os.ReadFile(filepath.Join(workDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s contents = %#v, want %#v", path, string(got), want)
+		}
+	}
+	exists, err := fsutil.Exists(partialPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("expected %s to be removed", partialPath)
+	}
+	status, err := cache.Status(workDir, art, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ContentsMatch {
+		t.Fatalf("status = %v, want up-to-date", status)
+	}
 }
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,7 +13,9 @@ import (
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/kevin-hanselman/dud/src/testutil"
+	"github.com/pkg/errors"
 	"go.uber.org/goleak"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestDirectoryCommitIntegration(t *testing.T) {
@@ -75,7 +78,65 @@ func TestDirectoryCommitIntegration(t *testing.T) {
 		defer os.RemoveAll(dirs.CacheDir)
 		defer os.RemoveAll(dirs.WorkDir)
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		actualStatus, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStatus := makeExpectedStatus(art)
+
+		assertThenRemoveChecksums(t, &actualStatus)
+
+		if diff := cmp.Diff(expectedStatus, actualStatus); diff != "" {
+			t.Fatalf("Status -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("max open files", func(t *testing.T) {
+		maxSharedWorkers = 8
+		defer func() { maxSharedWorkers = 1 }()
+
+		dirs, art, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		if err := cache.SetMaxOpenFiles(1); err == nil {
+			t.Fatal("expected error for limit below minimum")
+		}
+		if err := cache.SetMaxOpenFiles(minOpenFiles); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.CopyStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		actualStatus, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !actualStatus.ContentsMatch {
+			t.Fatalf("expected up-to-date directory, got %s", actualStatus)
+		}
+	})
+
+	t.Run("batched directory reads", func(t *testing.T) {
+		dirs, art, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		if err := cache.SetDirBatchSize(-1); err == nil {
+			t.Fatal("expected error for negative batch size")
+		}
+		if err := cache.SetDirBatchSize(2); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -98,7 +159,7 @@ func TestDirectoryCommitIntegration(t *testing.T) {
 		defer os.RemoveAll(dirs.CacheDir)
 		defer os.RemoveAll(dirs.WorkDir)
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -106,7 +167,7 @@ func TestDirectoryCommitIntegration(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -130,7 +191,7 @@ func TestDirectoryCommitIntegration(t *testing.T) {
 		defer os.RemoveAll(dirs.CacheDir)
 		defer os.RemoveAll(dirs.WorkDir)
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -138,7 +199,7 @@ func TestDirectoryCommitIntegration(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -156,6 +217,235 @@ func TestDirectoryCommitIntegration(t *testing.T) {
 			t.Fatalf("Status -want +got:\n%s", diff)
 		}
 	})
+
+	t.Run("child missing from cache", func(t *testing.T) {
+		dirs, art, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.CopyStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		statusBefore, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		missingArt := statusBefore.ChildrenStatus["bar"].ChildrenStatus["6.txt"].Artifact
+		missingPath, err := cache.PathForChecksum(missingArt.Checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dirs.CacheDir, missingPath)); err != nil {
+			t.Fatal(err)
+		}
+
+		actualStatus, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actualStatus.ContentsMatch {
+			t.Fatal("expected directory with missing child to be out-of-date")
+		}
+		if diff := cmp.Diff([]string{"bar/6.txt"}, actualStatus.MissingChildren()); diff != "" {
+			t.Fatalf("MissingChildren() -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("ordered", func(t *testing.T) {
+		dirs, art, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		for _, name := range []string{"10.txt", "9.txt"} {
+			if err := os.WriteFile(filepath.Join(dirs.WorkDir, "foo", name), []byte(name), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		art.Ordered = true
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		readManifest := func(checksum string) directoryManifest {
+			cachePath, err := cache.PathForChecksum(checksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			man, err := readDirManifest(filepath.Join(dirs.CacheDir, cachePath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return man
+		}
+
+		man := readManifest(art.Checksum)
+		want := []string{"1.txt", "2.txt", "3.txt", "4.txt", "5.txt", "9.txt", "10.txt", "bar"}
+		if diff := cmp.Diff(want, man.Order); diff != "" {
+			t.Fatalf("manifest order -want +got:\n%s", diff)
+		}
+
+		subMan := readManifest(man.Contents["bar"].Checksum)
+		want = []string{"4.txt", "5.txt", "6.txt", "7.txt", "8.txt"}
+		if diff := cmp.Diff(want, subMan.Order); diff != "" {
+			t.Fatalf("sub-directory manifest order -want +got:\n%s", diff)
+		}
+
+		// Committing again must yield the same checksum.
+		checksum := art.Checksum
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+		if art.Checksum != checksum {
+			t.Fatalf("checksum changed from %s to %s", checksum, art.Checksum)
+		}
+	})
+
+	t.Run("checksum doesn't depend on location", func(t *testing.T) {
+		dirs, _, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		arts := []artifact.Artifact{
+			{Path: "a", IsDir: true},
+			{Path: filepath.Join("b", "c"), IsDir: true},
+		}
+		for i := range arts {
+			subDir := filepath.Join(dirs.WorkDir, arts[i].Path, "sub")
+			if err := os.MkdirAll(subDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(subDir, "1.txt"), []byte("1"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cache.Commit(dirs.WorkDir, &arts[i], strategy.LinkStrategy, logger); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if arts[0].Checksum != arts[1].Checksum {
+			t.Fatalf(
+				"identical directories %s and %s have checksums %s and %s",
+				arts[0].Path,
+				arts[1].Path,
+				arts[0].Checksum,
+				arts[1].Checksum,
+			)
+		}
+	})
+
+	t.Run("include and exclude patterns", func(t *testing.T) {
+		dirs, art, cache := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		for _, path := range []string{"foo/9.log", "foo/bar/9.log", "foo/tmp_1.txt"} {
+			if err := os.WriteFile(filepath.Join(dirs.WorkDir, path), []byte(path), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		art.Include = []string{"*.txt"}
+		art.Exclude = []string{"tmp_*", "[4-5].txt"}
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		actualStatus, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStatus := makeExpectedStatus(art)
+		for _, status := range []*artifact.Status{&expectedStatus, expectedStatus.ChildrenStatus["bar"]} {
+			delete(status.ChildrenStatus, "4.txt")
+			delete(status.ChildrenStatus, "5.txt")
+		}
+		expectedStatus.ChildrenStatus["bar"].Include = art.Include
+		expectedStatus.ChildrenStatus["bar"].Exclude = art.Exclude
+
+		assertThenRemoveChecksums(t, &actualStatus)
+
+		if diff := cmp.Diff(expectedStatus, actualStatus); diff != "" {
+			t.Fatalf("Status -want +got:\n%s", diff)
+		}
+
+		// Ignored files are left in the workspace as regular files.
+		fileStatus, err := fsutil.FileStatusFromPath(filepath.Join(dirs.WorkDir, "foo", "9.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileStatus != fsutil.StatusRegularFile {
+			t.Fatalf("got ignored file status %v, want %v", fileStatus, fsutil.StatusRegularFile)
+		}
+	})
+
+	t.Run("ignore cache and metadata directories", func(t *testing.T) {
+		dirs, art, _ := setupDirTest(t)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+
+		// Place the cache inside the directory artifact.
+		cache, err := NewLocalCache(filepath.Join(dirs.WorkDir, "foo", "my_cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadataDir := filepath.Join(dirs.WorkDir, "foo", "bar", ".dud")
+		if err := os.Mkdir(metadataDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(metadataDir, "index"), []byte{}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		actualStatus, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStatus := makeExpectedStatus(art)
+
+		assertThenRemoveChecksums(t, &actualStatus)
+
+		if diff := cmp.Diff(expectedStatus, actualStatus); diff != "" {
+			t.Fatalf("Status -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("refuse symlinks outside the project", func(t *testing.T) {
+		outsideDir := t.TempDir()
+		outsidePath := filepath.Join(outsideDir, "secret.txt")
+		if err := os.WriteFile(outsidePath, []byte("secret"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for name, target := range map[string]string{
+			"absolute": outsidePath,
+			"dangling": filepath.Join(outsideDir, "missing.txt"),
+			"relative": "../../../../../../../../../../../../etc",
+		} {
+			t.Run(name, func(t *testing.T) {
+				dirs, art, cache := setupDirTest(t)
+				defer os.RemoveAll(dirs.CacheDir)
+				defer os.RemoveAll(dirs.WorkDir)
+				linkPath := filepath.Join(dirs.WorkDir, "foo", "bar", "link")
+				if err := os.Symlink(target, linkPath); err != nil {
+					t.Fatal(err)
+				}
+
+				_, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger)
+				var escapeErr SymlinkEscapeError
+				if !errors.As(err, &escapeErr) {
+					t.Fatalf("expected SymlinkEscapeError, got %v", err)
+				}
+			})
+		}
+	})
 }
 
 func assertThenRemoveChecksums(t *testing.T, statusGot *artifact.Status) {
@@ -207,3 +497,80 @@ func setupDirTest(t *testing.T) (testutil.TempDirs, artifact.Artifact, LocalCach
 
 	return dirs, art, cache
 }
+
+func TestStartCommitWorkersLazily(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errGroup, ctx := errgroup.WithContext(context.Background())
+	inputFiles := make(chan os.DirEntry)
+	feedDone := make(chan struct{})
+	moreWorkers := make(chan struct{}, 1)
+	outputArtifacts := make(chan *artifact.Artifact)
+	manifestReady := make(chan struct{})
+	activeSharedWorkers := make(chan struct{}, maxSharedWorkers)
+	spawnerDone := make(chan struct{})
+	go func() {
+		defer close(spawnerDone)
+		startCommitWorkers(
+			ctx,
+			errGroup,
+			cache,
+			workDir,
+			directoryManifest{},
+			artifact.Artifact{IsDir: true},
+			strategy.CopyStrategy,
+			-1,
+			inputFiles,
+			feedDone,
+			moreWorkers,
+			outputArtifacts,
+			manifestReady,
+			activeSharedWorkers,
+			newProgress(progressTemplateDefault, 0, ""),
+			false,
+		)
+	}()
+
+	// Feed the entries like commitDirArtifact does when reading in batches.
+	for _, entry := range entries {
+		select {
+		case inputFiles <- entry:
+		default:
+			select {
+			case moreWorkers <- struct{}{}:
+			default:
+			}
+			inputFiles <- entry
+		}
+		<-outputArtifacts
+	}
+
+	// At most one worker is started per entry, rather than as many as there
+	// are shared worker tokens.
+	if numShared := len(activeSharedWorkers); numShared > len(entries) {
+		t.Fatalf("%d shared workers started for %d entries", numShared, len(entries))
+	}
+
+	close(inputFiles)
+	close(feedDone)
+	close(manifestReady)
+	<-spawnerDone
+	if err := errGroup.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,8 @@ package cache
 import (
 	"bytes"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/kevin-hanselman/dud/src/agglog"
@@ -158,7 +160,7 @@ func TestDirectoryStatusIntegration(t *testing.T) {
 		// Disable recursion so the sub-dir doesn't get committed. Then enable
 		// recursion so status reports the untracked sub-dir.
 		art.DisableRecursion = true
-		err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger)
+		_, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -214,3 +216,55 @@ func TestDirectoryStatusIntegration(t *testing.T) {
 		}
 	})
 }
+
+func TestShallowDirStatus(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	dirs, art, cache := setupDirTest(t)
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+	cache.EnableShallowStatus()
+
+	childPaths := func(t *testing.T) (match bool, paths []string) {
+		status, err := cache.Status(dirs.WorkDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.Shallow {
+			t.Fatal("expected shallow status")
+		}
+		for path := range status.ChildrenStatus {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return status.ContentsMatch, paths
+	}
+
+	// Changes to the contents of files go unnoticed.
+	if err := os.WriteFile(filepath.Join(dirs.WorkDir, "foo", "bar", "8.txt"), []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if match, paths := childPaths(t); !match || len(paths) != 0 {
+		t.Fatalf("got match %v with children %v, want match with no children", match, paths)
+	}
+
+	if err := os.WriteFile(filepath.Join(dirs.WorkDir, "foo", "new.txt"), []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dirs.WorkDir, "foo", "1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	match, paths := childPaths(t)
+	if match {
+		t.Fatal("expected mismatch after adding and removing files")
+	}
+	if diff := cmp.Diff([]string{"1.txt", "new.txt"}, paths); diff != "" {
+		t.Fatalf("children -want +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// EnableDuplicateReport makes Commit report the files in each directory
+// Artifact that have identical contents. See CommitResult.Duplicates.
+func (ch *LocalCache) EnableDuplicateReport() {
+	ch.reportDuplicates = true
+}
+
+// duplicateSets collects the sets of duplicate files found while committing a
+// directory Artifact. Sub-directories are committed concurrently, so all
+// access goes through the mutex.
+type duplicateSets struct {
+	mu   sync.Mutex
+	sets [][]string
+}
+
+// add records the files in the directory at workPath that share a checksum
+// with another file in the same directory, according to the directory's
+// manifest.
+func (dupes *duplicateSets) add(workPath string, manifest *directoryManifest) {
+	byChecksum := make(map[string][]string)
+	for name, art := range manifest.Contents {
+		if art.IsDir {
+			continue
+		}
+		byChecksum[art.Checksum] = append(byChecksum[art.Checksum], filepath.Join(workPath, name))
+	}
+	dupes.mu.Lock()
+	defer dupes.mu.Unlock()
+	for _, paths := range byChecksum {
+		if len(paths) > 1 {
+			dupes.sets = append(dupes.sets, paths)
+		}
+	}
+}
+
+// sorted returns the sets of duplicate files with their paths relative to
+// workspaceDir. The paths in each set are sorted, as are the sets themselves.
+func (dupes *duplicateSets) sorted(workspaceDir string) ([][]string, error) {
+	dupes.mu.Lock()
+	defer dupes.mu.Unlock()
+	out := make([][]string, len(dupes.sets))
+	for i, set := range dupes.sets {
+		out[i] = make([]string, len(set))
+		for j, path := range set {
+			relPath, err := filepath.Rel(workspaceDir, path)
+			if err != nil {
+				return nil, err
+			}
+			out[i][j] = relPath
+		}
+		sort.Strings(out[i])
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i][0] < out[j][0]
+	})
+	return out, nil
+}
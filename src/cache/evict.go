@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/pkg/errors"
+)
+
+// Evict removes the objects of the files in the given Artifacts from the
+// Cache, including the chunks of chunked files and the files in directory
+// Artifacts. Directory and chunk manifests are kept, because they are small
+// and Status needs them to check directory and chunked Artifacts; files are
+// then checked against their checksums directly. Objects that aren't in the
+// Cache are skipped. Evict returns the number of objects removed.
+//
+// Evicted objects can be fetched again from a remote. Any workspace links to
+// them are left dangling, so only evict Artifacts that are checked out as
+// copies.
+func (ch LocalCache) Evict(arts map[string]*artifact.Artifact) (evicted int, err error) {
+	for _, art := range arts {
+		if err := evictArtifact(ch, *art, &evicted); err != nil {
+			return evicted, errors.Wrapf(err, "evict %s", art.Path)
+		}
+	}
+	return evicted, nil
+}
+
+func evictArtifact(ch LocalCache, art artifact.Artifact, evicted *int) error {
+	if art.SkipCache {
+		return nil
+	}
+	status, cachePath, _, err := checksumStatus(ch, art)
+	if err != nil {
+		return err
+	}
+	if !status.HasChecksum || !status.ChecksumInCache {
+		return nil
+	}
+	if art.IsDir {
+		man, err := readDirManifest(filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			return err
+		}
+		for _, childArt := range man.Contents {
+			if err := evictArtifact(ch, *childArt, evicted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if art.Chunked {
+		man, err := readChunkManifest(filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			return err
+		}
+		for _, cksum := range man.Chunks {
+			if err := evictObject(ch, cksum, evicted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return evictObject(ch, art.Checksum, evicted)
+}
+
+// evictObject removes the object with the given checksum. Files with
+// identical contents share an object, so it may already be gone.
+func evictObject(ch LocalCache, cksum string, evicted *int) error {
+	err := ch.RemoveBlob(cksum)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		*evicted++
+	}
+	return err
+}
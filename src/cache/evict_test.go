@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestEvict(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "a",
+		"data/sub/b.txt": "b",
+		"data/sub/c.txt": "a",
+		"foo.txt":        "foo",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arts := map[string]*artifact.Artifact{
+		"data":    {Path: "data", IsDir: true},
+		"foo.txt": {Path: "foo.txt"},
+	}
+	for _, art := range arts {
+		if _, err := cache.Commit(workDir, art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evicted, err := cache.Evict(arts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a.txt and c.txt share an object.
+	if evicted != 3 {
+		t.Fatalf("got %d objects evicted, want 3", evicted)
+	}
+	// Only the manifests of data and data/sub are left.
+	remaining := 0
+	err = cache.WalkBlobs(func(string, string, os.FileInfo) error {
+		remaining++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 2 {
+		t.Fatalf("got %d objects left in cache, want 2", remaining)
+	}
+
+	t.Run("status doesn't re-hash evicted files", func(t *testing.T) {
+		// Evicted objects are expected to be fetched on demand.
+		cache := cache
+		cache.EnableAutoFetch(t.TempDir())
+		// foo.txt still matches its fingerprint.
+		status, err := cache.Status(workDir, *arts["foo.txt"], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected foo.txt to match its checksum, got %s", status)
+		}
+		status, err = cache.Status(workDir, *arts["data"], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(status.MissingChildren()); got != 3 {
+			t.Fatalf("got %d children missing from cache, want 3: %s", got, status)
+		}
+	})
+
+	t.Run("commit restores evicted objects", func(t *testing.T) {
+		art := arts["foo.txt"]
+		if _, err := cache.Commit(workDir, art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		blobPath, err := cache.BlobPath(art.Checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(blobPath); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
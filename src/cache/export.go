@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/pkg/errors"
+)
+
+// ExportPaths rewrites the paths of the entries in an exported archive, like the
+// --strip-components option of tar. The zero value leaves paths unchanged.
+type ExportPaths struct {
+	// StripComponents is the number of leading components removed from the
+	// path of each entry. Entries left with no path are omitted.
+	StripComponents int
+	// Prefix is a relative path prepended to the path of each entry, after
+	// stripping components.
+	Prefix string
+}
+
+// Validate returns an error if the ExportPaths can't be applied.
+func (p ExportPaths) Validate() error {
+	if p.StripComponents < 0 {
+		return errors.Errorf("strip components must not be negative, got %d", p.StripComponents)
+	}
+	prefix := path.Clean(filepath.ToSlash(p.Prefix))
+	if p.Prefix != "" && (path.IsAbs(prefix) || prefix == ".." || strings.HasPrefix(prefix, "../")) {
+		return errors.Errorf("prefix %#v is outside of the archive", p.Prefix)
+	}
+	return nil
+}
+
+// rewrite returns the rewritten form of the slash-separated entry path name.
+// It returns false if the entry should be omitted.
+func (p ExportPaths) rewrite(name string) (string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) <= p.StripComponents {
+		return "", false
+	}
+	name = strings.Join(parts[p.StripComponents:], "/")
+	if p.Prefix != "" {
+		name = path.Join(filepath.ToSlash(p.Prefix), name)
+	}
+	return name, true
+}
+
+// ExportArchive writes a gzipped tar archive of the committed Artifact to w,
+// reading everything from the Cache. The archive holds a single file or
+// directory named after the Artifact, so extracting it reproduces the
+// Artifact without Dud or the Cache. The entries' paths are then rewritten
+// according to paths. All objects the Artifact references must be in the
+// Cache.
+func (ch LocalCache) ExportArchive(art artifact.Artifact, w io.Writer, paths ExportPaths) error {
+	errPrefix := "export " + art.Path
+	if art.SkipCache {
+		return errors.Errorf("%s: artifact isn't stored in the cache", errPrefix)
+	}
+	if err := paths.Validate(); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	// Objects in the cache don't record when their files were modified, so all
+	// files are stamped with the time of the export.
+	modTime := time.Now()
+	if err := exportArtifact(ch, art, filepath.Base(art.Path), paths, modTime, tarWriter); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if err := tarWriter.Close(); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	return errors.Wrap(gzipWriter.Close(), errPrefix)
+}
+
+// exportArtifact writes art to the archive under name, recursing into
+// directory Artifacts. The archive entries are named after name rewritten by
+// paths.
+func exportArtifact(
+	ch LocalCache,
+	art artifact.Artifact,
+	name string,
+	paths ExportPaths,
+	modTime time.Time,
+	tarWriter *tar.Writer,
+) error {
+	status, cachePath, _, err := checksumStatus(ch, art)
+	if err != nil {
+		return err
+	}
+	if !status.HasChecksum {
+		return InvalidChecksumError{art.Checksum}
+	}
+	if !status.ChecksumInCache {
+		return MissingFromCacheError{art.Checksum}
+	}
+	manifestPath := filepath.Join(ch.dir, cachePath)
+	entryName, include := paths.rewrite(name)
+	if art.IsDir {
+		man, err := readDirManifest(manifestPath)
+		if err != nil {
+			return err
+		}
+		if include {
+			header := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     entryName + "/",
+				Mode:     0o755,
+				ModTime:  modTime,
+			}
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+		}
+		childNames := make([]string, 0, len(man.Contents))
+		for childName := range man.Contents {
+			childNames = append(childNames, childName)
+		}
+		sort.Strings(childNames)
+		for _, childName := range childNames {
+			err := exportArtifact(
+				ch,
+				*man.Contents[childName],
+				path.Join(name, childName),
+				paths,
+				modTime,
+				tarWriter,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !include {
+		return nil
+	}
+	blobPaths := []string{manifestPath}
+	if art.Chunked {
+		chunkPaths, err := chunkCachePaths(ch, manifestPath)
+		if err != nil {
+			return err
+		}
+		blobPaths = make([]string, len(chunkPaths))
+		for i, chunkPath := range chunkPaths {
+			blobPaths[i] = filepath.Join(ch.dir, chunkPath)
+		}
+	}
+	var size int64
+	for _, blobPath := range blobPaths {
+		info, err := os.Stat(blobPath)
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entryName,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  modTime,
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	for _, blobPath := range blobPaths {
+		if err := copyFileTo(blobPath, tarWriter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFileTo(path string, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
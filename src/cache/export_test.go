@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestExportArchive(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "a",
+		"data/sub/b.txt": "b",
+		"data/sub/c.txt": "a",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	art := artifact.Artifact{Path: "data", IsDir: true}
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := cache.ExportArchive(art, buf, ExportPaths{}); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := filepath.Join(t.TempDir(), "out")
+	if err := fsutil.ExtractArchive(buf, outDir); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range files {
+		got, err := os.ReadFile(filepath.Join(outDir, path[len("data/"):]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s contains %#v, want %#v", path, string(got), want)
+		}
+	}
+
+	t.Run("rewrites paths", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		paths := ExportPaths{StripComponents: 2, Prefix: "out/v2"}
+		if err := cache.ExportArchive(art, buf, paths); err != nil {
+			t.Fatal(err)
+		}
+		gzipReader, err := gzip.NewReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarReader := tar.NewReader(gzipReader)
+		var names []string
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, header.Name)
+		}
+		want := []string{"out/v2/b.txt", "out/v2/c.txt"}
+		if diff := cmp.Diff(want, names); diff != "" {
+			t.Fatalf("archive entries -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("rejects prefixes outside the archive", func(t *testing.T) {
+		for _, prefix := range []string{"/abs", "..", "../up"} {
+			err := cache.ExportArchive(art, new(bytes.Buffer), ExportPaths{Prefix: prefix})
+			if err == nil {
+				t.Fatalf("expected error for prefix %#v", prefix)
+			}
+		}
+	})
+
+	t.Run("fails on missing objects", func(t *testing.T) {
+		if _, err := cache.Evict(map[string]*artifact.Artifact{"data": &art}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.ExportArchive(art, new(bytes.Buffer), ExportPaths{}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
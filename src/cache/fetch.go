@@ -1,24 +1,58 @@
 package cache
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/pkg/errors"
 )
 
+// IntegrityError is an error case where a file downloaded from a remote cache
+// doesn't match the checksum it was requested by.
+type IntegrityError struct {
+	expected, actual string
+}
+
+func (err IntegrityError) Error() string {
+	return fmt.Sprintf(
+		"integrity check failed: expected checksum %#v, got %#v",
+		err.expected,
+		err.actual,
+	)
+}
+
+// MissingFromRemoteError is an error case where a file requested from a
+// remote cache wasn't there to download.
+type MissingFromRemoteError struct {
+	checksum string
+}
+
+func (err MissingFromRemoteError) Error() string {
+	return fmt.Sprintf("checksum missing from remote: %#v", err.checksum)
+}
+
 // Fetch downloads an Artifact from a remote location to the local cache.
 //
 // This uses a map of Artifacts instead of a slice to ease both testing and
 // calling code. Primarily, a Stage's outputs will be passed to this function,
 // so it's convenient to pass stage.Outputs directly. This also eases testing,
 // because transcribing the map into a slice would introduce non-determinism.
+//
+// Fetch only populates the cache; the workspace is never touched. Directory
+// and chunked Artifacts are fetched along with everything their manifests
+// reference, so a later Checkout can succeed without the remote. Fetch
+// returns a MissingFromRemoteError if the remote doesn't have a file.
 func (ch LocalCache) Fetch(
 	remoteSrc string,
 	artifacts map[string]*artifact.Artifact,
 ) error {
 	fetchFiles := make(map[string]struct{})
 	dirArtifacts := make(map[string]*artifact.Artifact)
+	chunkedArtifacts := make(map[string]*artifact.Artifact)
 	// It's important not to use/assume what the string key in 'artifacts'
 	// represents. Before recursing below, we change the keys to checksums to
 	// prevent Artifacts with the same relative path from clobbering each
@@ -44,6 +78,8 @@ func (ch LocalCache) Fetch(
 		}
 		if art.IsDir {
 			dirArtifacts[cachePath] = art
+		} else if art.Chunked {
+			chunkedArtifacts[cachePath] = art
 		}
 	}
 
@@ -51,9 +87,30 @@ func (ch LocalCache) Fetch(
 	// currently expect remoteCopy not to be called if there's nothing to
 	// fetch.
 	if len(fetchFiles) > 0 {
-		if err := remoteCopy(remoteSrc, ch.dir, fetchFiles); err != nil {
+		if err := fetchVerified(ch, remoteSrc, fetchFiles); err != nil {
 			return errors.Wrap(err, "fetch")
 		}
+		// Some transports (e.g. rclone) skip files the remote doesn't have
+		// without reporting an error.
+		for _, art := range artifacts {
+			if art.SkipCache {
+				continue
+			}
+			cachePath, err := ch.PathForChecksum(art.Checksum)
+			if err != nil {
+				return errors.Wrapf(err, "fetch %s", art.Path)
+			}
+			if _, ok := fetchFiles[cachePath]; !ok {
+				continue
+			}
+			exists, err := fsutil.Exists(filepath.Join(ch.dir, cachePath), false)
+			if err != nil {
+				return errors.Wrapf(err, "fetch %s", art.Path)
+			}
+			if !exists {
+				return errors.Wrapf(MissingFromRemoteError{art.Checksum}, "fetch %s", art.Path)
+			}
+		}
 	}
 
 	children := make(map[string]*artifact.Artifact)
@@ -71,9 +128,94 @@ func (ch LocalCache) Fetch(
 			children[art.Checksum] = art
 		}
 	}
+	// Chunks are fetched like the files of a directory Artifact.
+	for cachePath, chunkedArt := range chunkedArtifacts {
+		man, err := readChunkManifest(filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			return errors.Wrapf(err, "fetch %s", chunkedArt.Path)
+		}
+		for _, cksum := range man.Chunks {
+			children[cksum] = &artifact.Artifact{Checksum: cksum, Path: chunkedArt.Path}
+		}
+	}
 	if len(children) == 0 {
 		return nil
 	}
 	// Don't wrap any error here because we're recursing.
 	return ch.Fetch(remoteSrc, children)
 }
+
+// fetchVerified downloads the given cache files from the remote to a temporary
+// directory in the cache, and only moves each file into place once its
+// contents match the checksum it is stored under. Anything else would be
+// trusted forever, as the cache is content-addressed. Files that fail the
+// check are deleted, and an IntegrityError is returned for the first such
+// file after all other files are moved into place.
+func fetchVerified(ch LocalCache, remoteSrc string, fileSet map[string]struct{}) error {
+	if err := os.MkdirAll(ch.dir, 0o755); err != nil {
+		return err
+	}
+	// Checksums can't contain dots (see PathForChecksum), so this directory
+	// will never collide with a cache path.
+	tempDir, err := os.MkdirTemp(ch.dir, ".fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := remoteCopy(remoteSrc, tempDir, fileSet, ch.bwLimit); err != nil {
+		return err
+	}
+
+	var integrityErr error
+	for cachePath := range fileSet {
+		tempPath := filepath.Join(tempDir, cachePath)
+		expected := strings.Replace(cachePath, string(filepath.Separator), "", 1)
+		actual, err := fileChecksum(ch, tempPath)
+		// Leave it to the caller to handle files the remote didn't have.
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			if integrityErr == nil {
+				integrityErr = errors.Wrap(IntegrityError{expected, actual}, cachePath)
+			}
+			continue
+		}
+		dstPath := filepath.Join(ch.dir, cachePath)
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+			return err
+		}
+		info, err := os.Stat(tempPath)
+		if err != nil {
+			return err
+		}
+		// As in commitBytes, sync the object before renaming it into place,
+		// so a crash can't leave a partial object under the checksum's name.
+		if ch.syncCommits {
+			if err := syncFile(tempPath); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(tempPath, dstPath); err != nil {
+			return err
+		}
+		if ch.syncCommits {
+			if err := syncDir(filepath.Dir(dstPath)); err != nil {
+				return err
+			}
+		}
+		err = ch.recordAudit(AuditRecord{
+			Operation: "fetch",
+			Checksum:  expected,
+			Bytes:     info.Size(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return integrityErr
+}
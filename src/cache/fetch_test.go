@@ -65,7 +65,7 @@ func mkdirsThen(src, dst string, f func(src, dst string) error) error {
 
 // Mock remoteCopy with a version that creates hard links between directories
 // TODO: Consider asserting the number of calls to remoteCopy.
-func mockRemoteCopy(src, dst string, fileSet map[string]struct{}) error {
+func mockRemoteCopy(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
 	for file := range fileSet {
 		if err := mkdirsThen(
 			filepath.Join(src, file),
@@ -86,7 +86,7 @@ func TestFetchIntegration(t *testing.T) {
 	logger := agglog.NewNullLogger()
 
 	remoteCopyOrig := remoteCopy
-	remoteCopyPanic := func(src, dst string, fileSet map[string]struct{}) error {
+	remoteCopyPanic := func(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
 		panic("unexpected call to remoteCopy")
 	}
 	remoteCopy = remoteCopyPanic
@@ -101,6 +101,9 @@ func TestFetchIntegration(t *testing.T) {
 		artStatus := artifact.Status{
 			HasChecksum:         true,
 			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			// The workspace file becomes the remote file, so it must match
+			// the Artifact's checksum.
+			ContentsMatch: true,
 		}
 
 		dirs, art, err := testutil.CreateArtifactTestCase(artStatus)
@@ -139,6 +142,84 @@ func TestFetchIntegration(t *testing.T) {
 		assertCacheDirsEqual(dirs.CacheDir, fakeRemote, t)
 	})
 
+	t.Run("fetch file artifact rejects corrupted download", func(t *testing.T) {
+		defer resetMocks()
+		artStatus := artifact.Status{
+			HasChecksum:         true,
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+		}
+
+		dirs, art, err := testutil.CreateArtifactTestCase(artStatus)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fakeRemote := filepath.Join(dirs.WorkDir, "fake_remote")
+
+		ch, err := NewLocalCache(dirs.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The workspace file doesn't match the Artifact's checksum, so it
+		// stands in for a corrupted file on the remote.
+		artCachePath, err := ch.PathForChecksum(art.Checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mkdirsThen(
+			filepath.Join(dirs.WorkDir, art.Path),
+			filepath.Join(fakeRemote, artCachePath),
+			os.Rename,
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		remoteCopy = mockRemoteCopy
+
+		err = ch.Fetch(fakeRemote, map[string]*artifact.Artifact{"art": &art})
+		if _, ok := errors.Cause(err).(IntegrityError); !ok {
+			t.Fatalf("expected IntegrityError, got %v", err)
+		}
+
+		entries, err := os.ReadDir(dirs.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("expected empty cache, got %v", entries)
+		}
+	})
+
+	t.Run("fetch file artifact returns error if missing from remote", func(t *testing.T) {
+		defer resetMocks()
+		artStatus := artifact.Status{HasChecksum: true}
+
+		dirs, art, err := testutil.CreateArtifactTestCase(artStatus)
+		defer os.RemoveAll(dirs.CacheDir)
+		defer os.RemoveAll(dirs.WorkDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch, err := NewLocalCache(dirs.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Like rclone, skip files missing from the remote without an error.
+		remoteCopy = func(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
+			return nil
+		}
+
+		err = ch.Fetch("/dev/null", map[string]*artifact.Artifact{"art": &art})
+		if !errors.Is(err, MissingFromRemoteError{art.Checksum}) {
+			t.Fatalf("expected MissingFromRemoteError, got %v", err)
+		}
+	})
+
 	t.Run("fetch file artifact noop if already in cache", func(t *testing.T) {
 		defer resetMocks()
 		artStatus := artifact.Status{HasChecksum: true, ChecksumInCache: true}
@@ -194,7 +275,7 @@ func TestFetchIntegration(t *testing.T) {
 
 		fakeRemote := filepath.Join(dirs.WorkDir, "fake_remote")
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -262,7 +343,7 @@ func TestFetchIntegration(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -292,3 +373,48 @@ func TestFetchIntegration(t *testing.T) {
 		assertCacheDirsEqual(dirs.CacheDir, fakeRemote, t)
 	})
 }
+
+func TestFetchSyncedCommits(t *testing.T) {
+	remoteCopyOrig := remoteCopy
+	remoteCopy = mockRemoteCopy
+	defer func() { remoteCopy = remoteCopyOrig }()
+
+	remote, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "foo.txt"}
+	if _, err := remote.Commit(workDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.EnableSyncedCommits()
+	files, dirs := recordSyncs(t) // defined in commit_test.go
+	if err := ch.Fetch(remote.Dir(), map[string]*artifact.Artifact{"foo": &art}); err != nil {
+		t.Fatal(err)
+	}
+
+	blobPath, err := ch.BlobPath(art.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobPath); err != nil {
+		t.Fatal(err)
+	}
+	// The object is synced under its temporary name, before it's renamed
+	// into place.
+	if len(files) != 1 {
+		t.Fatalf("got synced files %v, want the fetched object", files)
+	}
+	if !dirs[filepath.Dir(blobPath)] {
+		t.Fatalf("directory of %s wasn't synced; synced dirs: %v", blobPath, dirs)
+	}
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+)
+
+// findHardlinks returns the groups of entries in the directory at workPath
+// that are hard links to the same file. Files checked out as links to the
+// cache no longer share a file of their own, so entries that are symlinks keep
+// the groups recorded for them in oldManifest.
+func findHardlinks(
+	workPath string,
+	entries []os.DirEntry,
+	oldManifest directoryManifest,
+) ([][]string, error) {
+	var files []string
+	symlinks := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, entry.Name())
+		} else if entry.Type()&os.ModeSymlink != 0 {
+			symlinks[entry.Name()] = true
+		}
+	}
+	groups, err := fsutil.HardlinkGroups(workPath, files)
+	if err != nil {
+		return nil, err
+	}
+	for _, oldGroup := range oldManifest.Hardlinks {
+		var group []string
+		for _, name := range oldGroup {
+			if symlinks[name] {
+				group = append(group, name)
+			}
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups, nil
+}
+
+// consistentHardlinks returns the groups of hard links split by the checksums
+// of the committed files in contents, so that files in a group always have the
+// same contents. Groups left with fewer than two files are dropped.
+func consistentHardlinks(groups [][]string, contents map[string]*artifact.Artifact) [][]string {
+	var out [][]string
+	for _, group := range groups {
+		var checksums []string
+		byChecksum := make(map[string][]string)
+		for _, name := range group {
+			child, ok := contents[name]
+			if !ok || child.IsDir {
+				continue
+			}
+			if _, ok := byChecksum[child.Checksum]; !ok {
+				checksums = append(checksums, child.Checksum)
+			}
+			byChecksum[child.Checksum] = append(byChecksum[child.Checksum], name)
+		}
+		for _, checksum := range checksums {
+			if len(byChecksum[checksum]) > 1 {
+				out = append(out, byChecksum[checksum])
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// linkedHardlinks returns the files in the groups of hard links that are
+// linked to the first file of their group on checkout, rather than being
+// checked out themselves.
+func linkedHardlinks(groups [][]string) map[string]bool {
+	linked := make(map[string]bool)
+	for _, group := range groups {
+		for _, name := range group[1:] {
+			linked[name] = true
+		}
+	}
+	return linked
+}
+
+// checkoutHardlinks links the files in each group of hard links in the
+// directory at workPath to the first file of the group, which must already be
+// checked out. Existing files are only replaced if they have the same contents,
+// or if hard reset is enabled.
+func checkoutHardlinks(ch LocalCache, workPath string, groups [][]string) error {
+	for _, group := range groups {
+		target := filepath.Join(workPath, group[0])
+		for _, name := range group[1:] {
+			linkPath := filepath.Join(workPath, name)
+			exists, err := fsutil.Exists(linkPath, false)
+			if err != nil {
+				return err
+			}
+			if exists && !ch.hardReset {
+				match, err := fsutil.SameContents(linkPath, target)
+				if err != nil {
+					return err
+				}
+				if !match {
+					return &os.PathError{Op: "checkout", Path: linkPath, Err: os.ErrExist}
+				}
+			}
+			if err := fsutil.ReplaceWithLink(target, linkPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestPreserveHardlinks(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := agglog.NewNullLogger()
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "shared",
+		"data/same.txt":  "shared",
+		"data/sub/b.txt": "sub",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"data/c.txt":     "data/a.txt",
+		"data/sub/d.txt": "data/sub/b.txt",
+	}
+	// Hard links are only recorded between files in the same directory, so
+	// this link across directories is committed as a separate file.
+	links["data/sub/e.txt"] = "data/a.txt"
+	for newPath, oldPath := range links {
+		if err := os.Link(filepath.Join(workDir, oldPath), filepath.Join(workDir, newPath)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delete(links, "data/sub/e.txt")
+
+	readManifest := func(checksum string) directoryManifest {
+		cachePath, err := cache.PathForChecksum(checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		man, err := readDirManifest(filepath.Join(cache.Dir(), cachePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return man
+	}
+
+	art := artifact.Artifact{Path: "data", IsDir: true, PreserveHardlinks: true}
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	man := readManifest(art.Checksum)
+	// same.txt has the same contents as a.txt, but isn't a hard link to it.
+	if diff := cmp.Diff([][]string{{"a.txt", "c.txt"}}, man.Hardlinks); diff != "" {
+		t.Fatalf("manifest hard links -want +got:\n%s", diff)
+	}
+	subMan := readManifest(man.Contents["sub"].Checksum)
+	if diff := cmp.Diff([][]string{{"b.txt", "d.txt"}}, subMan.Hardlinks); diff != "" {
+		t.Fatalf("sub-directory manifest hard links -want +got:\n%s", diff)
+	}
+
+	// The files are now links to the cache, but committing again must keep
+	// the hard links and yield the same checksum.
+	checksum := art.Checksum
+	if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	if art.Checksum != checksum {
+		t.Fatalf("checksum changed from %s to %s", checksum, art.Checksum)
+	}
+
+	if err := os.RemoveAll(filepath.Join(workDir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+		t.Fatal(err)
+	}
+	sameFile := func(pathA, pathB string) bool {
+		infoA, err := os.Lstat(filepath.Join(workDir, pathA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infoB, err := os.Lstat(filepath.Join(workDir, pathB))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.SameFile(infoA, infoB)
+	}
+	for newPath, oldPath := range links {
+		if !sameFile(newPath, oldPath) {
+			t.Fatalf("expected %s to be a hard link to %s", newPath, oldPath)
+		}
+	}
+	if sameFile("data/same.txt", "data/a.txt") {
+		t.Fatal("expected data/same.txt to be a separate file")
+	}
+	if sameFile("data/sub/e.txt", "data/a.txt") {
+		t.Fatal("expected data/sub/e.txt to be a separate file")
+	}
+	status, err := cache.Status(workDir, art, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ContentsMatch {
+		t.Fatalf("status = %v, want up-to-date", status)
+	}
+
+	// Copies must also yield the same checksum.
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+	if art.Checksum != checksum {
+		t.Fatalf("checksum changed from %s to %s", checksum, art.Checksum)
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/pkg/errors"
+)
+
+// WriteManifestSidecar writes a human-readable copy of the directory manifests
+// for the given Artifacts to the file at path. The sidecar maps each directory
+// Artifact's path to the checksums of all files it contains, including files
+// in sub-directories, so it can be tracked and reviewed in source control. The
+// sidecar is purely informational; the content-addressed manifests in the
+// Cache remain authoritative. Artifacts that aren't committed directories are
+// ignored. If no Artifacts are committed directories, any existing sidecar at
+// path is removed.
+func (ch LocalCache) WriteManifestSidecar(path string, arts map[string]*artifact.Artifact) error {
+	errPrefix := "write manifest sidecar " + path
+	sidecar := make(map[string]map[string]string)
+	for artPath, art := range arts {
+		if !art.IsDir || art.SkipCache {
+			continue
+		}
+		files := make(map[string]string)
+		if err := ch.flattenDirManifest(art.Checksum, "", files); err != nil {
+			return errors.Wrapf(err, "%s: %s", errPrefix, artPath)
+		}
+		sidecar[artPath] = files
+	}
+	if len(sidecar) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, errPrefix)
+		}
+		return nil
+	}
+	// Map keys are sorted when encoding JSON, so the output is deterministic.
+	out, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	out = append(out, '\n')
+	return errors.Wrap(os.WriteFile(path, out, 0o644), errPrefix)
+}
+
+// flattenDirManifest records the checksum of every file in the directory
+// manifest with the given checksum, recursing into sub-directory manifests.
+// File paths are joined to prefix.
+func (ch LocalCache) flattenDirManifest(checksum, prefix string, files map[string]string) error {
+	cachePath, err := ch.PathForChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	man, err := readDirManifest(filepath.Join(ch.dir, cachePath))
+	if err != nil {
+		return err
+	}
+	for name, child := range man.Contents {
+		childPath := filepath.ToSlash(filepath.Join(prefix, name))
+		if child.IsDir {
+			if err := ch.flattenDirManifest(child.Checksum, childPath, files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[childPath] = child.Checksum
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestWriteManifestSidecar(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger := agglog.NewNullLogger()
+
+	dirs, art, cache := setupDirTest(t)
+	defer os.RemoveAll(dirs.CacheDir)
+	defer os.RemoveAll(dirs.WorkDir)
+
+	if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	fileArt := artifact.Artifact{Path: "foo/1.txt"}
+	sidecarPath := filepath.Join(dirs.WorkDir, "foo.dud.manifest")
+	arts := map[string]*artifact.Artifact{art.Path: &art, fileArt.Path: &fileArt}
+	if err := cache.WriteManifestSidecar(sidecarPath, arts); err != nil {
+		t.Fatal(err)
+	}
+
+	var sidecar map[string]map[string]string
+	sidecarBytes, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(sidecarBytes, &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	wantFiles := []string{
+		"1.txt", "2.txt", "3.txt", "4.txt", "5.txt",
+		"bar/4.txt", "bar/5.txt", "bar/6.txt", "bar/7.txt", "bar/8.txt",
+	}
+	gotFiles := []string{}
+	for path, checksum := range sidecar["foo"] {
+		if checksum == "" {
+			t.Fatalf("empty checksum for %s", path)
+		}
+		gotFiles = append(gotFiles, path)
+	}
+	sort.Strings(gotFiles)
+	if diff := cmp.Diff(wantFiles, gotFiles); diff != "" {
+		t.Fatalf("sidecar files -want +got:\n%s", diff)
+	}
+	if len(sidecar) != 1 {
+		t.Fatalf("sidecar has %d entries, want 1", len(sidecar))
+	}
+	if sidecar["foo"]["4.txt"] != sidecar["foo"]["bar/4.txt"] {
+		t.Fatal("expected files with identical contents to have identical checksums")
+	}
+
+	// Without any directory Artifacts, the sidecar is removed.
+	delete(arts, art.Path)
+	if err := cache.WriteManifestSidecar(sidecarPath, arts); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := fsutil.Exists(sidecarPath, false); err != nil || exists {
+		t.Fatalf("expected sidecar to be removed, exists: %v, err: %v", exists, err)
+	}
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"path/filepath"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Phases of a ProgressEvent.
+const (
+	PhaseCommit   = "commit"
+	PhaseCheckout = "checkout"
+)
+
+// A ProgressEvent reports that Commit or Checkout has finished with a file.
+type ProgressEvent struct {
+	// Phase is PhaseCommit or PhaseCheckout.
+	Phase string
+	// Path is the path of the file, joined to the workspace directory given
+	// to Commit or Checkout.
+	Path string
+	// BytesDone and BytesTotal are the progress of the current Artifact, as
+	// shown by its progress bar. BytesTotal grows as more of the Artifact's
+	// files are discovered. When a directory Artifact is checked out as
+	// links, these count files instead of bytes.
+	BytesDone, BytesTotal int64
+}
+
+// SetProgressEvents makes Commit and Checkout send a ProgressEvent to events
+// for each file they finish with, in addition to updating their progress bars.
+// Sends block, so events must be received from for as long as Commit or
+// Checkout is running. If events is nil, no events are sent.
+func (ch *LocalCache) SetProgressEvents(events chan<- ProgressEvent) {
+	ch.progressEvents = events
+}
+
+// emitProgress sends a ProgressEvent for the file at workspaceDir/path to the
+// channel set with SetProgressEvents, if any.
+func (ch LocalCache) emitProgress(phase, workspaceDir, path string, progress *pb.ProgressBar) {
+	if ch.progressEvents == nil {
+		return
+	}
+	ch.progressEvents <- ProgressEvent{
+		Phase:      phase,
+		Path:       filepath.Join(workspaceDir, path),
+		BytesDone:  progress.Current(),
+		BytesTotal: progress.Total(),
+	}
+}
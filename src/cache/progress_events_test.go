@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestProgressEvents(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	files := map[string]string{
+		"data/a.txt":     "a",
+		"data/b.txt":     "bb",
+		"data/sub/c.txt": "ccc",
+	}
+	for path, contents := range files {
+		path = filepath.Join(workDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Buffer enough events that nothing needs to receive them concurrently.
+	events := make(chan ProgressEvent, 10)
+	cache.SetProgressEvents(events)
+	collect := func(wantPhase string) (paths []string, last ProgressEvent) {
+		t.Helper()
+		for len(events) > 0 {
+			event := <-events
+			if event.Phase != wantPhase {
+				t.Fatalf("got phase %#v, want %#v", event.Phase, wantPhase)
+			}
+			rel, err := filepath.Rel(workDir, event.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, rel)
+			if event.BytesDone > last.BytesDone {
+				last = event
+			}
+		}
+		sort.Strings(paths)
+		return
+	}
+	wantPaths := []string{"data/a.txt", "data/b.txt", "data/sub/c.txt"}
+
+	art := artifact.Artifact{Path: "data", IsDir: true}
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+	paths, last := collect(PhaseCommit)
+	if diff := cmp.Diff(wantPaths, paths); diff != "" {
+		t.Fatalf("commit event paths -want +got:\n%s", diff)
+	}
+	if last.BytesDone != 6 || last.BytesTotal != 6 {
+		t.Fatalf("last commit event = %+v, want 6 of 6 bytes done", last)
+	}
+
+	if err := os.RemoveAll(filepath.Join(workDir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+		t.Fatal(err)
+	}
+	paths, last = collect(PhaseCheckout)
+	if diff := cmp.Diff(wantPaths, paths); diff != "" {
+		t.Fatalf("checkout event paths -want +got:\n%s", diff)
+	}
+	if last.BytesDone != 6 || last.BytesTotal != 6 {
+		t.Fatalf("last checkout event = %+v, want 6 of 6 bytes done", last)
+	}
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
@@ -10,7 +11,10 @@ import (
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/mattn/go-isatty"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 // Push uploads an Artifact from the local cache to a remote cache.
@@ -31,7 +35,7 @@ func (ch LocalCache) Push(remoteDst string, arts map[string]*artifact.Artifact)
 	}
 	progress.Finish()
 	if len(pushFiles) > 0 {
-		return errors.Wrap(remoteCopy(ch.dir, remoteDst, pushFiles), "push")
+		return errors.Wrap(remoteCopy(ch.dir, remoteDst, pushFiles, ch.bwLimit), "push")
 	}
 	return nil
 }
@@ -65,21 +69,72 @@ func gatherFilesToPush(
 				return err
 			}
 		}
+	} else if art.Chunked {
+		chunkPaths, err := chunkCachePaths(ch, filepath.Join(ch.dir, cachePath))
+		if err != nil {
+			return err
+		}
+		for _, chunkPath := range chunkPaths {
+			progress.Increment()
+			filesToPush[chunkPath] = struct{}{}
+		}
 	}
 	progress.Increment()
 	filesToPush[cachePath] = struct{}{}
 	return nil
 }
 
-var remoteCopy = func(src, dst string, fileSet map[string]struct{}) error {
-	cmd := exec.Command(
-		"rclone",
+// remoteCopy copies the given files from src to dst. If bwLimit is positive,
+// the combined transfer rate of all files is capped at bwLimit bytes per
+// second.
+var remoteCopy = func(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
+	// Absolute paths can't be rclone remotes, which always start with the
+	// name of the remote (e.g. "s3:dud"), so such remotes are local
+	// directories (e.g. a cache created with 'dud init --bare'). These are
+	// copied directly, so they work without rclone.
+	var err error
+	if filepath.IsAbs(src) && filepath.IsAbs(dst) {
+		err = localCopy(src, dst, fileSet, bwLimit)
+	} else {
+		err = rcloneCopy(src, dst, fileSet, bwLimit)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Ensure any local files that were created end up as read-only. Try to
+	// chmod all files, ignoring "no such file" errors which are probably due
+	// to the destination being remote. This is important even for push,
+	// because the "remote" might be a local directory.
+	return setFilePerms(dst, fileSet, cacheFilePerms)
+}
+
+func rcloneCopy(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
+	// rclone reports the bytes transferred, the transfer rate, and the ETA.
+	// Without a terminal to render its progress report, have rclone log the
+	// same stats periodically instead.
+	progressArgs := []string{"--progress"}
+	if !isatty.IsTerminal(os.Stderr.Fd()) {
+		progressArgs = []string{
+			"--stats",
+			transferLogInterval.String(),
+			"--stats-one-line",
+			"--stats-log-level",
+			"NOTICE",
+		}
+	}
+	args := append([]string{
 		"--config",
 		".dud/rclone.conf",
+	}, progressArgs...)
+	if bwLimit > 0 {
+		// rclone applies the limit to all of its transfers combined.
+		args = append(args, "--bwlimit", fmt.Sprintf("%dB", bwLimit))
+	}
+	args = append(args,
 		// Ideally these sorts of flags could be added to the rclone config,
 		// but I haven't found a way to add them.
 		// See: https://github.com/rclone/rclone/issues/2697
-		"--progress",
 		"--immutable",
 		// If file modification times change locally, without "--size-only",
 		// rclone will error-out because of the "--immutable" flag above.
@@ -91,6 +146,7 @@ var remoteCopy = func(src, dst string, fileSet map[string]struct{}) error {
 		src,
 		dst,
 	)
+	cmd := exec.Command("rclone", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	stdin, err := cmd.StdinPipe()
@@ -111,15 +167,84 @@ var remoteCopy = func(src, dst string, fileSet map[string]struct{}) error {
 		}
 	}()
 
-	if err := cmd.Wait(); err != nil {
-		return err
+	return cmd.Wait()
+}
+
+// localCopy copies the given files from one local directory to another. Like
+// rcloneCopy, files that already exist in the destination are left alone, as
+// cache files are immutable. Each file is written to a temporary file first,
+// so an interrupted copy never leaves a partial file in the destination. As
+// with rcloneCopy, bwLimit caps the combined rate of all concurrent copies.
+func localCopy(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
+	// Sum the sizes of all files to copy up front, so the progress report
+	// has a total to estimate the remaining time from.
+	var totalBytes int64
+	copyFiles := make([]string, 0, len(fileSet))
+	for file := range fileSet {
+		exists, err := fsutil.Exists(filepath.Join(dst, file), false)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(src, file))
+		if err != nil {
+			return errors.Wrapf(err, "copy %s", file)
+		}
+		totalBytes += info.Size()
+		copyFiles = append(copyFiles, file)
+	}
+	if len(copyFiles) == 0 {
+		return nil
 	}
 
-	// Ensure any local files that were created end up as read-only. Try to
-	// chmod all files, ignoring "no such file" errors which are probably due
-	// to the destination being remote. This is important even for push,
-	// because the "remote" might be a local directory.
-	return setFilePerms(dst, fileSet, cacheFilePerms)
+	progress, stopProgress := newTransferProgress(totalBytes, "Copying files")
+	defer stopProgress()
+	limiter := newBandwidthLimiter(bwLimit)
+	var errGroup errgroup.Group
+	errGroup.SetLimit(maxSharedWorkers)
+	for _, file := range copyFiles {
+		file := file
+		errGroup.Go(func() error {
+			err := copyFileAtomic(
+				filepath.Join(src, file),
+				filepath.Join(dst, file),
+				progress,
+				limiter,
+			)
+			return errors.Wrapf(err, "copy %s", file)
+		})
+	}
+	return errGroup.Wait()
+}
+
+func copyFileAtomic(
+	srcPath, dstPath string,
+	progress *pb.ProgressBar,
+	limiter *bandwidthLimiter,
+) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(dstPath), ".copy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err := io.Copy(tempFile, limiter.reader(progress.NewProxyReader(srcFile))); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), dstPath)
 }
 
 func setFilePerms(commonDir string, fileSet map[string]struct{}, mode fs.FileMode) error {
@@ -22,7 +22,7 @@ func TestPushIntegration(t *testing.T) {
 	logger := agglog.NewNullLogger()
 
 	remoteCopyOrig := remoteCopy
-	remoteCopyPanic := func(src, dst string, fileSet map[string]struct{}) error {
+	remoteCopyPanic := func(src, dst string, fileSet map[string]struct{}, bwLimit int64) error {
 		panic("unexpected call to remoteCopy")
 	}
 	remoteCopy = remoteCopyPanic
@@ -121,7 +121,7 @@ func TestPushIntegration(t *testing.T) {
 		defer os.RemoveAll(dirs.CacheDir)
 		defer os.RemoveAll(dirs.WorkDir)
 
-		if err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
+		if _, err := cache.Commit(dirs.WorkDir, &art, strategy.LinkStrategy, logger); err != nil {
 			t.Fatal(err)
 		}
 
@@ -141,3 +141,57 @@ func TestPushIntegration(t *testing.T) {
 		assertCacheDirsEqual(dirs.CacheDir, fakeRemote, t)
 	})
 }
+
+func TestLocalCopy(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	files := map[string]string{
+		filepath.Join("ab", "cdef"): "new",
+		filepath.Join("12", "3456"): "existing",
+	}
+	for file, contents := range files {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(file)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, file), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	existingPath := filepath.Join(dst, "12", "3456")
+	if err := os.MkdirAll(filepath.Dir(existingPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existingPath, []byte("untouched"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileSet := make(map[string]struct{})
+	for file := range files {
+		fileSet[file] = struct{}{}
+	}
+	if err := localCopy(src, dst, fileSet, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		filepath.Join("ab", "cdef"): "new",
+		filepath.Join("12", "3456"): "untouched",
+	}
+	for file, contents := range want {
+		got, err := os.ReadFile(filepath.Join(dst, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != contents {
+			t.Fatalf("%s contains %#v, want %#v", file, string(got), contents)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dst, "ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected no temporary files to remain, got %v", entries)
+	}
+}
@@ -2,12 +2,12 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 
 	"github.com/kevin-hanselman/dud/src/artifact"
-	"github.com/kevin-hanselman/dud/src/checksum"
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -22,7 +22,9 @@ func (ch LocalCache) Status(workspaceDir string, art artifact.Artifact, shortCir
 	status artifact.Status,
 	err error,
 ) {
-	if art.IsDir {
+	if art.IsDir && ch.shallowStatus {
+		status, err = shallowDirStatus(ch, workspaceDir, art)
+	} else if art.IsDir {
 		activeSharedWorkers := make(chan struct{}, maxSharedWorkers)
 		status, err = dirArtifactStatus(
 			context.Background(),
@@ -34,13 +36,36 @@ func (ch LocalCache) Status(workspaceDir string, art artifact.Artifact, shortCir
 		)
 	} else {
 		status, err = fileArtifactStatus(ch, workspaceDir, art)
+		if err == nil && isPinned(status) {
+			// The checksum was set without committing the file (e.g. by 'dud
+			// stage set-checksum'), so compare the workspace file to it
+			// directly.
+			workPath := filepath.Join(ch.canonicalDir(workspaceDir), art.Path)
+			status.ContentsMatch, err = matchesChecksum(ch, workPath, art.Checksum)
+		}
 	}
 	err = errors.Wrapf(err, "status %s", art.Path)
 	return
 }
 
-// checksumStatus populates the HasChecksum and ChecksumInCache fields of
-// artifact.Status and returns any relevant cache file information.
+// isPinned returns true if status describes a regular file whose checksum is
+// missing from the cache and has no fingerprint, which is how 'dud stage
+// set-checksum' leaves an Artifact. Commit usually records a fingerprint for
+// top-level files (see committedFingerprint), so few committed files are
+// re-hashed. Files in directory manifests never have fingerprints, so it's only
+// used for top-level file Artifacts.
+func isPinned(status artifact.Status) bool {
+	return status.HasChecksum &&
+		!status.ChecksumInCache &&
+		!status.SkipCache &&
+		!status.ContentsMatch &&
+		status.Fingerprint == "" &&
+		status.WorkspaceFileStatus == fsutil.StatusRegularFile
+}
+
+// checksumStatus populates the HasChecksum, ChecksumMalformed, and
+// ChecksumInCache fields of artifact.Status and returns any relevant cache
+// file information.
 func checksumStatus(ch LocalCache, art artifact.Artifact) (
 	status artifact.Status,
 	cachePath string,
@@ -51,6 +76,9 @@ func checksumStatus(ch LocalCache, art artifact.Artifact) (
 	if _, ok := err.(InvalidChecksumError); ok {
 		err = nil
 		status.HasChecksum = false
+		// An empty checksum means the Artifact was never committed. Anything
+		// else means the checksum was corrupted.
+		status.ChecksumMalformed = art.Checksum != ""
 		return
 	}
 	if err != nil {
@@ -87,7 +115,7 @@ var quickStatus = func(
 	}
 	status.Artifact = art
 
-	workPath = filepath.Join(workspaceDir, art.Path)
+	workPath = filepath.Join(ch.canonicalDir(workspaceDir), art.Path)
 	status.WorkspaceFileStatus, err = fsutil.FileStatusFromPath(workPath)
 	if err != nil {
 		return
@@ -124,30 +152,70 @@ func fileArtifactStatus(
 		return status, nil
 	}
 
-	if art.SkipCache {
-		if !status.HasChecksum {
-			return status, nil
-		}
-		fileReader, err := os.Open(workPath)
-		if err != nil {
-			return status, err
-		}
-		defer fileReader.Close()
-		workspaceFileChecksum, err := checksum.Checksum(fileReader)
+	if !status.HasChecksum {
+		return status, nil
+	}
+	if art.Fingerprint != "" {
+		info, err := os.Lstat(workPath)
 		if err != nil {
 			return status, err
 		}
-		status.ContentsMatch = workspaceFileChecksum == art.Checksum
-	} else {
-		if !status.ChecksumInCache {
+		if fileFingerprint(info, art.Checksum) == art.Fingerprint {
+			status.ContentsMatch = true
 			return status, nil
 		}
-		status.ContentsMatch, err = fsutil.SameContents(workPath, cachePath)
-		if err != nil {
-			return status, err
-		}
 	}
-	return status, nil
+	if art.Chunked && !art.SkipCache && status.ChecksumInCache {
+		status.ContentsMatch, err = chunkedContentsMatch(ch, workPath, cachePath)
+		return status, err
+	}
+	if art.SkipCache {
+		// Without a file in the cache, compare the workspace file to the
+		// checksum directly.
+		status.ContentsMatch, err = matchesChecksum(ch, workPath, art.Checksum)
+		return status, err
+	}
+	if !status.ChecksumInCache {
+		// Re-hashing every file whose object isn't cached (e.g. all of them
+		// with a remote primary cache) would make status as slow as commit.
+		// See isPinned for the exception.
+		return status, nil
+	}
+	status.ContentsMatch, err = fsutil.SameContents(workPath, cachePath)
+	return status, err
+}
+
+// fingerprintChecksumLen is the number of leading characters of the checksum
+// recorded in a fingerprint.
+const fingerprintChecksumLen = 16
+
+// fileFingerprint returns a string identifying the size and modification time
+// of a file, tied to the checksum of its contents. Because the checksum is
+// part of the fingerprint, a fingerprint stops matching once the Artifact's
+// checksum is changed by any means other than committing the file (e.g. by
+// 'dud stage set-checksum'). See artifact.Artifact.Fingerprint.
+func fileFingerprint(info os.FileInfo, cksum string) string {
+	if len(cksum) > fingerprintChecksumLen {
+		cksum = cksum[:fingerprintChecksumLen]
+	}
+	return fmt.Sprintf("%d-%d-%s", info.Size(), info.ModTime().UnixNano(), cksum)
+}
+
+func matchesChecksum(ch LocalCache, path, expected string) (bool, error) {
+	cksum, err := fileChecksum(ch, path)
+	if err != nil {
+		return false, err
+	}
+	return cksum == expected, nil
+}
+
+func fileChecksum(ch LocalCache, path string) (string, error) {
+	fileReader, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fileReader.Close()
+	return ch.checksumReader(fileReader)
 }
 
 func dirArtifactStatus(
@@ -181,6 +249,13 @@ func dirArtifactStatus(
 	// First, ensure all artifacts in the directoryManifest are up-to-date.
 	if status.ChecksumInCache {
 		manifest, err = readDirManifest(cachePath)
+		var corruptErr CorruptManifestError
+		if ch.reportCorruptManifests && errors.As(err, &corruptErr) {
+			status.ManifestCorrupt = true
+			status.ContentsMatch = false
+			status.ChildrenStatus = nil
+			return status, nil
+		}
 		if err != nil {
 			return status, err
 		}
@@ -210,14 +285,19 @@ func dirArtifactStatus(
 	}
 
 	// Second, get a directory listing and check for untracked files.
-	entries, err := readDir(workPath, art.DisableRecursion)
+	entries, err := readDir(ch, workPath, art)
 	if err != nil {
 		return status, err
 	}
 	children := make([]*artifact.Artifact, 0, len(entries))
 
 	for _, entry := range entries {
-		newArt := artifact.Artifact{Path: entry.Name(), IsDir: entry.IsDir()}
+		newArt := artifact.Artifact{
+			Path:    entry.Name(),
+			IsDir:   entry.IsDir(),
+			Include: art.Include,
+			Exclude: art.Exclude,
+		}
 		// Ignore all entries in the manifest; we've already checked them
 		// above. (While assigning to a nil map panics, accessing a nil map is
 		// safe.)
@@ -248,6 +328,78 @@ func dirArtifactStatus(
 	return status, err
 }
 
+// shallowDirStatus compares the entries of a directory Artifact with the
+// entries in its manifest by name and file type only. See
+// EnableShallowStatus.
+func shallowDirStatus(
+	ch LocalCache,
+	workspaceDir string,
+	art artifact.Artifact,
+) (artifact.Status, error) {
+	status, cachePath, workPath, err := quickStatus(ch, workspaceDir, art)
+	if err != nil {
+		return status, err
+	}
+	// Without a manifest there's nothing to compare against.
+	if !status.HasChecksum || !status.ChecksumInCache {
+		activeSharedWorkers := make(chan struct{}, maxSharedWorkers)
+		return dirArtifactStatus(
+			context.Background(),
+			ch,
+			workspaceDir,
+			art,
+			false,
+			activeSharedWorkers,
+		)
+	}
+	if status.WorkspaceFileStatus != fsutil.StatusDirectory {
+		return status, nil
+	}
+	manifest, err := readDirManifest(filepath.Join(ch.dir, cachePath))
+	var corruptErr CorruptManifestError
+	if ch.reportCorruptManifests && errors.As(err, &corruptErr) {
+		status.ManifestCorrupt = true
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	entries, err := readDir(ch, workPath, art)
+	if err != nil {
+		return status, err
+	}
+
+	status.Shallow = true
+	status.ChildrenStatus = make(map[string]*artifact.Status)
+	listed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		listed[entry.Name()] = true
+		childArt, ok := manifest.Contents[entry.Name()]
+		if !ok {
+			childArt = &artifact.Artifact{Path: entry.Name(), IsDir: entry.IsDir()}
+		} else if entry.IsDir() == childArt.IsDir {
+			continue
+		}
+		childStatus, _, _, err := quickStatus(ch, workPath, *childArt)
+		if err != nil {
+			return status, err
+		}
+		status.ChildrenStatus[childArt.Path] = &childStatus
+	}
+	for name, childArt := range manifest.Contents {
+		if listed[name] {
+			continue
+		}
+		childStatus, _, _, err := quickStatus(ch, workPath, *childArt)
+		if err != nil {
+			return status, err
+		}
+		status.ChildrenStatus[name] = &childStatus
+	}
+	status.ContentsMatch = len(status.ChildrenStatus) == 0
+	return status, nil
+}
+
 type shortCircuited struct{}
 
 func (c shortCircuited) Error() string {
@@ -287,7 +439,16 @@ func concurrentStatus(
 			select {
 			case childStatus := <-results:
 				status.ChildrenStatus[childStatus.Path] = childStatus
-				status.ContentsMatch = status.ContentsMatch && childStatus.ContentsMatch
+				// A child missing from the cache can't be checked out, even if
+				// its workspace file matches its checksum, unless it can be
+				// fetched on demand.
+				missingFromCache := childStatus.HasChecksum &&
+					!childStatus.ChecksumInCache &&
+					!childStatus.SkipCache &&
+					ch.autoFetchRemote == ""
+				status.ContentsMatch = status.ContentsMatch &&
+					childStatus.ContentsMatch &&
+					!missingFromCache
 				if shortCircuit && !status.ContentsMatch {
 					return shortCircuited{}
 				}
@@ -3,11 +3,17 @@ package cache
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/kevin-hanselman/dud/src/testutil"
+	"github.com/pkg/errors"
 )
 
 func TestStatusIntegration(t *testing.T) {
@@ -43,3 +49,236 @@ func testStatusIntegration(statusWant artifact.Status, t *testing.T) {
 		t.Fatalf("Status() -want +got:\n%s", diff)
 	}
 }
+
+func TestStatusMalformedChecksum(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+
+	for _, checksum := range []string{"", "ab"} {
+		art := artifact.Artifact{Path: "foo.bin", Checksum: checksum}
+
+		statusGot, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statusWant := artifact.Status{
+			Artifact:          art,
+			ChecksumMalformed: checksum != "",
+		}
+		if diff := cmp.Diff(statusWant, statusGot); diff != "" {
+			t.Fatalf("Status(%#v) -want +got:\n%s", checksum, diff)
+		}
+	}
+}
+
+func TestStatusCorruptManifest(t *testing.T) {
+	cache, err := NewLocalCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(workDir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "data", "foo.txt"), []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	art := artifact.Artifact{Path: "data", IsDir: true}
+	if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate the directory manifest.
+	manifestPath, err := cache.BlobPath(art.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(manifestPath, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifestPath, []byte(`{"Contents": {`), 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("error by default", func(t *testing.T) {
+		_, err := cache.Status(workDir, art, false)
+		var corruptErr CorruptManifestError
+		if !errors.As(err, &corruptErr) {
+			t.Fatalf("expected CorruptManifestError, got %v", err)
+		}
+	})
+
+	t.Run("reported in status", func(t *testing.T) {
+		cache := cache
+		cache.EnableCorruptManifestStatus()
+		statusGot, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statusWant := artifact.Status{
+			Artifact:            art,
+			WorkspaceFileStatus: fsutil.StatusDirectory,
+			HasChecksum:         true,
+			ChecksumInCache:     true,
+			ManifestCorrupt:     true,
+		}
+		if diff := cmp.Diff(statusWant, statusGot); diff != "" {
+			t.Fatalf("Status -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("repaired by commit", func(t *testing.T) {
+		// Use a new LocalCache, as this one remembers committing the
+		// manifest.
+		cache, err := NewLocalCache(cache.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		status, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.ContentsMatch {
+			t.Fatalf("expected up-to-date status, got %s", status)
+		}
+	})
+}
+
+func TestStatusFingerprint(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	setup := func(t *testing.T) (cache LocalCache, workDir, workPath string) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		workDir = t.TempDir()
+		workPath = filepath.Join(workDir, "foo.txt")
+		if err := os.WriteFile(workPath, []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	setModTime := func(t *testing.T, path string, modTime time.Time) {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit := func(t *testing.T, cache LocalCache, workDir string, strat strategy.CheckoutStrategy) artifact.Artifact {
+		art := artifact.Artifact{Path: "foo.txt"}
+		if _, err := cache.Commit(workDir, &art, strat, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		return art
+	}
+
+	contentsMatch := func(t *testing.T, cache LocalCache, workDir string, art artifact.Artifact) bool {
+		status, err := cache.Status(workDir, art, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.ContentsMatch
+	}
+
+	t.Run("matching fingerprint skips reading the file", func(t *testing.T) {
+		cache, workDir, workPath := setup(t)
+		modTime := time.Now().Add(-time.Hour)
+		setModTime(t, workPath, modTime)
+		art := commit(t, cache, workDir, strategy.CopyStrategy)
+		if art.Fingerprint == "" {
+			t.Fatal("expected fingerprint to be recorded")
+		}
+
+		// Change the contents, but not the size or modification time.
+		if err := os.WriteFile(workPath, []byte("bar"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		setModTime(t, workPath, modTime)
+		if !contentsMatch(t, cache, workDir, art) {
+			t.Fatal("expected fingerprint to match")
+		}
+
+		// Once the modification time changes, the contents are compared.
+		setModTime(t, workPath, modTime.Add(time.Minute))
+		if contentsMatch(t, cache, workDir, art) {
+			t.Fatal("expected out-of-date status")
+		}
+	})
+
+	t.Run("fingerprint matches but checksum changed", func(t *testing.T) {
+		cache, workDir, workPath := setup(t)
+		setModTime(t, workPath, time.Now().Add(-time.Hour))
+		art := commit(t, cache, workDir, strategy.CopyStrategy)
+		if art.Fingerprint == "" {
+			t.Fatal("expected fingerprint to be recorded")
+		}
+
+		// Point the Artifact at other contents, as 'stage set-checksum' does,
+		// without touching the workspace file.
+		otherDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(otherDir, "foo.txt"), []byte("bar"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		art.Checksum = commit(t, cache, otherDir, strategy.CopyStrategy).Checksum
+		if contentsMatch(t, cache, workDir, art) {
+			t.Fatal("expected out-of-date status")
+		}
+	})
+
+	t.Run("stale fingerprint falls back to comparing contents", func(t *testing.T) {
+		cache, workDir, workPath := setup(t)
+		setModTime(t, workPath, time.Now().Add(-time.Hour))
+		art := commit(t, cache, workDir, strategy.CopyStrategy)
+		setModTime(t, workPath, time.Now())
+		if !contentsMatch(t, cache, workDir, art) {
+			t.Fatal("expected up-to-date status")
+		}
+	})
+
+	t.Run("files missing from the cache are only hashed if pinned", func(t *testing.T) {
+		cache, workDir, workPath := setup(t)
+		setModTime(t, workPath, time.Now().Add(-time.Hour))
+		art := commit(t, cache, workDir, strategy.CopyStrategy)
+		if err := cache.RemoveBlob(art.Checksum); err != nil {
+			t.Fatal(err)
+		}
+		setModTime(t, workPath, time.Now())
+		if contentsMatch(t, cache, workDir, art) {
+			t.Fatal("expected committed file to be reported missing from cache")
+		}
+
+		// Without a fingerprint, as 'stage set-checksum' leaves it.
+		art.Fingerprint = ""
+		if !contentsMatch(t, cache, workDir, art) {
+			t.Fatal("expected pinned file to match its checksum")
+		}
+	})
+
+	t.Run("recently modified files have no fingerprint", func(t *testing.T) {
+		cache, workDir, _ := setup(t)
+		art := commit(t, cache, workDir, strategy.CopyStrategy)
+		if art.Fingerprint != "" {
+			t.Fatalf("got fingerprint %#v, want none", art.Fingerprint)
+		}
+	})
+
+	t.Run("linked files have no fingerprint", func(t *testing.T) {
+		cache, workDir, workPath := setup(t)
+		setModTime(t, workPath, time.Now().Add(-time.Hour))
+		art := commit(t, cache, workDir, strategy.LinkStrategy)
+		if art.Fingerprint != "" {
+			t.Fatalf("got fingerprint %#v, want none", art.Fingerprint)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SyncResult describes the outcome of SyncCaches.
+type SyncResult struct {
+	// Copied is the number of objects copied to the destination cache.
+	Copied int
+	// Deleted is the number of objects deleted from the destination cache.
+	Deleted int
+}
+
+// SyncCaches copies all objects in the src Cache that are missing from the dst
+// Cache. Objects are matched by their checksums, so objects already in dst
+// are never copied again. If verify is true, each object is checksummed
+// after it's copied, and objects that don't match their checksums are
+// discarded, as in Fetch. If deleteExtra is true, objects in dst that aren't
+// in src are deleted, so that dst ends up with exactly the objects in src.
+func SyncCaches(src, dst LocalCache, verify, deleteExtra bool) (result SyncResult, err error) {
+	errPrefix := "sync " + src.dir + " to " + dst.dir
+	// WalkBlobs treats a missing cache as empty, which would make deleteExtra
+	// empty the destination.
+	if _, err := os.Stat(src.dir); err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+	srcBlobs, err := blobCachePaths(src)
+	if err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+	dstBlobs, err := blobCachePaths(dst)
+	if err != nil {
+		return result, errors.Wrap(err, errPrefix)
+	}
+
+	copyFiles := make(map[string]struct{})
+	for cksum, cachePath := range srcBlobs {
+		if _, ok := dstBlobs[cksum]; !ok {
+			copyFiles[cachePath] = struct{}{}
+		}
+	}
+	if len(copyFiles) > 0 {
+		if err := os.MkdirAll(dst.dir, 0o755); err != nil {
+			return result, errors.Wrap(err, errPrefix)
+		}
+		if verify {
+			err = fetchVerified(dst, src.dir, copyFiles)
+		} else {
+			err = remoteCopy(src.dir, dst.dir, copyFiles, dst.bwLimit)
+		}
+		if err != nil {
+			return result, errors.Wrap(err, errPrefix)
+		}
+		result.Copied = len(copyFiles)
+	}
+
+	if !deleteExtra {
+		return result, nil
+	}
+	for cksum, cachePath := range dstBlobs {
+		if _, ok := srcBlobs[cksum]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dst.dir, cachePath)); err != nil {
+			return result, errors.Wrap(err, errPrefix)
+		}
+		result.Deleted++
+	}
+	return result, nil
+}
+
+// blobCachePaths returns the paths of all objects in the Cache relative to
+// the cache directory, keyed by checksum.
+func blobCachePaths(ch LocalCache) (map[string]string, error) {
+	paths := make(map[string]string)
+	err := ch.WalkBlobs(func(cksum, path string, _ os.FileInfo) error {
+		cachePath, err := filepath.Rel(ch.dir, path)
+		paths[cksum] = cachePath
+		return err
+	})
+	return paths, err
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/checksum"
+)
+
+func TestSyncCaches(t *testing.T) {
+	// addBlob adds an object with the given contents to the cache and returns
+	// its path. If cksum is empty, the object is stored under the checksum of
+	// its contents.
+	addBlob := func(t *testing.T, ch LocalCache, contents, cksum string) string {
+		if cksum == "" {
+			var err error
+			cksum, err = checksumString(contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		path, err := ch.BlobPath(cksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o444); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	setup := func(t *testing.T) (src, dst LocalCache) {
+		src, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err = NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		addBlob(t, src, "shared", "")
+		addBlob(t, dst, "shared", "")
+		addBlob(t, src, "new", "")
+		addBlob(t, dst, "extra", "")
+		return
+	}
+
+	listBlobs := func(t *testing.T, ch LocalCache) map[string]string {
+		blobs, err := blobCachePaths(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blobs
+	}
+
+	t.Run("copies missing objects", func(t *testing.T) {
+		src, dst := setup(t)
+
+		result, err := SyncCaches(src, dst, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(SyncResult{Copied: 1}, result); diff != "" {
+			t.Fatalf("SyncResult -want +got:\n%s", diff)
+		}
+		srcBlobs, dstBlobs := listBlobs(t, src), listBlobs(t, dst)
+		for cksum := range srcBlobs {
+			if _, ok := dstBlobs[cksum]; !ok {
+				t.Fatalf("object %s not copied", cksum)
+			}
+		}
+		if len(dstBlobs) != 3 {
+			t.Fatalf("got %d objects in destination, want 3", len(dstBlobs))
+		}
+	})
+
+	t.Run("deletes extra objects", func(t *testing.T) {
+		src, dst := setup(t)
+
+		result, err := SyncCaches(src, dst, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(SyncResult{Copied: 1, Deleted: 1}, result); diff != "" {
+			t.Fatalf("SyncResult -want +got:\n%s", diff)
+		}
+		if diff := cmp.Diff(listBlobs(t, src), listBlobs(t, dst)); diff != "" {
+			t.Fatalf("objects -src +dst:\n%s", diff)
+		}
+	})
+
+	t.Run("rejects corrupted objects when verifying", func(t *testing.T) {
+		src, dst := setup(t)
+		badChecksum, err := checksumString("expected")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addBlob(t, src, "corrupted", badChecksum)
+
+		_, err = SyncCaches(src, dst, true, false)
+
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if _, ok := listBlobs(t, dst)[badChecksum]; ok {
+			t.Fatal("corrupted object copied to destination")
+		}
+	})
+
+	t.Run("fails on missing source", func(t *testing.T) {
+		_, dst := setup(t)
+		src, err := NewLocalCache(filepath.Join(t.TempDir(), "missing"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := SyncCaches(src, dst, false, true); err == nil {
+			t.Fatal("expected error")
+		}
+		if len(listBlobs(t, dst)) != 2 {
+			t.Fatal("expected destination to be untouched")
+		}
+	})
+}
+
+func checksumString(contents string) (string, error) {
+	return checksum.Checksum(strings.NewReader(contents))
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"encoding/base64"
+
+	"github.com/kevin-hanselman/dud/src/fsutil"
+)
+
+// EnablePreserveXattrs makes Commit record the extended attributes of each
+// file Artifact, including POSIX ACLs, in the Artifact's Xattrs field.
+// Checkout then restores them on files it checks out as copies. Objects in
+// the Cache are shared between files, so the attributes can't be kept on the
+// objects themselves, and files checked out as links never get them.
+func (ch *LocalCache) EnablePreserveXattrs() {
+	ch.preserveXattrs = true
+}
+
+// readArtifactXattrs returns the extended attributes of the file at workPath
+// in the form stored in Artifact.Xattrs, or nil if the file has none.
+func readArtifactXattrs(workPath string) (map[string]string, error) {
+	attrs, err := fsutil.ReadXattrs(workPath)
+	if err != nil || len(attrs) == 0 {
+		return nil, err
+	}
+	encoded := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		encoded[name] = base64.StdEncoding.EncodeToString(value)
+	}
+	return encoded, nil
+}
+
+// writeArtifactXattrs sets the extended attributes recorded in
+// Artifact.Xattrs on the file at workPath.
+func writeArtifactXattrs(workPath string, encoded map[string]string) error {
+	if len(encoded) == 0 {
+		return nil
+	}
+	attrs := make(map[string][]byte, len(encoded))
+	for name, value := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		attrs[name] = decoded
+	}
+	return fsutil.WriteXattrs(workPath, attrs)
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/strategy"
+)
+
+func TestPreserveXattrs(t *testing.T) {
+	attrs := map[string][]byte{"user.origin": []byte("https://example.com/foo")}
+
+	setup := func(t *testing.T) (cache LocalCache, workDir string) {
+		cache, err := NewLocalCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		workDir = t.TempDir()
+		workPath := filepath.Join(workDir, "foo.txt")
+		if err := os.WriteFile(workPath, []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsutil.WriteXattrs(workPath, attrs); err != nil {
+			t.Skipf("filesystem doesn't support user xattrs: %v", err)
+		}
+		return
+	}
+
+	t.Run("restored on copy checkout", func(t *testing.T) {
+		cache, workDir := setup(t)
+		cache.EnablePreserveXattrs()
+		art := artifact.Artifact{Path: "foo.txt"}
+		if _, err := cache.Commit(workDir, &art, strategy.LinkStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		wantXattrs := map[string]string{"user.origin": "aHR0cHM6Ly9leGFtcGxlLmNvbS9mb28="}
+		if diff := cmp.Diff(wantXattrs, art.Xattrs); diff != "" {
+			t.Fatalf("Xattrs -want +got:\n%s", diff)
+		}
+
+		workPath := filepath.Join(workDir, "foo.txt")
+		if err := os.Remove(workPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Checkout(workDir, art, strategy.CopyStrategy, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fsutil.ReadXattrs(workPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(attrs, got); diff != "" {
+			t.Fatalf("workspace xattrs -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("not recorded by default", func(t *testing.T) {
+		cache, workDir := setup(t)
+		art := artifact.Artifact{Path: "foo.txt"}
+		if _, err := cache.Commit(workDir, &art, strategy.CopyStrategy, agglog.NewNullLogger()); err != nil {
+			t.Fatal(err)
+		}
+		if art.Xattrs != nil {
+			t.Fatalf("expected no Xattrs, got %v", art.Xattrs)
+		}
+	})
+}
@@ -34,6 +34,16 @@ var hasherPool = sync.Pool{
 	},
 }
 
+// IsValid returns true if cksum has the form of a checksum returned by
+// Checksum.
+func IsValid(cksum string) bool {
+	if len(cksum) != 2*blake3.New().Size() {
+		return false
+	}
+	_, err := hex.DecodeString(cksum)
+	return err == nil
+}
+
 func hashToHexString(h hash.Hash) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
@@ -54,7 +64,9 @@ func ChecksumBuffer(reader io.Reader, buffer []byte) (string, error) {
 	h := hasherPool.Get().(*blake3.Hasher)
 	defer hasherPool.Put(h)
 	h.Reset()
-	if _, err := io.CopyBuffer(h, reader, buffer); err != nil {
+	// Hide any WriterTo method of reader (e.g. that of *os.File), which
+	// io.CopyBuffer would use instead of buffer.
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{reader}, buffer); err != nil {
 		return "", err
 	}
 	return hashToHexString(h), nil
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/c2h5oh/datasize"
 )
@@ -26,6 +27,18 @@ func TestChecksum(t *testing.T) {
 	}
 }
 
+func TestIsValid(t *testing.T) {
+	valid := "288a86a79f20a3d6dccdca7713beaed178798296bdfa7913fa2a62d9727bf8f8"
+	if !IsValid(valid) {
+		t.Errorf("IsValid(%#v) = false, want true", valid)
+	}
+	for _, invalid := range []string{"", "288a86a7", valid + "00", valid[:62] + "zz"} {
+		if IsValid(invalid) {
+			t.Errorf("IsValid(%#v) = true, want false", invalid)
+		}
+	}
+}
+
 func BenchmarkChecksum(b *testing.B) {
 	b.Run("10MB", func(b *testing.B) { benchmarkChecksum(10*datasize.MB, b) })
 	b.Run("50MB", func(b *testing.B) { benchmarkChecksum(50*datasize.MB, b) })
@@ -50,3 +63,35 @@ func benchmarkChecksum(inputSize datasize.ByteSize, b *testing.B) {
 		}
 	}
 }
+
+// latencyReader delays every read, like a file on a network mount.
+type latencyReader struct {
+	r       io.Reader
+	latency time.Duration
+}
+
+func (lr latencyReader) Read(p []byte) (int, error) {
+	time.Sleep(lr.latency)
+	return lr.r.Read(p)
+}
+
+// BenchmarkChecksumBufferSize shows the effect of the buffer size on reading
+// from storage with high latency per read.
+func BenchmarkChecksumBufferSize(b *testing.B) {
+	input := make([]byte, 64*datasize.MB)
+	if _, err := rand.Read(input); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []datasize.ByteSize{64 * datasize.KB, 1 * datasize.MB, 8 * datasize.MB} {
+		buffer := make([]byte, size)
+		b.Run(size.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				reader := latencyReader{bytes.NewReader(input), 100 * time.Microsecond}
+				if _, err := ChecksumBuffer(reader, buffer); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package checksum
+
+import (
+	"io"
+	"sync"
+
+	"github.com/zeebo/blake3"
+)
+
+// A hashJob asks a Pool worker to write block to hasher, then close done.
+type hashJob struct {
+	hasher *blake3.Hasher
+	block  []byte
+	done   chan struct{}
+}
+
+// A Pool hashes data on a fixed number of goroutines, separately from the
+// goroutines reading the data. This bounds the number of blocks hashed at once
+// independently of the number of files read at once. Blocks of the same reader
+// are still hashed in order.
+type Pool struct {
+	jobs chan hashJob
+	wg   sync.WaitGroup
+}
+
+// NewPool starts a Pool with n hashing goroutines. Call Close to stop them.
+func NewPool(n int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+	pool := &Pool{jobs: make(chan hashJob)}
+	pool.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer pool.wg.Done()
+			for job := range pool.jobs {
+				job.hasher.Write(job.block)
+				close(job.done)
+			}
+		}()
+	}
+	return pool
+}
+
+// Close stops the Pool's goroutines once they finish their current jobs. The
+// Pool must not be used afterwards.
+func (pool *Pool) Close() {
+	close(pool.jobs)
+	pool.wg.Wait()
+}
+
+// Checksum is like the package-level Checksum, but hashes on the Pool.
+func (pool *Pool) Checksum(reader io.Reader) (string, error) {
+	first := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(first)
+	second := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(second)
+	return pool.ChecksumBuffers(reader, *first, *second)
+}
+
+// ChecksumBuffers is like ChecksumBuffer, but hashes on the Pool. It reads
+// into the two buffers in turn, so one block is read from reader while the
+// block before it is hashed. The last block is hashed on the calling goroutine,
+// so data that fits in a single block (e.g. a small file) never waits on the
+// Pool. The buffers must not overlap, and neither may be zero-length.
+func (pool *Pool) ChecksumBuffers(reader io.Reader, first, second []byte) (string, error) {
+	h := hasherPool.Get().(*blake3.Hasher)
+	defer hasherPool.Put(h)
+	h.Reset()
+	buffers := [2][]byte{first, second}
+	// pending is closed once the block in flight, if any, is hashed.
+	var pending chan struct{}
+	for i := 0; ; i ^= 1 {
+		n, err := io.ReadFull(reader, buffers[i])
+		// Wait for the previous block before queueing this one, to keep the
+		// blocks in order.
+		if pending != nil {
+			<-pending
+			pending = nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			h.Write(buffers[i][:n])
+			break
+		}
+		if n > 0 {
+			pending = make(chan struct{})
+			pool.jobs <- hashJob{hasher: h, block: buffers[i][:n], done: pending}
+		}
+		if err != nil {
+			if pending != nil {
+				<-pending
+			}
+			return "", err
+		}
+	}
+	if pending != nil {
+		<-pending
+	}
+	return hashToHexString(h), nil
+}
@@ -0,0 +1,96 @@
+package checksum
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	pool := NewPool(2)
+	defer pool.Close()
+
+	input := make([]byte, 3*DefaultBufferSize+17)
+	if _, err := rand.Read(input); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, int(DefaultBufferSize), len(input)} {
+		want, err := Checksum(bytes.NewReader(input[:size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := pool.Checksum(bytes.NewReader(input[:size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("size %d: Pool.Checksum = %s, want %s", size, got, want)
+		}
+		got, err = pool.ChecksumBuffers(bytes.NewReader(input[:size]), make([]byte, 3), make([]byte, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("size %d: Pool.ChecksumBuffers = %s, want %s", size, got, want)
+		}
+	}
+
+	t.Run("concurrent readers", func(t *testing.T) {
+		want, err := Checksum(bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := pool.Checksum(bytes.NewReader(input))
+				if err == nil && got != want {
+					err = errors.New("checksum mismatch")
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("small inputs skip the pool", func(t *testing.T) {
+		// A Pool without workers blocks every job it's sent.
+		idle := &Pool{jobs: make(chan hashJob)}
+		want, err := Checksum(bytes.NewReader(input[:100]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := idle.Checksum(bytes.NewReader(input[:100]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("Pool.Checksum = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("read error", func(t *testing.T) {
+		readErr := errors.New("read failed")
+		reader := io.MultiReader(bytes.NewReader(input), &errReader{readErr})
+		if _, err := pool.Checksum(reader); !errors.Is(err, readErr) {
+			t.Fatalf("got error %v, want %v", err, readErr)
+		}
+	})
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(commitArchiveCmd)
+}
+
+var commitArchiveCmd = &cobra.Command{
+	Use:   "commit-archive [flags] archive artifact_path",
+	Short: "Commit the contents of an archive as a directory artifact",
+	Long: `Commit-archive commits the contents of an archive as a directory artifact.
+
+Commit-archive reads the given tar, gzipped tar, or zip archive and stores each
+file in it in the cache, without extracting the archive to disk. The files
+become the contents of the given directory artifact, which must be the output
+of a stage in the index, and the artifact's new checksum is recorded in the
+stage file. Use this to track the contents of a large archive without needing
+the disk space to extract it.
+
+The archive's format is determined by its extension: .tar, .tar.gz, .tgz, or
+.zip. Archives may only contain regular files and directories, and no member
+may have a path outside of the archive's root. Directory artifacts with
+'include' or 'exclude' patterns or 'preserve-hardlinks' aren't supported.
+
+The workspace is left untouched. Run 'dud checkout' afterward to create the
+files at the artifact's path, as if the archive had been extracted there.
+Committing an archive whose files match an existing directory, file for file,
+gives the same checksum as committing the directory itself.
+
+If 'manifest-format', 'detect-content-types', 'temp-dir', or 'signing-key' are
+set in the config, they apply as they do for commit.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, ch, idx, err := prepare(args)
+		if err != nil {
+			fatal(err)
+		}
+		archivePath, artPath := args[0], args[1]
+
+		if err := ch.SetManifestFormat(viper.GetString("manifest-format")); err != nil {
+			fatal(err)
+		}
+
+		if viper.GetBool("detect-content-types") {
+			ch.EnableContentTypeDetection()
+		}
+
+		if err := ch.SetTempDir(viper.GetString("temp-dir")); err != nil {
+			fatal(err)
+		}
+
+		signingKey, err := loadSigningKey() // defined in cmd/verify.go
+		if err != nil {
+			fatal(err)
+		}
+
+		stagePath, art, ok := idx.FindOutput(artPath)
+		if !ok {
+			fatal(fmt.Errorf("artifact %s is not the output of any stage", artPath))
+		}
+		stg := idx[stagePath]
+		if stg.Frozen {
+			fatal(fmt.Errorf("stage %s is frozen", stagePath))
+		}
+
+		logger.Info.Printf("committing %s to %s in stage %s\n", archivePath, artPath, stagePath)
+		result, err := ch.CommitArchive(archivePath, art)
+		if err != nil {
+			fatal(err)
+		}
+		stg.Checksum, err = stg.CalculateChecksum()
+		if err != nil {
+			fatal(err)
+		}
+		if signingKey != nil {
+			stg.Sign(signingKey)
+		}
+		if err := stg.ToFile(stagePath); err != nil {
+			fatal(err)
+		}
+		logCommitTotals(result) // defined in cmd/commit.go
+	},
+}
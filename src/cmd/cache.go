@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/checksum"
+	"github.com/kevin-hanselman/dud/src/index"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	syncCacheCmd.Flags().BoolVar(
+		&verifySync,
+		"verify",
+		false,
+		"checksum each copied object and discard any that don't match",
+	)
+	syncCacheCmd.Flags().BoolVar(
+		&deleteExtraBlobs,
+		"delete",
+		false,
+		"delete objects in the destination that aren't in the source",
+	)
+	cacheCmd.AddCommand(syncCacheCmd)
+	cacheCmd.AddCommand(removeBlobCmd)
+	orphansCmd.Flags().BoolVar(
+		&verifyLinks,
+		"verify-links",
+		false,
+		"don't list objects linked from anywhere in the workspace",
+	)
+	cacheCmd.AddCommand(orphansCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+var verifySync, deleteExtraBlobs bool
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Commands for managing cache directories",
+	Long:  `Cache is a group of commands for managing cache directories.`,
+}
+
+var syncCacheCmd = &cobra.Command{
+	Use:   "sync [flags] src_dir dst_dir",
+	Short: "Copy objects missing from one cache directory from another",
+	Long: `Sync copies objects missing from one cache directory from another.
+
+Sync compares the objects in the two cache directories by checksum, and copies
+only the objects in src_dir that are missing from dst_dir. This is useful for
+keeping a backup of a cache, or for moving a cache between machines. Neither
+directory needs to belong to the current project, and the project isn't
+locked.
+
+With --verify, each object is checksummed once it's copied, and objects that
+don't match their checksums are discarded. With --delete, objects in dst_dir
+that aren't in src_dir are deleted, so dst_dir ends up with exactly the objects
+in src_dir.`,
+	Example: "dud cache sync .dud/cache /mnt/backup/dud_cache",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		src, err := cache.NewLocalCache(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		dst, err := cache.NewLocalCache(args[1])
+		if err != nil {
+			fatal(err)
+		}
+		result, err := cache.SyncCaches(src, dst, verifySync, deleteExtraBlobs)
+		if err != nil {
+			fatal(err)
+		}
+		logger.Info.Printf("Copied %d objects.\n", result.Copied)
+		if deleteExtraBlobs {
+			logger.Info.Printf("Deleted %d objects.\n", result.Deleted)
+		}
+	},
+}
+
+var removeBlobCmd = &cobra.Command{
+	Use:   "rm [flags] checksum...",
+	Short: "Remove specific objects from the cache",
+	Long: `Rm removes the objects with the given checksums from the project's cache.
+
+Use rm to discard an object known to be corrupted, or to force it to be fetched
+again. Rm refuses to remove an object while a link in the workspace outputs of
+any stage points to it, because that would break the link. Check out a copy of
+the artifact (or remove the link) first.
+
+Rm warns if a stage in the index still references the object. Until the object
+is committed or fetched again, checking out that stage will fail.`,
+	Example: "dud cache rm 8843d7f92416211de9ebb963ff4ce28125932878",
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, ch, idx, err := prepare(nil)
+		if err != nil {
+			fatal(err)
+		}
+		var arts []*artifact.Artifact
+		for _, stg := range idx {
+			for _, art := range stg.Outputs {
+				arts = append(arts, art)
+			}
+		}
+		referenced, err := ch.ReferencedBlobs(arts)
+		if err != nil {
+			fatal(err)
+		}
+		for _, cksum := range args {
+			if err := removeBlob(ch, idx, cksum); err != nil {
+				fatal(err)
+			}
+			logger.Info.Printf("Removed %s.\n", cksum)
+			if referenced[cksum] {
+				logger.Error.Printf(
+					"object %s is still referenced by the index; fetch or commit it again before checking it out\n",
+					cksum,
+				)
+			}
+		}
+	},
+}
+
+var orphansCmd = &cobra.Command{
+	Use:   "orphans",
+	Short: "List objects in the cache that no stage references",
+	Long: `Orphans lists the objects in the project's cache that aren't referenced by any
+stage in the index or by the index log, without removing them.
+
+These are the objects 'dud prune --cached' would remove, usually earlier
+versions of committed artifacts. Orphans prints one line per object with its
+checksum and size in bytes, in order of checksum, followed by the number of
+objects and the total space they take up. It never modifies the cache.
+
+With --verify-links, orphans searches the whole workspace for links into the
+cache, and doesn't list the objects they point to.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, ch, idx, err := prepare(nil)
+		if err != nil {
+			fatal(err)
+		}
+		tabWriter := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		var count int
+		var size int64
+		err = walkUnreferencedBlobs(ch, idx, verifyLinks, func(cksum string, info os.FileInfo) error {
+			count++
+			size += info.Size()
+			_, err := fmt.Fprintf(tabWriter, "%s\t%d\n", cksum, info.Size())
+			return err
+		})
+		if err != nil {
+			fatal(err)
+		}
+		if err := tabWriter.Flush(); err != nil {
+			fatal(err)
+		}
+		logger.Info.Printf(
+			"%d orphaned objects (%s)\n",
+			count,
+			datasize.ByteSize(size).HumanReadable(),
+		)
+	},
+}
+
+// removeBlob removes the object with the given checksum from the cache,
+// unless a link in the workspace outputs of a stage points to it.
+func removeBlob(ch cache.LocalCache, idx index.Index, cksum string) error {
+	errPrefix := "remove " + cksum
+	blobPath, err := ch.BlobPath(cksum)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if _, err := os.Lstat(blobPath); err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	// Links may reach the cache through a symlinked directory.
+	resolvedBlobPath, err := filepath.EvalSymlinks(blobPath)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	var links []string
+	for _, stagePath := range idx.SortStagePaths() {
+		for _, art := range idx[stagePath].Outputs {
+			if art.SkipCache {
+				continue
+			}
+			artLinks, err := linksTo(art.Path, resolvedBlobPath)
+			if err != nil {
+				return errors.Wrap(err, errPrefix)
+			}
+			links = append(links, artLinks...)
+		}
+	}
+	if len(links) > 0 {
+		return fmt.Errorf(
+			"%s: object is linked in the workspace by %s",
+			errPrefix,
+			strings.Join(links, ", "),
+		)
+	}
+	return errors.Wrap(ch.RemoveBlob(cksum), errPrefix)
+}
+
+// linksTo returns the links at or under path that resolve to target. target
+// must have no symlinks in it.
+func linksTo(path, target string) (links []string, err error) {
+	err = walkLinks(path, nil, func(link, resolved string) error {
+		if resolved == target {
+			links = append(links, link)
+		}
+		return nil
+	})
+	return
+}
+
+// walkLinks calls fn for each link at or under path that resolves to an
+// existing file, with the absolute, symlink-free path it resolves to.
+// Directories in skipDirs are not searched.
+func walkLinks(path string, skipDirs map[string]bool, fn func(link, resolved string) error) error {
+	return filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && skipDirs[path] {
+			return filepath.SkipDir
+		}
+		if entry.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// EvalSymlinks keeps relative paths relative.
+		resolved, err = filepath.Abs(resolved)
+		if err != nil {
+			return err
+		}
+		return fn(path, resolved)
+	})
+}
+
+// addLinkedBlobs adds the checksum of every object in the cache that a link in
+// the workspace points to to referenced. It assumes the working directory is
+// the project root.
+func addLinkedBlobs(ch cache.LocalCache, referenced map[string]bool) error {
+	errPrefix := "find links to the cache"
+	cacheDir, err := filepath.Abs(ch.Dir())
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	// Links may reach the cache through a symlinked directory.
+	cacheDir, err = filepath.EvalSymlinks(cacheDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	skipDirs := map[string]bool{".dud": true, ".git": true}
+	for _, path := range discoverySkipPaths() { // defined in cmd/root.go
+		skipDirs[path] = true
+	}
+	err = walkLinks(".", skipDirs, func(_, resolved string) error {
+		relPath, err := filepath.Rel(cacheDir, resolved)
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			return nil
+		}
+		// See cache.PathForChecksum for the layout of the cache.
+		cksum := strings.ReplaceAll(filepath.ToSlash(relPath), "/", "")
+		if checksum.IsValid(cksum) {
+			referenced[cksum] = true
+		}
+		return nil
+	})
+	return errors.Wrap(err, errPrefix)
+}
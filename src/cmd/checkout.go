@@ -1,8 +1,23 @@
 package cmd
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/index"
 	"github.com/kevin-hanselman/dud/src/strategy"
+	"github.com/mattn/go-isatty"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func init() {
@@ -14,6 +29,32 @@ func init() {
 		false,
 		"copy artifacts instead of linking",
 	)
+	checkoutCmd.Flags().BoolVar(
+		&relink,
+		"relink",
+		false,
+		"replace links that don't point to the committed artifact",
+	)
+	checkoutCmd.Flags().BoolVar(
+		&hardReset,
+		"hard",
+		false,
+		"discard all local changes to artifacts, including untracked files in directories",
+	)
+	checkoutCmd.Flags().BoolVarP(
+		&forceHardReset,
+		"force",
+		"f",
+		false,
+		"don't ask for confirmation before a hard reset",
+	)
+	checkoutCmd.Flags().BoolVarP(
+		&keepGoing, // defined in cmd/root.go
+		"keep-going",
+		"k",
+		false,
+		"check out other stages when a stage fails",
+	)
 	checkoutCmd.Flags().BoolVarP(
 		&disableRecursion,
 		"single-stage",
@@ -21,12 +62,119 @@ func init() {
 		false,
 		"disable recursive operation on upstream stages",
 	)
+	checkoutCmd.Flags().BoolVarP(
+		&checkoutDryRun,
+		"dry-run",
+		"n",
+		false,
+		"print what checkout would do without changing the workspace",
+	)
+	addRelativeToFlag(checkoutCmd)
+}
+
+var useCopyStrategy, disableRecursion, relink, hardReset, forceHardReset, checkoutDryRun bool
+
+// setPreserveXattrs applies the 'preserve-xattrs' config field to the cache.
+// Extended attributes are only restored on files checked out as copies, so a
+// warning is logged if strat links files instead.
+func setPreserveXattrs(ch *cache.LocalCache, strat strategy.CheckoutStrategy) {
+	if !viper.GetBool("preserve-xattrs") {
+		return
+	}
+	ch.EnablePreserveXattrs()
+	if strat == strategy.LinkStrategy {
+		logger.Error.Println("extended attributes aren't preserved on linked files; use --copy to preserve them")
+	}
 }
 
-var useCopyStrategy, disableRecursion bool
+// confirmHardReset asks the user to confirm a hard reset. It returns false
+// without asking if standard input is not a terminal.
+func confirmHardReset() (bool, error) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return false, nil
+	}
+	fmt.Print("Discard all local changes to the checked out artifacts? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// writeCheckoutPlan writes the action checkout would take for each output of
+// the given stages, and of all stages upstream of them unless recursion is
+// disabled. See artifact.Status.CheckoutAction for the actions.
+func writeCheckoutPlan(
+	writer io.Writer,
+	idx index.Index,
+	ch cache.Cache,
+	rootDir string,
+	paths []string,
+) error {
+	indexStatus := make(index.Status)
+	for _, path := range paths {
+		inProgress := make(map[string]bool)
+		if err := idx.Status(path, ch, rootDir, false, indexStatus, inProgress); err != nil {
+			return err
+		}
+	}
+	stagePaths := paths
+	if !disableRecursion {
+		stagePaths = make([]string, 0, len(indexStatus))
+		for path := range indexStatus {
+			stagePaths = append(stagePaths, path)
+		}
+	}
+	sort.Strings(stagePaths)
+
+	tabWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, stagePath := range stagePaths {
+		outputStatus := indexStatus.OutputStatus(stagePath)
+		artPaths := make([]string, 0, len(outputStatus))
+		for path := range outputStatus {
+			artPaths = append(artPaths, path)
+		}
+		sort.Strings(artPaths)
+		for _, path := range artPaths {
+			action := outputStatus[path].CheckoutAction(relink, hardReset)
+			fmt.Fprintf(tabWriter, "%s\t%s\n", action, path)
+		}
+	}
+	return tabWriter.Flush()
+}
+
+// checkoutArtifactPath checks out the output artifact at path, or the file or
+// directory at path within a directory artifact, without checking out the rest
+// of the stage that owns it. It returns the artifact it checked out.
+func checkoutArtifactPath(
+	idx index.Index,
+	ch cache.LocalCache,
+	rootDir string,
+	path string,
+	strat strategy.CheckoutStrategy,
+) (artifact.Artifact, error) {
+	_, art, ok := idx.FindOwner(path)
+	if !ok {
+		return artifact.Artifact{}, fmt.Errorf("%s is neither a stage nor the output of any stage", path)
+	}
+	logger.Info.Printf("checking out %s\n", path)
+	if art.Path == path {
+		return *art, ch.Checkout(rootDir, *art, strat, nil)
+	}
+	childPath, err := filepath.Rel(art.Path, path)
+	if err != nil {
+		return *art, err
+	}
+	child, err := ch.ChildArtifact(rootDir, *art, childPath)
+	if err != nil {
+		return *art, errors.Wrap(err, "checkout")
+	}
+	return child, ch.Checkout(rootDir, child, strat, nil)
+}
 
 var checkoutCmd = &cobra.Command{
-	Use:   "checkout [flags] [stage_file]...",
+	Use:   "checkout [flags] [stage_file | artifact_path]...",
 	Short: "Load committed artifacts from the cache",
 	Long: `Checkout loads previously committed artifacts from the cache.
 
@@ -35,7 +183,72 @@ available in the workspace. By default, checkout creates symlinks to the cache,
 but copies of the cached artifacts can be checked out using --copy. If no
 stage files are passed in, checkout will act on all stages in the index. By
 default, checkout will act recursively on all stages upstream of the given
-stage(s).`,
+stage(s).
+
+If the workspace is on a filesystem that doesn't support symlinks, such as FAT,
+checkout copies files instead of failing. The same goes for the links commit
+creates.
+
+Checkout also accepts the paths of output artifacts, including files and
+directories inside directory artifacts. Only the given artifact is checked
+out, not the rest of the stage that owns it or any upstream stages. This makes
+it possible to check out a single file from a huge directory artifact. The rest
+of the directory artifact is left as is.
+
+Checkout fails if a link in the workspace points to the wrong file in the
+cache, such as after pulling a new version of a stage file from source control.
+Use --relink to replace these links.
+
+Checkout can be safely re-run after it was interrupted. Files already checked
+out are left as they are, including copies whose contents match the cache, so
+only the rest of each directory artifact is checked out. Copies are written
+to a hidden file ending in ".dud-partial" next to their destination before
+being moved into place, so an interrupted checkout never leaves a truncated
+file behind.
+
+For directory artifacts with 'preserve-hardlinks' set, checking out with --copy
+recreates the hard links recorded at commit time instead of writing a separate
+copy of each linked file. Only links between files in the same directory are
+recorded.
+
+With --hard, checkout discards all local changes to the artifacts, leaving
+them exactly as they were committed. Modified files are replaced, and files and
+directories inside directory artifacts that weren't committed are deleted.
+Because uncommitted changes are lost for good, checkout asks for confirmation
+first, unless --force is given.
+
+If 'preserve-xattrs' is set to true in the config, checkout restores the
+extended attributes recorded by commit on files checked out with --copy.
+
+If 'auto-fetch' is set to true in the config, checkout downloads any artifacts
+missing from the cache from the remote cache, so a separate fetch is not
+needed. Like fetch, this requires rclone to be installed on your machine.
+
+If 'cache-type' is set to "remote" in the config, the remote is the primary
+cache. Checkout fetches any artifacts missing from the local cache from the
+remote, checks them out as copies, and then removes their files from the local
+cache. Objects are pushed to the remote before they're removed, so objects
+that were only in the local cache aren't lost. Objects are only removed once
+every stage is checked out, so the local disk needs room for all the fetched
+artifacts at once.
+
+With --keep-going, a stage that fails to check out doesn't stop checkout from
+checking out the remaining stages. All errors are printed at the end, and
+checkout exits with a non-zero code.
+
+With --dry-run, checkout prints the action it would take for each artifact
+without changing the workspace: "create" for missing artifacts, "update" for
+directories missing some of their contents, "relink" for links to the wrong
+object in the cache, "overwrite" for local changes discarded by --hard, and
+"skip" for artifacts that are already up-to-date. Artifacts that checkout
+would fail on are reported as "conflict" (local changes), "missing" (missing
+from the cache), "uncommitted", or "malformed" (a malformed checksum).
+Artifacts aren't fetched from the remote, even with 'auto-fetch'.
+
+With --relative-to, artifacts are checked out under the given directory instead
+of the project root, at the same paths relative to it. This materializes
+outputs in another location (e.g. a scratch directory) without touching the
+project's workspace.`,
 	Run: func(cmd *cobra.Command, paths []string) {
 		strat := strategy.LinkStrategy
 		if useCopyStrategy {
@@ -46,11 +259,31 @@ stage(s).`,
 		if err != nil {
 			fatal(err)
 		}
+		baseDir := workspaceDir(rootDir)
 
 		if len(idx) == 0 {
 			fatal(emptyIndexError{})
 		}
 
+		remoteCache, err := usesRemoteCache()
+		if err != nil {
+			fatal(err)
+		}
+		if remoteCache {
+			// Links would dangle once the objects leave the local cache.
+			useCopyStrategy = true
+			strat = strategy.CopyStrategy
+		}
+
+		setPreserveXattrs(&ch, strat)
+
+		if relink {
+			if useCopyStrategy {
+				fatal(errors.New("cannot use --relink with --copy"))
+			}
+			ch.EnableRelink()
+		}
+
 		if len(paths) == 0 {
 			// Ignore disableRecursion flag when no args passed.
 			disableRecursion = false
@@ -59,22 +292,77 @@ stage(s).`,
 			}
 		}
 
+		if checkoutDryRun {
+			if err := writeCheckoutPlan(os.Stdout, idx, ch, baseDir, paths); err != nil {
+				fatal(err)
+			}
+			return
+		}
+
+		if hardReset {
+			if !forceHardReset {
+				confirmed, err := confirmHardReset()
+				if err != nil {
+					fatal(err)
+				}
+				if !confirmed {
+					fatal(errors.New("hard reset not confirmed; use --force to skip confirmation"))
+				}
+			}
+			ch.EnableHardReset()
+		}
+
+		if viper.GetBool("auto-fetch") {
+			remote := viper.GetString("remote")
+			if remote == "" {
+				fatal(noRemoteError{})
+			}
+			ch.EnableAutoFetch(remote)
+			if err := setBandwidthLimit(&ch); err != nil {
+				fatal(err)
+			}
+		}
+
 		checkedOut := make(map[string]bool)
+		// checkedOutArts holds the artifacts checked out by artifact path.
+		checkedOutArts := make(map[string]*artifact.Artifact)
+		errs := make(map[string]error)
 		for _, path := range paths {
-			inProgress := make(map[string]bool)
-			if err := idx.Checkout(
-				path,
-				ch,
-				rootDir,
-				strat,
-				!disableRecursion,
-				checkedOut,
-				inProgress,
-				logger,
-			); err != nil {
-				fatal(err)
+			var err error
+			if _, isStage := idx[path]; isStage {
+				inProgress := make(map[string]bool)
+				err = idx.Checkout(
+					path,
+					ch,
+					baseDir,
+					strat,
+					!disableRecursion,
+					checkedOut,
+					inProgress,
+					logger,
+				)
+			} else {
+				var art artifact.Artifact
+				art, err = checkoutArtifactPath(idx, ch, baseDir, path, strat)
+				if err == nil {
+					checkedOutArts[path] = &art
+				}
+			}
+			if err != nil {
+				stageFailed(errs, path, err)
 			}
 			logger.Info.Println()
 		}
+		if remoteCache {
+			for path := range checkedOut {
+				for artPath, art := range idx[path].Outputs {
+					checkedOutArts[filepath.Join(path, artPath)] = art
+				}
+			}
+			if err := pushAndEvict(ch, checkedOutArts); err != nil {
+				fatal(err)
+			}
+		}
+		reportStageErrors(errs)
 	},
 }
@@ -1,8 +1,16 @@
 package cmd
 
 import (
+	"path/filepath"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
 	"github.com/kevin-hanselman/dud/src/strategy"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func init() {
@@ -14,6 +22,108 @@ func init() {
 		false,
 		"On checkout, copy the file instead of linking.",
 	)
+	commitCmd.Flags().BoolVarP(
+		&keepGoing, // defined in cmd/root.go
+		"keep-going",
+		"k",
+		false,
+		"commit other stages when a stage fails",
+	)
+	commitCmd.Flags().StringVar(
+		&maxFileSize,
+		"max-size",
+		"",
+		"fail to commit any file larger than this size (e.g. 500MB)",
+	)
+	commitCmd.Flags().IntVar(
+		&checksumThreads,
+		"threads",
+		0,
+		"hash up to this many chunks of a chunked file at once",
+	)
+	commitCmd.Flags().IntVar(
+		&ioThreads,
+		"threads-io",
+		0,
+		"read up to this many files of a directory at once",
+	)
+	commitCmd.Flags().IntVar(
+		&cpuThreads,
+		"threads-cpu",
+		0,
+		"hash up to this many blocks of file data at once",
+	)
+	commitCmd.Flags().BoolVar(
+		&reportDupes,
+		"report-dupes",
+		false,
+		"report files with identical contents in directory artifacts",
+	)
+	commitCmd.Flags().BoolVar(
+		&atomicManifest,
+		"atomic-manifest",
+		false,
+		"sync new cache objects to disk before updating stage files",
+	)
+	commitCmd.Flags().BoolVar(
+		&thawFrozen,
+		"thaw",
+		false,
+		"commit frozen stages too",
+	)
+	commitCmd.Flags().BoolVar(
+		&forceCommit,
+		"force",
+		false,
+		"re-hash and re-store all files, replacing objects already in the cache",
+	)
+	addRelativeToFlag(commitCmd)
+	commitCmd.Flags().DurationVar(
+		&waitTimeout,
+		"wait",
+		0,
+		"wait up to this long for each missing output to appear (e.g. 30s)",
+	)
+}
+
+var (
+	maxFileSize     string
+	checksumThreads int
+	ioThreads       int
+	cpuThreads      int
+	reportDupes     bool
+	atomicManifest  bool
+	thawFrozen      bool
+	forceCommit     bool
+	waitTimeout     time.Duration
+)
+
+// setChecksumThreads applies the --threads flag to the cache, falling back to
+// the 'checksum-threads' config field if the flag isn't set.
+func setChecksumThreads(ch *cache.LocalCache) error {
+	threads := checksumThreads
+	if threads == 0 {
+		threads = viper.GetInt("checksum-threads")
+	}
+	return ch.SetChecksumThreads(threads)
+}
+
+// setCommitThreads applies the --threads-io and --threads-cpu flags to the
+// cache, falling back to the 'threads-io' and 'threads-cpu' config fields for
+// flags that aren't set.
+func setCommitThreads(ch *cache.LocalCache) error {
+	threads := ioThreads
+	if threads == 0 {
+		threads = viper.GetInt("threads-io")
+	}
+	if err := ch.SetIOThreads(threads); err != nil {
+		return err
+	}
+	threads = cpuThreads
+	if threads == 0 {
+		threads = viper.GetInt("threads-cpu")
+	}
+	return ch.SetCPUThreads(threads)
 }
 
 var commitCmd = &cobra.Command{
@@ -24,7 +134,96 @@ var commitCmd = &cobra.Command{
 For each stage file passed in, commit saves all output artifacts in the cache
 and records their checksums in the stage file. If no stage files are passed
 in, commit will act on all stages in the index. By default, commit will act
-recursively on all stages upstream of the given stage(s).`,
+recursively on all stages upstream of the given stage(s).
+
+Commit always records the current checksum of each stage's definition, even if
+all of its artifacts are already up-to-date. Committing is therefore the way to
+mark an edited stage definition as up-to-date in status.
+
+Commit refuses to commit a directory artifact that contains a symlink
+pointing outside of the project and the cache, even if the link is dangling.
+This guards against capturing files from elsewhere on the system by accident.
+Likewise, commit refuses to commit an artifact whose path resolves (e.g.
+through a symlinked directory) to a location inside of the cache or the .dud
+directory, before committing any of the artifact's files.
+
+Commit adds every file to the local cache first, even if 'cache-type' is set
+to "remote" in the config, so the local disk needs room for all the committed
+files at once. See the config created by 'dud init' for the options that
+affect how commit stores files.
+
+Commit skips stages with 'frozen: true' in their stage files, leaving their
+stage files and outputs untouched and not recursing into their upstream
+stages. Stages downstream of a frozen stage use its recorded output checksums.
+Freeze a stage to protect a vetted result, such as a published dataset, from
+being re-committed by accident. With --thaw, commit ignores the field and
+commits frozen stages like any other; the field itself is kept.
+
+Commit reads files and hashes them on separate pools of workers, so that each
+file's next block is read while the previous one is hashed. Files that fit in
+a single block are hashed by the worker that reads them. Three flags set the
+size of the pools; none of them affects checksums:
+
+  --threads-io   files of a directory artifact read at once, plus one per
+                 sub-directory (default 64). Raise it when reading is the
+                 bottleneck, as on network filesystems.
+  --threads      chunks of a single chunked file artifact read at once
+                 (default 1). Raise it to hash one large file faster.
+  --threads-cpu  blocks hashed at once, across all files and chunks (default
+                 the number of CPUs). Lower it to leave CPUs free for other
+                 work. Raising the other two past it only helps when reading
+                 is slower than hashing.
+
+If the flags aren't set, 'threads-io', 'checksum-threads', and 'threads-cpu'
+from the config are used.
+
+With --relative-to, commit reads each artifact from under the given directory
+instead of the project root, at the same path relative to it. Use this when a
+stage's outputs are generated into a configurable location. The checksums are
+recorded in the project's stage files as usual.
+
+With --wait, commit waits up to the given duration (e.g. "30s" or "5m") for
+each missing output to appear before committing it, rather than failing right
+away. This smooths over races with processes that produce outputs in the
+background. Commit still fails if an output is missing once the time is up.
+Outputs should be created atomically (e.g. written elsewhere and then renamed
+into place), or commit may read them before they're complete.
+
+With --max-size, commit fails if any file is larger than the given size, such
+as "500MB" or "2GB". A plain number is a size in bytes. The file is left in
+place and nothing is added to the cache. Use this guardrail in scripts and CI
+to avoid committing an unexpectedly large file.
+
+With --report-dupes, commit prints each set of files within a directory
+artifact whose contents are identical. Duplicate files are only stored once in
+the cache either way; the report helps find data that was copied by accident.
+Files are only compared with others in the same directory.
+
+After committing, commit prints how many files it committed and how many of
+those were already in the cache, such as copies of other files, along with the
+space that deduplication saved. Files that were already up-to-date aren't
+counted.
+
+Commit writes all of a stage's objects to the cache, including the manifests
+of directory and chunked file artifacts, before it updates the stage file, and
+each stage file is replaced atomically. An interrupted commit therefore leaves
+each stage file either as it was or fully updated. With --atomic-manifest, or
+if 'cache-fsync' is set to true in the config, commit also syncs every new
+object to disk before updating the stage file, so the stage file never
+references an object lost in a crash or power failure.
+Run 'dud doctor' after such a crash to check that committed manifests are
+intact.
+
+With --force, commit re-hashes and re-stores every file of every output, even
+if it looks up-to-date, replacing any copy already in the cache. Files checked
+out as links are the objects in the cache themselves, so they're only
+re-hashed, and commit fails if their contents no longer match their checksums.
+Use --force to repair a cache suspected of corruption; it's slower than a
+normal commit, but otherwise safe.
+
+With --keep-going, a stage that fails to commit doesn't stop commit from
+committing the remaining stages. All errors are printed at the end, and commit
+exits with a non-zero code.`,
 	Run: func(cmd *cobra.Command, paths []string) {
 		strat := strategy.LinkStrategy
 		if useCopyStrategy {
@@ -36,6 +235,84 @@ recursively on all stages upstream of the given stage(s).`,
 			fatal(err)
 		}
 
+		remoteCache, err := usesRemoteCache()
+		if err != nil {
+			fatal(err)
+		}
+		if remoteCache {
+			// Links would dangle once the objects leave the local cache.
+			strat = strategy.CopyStrategy
+		}
+
+		setPreserveXattrs(&ch, strat) // defined in cmd/checkout.go
+
+		if err := ch.SetMaxOpenFiles(viper.GetInt("max-open-files")); err != nil {
+			fatal(err)
+		}
+
+		if err := ch.SetDirBatchSize(viper.GetInt("dir-batch-size")); err != nil {
+			fatal(err)
+		}
+
+		if err := ch.SetManifestFormat(viper.GetString("manifest-format")); err != nil {
+			fatal(err)
+		}
+
+		if err := setChecksumThreads(&ch); err != nil {
+			fatal(err)
+		}
+
+		if err := setCommitThreads(&ch); err != nil {
+			fatal(err)
+		}
+
+		if viper.GetBool("force-copy") {
+			ch.EnableForceCopy()
+		}
+
+		if viper.GetBool("content-defined-chunking") {
+			ch.EnableContentDefinedChunking()
+		}
+
+		if viper.GetBool("detect-content-types") {
+			ch.EnableContentTypeDetection()
+		}
+
+		if reportDupes {
+			ch.EnableDuplicateReport()
+		}
+
+		if atomicManifest {
+			ch.EnableSyncedCommits()
+		}
+
+		if forceCommit {
+			ch.EnableForceCommit()
+		}
+
+		if err := ch.SetTempDir(viper.GetString("temp-dir")); err != nil {
+			fatal(err)
+		}
+
+		if err := ch.SetWaitTimeout(waitTimeout); err != nil {
+			fatal(err)
+		}
+
+		signingKey, err := loadSigningKey() // defined in cmd/verify.go
+		if err != nil {
+			fatal(err)
+		}
+
+		if maxFileSize != "" {
+			var size datasize.ByteSize
+			if err := size.UnmarshalText([]byte(maxFileSize)); err != nil {
+				fatal(errors.Wrapf(err, "invalid max size %#v", maxFileSize))
+			}
+			if err := ch.SetMaxFileSize(int64(size.Bytes())); err != nil {
+				fatal(err)
+			}
+		}
+
 		if len(paths) == 0 { // By default, commit all Stages.
 			for path := range idx {
 				paths = append(paths, path)
@@ -48,22 +325,63 @@ recursively on all stages upstream of the given stage(s).`,
 
 		committed := make(map[string]bool)
 		written := make(map[string]bool)
+		errs := make(map[string]error)
 		for _, path := range paths {
 			inProgress := make(map[string]bool)
-			err := idx.Commit(path, ch, rootDir, strat, committed, inProgress, logger)
+			err := idx.Commit(path, ch, workspaceDir(rootDir), strat, thawFrozen, committed, inProgress, logger)
 			if err != nil {
-				fatal(err)
+				stageFailed(errs, path, err)
 			}
+			// Even if the commit failed, write any upstream stages that were
+			// committed successfully.
 			for path := range committed {
 				if written[path] {
 					continue
 				}
+				written[path] = true
+				if signingKey != nil {
+					idx[path].Sign(signingKey)
+				}
 				if err := idx[path].ToFile(path); err != nil {
-					fatal(err)
+					stageFailed(errs, path, err)
+					continue
+				}
+				if viper.GetBool("manifest-sidecar") {
+					err := ch.WriteManifestSidecar(path+".manifest", idx[path].Outputs)
+					if err != nil {
+						stageFailed(errs, path, err)
+					}
 				}
-				written[path] = true
 			}
 			logger.Info.Println()
 		}
+		logCommitTotals(ch.CommitTotals())
+		if remoteCache {
+			arts := make(map[string]*artifact.Artifact)
+			for path := range committed {
+				for artPath, art := range idx[path].Outputs {
+					arts[filepath.Join(path, artPath)] = art
+				}
+			}
+			if err := pushAndEvict(ch, arts); err != nil {
+				fatal(err)
+			}
+		}
+		reportStageErrors(errs)
 	},
 }
+
+// logCommitTotals summarizes the files added to the cache, distinguishing those
+// whose contents were already there.
+func logCommitTotals(totals cache.CommitResult) {
+	numFiles := totals.FilesAdded + totals.FilesDeduplicated
+	if numFiles == 0 {
+		return
+	}
+	logger.Info.Printf(
+		"committed %d files, %d already in the cache (deduplication saved %s)\n",
+		numFiles,
+		totals.FilesDeduplicated,
+		datasize.ByteSize(totals.BytesDeduplicated).HR(),
+	)
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(compareCmd)
+}
+
+var compareCmd = &cobra.Command{
+	Use:   "compare stage_file_a stage_file_b",
+	Short: "Check whether two stages have equivalent outputs",
+	Long: `Compare checks whether two stages have equivalent outputs.
+
+Compare matches up the outputs of the two stages by their paths relative to
+each stage's working directory, and compares the checksums recorded in their
+stage files. Two versions of a stage that write the same files to different
+directories can then be compared. Directory outputs whose checksums
+differ are compared file by file using their manifests in the cache, and each
+file that differs or is in only one of the directories is listed. Nothing is
+read from the workspace, so both stages must be committed.
+
+Each output is reported as one of:
+  matches           both stages recorded the same contents
+  differs           the stages recorded different contents
+  only in <stage>   only one of the stages has the output
+  not committed     one of the stages has no checksum for the output
+
+Use compare to confirm that a refactored pipeline produces identical results
+to the original. The stages need not be in the index. Compare exits with a
+non-zero code if any output doesn't match.`,
+	Example: "dud compare train.yaml train_v2.yaml",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, paths []string) {
+		_, ch, err := prepareWithoutIndex(paths)
+		if err != nil {
+			fatal(err)
+		}
+		stageA, err := stage.FromFile(paths[0])
+		if err != nil {
+			fatal(err)
+		}
+		stageB, err := stage.FromFile(paths[1])
+		if err != nil {
+			fatal(err)
+		}
+		mismatches, total, err := compareStageOutputs(os.Stdout, ch, paths, stageA, stageB)
+		if err != nil {
+			fatal(err)
+		}
+		if mismatches > 0 {
+			fatal(errors.Errorf("%d of %d outputs don't match", mismatches, total))
+		}
+	},
+}
+
+// compareStageOutputs writes one line for each output of either Stage, sorted
+// by path relative to the Stage's working directory, followed by the files
+// that differ in directory outputs. It returns the number of outputs that
+// don't match and the total number of outputs.
+func compareStageOutputs(
+	writer io.Writer,
+	ch cache.LocalCache,
+	stagePaths []string,
+	stageA, stageB stage.Stage,
+) (mismatches, total int, err error) {
+	outputsA, err := outputsByWorkingDirPath(stageA)
+	if err != nil {
+		return
+	}
+	outputsB, err := outputsByWorkingDirPath(stageB)
+	if err != nil {
+		return
+	}
+	pathSet := make(map[string]bool)
+	for path := range outputsA {
+		pathSet[path] = true
+	}
+	for path := range outputsB {
+		pathSet[path] = true
+	}
+	paths := make([]string, 0, len(pathSet))
+	for path := range pathSet {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tabWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, path := range paths {
+		artA, inA := outputsA[path]
+		artB, inB := outputsB[path]
+		var diffs []string
+		var description string
+		switch {
+		case !inB:
+			description = "only in " + stagePaths[0]
+		case !inA:
+			description = "only in " + stagePaths[1]
+		case artA.Checksum == "" || artB.Checksum == "":
+			description = "not committed"
+		case artA.Checksum == artB.Checksum:
+			description = "matches"
+		default:
+			description = "differs"
+			if artA.IsDir && artB.IsDir {
+				if diffs, err = ch.DirDifferences(*artA, *artB); err != nil {
+					return
+				}
+			}
+		}
+		if description != "matches" {
+			mismatches++
+		}
+		fmt.Fprintf(tabWriter, "%s\t%s\n", path, description)
+		for _, diff := range diffs {
+			fmt.Fprintf(tabWriter, "  %s\n", filepath.Join(path, diff))
+		}
+	}
+	return mismatches, len(paths), tabWriter.Flush()
+}
+
+// outputsByWorkingDirPath returns the Stage's outputs keyed by their paths
+// relative to the Stage's working directory.
+func outputsByWorkingDirPath(stg stage.Stage) (map[string]*artifact.Artifact, error) {
+	outputs := make(map[string]*artifact.Artifact, len(stg.Outputs))
+	for path, art := range stg.Outputs {
+		relPath, err := filepath.Rel(stg.WorkingDir, path)
+		if err != nil {
+			return nil, err
+		}
+		outputs[relPath] = art
+	}
+	return outputs, nil
+}
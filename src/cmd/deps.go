@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(depsCmd)
+}
+
+var depsCmd = &cobra.Command{
+	Use:   "deps stage_or_artifact",
+	Short: "List the stages that depend on a stage or artifact",
+	Long: `Deps lists the stages that depend on a stage or artifact.
+
+Deps prints the path of every stage that depends on the given stage file or
+artifact, directly or through other stages. A stage depends on a stage file if
+any of its inputs are outputs of that stage, and it depends on an artifact if
+any of its inputs are the artifact, are inside it, or contain it. These are the
+stages that would need to re-run if the stage or artifact changed.
+
+Stages are listed in the order they would run: each stage is listed after all
+the stages it depends on.`,
+	Example: "dud deps data/raw.csv",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, _, idx, err := prepare(args)
+		if err != nil {
+			fatal(err)
+		}
+
+		dependents, err := idx.Dependents(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		for _, stagePath := range dependents {
+			logger.Info.Println(stagePath)
+		}
+	},
+}
@@ -0,0 +1,332 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/index"
+	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// A checkResult is the outcome of one of doctor's checks.
+type checkResult struct {
+	// problems describes each problem found. The check passed if there are
+	// none.
+	problems []string
+	// hint tells the user how to fix the problems.
+	hint string
+	// warnOnly is true if the problems don't need fixing.
+	warnOnly bool
+	// skipped is true if the check couldn't run because an earlier check
+	// failed.
+	skipped bool
+}
+
+// doctor holds the state shared by doctor's checks. Later checks use the
+// stages loaded by earlier ones.
+type doctor struct {
+	ch  cache.LocalCache
+	idx index.Index
+	// idxComplete is true if every stage in the index loaded without problems.
+	idxComplete bool
+	// manifestsIntact is true if no manifests in the cache are corrupt.
+	manifestsIntact bool
+}
+
+func (d *doctor) checkLock() checkResult {
+	exists, err := fsutil.Exists(lockPath, false)
+	if err != nil {
+		return checkResult{problems: []string{err.Error()}}
+	}
+	if !exists {
+		return checkResult{}
+	}
+	return checkResult{
+		problems: []string{fmt.Sprintf("lock file %s exists", lockPath)},
+		hint: fmt.Sprintf(
+			"If no other Dud command is running, Dud exited unexpectedly; remove %s.",
+			lockPath,
+		),
+	}
+}
+
+func (d *doctor) checkCache() checkResult {
+	hint := "Create the cache directory, or set 'cache' in the config to a writable directory."
+	info, err := os.Stat(d.ch.Dir())
+	if err != nil {
+		return checkResult{problems: []string{err.Error()}, hint: hint}
+	}
+	if !info.IsDir() {
+		return checkResult{
+			problems: []string{fmt.Sprintf("%s is not a directory", d.ch.Dir())},
+			hint:     hint,
+		}
+	}
+	tempFile, err := os.CreateTemp(d.ch.Dir(), ".doctor-")
+	if err != nil {
+		return checkResult{problems: []string{err.Error()}, hint: hint}
+	}
+	tempFile.Close()
+	if err := os.Remove(tempFile.Name()); err != nil {
+		return checkResult{problems: []string{err.Error()}}
+	}
+	return checkResult{}
+}
+
+// checkStages loads every stage in the index, reporting each stage file that
+// is missing or invalid, and each output claimed by more than one stage.
+func (d *doctor) checkStages() checkResult {
+	d.idx = make(index.Index)
+	if stageGlobs := viper.GetStringSlice("stages"); len(stageGlobs) > 0 {
+		idx, err := index.FromGlobs(stageGlobs, discoverySkipPaths()...) // defined in cmd/root.go
+		if err != nil {
+			return checkResult{
+				problems: []string{err.Error()},
+				hint:     "Fix the stage file, or the patterns in the 'stages' config field.",
+			}
+		}
+		d.idx, d.idxComplete = idx, true
+		return checkResult{}
+	}
+
+	stagePaths, err := index.StagePathsFromFile(indexPath)
+	if err != nil {
+		return checkResult{
+			problems: []string{err.Error()},
+			hint:     "Run 'dud init' to create a new project.",
+		}
+	}
+	var result checkResult
+	for _, stagePath := range stagePaths {
+		stg, err := stage.FromFile(stagePath)
+		if err == nil {
+			err = d.idx.AddStage(stg, stagePath)
+		}
+		if err != nil {
+			result.problems = append(result.problems, err.Error())
+		}
+	}
+	if len(result.problems) > 0 {
+		result.hint = fmt.Sprintf(
+			"Fix each stage file, or remove stages that no longer exist from %s.",
+			indexPath,
+		)
+	}
+	d.idxComplete = len(result.problems) == 0
+	return result
+}
+
+// checkLinks reports links in the workspace outputs of all stages that don't
+// point to an existing object in the cache.
+func (d *doctor) checkLinks() checkResult {
+	var result checkResult
+	for _, stagePath := range d.idx.SortStagePaths() {
+		for _, art := range d.idx[stagePath].Outputs {
+			if art.SkipCache {
+				continue
+			}
+			problems, err := d.badLinks(art.Path)
+			if err != nil {
+				return checkResult{problems: []string{err.Error()}}
+			}
+			result.problems = append(result.problems, problems...)
+		}
+	}
+	if len(result.problems) > 0 {
+		result.hint = "Run 'dud checkout --relink' to replace the links with links to the cache."
+	}
+	return result
+}
+
+// badLinks returns a description of each link at or under path that points
+// outside the cache or to nothing at all.
+func (d *doctor) badLinks(path string) (problems []string, err error) {
+	cacheDir := d.ch.Dir() + string(filepath.Separator)
+	err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || entry.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			// Checkout creates relative links.
+			target, err = filepath.Abs(filepath.Join(filepath.Dir(path), target))
+			if err != nil {
+				return err
+			}
+		}
+		if !strings.HasPrefix(target, cacheDir) {
+			problems = append(problems, fmt.Sprintf("%s links outside the cache to %s", path, target))
+		} else if exists, err := fsutil.Exists(target, true); err != nil {
+			return err
+		} else if !exists {
+			problems = append(problems, fmt.Sprintf("%s links to %s, which doesn't exist", path, target))
+		}
+		return nil
+	})
+	return
+}
+
+// checkManifests reports directory and chunked file outputs whose manifests
+// in the cache are corrupt, such as after a crash during commit.
+func (d *doctor) checkManifests() checkResult {
+	var arts []*artifact.Artifact
+	for _, stg := range d.idx {
+		for _, art := range stg.Outputs {
+			arts = append(arts, art)
+		}
+	}
+	corrupt, err := d.ch.CorruptManifests(arts)
+	if err != nil {
+		return checkResult{problems: []string{err.Error()}}
+	}
+	d.manifestsIntact = len(corrupt) == 0
+	var result checkResult
+	for _, art := range corrupt {
+		result.problems = append(
+			result.problems,
+			fmt.Sprintf("%s has a corrupt manifest %s", art.Path, art.Checksum),
+		)
+	}
+	if len(result.problems) > 0 {
+		result.hint = "Remove each manifest with 'dud cache rm', then re-commit or fetch the artifacts."
+	}
+	return result
+}
+
+// checkOrphans reports objects in the cache that aren't referenced by any
+// stage or linked from the workspace. These are normal after re-committing a
+// stage, so they're only a warning.
+func (d *doctor) checkOrphans() checkResult {
+	if !d.idxComplete || !d.manifestsIntact {
+		return checkResult{skipped: true}
+	}
+	var count int
+	var size int64
+	err := walkUnreferencedBlobs(d.ch, d.idx, true, func(_ string, info os.FileInfo) error {
+		count++
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return checkResult{problems: []string{err.Error()}}
+	}
+	if count == 0 {
+		return checkResult{}
+	}
+	return checkResult{
+		problems: []string{fmt.Sprintf(
+			"%d objects (%s) aren't referenced by any stage",
+			count,
+			datasize.ByteSize(size).HumanReadable(),
+		)},
+		hint:     "These are usually earlier versions of committed artifacts.",
+		warnOnly: true,
+	}
+}
+
+// writeCheckResult writes a line with the outcome of the named check, followed
+// by any problems and the hint. It returns true if the check failed.
+func writeCheckResult(writer io.Writer, name string, result checkResult) (failed bool) {
+	switch {
+	case result.skipped:
+		fmt.Fprintf(writer, "skip  %s\n", name)
+		return false
+	case len(result.problems) == 0:
+		fmt.Fprintf(writer, "ok    %s\n", name)
+		return false
+	case result.warnOnly:
+		fmt.Fprintf(writer, "warn  %s\n", name)
+	default:
+		fmt.Fprintf(writer, "FAIL  %s\n", name)
+		failed = true
+	}
+	for _, problem := range result.problems {
+		fmt.Fprintf(writer, "      %s\n", problem)
+	}
+	if result.hint != "" {
+		fmt.Fprintf(writer, "      hint: %s\n", result.hint)
+	}
+	return
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the project for common problems",
+	Long: `Doctor checks the project for common problems.
+
+Doctor runs each of the following checks, and prints whether it passed along
+with hints for fixing any problems found:
+
+  - The project isn't locked by another Dud command.
+  - The cache directory exists and is writable.
+  - Every stage in the index loads, and no two stages own the same artifact.
+  - Links in the workspace point to objects in the cache.
+  - The manifests of committed directory and chunked file artifacts match
+    their checksums. A crash during commit can leave them corrupt.
+  - Every object in the cache is referenced by a stage or linked from the
+    workspace. Unreferenced objects are usually earlier versions of
+    artifacts, so this is only a warning.
+
+Doctor doesn't change anything, and doesn't lock the project. It exits with a
+non-zero code if any check fails.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		rootDir, err := getProjectRootDir()
+		if err != nil {
+			fatal(err)
+		}
+		if err := os.Chdir(rootDir); err != nil {
+			fatal(err)
+		}
+		if err := readConfig(rootDir); err != nil {
+			fatal(err)
+		}
+		ch, err := cache.NewLocalCache(viper.GetString("cache"))
+		if err != nil {
+			fatal(err)
+		}
+
+		d := doctor{ch: ch}
+		checks := []struct {
+			name  string
+			check func() checkResult
+		}{
+			{"project is unlocked", d.checkLock},
+			{"cache directory is writable", d.checkCache},
+			{"stages load without conflicts", d.checkStages},
+			{"workspace links point into the cache", d.checkLinks},
+			{"committed manifests are intact", d.checkManifests},
+			{"cache objects are referenced", d.checkOrphans},
+		}
+		var failed int
+		for _, check := range checks {
+			if writeCheckResult(os.Stdout, check.name, check.check()) {
+				failed++
+			}
+		}
+		if failed > 0 {
+			fatal(errors.Errorf("%d of %d checks failed", failed, len(checks)))
+		}
+	},
+}
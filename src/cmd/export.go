@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	exportCmd.Flags().IntVar(
+		&exportPaths.StripComponents,
+		"strip-components",
+		0,
+		"remove this many leading components from the path of each archive entry",
+	)
+	exportCmd.Flags().StringVar(
+		&exportPaths.Prefix,
+		"prefix",
+		"",
+		"prepend this path to the path of each archive entry",
+	)
+	rootCmd.AddCommand(exportCmd)
+}
+
+var exportPaths cache.ExportPaths
+
+var exportCmd = &cobra.Command{
+	Use:   "export [flags] artifact_path archive",
+	Short: "Write a committed artifact to a gzipped tar archive",
+	Long: `Export writes a committed artifact to a gzipped tar archive.
+
+Export reads the artifact from the cache, not the workspace, so the archive
+holds the artifact exactly as it was committed. The archive holds a single
+file or directory named after the artifact, so anyone can extract it without
+Dud or the cache. The artifact may be a stage output, or a file or directory
+within a directory artifact. All of the artifact's files must be in the cache;
+run 'dud fetch' first if needed.
+
+Use --strip-components and --prefix to lay out the archive differently from
+the workspace, without committing the artifact again. As with tar,
+--strip-components removes the given number of leading components from the
+path of each archive entry, starting with the artifact's own name, and leaves
+out entries with no path left. --prefix then prepends the given relative path
+to every entry. Only archives holding a single file or directory can be added
+to a project with 'dud import'.
+
+Use 'dud import' to add an exported archive to another project.`,
+	Example: `dud export data/ data.tar.gz
+dud export --strip-components 1 --prefix datasets/v2 data/ data.tar.gz`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		rootDir, ch, idx, err := prepare(args)
+		if err != nil {
+			fatal(err)
+		}
+		artPath, archivePath := args[0], args[1]
+
+		_, owner, ok := idx.FindOwner(artPath)
+		if !ok {
+			fatal(fmt.Errorf("artifact %s is not the output of any stage", artPath))
+		}
+		art := *owner
+		if owner.Path != artPath {
+			childPath, err := filepath.Rel(owner.Path, artPath)
+			if err != nil {
+				fatal(err)
+			}
+			if art, err = ch.ChildArtifact(rootDir, *owner, childPath); err != nil {
+				fatal(err)
+			}
+		}
+
+		if err := exportPaths.Validate(); err != nil {
+			fatal(err)
+		}
+		if err := exportArchive(ch, art, archivePath); err != nil {
+			fatal(err)
+		}
+		logger.Info.Printf("Exported %s to %s.\n", artPath, archivePath)
+	},
+}
+
+// exportArchive writes the archive of art to archivePath, leaving nothing
+// behind if it fails.
+func exportArchive(ch cache.LocalCache, art artifact.Artifact, archivePath string) (err error) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(archivePath)
+		}
+	}()
+	return ch.ExportArchive(art, file, exportPaths)
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"github.com/c2h5oh/datasize"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -14,6 +17,31 @@ func init() {
 		false,
 		"don't operate recursively over Stage inputs",
 	)
+	fetchCmd.Flags().StringVar(
+		&bandwidthLimit,
+		"bwlimit",
+		"",
+		"limit the combined transfer rate, in bytes per second (e.g. 10MB)",
+	)
+}
+
+var bandwidthLimit string
+
+// setBandwidthLimit applies the --bwlimit flag to the cache, falling back to
+// the 'bwlimit' config field if the flag isn't set.
+func setBandwidthLimit(ch *cache.LocalCache) error {
+	limit := bandwidthLimit
+	if limit == "" {
+		limit = viper.GetString("bwlimit")
+	}
+	if limit == "" {
+		return nil
+	}
+	var rate datasize.ByteSize
+	if err := rate.UnmarshalText([]byte(limit)); err != nil {
+		return errors.Wrapf(err, "invalid bandwidth limit %#v", limit)
+	}
+	return ch.SetBandwidthLimit(int64(rate.Bytes()))
 }
 
 type noRemoteError struct{}
@@ -32,7 +60,21 @@ remote cache specified in the Dud config file. If no stage files are passed
 in, fetch will act on all stages in the index. By default, fetch will act
 recursively on all stages upstream of the given stage(s).
 
-This command requires rclone to be installed on your machine. Visit
+Fetch only populates the local cache; it never modifies the workspace. For
+directory artifacts, the manifest and every file it references are fetched,
+so a later 'dud checkout' works without access to the remote. Fetch fails if
+the remote is missing any file.
+
+Every downloaded file is checked against its checksum before it is added to the
+cache. Fetch fails if any file doesn't match, such as after a truncated
+download, and the file is discarded.
+
+With --bwlimit, the combined rate of all downloads is capped at the given
+number of bytes per second (e.g. 10MB). The 'bwlimit' config field sets a
+default limit.
+
+This command requires rclone to be installed on your machine, unless the remote
+is the absolute path of a local directory (see 'dud init --bare'). Visit
 https://rclone.org/ for more information and installation instructions.`,
 	Run: func(cmd *cobra.Command, paths []string) {
 		rootDir, ch, idx, err := prepare(paths)
@@ -45,6 +87,10 @@ https://rclone.org/ for more information and installation instructions.`,
 			fatal(noRemoteError{})
 		}
 
+		if err := setBandwidthLimit(&ch); err != nil {
+			fatal(err)
+		}
+
 		if len(paths) == 0 {
 			// Ignore disableRecursion flag when no args passed.
 			disableRecursion = false
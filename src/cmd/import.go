@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/kevin-hanselman/dud/src/strategy"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().BoolVarP(
+		&useCopyStrategy, // defined in cmd/checkout.go
+		"copy",
+		"c",
+		false,
+		"On checkout, copy the file instead of linking.",
+	)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [flags] archive path",
+	Short: "Commit the contents of a gzipped tar archive as a new stage",
+	Long: `Import extracts a gzipped tar archive and commits it as a new stage.
+
+The archive must hold a single file or directory, such as an archive written
+by 'dud export'. Import extracts it to the given path, which must not exist,
+whatever it is named in the archive. Import then creates a stage file named
+<path>.dud with the path as its only output, adds the stage to the index, and
+commits it. If 'signing-key' is set in the config, import signs the new stage
+file, like commit.`,
+	Example: "dud import data.tar.gz data",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		strat := strategy.LinkStrategy
+		if useCopyStrategy {
+			strat = strategy.CopyStrategy
+		}
+
+		rootDir, ch, idx, err := prepare(args)
+		if err != nil {
+			fatal(err)
+		}
+		if isIndexDerived() {
+			fatal(derivedIndexError{})
+		}
+		archivePath, artPath := args[0], args[1]
+		stagePath := artPath + ".dud"
+
+		signingKey, err := loadSigningKey() // defined in cmd/verify.go
+		if err != nil {
+			fatal(err)
+		}
+
+		exists, err := fsutil.Exists(stagePath, false)
+		if err != nil {
+			fatal(err)
+		}
+		if exists {
+			fatal(fmt.Errorf("stage file %s already exists", stagePath))
+		}
+
+		archive, err := os.Open(archivePath)
+		if err != nil {
+			fatal(err)
+		}
+		err = fsutil.ExtractArchive(archive, artPath)
+		archive.Close()
+		if err != nil {
+			fatal(err)
+		}
+
+		fileStatus, err := fsutil.FileStatusFromPath(artPath)
+		if err != nil {
+			fatal(err)
+		}
+		stg := stage.Stage{
+			WorkingDir: ".",
+			Outputs: map[string]*artifact.Artifact{
+				artPath: {
+					Path:  artPath,
+					IsDir: fileStatus == fsutil.StatusDirectory,
+				},
+			},
+		}
+		if err := stg.Validate(stagePath); err != nil {
+			os.RemoveAll(artPath)
+			fatal(err)
+		}
+		if err := idx.AddStage(stg, stagePath); err != nil {
+			os.RemoveAll(artPath)
+			fatal(err)
+		}
+		committed := make(map[string]bool)
+		inProgress := make(map[string]bool)
+		if err := idx.Commit(stagePath, ch, rootDir, strat, false, committed, inProgress, logger); err != nil {
+			fatal(err)
+		}
+		if signingKey != nil {
+			idx[stagePath].Sign(signingKey)
+		}
+		if err := idx[stagePath].ToFile(stagePath); err != nil {
+			fatal(err)
+		}
+		if err := writeIndex(rootDir, ch, idx); err != nil {
+			fatal(err)
+		}
+		logger.Info.Printf("Added %s to the index.\n", stagePath)
+	},
+}
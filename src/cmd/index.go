@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/fsutil"
+	"github.com/kevin-hanselman/dud/src/index"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	indexCmd.AddCommand(indexLogCmd)
+	indexCmd.AddCommand(indexRestoreCmd)
+	rootCmd.AddCommand(indexCmd)
+}
+
+// indexLogEntry is a line of the index log, which records a version of the
+// index file stored in the cache.
+type indexLogEntry struct {
+	Time     time.Time
+	Checksum string
+}
+
+// readIndexLog returns the entries of the index log, oldest first. A missing
+// log has no entries. It assumes the working directory is the project root.
+func readIndexLog() ([]indexLogEntry, error) {
+	errPrefix := "read index log " + indexLogPath
+	file, err := os.Open(indexLogPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errPrefix)
+	}
+	defer file.Close()
+	var entries []indexLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s: malformed line %#v", errPrefix, scanner.Text())
+		}
+		logTime, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			return nil, errors.Wrap(err, errPrefix)
+		}
+		entries = append(entries, indexLogEntry{Time: logTime, Checksum: fields[1]})
+	}
+	return entries, errors.Wrap(scanner.Err(), errPrefix)
+}
+
+// recordIndexHistory stores the index file in the cache and appends its
+// checksum to the index log, unless it's the latest version in the log
+// already. It assumes the working directory is the project root.
+func recordIndexHistory(ch cache.LocalCache) error {
+	errPrefix := "record index history"
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	defer file.Close()
+	cksum, err := ch.CommitBlob(file)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	entries, err := readIndexLog()
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if len(entries) > 0 && entries[len(entries)-1].Checksum == cksum {
+		return nil
+	}
+	logFile, err := os.OpenFile(indexLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if _, err := fmt.Fprintf(logFile, "%s %s\n", time.Now().UTC().Format(time.RFC3339), cksum); err != nil {
+		logFile.Close()
+		return errors.Wrap(err, errPrefix)
+	}
+	return errors.Wrap(logFile.Close(), errPrefix)
+}
+
+// addIndexHistoryBlobs adds the checksums of all versions of the index file in
+// the index log to referenced, so they aren't treated as unused objects.
+func addIndexHistoryBlobs(referenced map[string]bool) error {
+	entries, err := readIndexLog()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		referenced[entry.Checksum] = true
+	}
+	return nil
+}
+
+// findIndexVersion returns the checksum in the index log that starts with
+// prefix. The prefix must match exactly one checksum.
+func findIndexVersion(entries []indexLogEntry, prefix string) (string, error) {
+	var match string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Checksum, prefix) || entry.Checksum == match {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("checksum %s is ambiguous in the index log", prefix)
+		}
+		match = entry.Checksum
+	}
+	if match == "" {
+		return "", fmt.Errorf("checksum %s is not in the index log", prefix)
+	}
+	return match, nil
+}
+
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "Commands for managing the history of the index",
+	Long: `Index is a group of commands for managing the history of the index.
+
+If 'index-history' is set to true in the config, every command that changes the
+index file stores its new version as an object in the cache, and appends the
+object's checksum to .dud/index-log with the time of the change. This keeps a
+lightweight history of which stages were in the index, without source control,
+so a change to the index can be undone. Only the list of stages is recorded,
+not the stage files themselves.
+
+Versions of the index in the log are kept by 'dud prune --cached'.`,
+}
+
+var indexLogCmd = &cobra.Command{
+	Use:   "log",
+	Short: "List past versions of the index",
+	Long: `Log lists the versions of the index recorded in .dud/index-log, newest first.
+
+Each line shows the checksum of the version, when it was recorded, and how many
+stages it lists. The version that matches the current index file is marked
+"(current)". Versions whose objects are missing from the cache are marked
+"(missing from cache)".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, ch, err := prepareWithoutIndex(nil)
+		if err != nil {
+			fatal(err)
+		}
+		entries, err := readIndexLog()
+		if err != nil {
+			fatal(err)
+		}
+		current, err := index.FileChecksum(indexPath)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			fatal(err)
+		}
+		if err := writeIndexLog(os.Stdout, ch, entries, current); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// writeIndexLog writes one line for each entry of the index log, newest first.
+func writeIndexLog(writer io.Writer, ch cache.LocalCache, entries []indexLogEntry, current string) error {
+	tabWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		blobPath, err := ch.BlobPath(entry.Checksum)
+		if err != nil {
+			return err
+		}
+		var description string
+		stagePaths, err := index.StagePathsFromFile(blobPath)
+		if os.IsNotExist(errors.Cause(err)) {
+			description = "(missing from cache)"
+		} else if err != nil {
+			return err
+		} else {
+			description = fmt.Sprintf("%d stages", len(stagePaths))
+		}
+		if entry.Checksum == current {
+			description += " (current)"
+		}
+		fmt.Fprintf(
+			tabWriter,
+			"%s\t%s\t%s\n",
+			entry.Checksum,
+			entry.Time.Local().Format(time.RFC3339),
+			description,
+		)
+	}
+	return tabWriter.Flush()
+}
+
+var indexRestoreCmd = &cobra.Command{
+	Use:   "restore checksum",
+	Short: "Replace the index with a past version",
+	Long: `Restore replaces the index file with a past version from .dud/index-log.
+
+The checksum may be abbreviated to any prefix that matches only one version in
+the log. Stage files aren't changed, so a stage file removed since the version
+was recorded must be restored from source control or re-created. If
+'index-history' is set to true, the restored index is recorded as a new
+version, so the restore itself can be undone.`,
+	Example: "dud index restore 8843d7f9",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rootDir, ch, err := prepareWithoutIndex(nil)
+		if err != nil {
+			fatal(err)
+		}
+		if isIndexDerived() {
+			fatal(derivedIndexError{})
+		}
+		entries, err := readIndexLog()
+		if err != nil {
+			fatal(err)
+		}
+		cksum, err := findIndexVersion(entries, args[0])
+		if err != nil {
+			fatal(err)
+		}
+		blobPath, err := ch.BlobPath(cksum)
+		if err != nil {
+			fatal(err)
+		}
+		stagePaths, err := index.StagePathsFromFile(blobPath)
+		if err != nil {
+			fatal(err)
+		}
+		err = fsutil.WriteFileAtomic(indexPath, 0o644, func(w io.Writer) error {
+			for _, stagePath := range stagePaths {
+				if _, err := fmt.Fprintln(w, stagePath); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fatal(err)
+		}
+		if viper.GetBool("index-history") {
+			if err := recordIndexHistory(ch); err != nil {
+				fatal(err)
+			}
+		}
+		logger.Info.Printf("Restored the index in %s to %s (%d stages).\n", rootDir, cksum, len(stagePaths))
+	},
+}
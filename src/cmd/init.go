@@ -1,18 +1,60 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 )
 
+var bareCacheDir string
+
+// initBareCache creates an empty cache directory at dir, for use as a remote.
+func initBareCache(dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(absDir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("cannot create bare cache in %s: directory is not empty", absDir)
+	}
+	logger.Info.Printf(`Bare Dud cache initialized in %s.
+To push to and fetch from this cache, add the following to a project's
+.dud/config.yaml:
+
+remote: %s
+`, absDir, absDir)
+	return nil
+}
+
 func init() {
-	rootCmd.AddCommand(&cobra.Command{
+	initCmd := &cobra.Command{
 		Use:   "init",
 		Short: "Initialize a Dud project",
-		Long:  `Init initializes a Dud project in the current directory.`,
-		Args:  cobra.NoArgs,
+		Long: `Init initializes a Dud project in the current directory.
+
+With --bare, init instead creates an empty cache in the given directory, with
+no project around it. A bare cache can be shared as the remote of many
+projects by setting 'remote' to its absolute path in each project's config.
+Remotes that are absolute paths are read and written directly, so they don't
+require rclone.`,
+		Args: cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
+			if bareCacheDir != "" {
+				if err := initBareCache(bareCacheDir); err != nil {
+					fatal(err)
+				}
+				return
+			}
+
 			if err := os.MkdirAll(".dud/cache", 0o755); err != nil {
 				fatal(err)
 			}
@@ -34,6 +76,167 @@ func init() {
 #
 # For more info, see the rclone docs:
 # https://rclone.org/docs/#syntax-of-remote-paths
+#
+# 'remote' can also be the absolute path of a local directory, such as a shared
+# cache created with 'dud init --bare'. Local remotes don't require rclone.
+#
+# remote: /mnt/shared/dud-cache
+#
+# To have 'dud checkout' download artifacts missing from the local cache from
+# the remote, instead of running 'dud fetch' first, set 'auto-fetch' to true.
+#
+# auto-fetch: true
+#
+# To limit the combined transfer rate of push, fetch, and auto-fetch, set
+# 'bwlimit' to a number of bytes per second. The --bwlimit flag overrides it.
+#
+# bwlimit: 10MB
+#
+# On machines without room for a full local cache (e.g. ephemeral compute), set
+# 'cache-type' to "remote" to make the remote the primary cache. 'dud commit'
+# then pushes committed files to the remote and removes them from the local
+# cache, and 'dud checkout' fetches files as needed, checks them out as copies,
+# and removes them from the local cache afterward. Only the small manifests of
+# directory and chunked artifacts are kept locally. Files aren't streamed
+# between the workspace and the remote: each commit or checkout stages the
+# objects of every artifact it handles in the local cache, and only removes them
+# once the command is done, so the local disk still needs room for all of them
+# at once. 'dud status' doesn't re-hash files whose objects aren't in the local
+# cache, so it reports files in directory artifacts as missing from the cache,
+# and their directories as modified. The default is "local".
+#
+# cache-type: remote
+
+# To build the index from stage files matching glob patterns instead of from
+# .dud/index, set 'stages' to a list of patterns relative to the project root.
+# A "**" path component matches zero or more directories. The cache directory
+# and directories wholly owned by a discovered stage's directory outputs are not
+# searched. When set, 'dud stage add' and 'dud stage remove' are disabled.
+#
+# stages: ['**/*.dud']
+
+# To write a human-readable listing of each stage's directory outputs next to
+# the stage file on commit (e.g. data.dud.manifest), set 'manifest-sidecar' to
+# true. These files can be tracked in source control for review; Dud never
+# reads them.
+#
+# manifest-sidecar: true
+
+# To limit how many files 'dud commit' opens at once, set 'max-open-files'.
+# This helps when committing very large directories exhausts the limit of open
+# file descriptors (e.g. "too many open files" errors). It must be at least 2.
+#
+# max-open-files: 256
+
+# By default, 'dud commit' reads all entries of a directory before committing
+# any of them. For directories with millions of files, set 'dir-batch-size' to
+# read and commit entries that many at a time, which bounds memory use.
+#
+# dir-batch-size: 10000
+
+# By default, 'dud commit' encodes directory manifests as JSON. For directories
+# with millions of files, set 'manifest-format' to "msgpack" for smaller
+# manifests that are faster to read. Manifests in either format can always be
+# read, but versions of Dud without this setting can't read msgpack manifests.
+# The format is part of a directory's checksum, so changing it changes the
+# checksums of directories committed afterward.
+#
+# manifest-format: msgpack
+
+# By default, 'dud commit' moves files into the cache when possible instead of
+# copying them. If the cache is on a network filesystem (e.g. NFS) where moving
+# files is unreliable, set 'force-copy' to true to always copy files instead.
+#
+# force-copy: true
+#
+# When 'dud commit' copies a file into the cache, it first writes it to a
+# temporary file in the cache directory. To write temporary files somewhere
+# else, such as a fast scratch disk, set 'temp-dir'. Relative paths are
+# relative to the project root. If 'temp-dir' is on a different filesystem than
+# the cache, each temporary file is copied into the cache rather than moved.
+#
+# temp-dir: /scratch/dud
+#
+# To keep the extended attributes of files, including POSIX ACLs, set
+# 'preserve-xattrs' to true. 'dud commit' then records each file's attributes,
+# and 'dud checkout --copy' restores them. Attributes in the "security" and
+# "trusted" namespaces are skipped. Linked files can't have attributes of their
+# own, as the objects in the cache are shared.
+#
+# preserve-xattrs: true
+
+# To keep a record of every change to the cache, set 'audit-log' to true. Dud
+# then appends a JSON object to .dud/audit.log for each artifact committed or
+# checked out and each object fetched or removed, with the time, operation,
+# artifact path, checksum, size in bytes, and checkout strategy.
+#
+# audit-log: true
+
+# To keep a history of the index, set 'index-history' to true. Every command
+# that changes .dud/index then stores the new version in the cache and appends
+# its checksum to .dud/index-log. Use 'dud index log' to list past versions and
+# 'dud index restore' to roll back to one.
+#
+# index-history: true
+
+# By default, objects are written to the cache without waiting for them to
+# reach the disk, so a power loss shortly after 'dud commit' can lose them. To
+# sync every object and its cache directory to disk as commit or fetch writes
+# it, set 'cache-fsync' to true. This slows down commits, but is worth it if the
+# cache is the primary copy of your data.
+#
+# cache-fsync: true
+
+# To hash several chunks of a chunked file artifact at once, set
+# 'checksum-threads'. This speeds up 'dud commit' and 'dud status' on very large
+# chunked files when hashing is CPU-bound. It doesn't affect checksums. The
+# --threads flag takes precedence.
+#
+# checksum-threads: 4
+
+# 'dud commit' reads files on up to 64 workers and hashes them on as many
+# workers as there are CPUs. Tune the two separately with 'threads-io' and
+# 'threads-cpu', e.g. to read more files at once from high-latency storage.
+# 'threads-cpu' also caps the hashing of the chunks read at once under
+# 'checksum-threads'. None of these affects checksums. The --threads-io and
+# --threads-cpu flags take precedence.
+#
+# threads-io: 128
+# threads-cpu: 4
+
+# Files are read through a 64KB buffer while they're hashed. On storage with
+# high latency, such as network mounts, a larger 'checksum-buffer-size' can
+# improve throughput by reading files in fewer, larger requests. It doesn't
+# affect checksums.
+#
+# checksum-buffer-size: 4MB
+
+# By default, chunked file artifacts are split into fixed-size chunks. To split
+# them where their contents call for it instead, set 'content-defined-chunking'
+# to true. Files (and versions of a file) that share regions then share chunks
+# in the cache, even when data was inserted or removed before those regions.
+# Chunked artifacts committed before the change keep their chunks.
+#
+# content-defined-chunking: true
+
+# To record the MIME type of each committed file, detected from its first
+# bytes, set 'detect-content-types' to true. The type is stored with the file's
+# checksum in its stage file or directory manifest, for tools that catalog
+# artifacts, and shows up in 'dud status --format json'. When a file changes,
+# the detected type replaces any type set by hand. It doesn't affect any file's
+# checksum, but as a directory's manifest lists the types of its files, it
+# changes the checksums of directory artifacts.
+#
+# detect-content-types: true
+
+# To sign stage files, set 'signing-key' to the path of an Ed25519 private key
+# in PEM format (e.g. from 'openssl genpkey -algorithm ed25519'). 'dud commit'
+# then signs the checksums recorded in each stage file it writes, and 'dud
+# verify-signatures' checks the signatures against the public key at
+# 'signing-public-key'. Keep the private key out of source control.
+#
+# signing-key: /path/to/dud.key
+# signing-public-key: dud.pub
 `
 
 			if err := os.WriteFile(".dud/config.yaml", []byte(dudConf), 0o644); err != nil {
@@ -61,5 +264,12 @@ func init() {
 			logger.Info.Println(`Dud project initialized.
 See .dud/config.yaml and .dud/rclone.conf to customize the project.`)
 		},
-	})
+	}
+	initCmd.Flags().StringVar(
+		&bareCacheDir,
+		"bare",
+		"",
+		"create an empty cache in the given directory for use as a remote",
+	)
+	rootCmd.AddCommand(initCmd)
 }
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(pathCmd)
+	pathCmd.Flags().BoolVar(
+		&listChildBlobs,
+		"children",
+		false,
+		"list the cache paths of all files in a directory artifact",
+	)
+}
+
+var listChildBlobs bool
+
+var pathCmd = &cobra.Command{
+	Use:   "path [flags] artifact_path",
+	Short: "Print the location of a committed artifact in the cache",
+	Long: `Path prints the absolute path of a committed artifact in the cache.
+
+Path looks up the checksum of the given artifact, which must be the output of
+a stage in the index, and prints where the artifact is stored in the cache.
+The path is printed whether or not the file exists in the cache. For a
+directory artifact, this is the path of the directory manifest. Use --children
+to instead list the paths of all files in the directory, including files in
+sub-directories. Files with identical contents are stored once, so they are
+only listed once.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, ch, idx, err := prepare(args)
+		if err != nil {
+			fatal(err)
+		}
+		artPath := args[0]
+
+		_, art, ok := idx.FindOutput(artPath)
+		if !ok {
+			fatal(fmt.Errorf("artifact %s is not the output of any stage", artPath))
+		}
+
+		if !listChildBlobs {
+			blobPath, err := ch.BlobPath(art.Checksum)
+			if err != nil {
+				fatal(errors.Wrapf(err, "artifact %s", artPath))
+			}
+			logger.Info.Println(blobPath)
+			return
+		}
+
+		if !art.IsDir {
+			fatal(fmt.Errorf("artifact %s is not a directory", artPath))
+		}
+		blobPaths, err := ch.LeafBlobPaths(*art)
+		if err != nil {
+			fatal(err)
+		}
+		for _, blobPath := range blobPaths {
+			logger.Info.Println(blobPath)
+		}
+	},
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/index"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	pruneCmd.Flags().BoolVar(
+		&pruneCached,
+		"cached",
+		false,
+		"also remove cache objects not referenced by any remaining stage",
+	)
+	pruneCmd.Flags().BoolVar(
+		&verifyLinks,
+		"verify-links",
+		false,
+		"with --cached, keep objects linked from anywhere in the workspace",
+	)
+	rootCmd.AddCommand(pruneCmd)
+}
+
+var pruneCached, verifyLinks bool
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune [flags]",
+	Short: "Remove stages whose stage files no longer exist from the index",
+	Long: `Prune removes stages whose stage files no longer exist from the index.
+
+Deleting a stage file without running 'dud stage remove' leaves the stage in
+the index, and most commands then fail to load the index. Prune removes every
+such stage from the index and reports each one it removes.
+
+With --cached, prune also removes all objects in the cache that aren't
+referenced by any of the remaining stages. Because the pruned stage files are
+gone, prune can't tell which objects they referenced, so this also removes any
+earlier versions of the remaining stages' artifacts. Versions of the index in
+.dud/index-log are kept. Links in the workspace to the removed objects are left
+dangling, unless --verify-links is given. With --verify-links, prune searches
+the whole workspace for links into the cache, and keeps every object they point
+to, even if no stage references it.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		rootDir, ch, err := prepareWithoutIndex(nil)
+		if err != nil {
+			fatal(err)
+		}
+
+		if isIndexDerived() {
+			fatal(derivedIndexError{})
+		}
+
+		if indexChecksum, err = index.FileChecksum(indexPath); err != nil {
+			fatal(err)
+		}
+		idx, missing, err := index.FromFileSkipMissing(indexPath)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, path := range missing {
+			logger.Info.Printf("Removed %s from the index.\n", path)
+		}
+		if len(missing) > 0 {
+			if err := writeIndex(rootDir, ch, idx); err != nil {
+				fatal(err)
+			}
+		}
+
+		if pruneCached {
+			count, size, err := removeUnreferencedBlobs(ch, idx, verifyLinks)
+			if err != nil {
+				fatal(err)
+			}
+			logger.Info.Printf(
+				"Removed %d objects (%s) from the cache.\n",
+				count,
+				datasize.ByteSize(size).HumanReadable(),
+			)
+		}
+	},
+}
+
+// removeUnreferencedBlobs removes all objects in the cache that aren't
+// referenced by the outputs of any stage in the Index or by the index log. See
+// walkUnreferencedBlobs for verifyLinks. It returns the number of objects
+// removed and their total size.
+func removeUnreferencedBlobs(
+	ch cache.LocalCache,
+	idx index.Index,
+	verifyLinks bool,
+) (count int, size int64, err error) {
+	err = walkUnreferencedBlobs(ch, idx, verifyLinks, func(cksum string, info os.FileInfo) error {
+		if err := ch.RemoveBlob(cksum); err != nil {
+			return err
+		}
+		count++
+		size += info.Size()
+		return nil
+	})
+	return
+}
+
+// walkUnreferencedBlobs calls fn for each object in the cache that isn't
+// referenced by the outputs of any stage in the Index or by the index log, in
+// order of checksum. If verifyLinks is true, objects linked from anywhere in
+// the workspace count as referenced.
+func walkUnreferencedBlobs(
+	ch cache.LocalCache,
+	idx index.Index,
+	verifyLinks bool,
+	fn func(cksum string, info os.FileInfo) error,
+) error {
+	var arts []*artifact.Artifact
+	for _, stg := range idx {
+		for _, art := range stg.Outputs {
+			arts = append(arts, art)
+		}
+	}
+	referenced, err := ch.ReferencedBlobs(arts)
+	if err != nil {
+		return err
+	}
+	if err := addIndexHistoryBlobs(referenced); err != nil {
+		return err
+	}
+	if verifyLinks {
+		if err := addLinkedBlobs(ch, referenced); err != nil { // defined in cmd/cache.go
+			return err
+		}
+	}
+	return ch.WalkBlobs(func(cksum, _ string, info os.FileInfo) error {
+		if referenced[cksum] {
+			return nil
+		}
+		return fn(cksum, info)
+	})
+}
@@ -20,6 +20,12 @@ func init() {
 		false,
 		"don't operate recursively over Stage inputs",
 	)
+	pullCmd.Flags().StringVar(
+		&bandwidthLimit,
+		"bwlimit",
+		"",
+		"limit the combined transfer rate, in bytes per second (e.g. 10MB)",
+	)
 }
 
 var pullCmd = &cobra.Command{
@@ -27,7 +33,8 @@ var pullCmd = &cobra.Command{
 	Short: "Fetch artifacts from the remote and checkout",
 	Long: `Pull runs fetch followed by checkout.
 
-This command requires rclone to be installed on your machine. Visit
+This command requires rclone to be installed on your machine, unless the remote
+is the absolute path of a local directory (see 'dud init --bare'). Visit
 https://rclone.org/ for more information and installation instructions.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fetchCmd.Run(cmd, args)
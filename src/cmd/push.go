@@ -13,6 +13,12 @@ func init() {
 		false,
 		"disable recursive operation on upstream stages",
 	)
+	pushCmd.Flags().StringVar(
+		&bandwidthLimit,
+		"bwlimit",
+		"",
+		"limit the combined transfer rate, in bytes per second (e.g. 10MB)",
+	)
 	rootCmd.AddCommand(pushCmd)
 }
 
@@ -26,7 +32,12 @@ remote cache specified in the Dud config file. If no stage files are passed
 in, push will act on all stages in the index. By default, push will
 act recursively on all stages upstream of the given stage(s).
 
-This command requires rclone to be installed on your machine. Visit
+With --bwlimit, the combined rate of all uploads is capped at the given number
+of bytes per second (e.g. 10MB). The 'bwlimit' config field sets a default
+limit.
+
+This command requires rclone to be installed on your machine, unless the remote
+is the absolute path of a local directory (see 'dud init --bare'). Visit
 https://rclone.org/ for more information and installation instructions.`,
 	Run: func(cmd *cobra.Command, paths []string) {
 		rootDir, ch, idx, err := prepare(paths)
@@ -39,6 +50,10 @@ https://rclone.org/ for more information and installation instructions.`,
 			fatal(noRemoteError{})
 		}
 
+		if err := setBandwidthLimit(&ch); err != nil {
+			fatal(err)
+		}
+
 		if len(idx) == 0 {
 			fatal(emptyIndexError{})
 		}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/kevin-hanselman/dud/src/strategy"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	refreshCmd.Flags().BoolVarP(
+		&keepGoing, // defined in cmd/root.go
+		"keep-going",
+		"k",
+		false,
+		"refresh other stages when a stage fails",
+	)
+	rootCmd.AddCommand(refreshCmd)
+}
+
+var refreshCmd = &cobra.Command{
+	Use:   "refresh [flags] stage_file...",
+	Short: "Record the current checksums of stage outputs without caching them",
+	Long: `Refresh records the current checksums of stage outputs without caching them.
+
+For each stage file passed in, refresh checksums every output artifact as it
+is in the workspace and records the checksums in the stage file, like commit,
+but without adding the contents of any files to the cache. Use it to make
+the workspace the new canonical version of a stage's outputs after changing
+them outside of Dud, without storing copies in the cache yet. Run commit later
+to add the files to the cache.
+
+Workspace files are left in place as they are. Only the given stages are
+refreshed, not the stages upstream of them. Like commit, refresh records the
+checksum of each stage's definition, so status reports the definition as
+up-to-date. If 'signing-key' is set in the config, refresh signs each stage it
+writes, like commit.
+
+The manifests of directory and chunked file artifacts are written to the
+cache, so status can compare their contents. Status then reports refreshed
+files as "matches checksum, missing from cache" while they're unchanged, and
+files in refreshed directories as "missing from cache". Fetch, checkout, and
+push treat them all as missing from the cache.
+
+With --keep-going, a stage that fails to refresh doesn't stop refresh from
+refreshing the remaining stages. All errors are printed at the end, and
+refresh exits with a non-zero code.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, paths []string) {
+		rootDir, ch, idx, err := prepare(paths)
+		if err != nil {
+			fatal(err)
+		}
+
+		if err := setChecksumThreads(&ch); err != nil { // defined in cmd/commit.go
+			fatal(err)
+		}
+		ch.EnableChecksumOnly()
+
+		signingKey, err := loadSigningKey() // defined in cmd/verify.go
+		if err != nil {
+			fatal(err)
+		}
+
+		errs := make(map[string]error)
+		for _, path := range paths {
+			stg, ok := idx[path]
+			if !ok {
+				stageFailed(errs, path, fmt.Errorf("stage %s is not in the index", path))
+				continue
+			}
+			logger.Info.Printf("refreshing stage %s\n", path)
+			if err := refreshStage(stg, rootDir, ch); err != nil {
+				stageFailed(errs, path, err)
+				continue
+			}
+			if signingKey != nil {
+				stg.Sign(signingKey)
+			}
+			if err := stg.ToFile(path); err != nil {
+				stageFailed(errs, path, err)
+			}
+		}
+		reportStageErrors(errs)
+	},
+}
+
+// refreshStage records the current checksums of the Stage's outputs using a
+// checksum-only cache, and checksums the Stage definition as commit does.
+func refreshStage(stg *stage.Stage, rootDir string, ch cache.Cache) (err error) {
+	for _, art := range stg.Outputs {
+		if _, err := ch.Commit(rootDir, art, strategy.CopyStrategy, logger); err != nil {
+			return err
+		}
+	}
+	stg.Checksum, err = stg.CalculateChecksum()
+	return
+}
@@ -6,11 +6,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/pprof"
 	"runtime/trace"
+	"sort"
 	"strings"
 
-	"github.com/felixge/fgprof"
+	"github.com/c2h5oh/datasize"
 	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
 	"github.com/kevin-hanselman/dud/src/cache"
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/index"
@@ -22,8 +26,10 @@ import (
 )
 
 const (
-	indexPath = ".dud/index"
-	lockPath  = ".dud/lock"
+	indexPath    = ".dud/index"
+	lockPath     = ".dud/lock"
+	auditLogPath = ".dud/audit.log"
+	indexLogPath = ".dud/index-log"
 )
 
 type emptyIndexError struct{}
@@ -32,6 +38,18 @@ func (e emptyIndexError) Error() string {
 	return "index is empty"
 }
 
+type derivedIndexError struct{}
+
+func (e derivedIndexError) Error() string {
+	return "the index is derived from the 'stages' config field and cannot be edited directly"
+}
+
+type notProjectError struct{}
+
+func (e notProjectError) Error() string {
+	return "not a dud repository (or any parent up to /); run 'dud init'"
+}
+
 type projectLockedError struct{}
 
 func (e projectLockedError) Error() string {
@@ -41,29 +59,37 @@ func (e projectLockedError) Error() string {
 var (
 	// Version is the version of the app.
 	Version string
+	// Commit is the git commit the app was built from.
+	Commit string
+	// BuildDate is the time the app was built.
+	BuildDate string
 
 	rootCmd = &cobra.Command{
 		Use: "dud",
 		Long: `Dud is a lightweight tool for versioning data alongside source code and
 building data pipelines.`,
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if workDir != "" {
+				if err := os.Chdir(workDir); err != nil {
+					fatal(err)
+				}
+			}
+			// Discover the project root once, before any command changes the
+			// working directory. Commands that need a project report the error.
+			projectRootDir, projectRootErr = findProjectRootDir()
+			projectRootSearched = true
 			if verbose {
 				logger.Debug = log.New(os.Stderr, "", 0)
 			}
+			doProfile := profileDir != ""
 			if doProfile && doTrace {
 				fatal(errors.New("cannot enable both profiling and tracing"))
 			}
 			if doProfile {
 				logger.Info.Println("enabled profiling")
-				// TODO: If we stop relying on the project-wide lock file, this
-				// should be flocked.
-				debugOutput, err := os.Create("dud.pprof")
-				if err != nil {
+				if err := startProfiling(profileDir); err != nil {
 					fatal(err)
 				}
-				// TODO: Consider replacing this with github.com/pkg/profile
-				stopProfiling = fgprof.Start(debugOutput, fgprof.FormatPprof)
-				fgprof.Start(debugOutput, fgprof.FormatPprof)
 			} else if doTrace {
 				logger.Info.Println("enabled tracing")
 				// TODO: If we stop relying on the project-wide lock file, this
@@ -83,15 +109,41 @@ building data pipelines.`,
 	// This is the Logger for the entire application.
 	logger *agglog.AggLogger
 
-	doProfile, doTrace, verbose, projectLocked bool
-	debugOutput                                *os.File
-	stopProfiling                              func() error
+	doTrace, verbose, projectLocked, keepGoing bool
+	profileDir, workDir                        string
+	debugOutput, heapOutput                    *os.File
+	// indexChecksum is the checksum of the index file when it was loaded.
+	indexChecksum string
+	// projectRootDir is the project root directory discovered from the
+	// working directory the command was run in, or projectRootErr if it
+	// couldn't be found.
+	projectRootDir      string
+	projectRootErr      error
+	projectRootSearched bool
 )
 
 func init() {
-	rootCmd.PersistentFlags().BoolVar(&doProfile, "profile", false, "enable profiling")
+	rootCmd.PersistentFlags().StringVar(
+		&profileDir,
+		"profile",
+		"",
+		"write CPU and heap profiles to the given directory",
+	)
+	// Allow "--profile" without a value to write to the current directory.
+	// Note this means a directory must be passed as "--profile=<dir>".
+	rootCmd.PersistentFlags().Lookup("profile").NoOptDefVal = "."
+	if err := rootCmd.PersistentFlags().MarkHidden("profile"); err != nil {
+		panic(err)
+	}
 	rootCmd.PersistentFlags().BoolVar(&doTrace, "trace", false, "enable tracing")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "increase output verbosity")
+	rootCmd.PersistentFlags().StringVarP(
+		&workDir,
+		"dir",
+		"C",
+		"",
+		"run as if dud was started in the given directory",
+	)
 
 	rootCmd.AddCommand(&cobra.Command{
 		Use:    "gen-docs",
@@ -118,14 +170,6 @@ func init() {
 		},
 	})
 
-	rootCmd.AddCommand(&cobra.Command{
-		Use:   "version",
-		Short: "Print the version number and exit",
-		Args:  cobra.NoArgs,
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(Version)
-		},
-	})
 }
 
 // Main is the entry point to the cobra CLI.
@@ -159,6 +203,54 @@ func fatal(err error) {
 	logger.Error.Fatal(err)
 }
 
+// stageFailed handles an error from processing the given stage. It calls fatal
+// unless keepGoing is set, in which case the error is recorded in errs so the
+// remaining stages can be processed.
+func stageFailed(errs map[string]error, stagePath string, err error) {
+	if !keepGoing {
+		fatal(err)
+	}
+	errs[stagePath] = err
+}
+
+// reportStageErrors prints every error recorded by stageFailed, in order of
+// stage path, then exits with a non-zero status. It does nothing if errs is
+// empty.
+func reportStageErrors(errs map[string]error) {
+	if len(errs) == 0 {
+		return
+	}
+	stagePaths := make([]string, 0, len(errs))
+	for path := range errs {
+		stagePaths = append(stagePaths, path)
+	}
+	sort.Strings(stagePaths)
+	for _, path := range stagePaths {
+		logger.Error.Printf("%s: %v\n", path, errs[path])
+	}
+	fatal(fmt.Errorf("stages failed: %d", len(errs)))
+}
+
+// startProfiling starts CPU profiling and creates the output files for both
+// the CPU and heap profiles. Both files are created up front because prepare()
+// may change the working directory before the heap profile is written.
+func startProfiling(dir string) (err error) {
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	// TODO: If we stop relying on the project-wide lock file, these should be
+	// flocked.
+	debugOutput, err = os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return
+	}
+	heapOutput, err = os.Create(filepath.Join(dir, "heap.pprof"))
+	if err != nil {
+		return
+	}
+	return pprof.StartCPUProfile(debugOutput)
+}
+
 func stopDebugging() error {
 	if debugOutput != nil {
 		defer debugOutput.Close()
@@ -166,9 +258,14 @@ func stopDebugging() error {
 	if doTrace {
 		logger.Info.Println("writing tracing output to dud.trace")
 		trace.Stop()
-	} else if stopProfiling != nil {
-		logger.Info.Println("writing profiling output to dud.pprof")
-		if err := stopProfiling(); err != nil {
+	} else if heapOutput != nil {
+		defer heapOutput.Close()
+		logger.Info.Printf("writing profiling output to %s\n", profileDir)
+		pprof.StopCPUProfile()
+		// Get up-to-date statistics on live objects before writing the heap
+		// profile.
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(heapOutput); err != nil {
 			return err
 		}
 	}
@@ -216,7 +313,18 @@ func readConfig(rootDir string) (err error) {
 	return
 }
 
+// getProjectRootDir returns the project root directory discovered by rootCmd.
 func getProjectRootDir() (string, error) {
+	if !projectRootSearched {
+		projectRootDir, projectRootErr = findProjectRootDir()
+		projectRootSearched = true
+	}
+	return projectRootDir, projectRootErr
+}
+
+// findProjectRootDir returns the closest directory to the working directory,
+// including the working directory itself, that contains a .dud directory.
+func findProjectRootDir() (string, error) {
 	dirname, err := os.Getwd()
 	if err != nil {
 		return "", err
@@ -232,11 +340,11 @@ func getProjectRootDir() (string, error) {
 			return dirname, nil
 		}
 
-		dirname = filepath.Dir(dirname)
-
-		if dirname == "/" {
-			return "", errors.New("no project root directory found")
+		parent := filepath.Dir(dirname)
+		if parent == dirname {
+			return "", notProjectError{}
 		}
+		dirname = parent
 	}
 }
 
@@ -254,6 +362,23 @@ func pathAbsThenRel(base string, path string) (string, error) {
 // lock file. This isn't a comprehensive solution for concurrent user errors,
 // but it should prevent the most common problems.
 func lockProject(rootDir string) error {
+	locked, err := tryLockProject(rootDir)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		logger.Error.Println(`Another invocation of Dud may be running, or Dud may have exited
+unexpectedly and orphaned the lock file. If you are certain Dud is not already
+running and your project is healthy, you may remove the lock file and try
+running Dud again.`)
+		return projectLockedError{}
+	}
+	return nil
+}
+
+// tryLockProject attempts to lock the project like lockProject, but it
+// returns false instead of an error if the project is already locked.
+func tryLockProject(rootDir string) (bool, error) {
 	// If we're already in the project root, we technically can use lockPath
 	// directly, but this approach explicitly requires we know the project
 	// root.
@@ -266,16 +391,12 @@ func lockProject(rootDir string) error {
 	)
 	if err == nil {
 		projectLocked = true
-		return lockFile.Close()
+		return true, lockFile.Close()
 	}
 	if os.IsExist(err) {
-		logger.Error.Println(`Another invocation of Dud may be running, or Dud may have exited
-unexpectedly and orphaned the lock file. If you are certain Dud is not already
-running and your project is healthy, you may remove the lock file and try
-running Dud again.`)
-		return projectLockedError{}
+		return false, nil
 	}
-	return err
+	return false, err
 }
 
 func unlockProject() error {
@@ -292,6 +413,15 @@ func unlockProject() error {
 // The paths argument is updated in-place so each path is relative to the
 // project root directory.
 func prepare(paths []string) (rootDir string, ch cache.LocalCache, idx index.Index, err error) {
+	if rootDir, ch, err = prepareWithoutIndex(paths); err != nil {
+		return
+	}
+	idx, err = loadIndex()
+	return
+}
+
+// prepareWithoutIndex does everything prepare does except load the Index.
+func prepareWithoutIndex(paths []string) (rootDir string, ch cache.LocalCache, err error) {
 	// The order of operations here is important. Before we cd to the project
 	// root directory, we need to adjust the paths, which are relative to the
 	// working directory (or absolute paths already).
@@ -307,6 +437,12 @@ func prepare(paths []string) (rootDir string, ch cache.LocalCache, idx index.Ind
 		}
 	}
 
+	if relativeTo != "" {
+		if relativeTo, err = filepath.Abs(relativeTo); err != nil {
+			return
+		}
+	}
+
 	if err = os.Chdir(rootDir); err != nil {
 		return
 	}
@@ -324,6 +460,158 @@ func prepare(paths []string) (rootDir string, ch cache.LocalCache, idx index.Ind
 		return
 	}
 
-	idx, err = index.FromFile(indexPath)
+	if viper.GetBool("audit-log") {
+		ch.EnableAuditLog(filepath.Join(rootDir, auditLogPath))
+	}
+
+	if viper.GetBool("cache-fsync") {
+		ch.EnableSyncedCommits()
+	}
+
+	if err = setChecksumBufferSize(&ch); err != nil {
+		return
+	}
+
+	var remoteCache bool
+	if remoteCache, err = usesRemoteCache(); err != nil {
+		return
+	}
+	if remoteCache {
+		// The local cache only holds objects in transit, so any object missing
+		// from it is fetched from the remote on demand.
+		ch.EnableAutoFetch(viper.GetString("remote"))
+		if err = setBandwidthLimit(&ch); err != nil {
+			return
+		}
+	}
 	return
 }
+
+// relativeTo holds the --relative-to flag of the commands that support it.
+// prepareWithoutIndex makes it absolute.
+var relativeTo string
+
+// addRelativeToFlag adds the --relative-to flag to cmd. Commands with the flag
+// should resolve artifact paths against workspaceDir(rootDir).
+func addRelativeToFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(
+		&relativeTo,
+		"relative-to",
+		"",
+		"resolve artifact paths against this directory instead of the project root",
+	)
+}
+
+// workspaceDir returns the directory to resolve artifact paths against: the
+// given project root directory, unless overridden with --relative-to.
+func workspaceDir(rootDir string) string {
+	if relativeTo != "" {
+		return relativeTo
+	}
+	return rootDir
+}
+
+// setChecksumBufferSize applies the 'checksum-buffer-size' config field to the
+// cache.
+func setChecksumBufferSize(ch *cache.LocalCache) error {
+	bufferSize := viper.GetString("checksum-buffer-size")
+	if bufferSize == "" {
+		return nil
+	}
+	var size datasize.ByteSize
+	if err := size.UnmarshalText([]byte(bufferSize)); err != nil {
+		return errors.Wrapf(err, "invalid checksum buffer size %#v", bufferSize)
+	}
+	return ch.SetChecksumBufferSize(int64(size.Bytes()))
+}
+
+// usesRemoteCache returns true if the 'cache-type' config field makes the
+// remote the primary cache. readConfig() must be called beforehand.
+func usesRemoteCache() (bool, error) {
+	switch cacheType := viper.GetString("cache-type"); cacheType {
+	case "", "local":
+		return false, nil
+	case "remote":
+		if viper.GetString("remote") == "" {
+			return false, noRemoteError{}
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf(
+			"invalid cache type %#v; must be \"local\" or \"remote\"",
+			cacheType,
+		)
+	}
+}
+
+// pushAndEvict pushes the objects of the given Artifacts to the remote and then
+// removes them from the local cache. Objects are only removed once the push
+// succeeds, so nothing that exists solely in the local cache is lost.
+func pushAndEvict(ch cache.LocalCache, arts map[string]*artifact.Artifact) error {
+	if len(arts) == 0 {
+		return nil
+	}
+	if err := ch.Push(viper.GetString("remote"), arts); err != nil {
+		return err
+	}
+	evicted, err := ch.Evict(arts)
+	if err != nil {
+		return err
+	}
+	logger.Debug.Printf("removed %d objects from the local cache\n", evicted)
+	return nil
+}
+
+// loadIndex loads the Index for the project. It assumes the working directory
+// is the project root and the config has been read.
+func loadIndex() (index.Index, error) {
+	// If the user configured glob patterns for Stage files, the Index is
+	// built on the fly and the index file is ignored.
+	if stageGlobs := viper.GetStringSlice("stages"); len(stageGlobs) > 0 {
+		return index.FromGlobs(stageGlobs, discoverySkipPaths()...)
+	}
+	var err error
+	if indexChecksum, err = index.FileChecksum(indexPath); err != nil {
+		return nil, err
+	}
+	return index.FromFile(indexPath)
+}
+
+// discoverySkipPaths returns the directories, relative to the project root,
+// that stage discovery must not search. It assumes the working directory is
+// the project root.
+func discoverySkipPaths() []string {
+	cacheDir, err := filepath.Abs(viper.GetString("cache"))
+	if err != nil {
+		return nil
+	}
+	rootDir, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	relCacheDir, err := filepath.Rel(rootDir, cacheDir)
+	if err != nil || relCacheDir == "." || strings.HasPrefix(relCacheDir, "..") {
+		return nil
+	}
+	return []string{relCacheDir}
+}
+
+// writeIndex writes the Index to the index file, unless the file was modified
+// since loadIndex read it. If 'index-history' is set, the new version of the
+// index file is also recorded in the index log.
+func writeIndex(rootDir string, ch cache.LocalCache, idx index.Index) error {
+	err := idx.ToFileIfUnchanged(filepath.Join(rootDir, indexPath), indexChecksum)
+	if err != nil {
+		return err
+	}
+	if viper.GetBool("index-history") {
+		return recordIndexHistory(ch)
+	}
+	return nil
+}
+
+// isIndexDerived returns true if the Index is built from the 'stages' config
+// field rather than the index file. prepare() must be called beforehand.
+func isIndexDerived() bool {
+	return len(viper.GetStringSlice("stages")) > 0
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func init() {
@@ -13,6 +14,12 @@ func init() {
 		false,
 		"disable recursive operation on upstream stages",
 	)
+	runCmd.Flags().IntVar(
+		&checksumThreads, // defined in cmd/commit.go
+		"threads",
+		0,
+		"hash up to this many chunks of a chunked file at once",
+	)
 }
 
 var runSingleStage bool
@@ -26,13 +33,43 @@ For each stage passed in, run executes a stage's command if it is out-of-date.
 If no stage files are passed in, run will act on all stages in the index. By
 default, run will act recursively on all stages upstream of the given stage,
 and thus run will execute a stage's command if any upstream stages are
-out-of-date.`,
+out-of-date.
+
+An output declared with 'capture: stdout' receives the standard output of its
+stage's command. Rather than being written to the workspace and read back on
+commit, the output is committed to the cache as the command writes it, and then
+linked into the workspace. Run records its new checksum in the stage file, so
+a later commit doesn't need to read it again. At most one output per stage may
+capture stdout, and it must be a file output that is neither chunked nor
+skips the cache. If 'signing-key' is set in the config, run signs each stage
+file it writes, like commit.`,
 	Run: func(cmd *cobra.Command, paths []string) {
 		rootDir, ch, idx, err := prepare(paths)
 		if err != nil {
 			fatal(err)
 		}
 
+		if err := setChecksumThreads(&ch); err != nil {
+			fatal(err)
+		}
+
+		if viper.GetBool("force-copy") {
+			ch.EnableForceCopy()
+		}
+
+		if viper.GetBool("content-defined-chunking") {
+			ch.EnableContentDefinedChunking()
+		}
+
+		if viper.GetBool("detect-content-types") {
+			ch.EnableContentTypeDetection()
+		}
+
+		signingKey, err := loadSigningKey() // defined in cmd/verify.go
+		if err != nil {
+			fatal(err)
+		}
+
 		if len(idx) == 0 {
 			fatal(emptyIndexError{})
 		}
@@ -44,13 +81,31 @@ out-of-date.`,
 		}
 
 		ran := make(map[string]bool)
+		var runErr error
 		for _, path := range paths {
 			inProgress := make(map[string]bool)
-			err := idx.Run(path, ch, rootDir, !runSingleStage, ran, inProgress, logger)
-			if err != nil {
-				fatal(err)
+			runErr = idx.Run(path, ch, rootDir, !runSingleStage, ran, inProgress, logger)
+			if runErr != nil {
+				break
 			}
 			logger.Info.Println()
 		}
+
+		// Captured outputs were committed while their stages ran, so record
+		// their new checksums even if a later stage failed.
+		for path, stg := range idx {
+			if _, ok := stg.CapturedOutput(); !ok || !ran[path] {
+				continue
+			}
+			if signingKey != nil {
+				stg.Sign(signingKey)
+			}
+			if err := stg.ToFile(path); err != nil {
+				fatal(err)
+			}
+		}
+		if runErr != nil {
+			fatal(runErr)
+		}
 	},
 }
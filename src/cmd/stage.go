@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/checksum"
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/stage"
 
@@ -21,6 +23,10 @@ A Stage is a group of Artifacts, or an operation that consumes and/or produces
 a group of Artifacts. Stages are defined by the user in YAML files and should be
 tracked with source control.
 
+Stage files ending in .json or .toml are read and written as JSON or TOML
+instead, with the same field names as YAML stage files. This suits stage files
+generated by other programs. All other stage files are YAML.
+
 Below is a fully-annotated Stage YAML file for reference.
 
 ` + "``` yaml" + `
@@ -41,6 +47,19 @@ command: python train.py
 # project root.
 working-dir: .
 
+# Environment variables set for the Stage's command, on top of the environment
+# Dud is run with. Values can reference other variables as $VAR or ${VAR},
+# including variables set here. A variable referencing itself, such as PATH
+# below, expands to the value Dud was run with.
+env:
+  DATA_ROOT: data
+  PATH: ${PATH}:./bin
+
+# 'frozen' tells 'dud commit' to skip this Stage, leaving this file and the
+# Stage's outputs untouched, unless '--thaw' is passed. 'dud status' marks the
+# Stage definition as frozen. Defaults to false when omitted.
+frozen: true
+
 # The set of Artifacts which the Stage requires to run 'command' above.
 inputs:
   # The Artifact path. All paths are relative to the project's root
@@ -66,6 +85,31 @@ outputs:
     # Artifacts.
     disable-recursion: true
 
+    # 'ordered' tells Dud to record the natural order of the directory's
+    # contents (e.g. "shard-2" before "shard-10") in the directory manifest,
+    # including in all sub-directories. Defaults to false when omitted. Not
+    # applicable for file Artifacts.
+    ordered: true
+
+    # 'preserve-hardlinks' tells Dud to record which files in the directory
+    # are hard links to the same file, including in all sub-directories.
+    # Checking out the directory as copies then links them again instead of
+    # copying their contents twice. Only hard links between files in the same
+    # directory are recorded; files linked across sub-directories are checked
+    # out as separate copies. Defaults to false when omitted. Not applicable
+    # for file Artifacts.
+    preserve-hardlinks: true
+
+    # 'include' and 'exclude' tell Dud which entries of this directory Artifact
+    # to track, using glob patterns matched against each entry's name. If
+    # 'include' is set, only files matching one of its patterns are tracked;
+    # sub-directories are always tracked. Files and sub-directories matching an
+    # 'exclude' pattern are ignored, even if they match 'include'. Both apply
+    # to all sub-directories. Ignored entries are left alone in the workspace.
+    # Not applicable for file Artifacts.
+    include: ['*.tfevents.*']
+    exclude: ['_tmp_*']
+
   metrics.json:
     # 'skip-cache' tells Dud not to commit this Artifact to the cache. Dud will
     # still write a checksum for this Artifact during 'dud commit', and it will
@@ -73,6 +117,41 @@ outputs:
     # for declaring Stage outputs which can be safely stored in source control
     # rather than Dud. This option is implicit for Artifacts in 'inputs'.
     skip-cache: true
+
+  logs/events.log:
+    # 'chunked' tells Dud to split the file into chunks and store each chunk in
+    # the cache separately. Committing a file that was changed or appended to
+    # only adds the changed chunks to the cache, which saves space and time for
+    # large, append-mostly files. Chunked files are never linked to the cache;
+    # they are always checked out as copies. Set 'content-defined-chunking' in
+    # the config to share chunks between files with common regions. Defaults
+    # to false when omitted. Not applicable for directory Artifacts.
+    chunked: true
+
+  model.bin:
+    # The size and modification time of the file when it was last committed,
+    # written during 'dud commit' for files that are left as regular files in
+    # the workspace (e.g. committed with '--copy'). While the file's size and
+    # modification time are unchanged, 'dud status' trusts that its contents
+    # match the checksum without reading it. Removing it is always safe.
+    fingerprint: 1048576-1700000000000000000
+
+  predictions.csv:
+    # 'capture' tells 'dud run' to commit the standard output of the Stage's
+    # command as this Artifact, streaming it into the cache instead of
+    # writing it to the workspace and reading it back. The only supported
+    # value is 'stdout', and at most one output per Stage may use it. Not
+    # applicable for directory, chunked, or skip-cache Artifacts, or for
+    # inputs.
+    capture: stdout
+
+  reports/summary.pdf:
+    # A MIME type or other format hint for the file, for tools that catalog
+    # artifacts. Dud never reads it, and it doesn't affect any checksums. If
+    # 'detect-content-types' is set in the config, 'dud commit' fills it in
+    # from the file's contents, and replaces it whenever the file changes.
+    # Not applicable for directory Artifacts.
+    content-type: application/pdf
 ` + "```",
 }
 
@@ -82,8 +161,16 @@ var genStageCmd = &cobra.Command{
 	Long: `Gen generates stage YAML and prints it to standard output.
 
 The output of this command can be redirected to a file and modified further as
-needed.`,
-	Example: `dud stage gen -o data/ python download_data.py > download.yaml`,
+needed.
+
+An input or output path may be a glob pattern, such as 'shards/*.csv'. Quote
+it so the shell doesn't expand it. Each existing file or directory the pattern
+matches becomes an artifact of its own, which is committed, checked out, and
+reported by status individually, unlike the files of a directory artifact.
+Patterns are expanded once, when the stage is generated; files created later
+aren't added to the stage.`,
+	Example: `dud stage gen -o data/ python download_data.py > download.yaml
+dud stage gen -i 'shards/*.csv' -o summary.json python summarize.py > summarize.yaml`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Don't use prepare() here because we need to transform the path
 		// arguments (e.g. stageWorkingDir).
@@ -91,36 +178,92 @@ needed.`,
 		if err != nil {
 			fatal(err)
 		}
-		stageWorkingDir, err := pathAbsThenRel(rootDir, stageWorkingDir)
+		stg, err := stageFromFlags(rootDir, strings.Join(args, " "))
 		if err != nil {
 			fatal(err)
 		}
-		stg := stage.Stage{
-			WorkingDir: stageWorkingDir,
-			Command:    strings.Join(args, " "),
+		if err := stg.Validate(""); err != nil {
+			fatal(err)
 		}
-		stg.Outputs = make(map[string]*artifact.Artifact, len(stageOutputs))
-		for _, path := range stageOutputs {
-			art, err := createArtifactFromPath(rootDir, path)
-			if err != nil {
-				fatal(err)
-			}
-			stg.Outputs[art.Path] = art
+		if err := stg.Serialize(os.Stdout); err != nil {
+			fatal(err)
 		}
-		stg.Inputs = make(map[string]*artifact.Artifact, len(stageInputs))
-		for _, path := range stageInputs {
-			art, err := createArtifactFromPath(rootDir, path)
+	},
+}
+
+var newStageCmd = &cobra.Command{
+	Use:   "new [flags] stage_name",
+	Short: "Create a new stage file using the CLI",
+	Long: `New creates a stage file named <stage_name>.dud.
+
+New builds a stage definition from the flags passed on the command line,
+validates it, and writes it to a new stage file. New fails if the stage file
+already exists, if the stage's working directory does not exist, or if any of
+the stage's outputs are already owned by a stage in the index. With --add, the
+new stage is also added to the index.
+
+As with 'dud stage gen', a quoted glob pattern passed to --dep or --out adds
+each file or directory it matches as an artifact of its own.`,
+	Example: `dud stage new train --dep train.py --dep data/ --out model.pkl --cmd 'python train.py' --add`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// As with 'stage gen', the path arguments must be transformed before
+		// prepare() changes to the project root.
+		rootDir, err := getProjectRootDir()
+		if err != nil {
+			fatal(err)
+		}
+		if stageWorkingDir != "" {
+			fileStatus, err := fsutil.FileStatusFromPath(stageWorkingDir)
 			if err != nil {
 				fatal(err)
 			}
-			stg.Inputs[art.Path] = art
+			if fileStatus != fsutil.StatusDirectory {
+				fatal(fmt.Errorf("working directory %s is not a directory", stageWorkingDir))
+			}
 		}
-		if err := stg.Validate(""); err != nil {
+		stg, err := stageFromFlags(rootDir, stageCommand)
+		if err != nil {
 			fatal(err)
 		}
-		if err := stg.Serialize(os.Stdout); err != nil {
+		stagePath := []string{args[0] + ".dud"}
+
+		_, ch, idx, err := prepare(stagePath)
+		if err != nil {
 			fatal(err)
 		}
+
+		if addNewStage && isIndexDerived() {
+			fatal(derivedIndexError{})
+		}
+
+		if err := stg.Validate(stagePath[0]); err != nil {
+			fatal(err)
+		}
+		exists, err := fsutil.Exists(stagePath[0], false)
+		if err != nil {
+			fatal(err)
+		}
+		if exists {
+			fatal(fmt.Errorf("stage file %s already exists", stagePath[0]))
+		}
+		// Adding the Stage to the Index checks for ownership conflicts, even if
+		// we don't write the Index afterwards.
+		if err := idx.AddStage(stg, stagePath[0]); err != nil {
+			fatal(err)
+		}
+
+		if err := stg.ToFile(stagePath[0]); err != nil {
+			fatal(err)
+		}
+		logger.Info.Printf("Created %s.", stagePath[0])
+
+		if addNewStage {
+			if err := writeIndex(rootDir, ch, idx); err != nil {
+				fatal(err)
+			}
+			logger.Info.Printf("Added %s to the index.", stagePath[0])
+		}
 	},
 }
 
@@ -134,11 +277,15 @@ checks if it conflicts with any stages already in the index, then adds the
 stage to the index file.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, paths []string) {
-		rootDir, _, idx, err := prepare(paths)
+		rootDir, ch, idx, err := prepare(paths)
 		if err != nil {
 			fatal(err)
 		}
 
+		if isIndexDerived() {
+			fatal(derivedIndexError{})
+		}
+
 		for _, path := range paths {
 			stg, err := stage.FromFile(path)
 			if err != nil {
@@ -150,9 +297,74 @@ stage to the index file.`,
 			logger.Info.Printf("Added %s to the index.", path)
 		}
 
-		if err := idx.ToFile(filepath.Join(rootDir, indexPath)); err != nil {
+		if err := writeIndex(rootDir, ch, idx); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+var setChecksumStageCmd = &cobra.Command{
+	Use:   "set-checksum --checksum checksum stage_file artifact_path",
+	Short: "Set the expected checksum of a file artifact",
+	Long: `Set-checksum sets the checksum of a file artifact in a stage file.
+
+Set-checksum records the given checksum for an artifact without committing the
+artifact, so the expected contents of the artifact can be pinned before the
+file is available. Once the file is present in the workspace, status reports
+whether its contents match the checksum. Use 'dud checksum' to calculate the
+checksum of a file.
+
+Set-checksum discards everything else commit recorded about the artifact's old
+contents, such as its content type. If 'signing-key' is set in the config,
+set-checksum signs the stage again. Otherwise, it removes the stage's signature,
+which would no longer be valid.`,
+	Example: `dud stage set-checksum --checksum 288a86a79f20a3d6dccdca7713beaed178798296bdfa7913fa2a62d9727bf8f8 data.dud data/raw.csv`,
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, _, _, err := prepare(args); err != nil {
+			fatal(err)
+		}
+		stagePath, artPath := args[0], args[1]
+
+		if !checksum.IsValid(artifactChecksum) {
+			fatal(fmt.Errorf("invalid checksum: %#v", artifactChecksum))
+		}
+
+		stg, err := stage.FromFile(stagePath)
+		if err != nil {
+			fatal(err)
+		}
+		art, ok := stg.Outputs[artPath]
+		if !ok {
+			art, ok = stg.Inputs[artPath]
+		}
+		if !ok {
+			fatal(fmt.Errorf("%s: no artifact %s", stagePath, artPath))
+		}
+		if art.IsDir {
+			fatal(fmt.Errorf("%s: cannot set the checksum of directory artifact %s", stagePath, artPath))
+		}
+		art.Checksum = artifactChecksum
+		// Everything else recorded on commit describes the old contents.
+		art.Fingerprint = ""
+		art.Xattrs = nil
+		art.ContentType = ""
+
+		signingKey, err := loadSigningKey() // defined in cmd/verify.go
+		if err != nil {
+			fatal(err)
+		}
+		if signingKey != nil {
+			stg.Sign(signingKey)
+		} else if stg.Signature != "" {
+			stg.Signature = ""
+			logger.Info.Printf("Removed the signature of %s; commit with a signing key to sign it again.", stagePath)
+		}
+
+		if err := stg.ToFile(stagePath); err != nil {
 			fatal(err)
 		}
+		logger.Info.Printf("Set checksum of %s in %s.", artPath, stagePath)
 	},
 }
 
@@ -163,11 +375,15 @@ var removeStageCmd = &cobra.Command{
 	Aliases: []string{"rm"},
 	Args:    cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, paths []string) {
-		rootDir, _, idx, err := prepare(paths)
+		rootDir, ch, idx, err := prepare(paths)
 		if err != nil {
 			fatal(err)
 		}
 
+		if isIndexDerived() {
+			fatal(derivedIndexError{})
+		}
+
 		for _, path := range paths {
 			if err := idx.RemoveStage(path); err != nil {
 				fatal(err)
@@ -175,15 +391,17 @@ var removeStageCmd = &cobra.Command{
 			logger.Info.Printf("Removed %s from the index.", path)
 		}
 
-		if err := idx.ToFile(filepath.Join(rootDir, indexPath)); err != nil {
+		if err := writeIndex(rootDir, ch, idx); err != nil {
 			fatal(err)
 		}
 	},
 }
 
 var (
-	stageOutputs, stageInputs []string
-	stageWorkingDir           string
+	stageOutputs, stageInputs     []string
+	stageWorkingDir, stageCommand string
+	artifactChecksum              string
+	addNewStage                   bool
 )
 
 func init() {
@@ -211,12 +429,133 @@ func init() {
 		"working directory for the stage's command",
 	)
 
+	newStageCmd.Flags().StringSliceVarP(
+		&stageOutputs,
+		"out",
+		"o",
+		[]string{},
+		"one or more output files or directories",
+	)
+
+	newStageCmd.Flags().StringSliceVarP(
+		&stageInputs,
+		"dep",
+		"d",
+		[]string{},
+		"one or more input files or directories",
+	)
+
+	newStageCmd.Flags().StringVarP(
+		&stageWorkingDir,
+		"work-dir",
+		"w",
+		"",
+		"working directory for the stage's command",
+	)
+
+	newStageCmd.Flags().StringVarP(
+		&stageCommand,
+		"cmd",
+		"c",
+		"",
+		"the stage's command",
+	)
+
+	newStageCmd.Flags().BoolVarP(
+		&addNewStage,
+		"add",
+		"a",
+		false,
+		"add the new stage to the index",
+	)
+
+	setChecksumStageCmd.Flags().StringVar(
+		&artifactChecksum,
+		"checksum",
+		"",
+		"the expected checksum of the artifact",
+	)
+	if err := setChecksumStageCmd.MarkFlagRequired("checksum"); err != nil {
+		panic(err)
+	}
+
 	stageCmd.AddCommand(genStageCmd)
+	stageCmd.AddCommand(newStageCmd)
 	stageCmd.AddCommand(addStageCmd)
 	stageCmd.AddCommand(removeStageCmd)
+	stageCmd.AddCommand(setChecksumStageCmd)
 	rootCmd.AddCommand(stageCmd)
 }
 
+// stageFromFlags creates a Stage from the flags shared by 'stage gen' and
+// 'stage new'. It must be called before changing to the project root.
+func stageFromFlags(rootDir, command string) (stg stage.Stage, err error) {
+	workingDir, err := pathAbsThenRel(rootDir, stageWorkingDir)
+	if err != nil {
+		return
+	}
+	stg = stage.Stage{
+		WorkingDir: workingDir,
+		Command:    command,
+	}
+	outputs, err := expandArtifactGlobs(stageOutputs)
+	if err != nil {
+		return
+	}
+	inputs, err := expandArtifactGlobs(stageInputs)
+	if err != nil {
+		return
+	}
+	stg.Outputs = make(map[string]*artifact.Artifact, len(outputs))
+	for _, path := range outputs {
+		art, err := createArtifactFromPath(rootDir, path)
+		if err != nil {
+			return stg, err
+		}
+		stg.Outputs[art.Path] = art
+	}
+	stg.Inputs = make(map[string]*artifact.Artifact, len(inputs))
+	for _, path := range inputs {
+		art, err := createArtifactFromPath(rootDir, path)
+		if err != nil {
+			return stg, err
+		}
+		stg.Inputs[art.Path] = art
+	}
+	return
+}
+
+// expandArtifactGlobs replaces each path that contains glob metacharacters,
+// and doesn't exist as written, with the paths of the files and directories it
+// matches. Each match becomes an artifact of its own. A pattern that matches
+// nothing is an error.
+func expandArtifactGlobs(paths []string) ([]string, error) {
+	expanded := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !strings.ContainsAny(path, "*?[") {
+			expanded = append(expanded, path)
+			continue
+		}
+		exists, err := fsutil.Exists(path, false)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			expanded = append(expanded, path)
+			continue
+		}
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %#v: %w", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern %#v matched no files", path)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
 func createArtifactFromPath(rootDir, path string) (art *artifact.Artifact, err error) {
 	// Use 'path' here because we haven't changed to the project root.
 	fileStatus, err := fsutil.FileStatusFromPath(path)
@@ -1,41 +1,551 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"text/tabwriter"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/index"
 	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/mattn/go-isatty"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
+const (
+	// How long to wait for filesystem events to settle before refreshing the
+	// status in watch mode.
+	watchDebounce = 300 * time.Millisecond
+	// How often to refresh the status in watch mode when filesystem
+	// notifications are unavailable, or when the project is locked.
+	watchPollInterval = 2 * time.Second
+	// The most children of a directory artifact to list as missing from the
+	// cache before summarizing the rest.
+	maxListedMissingChildren = 10
+
+	statusFormatHuman     = "human"
+	statusFormatJSON      = "json"
+	statusFormatPorcelain = "porcelain"
+	statusFormatNDJSON    = "ndjson"
+	statusFormatTree      = "tree"
+)
+
 func init() {
 	statusCmd.Flags().BoolVar(&debugStatus, "debug", false, "print verbose JSON instead of regular output")
+	statusCmd.Flags().StringVar(
+		&statusFormat,
+		"format",
+		statusFormatHuman,
+		"output format: human, tree, json, ndjson, or porcelain",
+	)
+	statusCmd.Flags().BoolVar(
+		&noLockCheck,
+		"no-lock-check",
+		false,
+		"don't check if stage definitions were modified since their last commit",
+	)
+	statusCmd.Flags().BoolVarP(
+		&keepGoing, // defined in cmd/root.go
+		"keep-going",
+		"k",
+		false,
+		"report the status of other stages when a stage fails",
+	)
+	statusCmd.Flags().BoolVarP(
+		&watchStatus,
+		"watch",
+		"w",
+		false,
+		"continuously print status as artifacts and stages change",
+	)
+	statusCmd.Flags().StringVarP(
+		&statusOutput,
+		"output",
+		"o",
+		"",
+		"write status to the given file instead of standard output; use a .json extension for JSON output",
+	)
+	statusCmd.Flags().BoolVar(
+		&outputsOnly,
+		"outputs-only",
+		false,
+		"only report the status of stage outputs",
+	)
+	statusCmd.Flags().BoolVar(
+		&depsOnly,
+		"deps-only",
+		false,
+		"only report the status of stage inputs",
+	)
+	statusCmd.Flags().IntVar(
+		&checksumThreads, // defined in cmd/commit.go
+		"threads",
+		0,
+		"hash up to this many chunks of a chunked file at once",
+	)
+	statusCmd.Flags().BoolVar(
+		&onlyCached,
+		"only-cached",
+		false,
+		"only report artifacts that can be deleted and restored from the cache",
+	)
+	statusCmd.Flags().BoolVar(
+		&notCached,
+		"not-cached",
+		false,
+		"only report artifacts whose workspace contents would be lost if deleted",
+	)
+	statusCmd.Flags().StringVar(
+		&statusLock,
+		"lock",
+		"",
+		"compare the workspace to the checksums in the given stage file instead",
+	)
+	statusCmd.Flags().BoolVar(
+		&staleOnly,
+		"stale",
+		false,
+		"only report stages whose definitions were modified since their last commit",
+	)
+	statusCmd.Flags().BoolVar(
+		&reportCorrupt,
+		"report-corrupt",
+		false,
+		"report directory artifacts with corrupt manifests instead of failing",
+	)
+	statusCmd.Flags().BoolVar(
+		&shallowStatus,
+		"shallow",
+		false,
+		"only compare the entries of directory artifacts, not their contents (approximate)",
+	)
+	addRelativeToFlag(statusCmd)
 	rootCmd.AddCommand(statusCmd)
 }
 
 func writeStageStatus(writer io.Writer, stagePath string, status stage.Status) error {
-	var stageFileStatus string
-	if status.ChecksumMatches {
-		stageFileStatus = "up-to-date"
-	} else if status.HasChecksum {
-		stageFileStatus = "modified"
-	} else {
-		stageFileStatus = "not checksummed"
+	writeStageDefinitionStatus(writer, stagePath, status)
+	artPaths := make([]string, 0, len(status.ArtifactStatus))
+	for path := range status.ArtifactStatus {
+		artPaths = append(artPaths, path)
 	}
-	fmt.Fprintf(writer, "%s\tstage definition %s\n", stagePath, stageFileStatus)
-	for path, artStatus := range status.ArtifactStatus {
+	sort.Strings(artPaths)
+	for _, path := range artPaths {
+		artStatus := status.ArtifactStatus[path]
 		fmt.Fprintf(writer, "  %s\t%s\n", path, artStatus)
+		missing := artStatus.MissingChildren()
+		for i, childPath := range missing {
+			if i == maxListedMissingChildren {
+				fmt.Fprintf(writer, "    ... and %d more missing from cache\n", len(missing)-i)
+				break
+			}
+			fmt.Fprintf(writer, "    missing from cache: %s\n", filepath.Join(path, childPath))
+		}
 	}
 	return nil
 }
 
+// writeTreeStageStatus writes the status of the Stage like writeStageStatus,
+// but draws the contents of each directory artifact as a tree below it, like
+// the tree command, with the status of every file and sub-directory.
+func writeTreeStageStatus(writer io.Writer, stagePath string, status stage.Status) {
+	writeStageDefinitionStatus(writer, stagePath, status)
+	artPaths := make([]string, 0, len(status.ArtifactStatus))
+	for path := range status.ArtifactStatus {
+		artPaths = append(artPaths, path)
+	}
+	sort.Strings(artPaths)
+	for _, path := range artPaths {
+		artStatus := status.ArtifactStatus[path]
+		fmt.Fprintf(writer, "  %s\t%s\n", path, artStatus)
+		writeStatusTree(writer, "  ", artStatus)
+	}
+}
+
+// writeStatusTree writes one line for each child of the directory Artifact's
+// status, in order of their names, each followed by the lines of its own
+// children.
+func writeStatusTree(writer io.Writer, indent string, artStatus artifact.Status) {
+	names := make([]string, 0, len(artStatus.ChildrenStatus))
+	for name := range artStatus.ChildrenStatus {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		branch, childIndent := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, childIndent = "└── ", "    "
+		}
+		childStatus := artStatus.ChildrenStatus[name]
+		fmt.Fprintf(writer, "%s%s%s\t%s\n", indent, branch, name, childStatus)
+		writeStatusTree(writer, indent+childIndent, *childStatus)
+	}
+}
+
+// writeStageDefinitionStatus writes the line for the Stage definition of a
+// Stage's status in the human format.
+func writeStageDefinitionStatus(writer io.Writer, stagePath string, status stage.Status) {
+	if status.Skipped {
+		fmt.Fprintln(writer, stagePath)
+	} else {
+		var stageFileStatus string
+		if status.ChecksumMatches {
+			stageFileStatus = "up-to-date"
+		} else if status.HasChecksum {
+			stageFileStatus = "modified"
+		} else {
+			stageFileStatus = "not checksummed"
+		}
+		if status.Frozen {
+			stageFileStatus += " (frozen)"
+		}
+		fmt.Fprintf(writer, "%s\tstage definition %s\n", stagePath, stageFileStatus)
+	}
+}
+
+// scopedStageStatus returns the status of the Stage at stagePath, limited to
+// its outputs or inputs if --outputs-only or --deps-only was given, and to the
+// Artifacts selected by --only-cached or --not-cached.
+func scopedStageStatus(indexStatus index.Status, stagePath string) stage.Status {
+	status := indexStatus[stagePath]
+	if outputsOnly {
+		status.ArtifactStatus = indexStatus.OutputStatus(stagePath)
+	} else if depsOnly {
+		status.ArtifactStatus = indexStatus.InputStatus(stagePath)
+	}
+	if onlyCached || notCached {
+		filtered := make(map[string]artifact.Status, len(status.ArtifactStatus))
+		for path, artStatus := range status.ArtifactStatus {
+			if isCachedSelected(artStatus) {
+				filtered[path] = artStatus
+			}
+		}
+		status.ArtifactStatus = filtered
+	}
+	return status
+}
+
+// isStageSelected returns true if the Stage is selected by --stale, or if
+// --stale wasn't given.
+func isStageSelected(status stage.Status) bool {
+	return !staleOnly || !status.ChecksumMatches
+}
+
+// isCachedSelected returns true if the Artifact is selected by --only-cached
+// or --not-cached. Artifacts missing from the workspace have nothing to lose,
+// so --not-cached leaves them out.
+func isCachedSelected(artStatus artifact.Status) bool {
+	if onlyCached {
+		return artStatus.Recoverable()
+	}
+	return artStatus.WorkspaceFileStatus != fsutil.StatusAbsent && !artStatus.Recoverable()
+}
+
+func writeIndexStatus(writer io.Writer, indexStatus index.Status, format string) error {
+	if format == statusFormatJSON {
+		if outputsOnly || depsOnly || onlyCached || notCached || staleOnly {
+			scoped := make(index.Status, len(indexStatus))
+			for path, status := range indexStatus {
+				if isStageSelected(status) {
+					scoped[path] = scopedStageStatus(indexStatus, path)
+				}
+			}
+			indexStatus = scoped
+		}
+		return json.NewEncoder(writer).Encode(indexStatus)
+	}
+	return writeStagesStatus(writer, indexStatus, make(map[string]bool), format)
+}
+
+// ndjsonStageStatus is the status of a single Stage in the NDJSON format.
+type ndjsonStageStatus struct {
+	Path string
+	stage.Status
+}
+
+// writeStagesStatus writes the status of every Stage in indexStatus that is
+// not yet in written and is selected by --stale, in order of their paths, then
+// adds them to written.
+// JSON is not supported. In the porcelain format, Artifacts shared between
+// Stages are only written once, so they are also tracked in written.
+func writeStagesStatus(
+	writer io.Writer,
+	indexStatus index.Status,
+	written map[string]bool,
+	format string,
+) error {
+	stagePaths := make([]string, 0, len(indexStatus))
+	for path, status := range indexStatus {
+		if written[path] {
+			continue
+		}
+		if !isStageSelected(status) {
+			written[path] = true
+			continue
+		}
+		stagePaths = append(stagePaths, path)
+	}
+	sort.Strings(stagePaths)
+	if format == statusFormatNDJSON {
+		encoder := json.NewEncoder(writer)
+		for _, path := range stagePaths {
+			if err := encoder.Encode(ndjsonStageStatus{path, scopedStageStatus(indexStatus, path)}); err != nil {
+				return err
+			}
+			written[path] = true
+		}
+		return nil
+	}
+	if format == statusFormatPorcelain {
+		for _, path := range stagePaths {
+			writePorcelainStageStatus(writer, path, scopedStageStatus(indexStatus, path), written)
+		}
+		return nil
+	}
+	tabWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, path := range stagePaths {
+		if format == statusFormatTree {
+			writeTreeStageStatus(tabWriter, path, scopedStageStatus(indexStatus, path))
+			fmt.Fprintln(tabWriter)
+			written[path] = true
+			continue
+		}
+		if err := writeStageStatus(tabWriter, path, scopedStageStatus(indexStatus, path)); err != nil {
+			return err
+		}
+		fmt.Fprintln(tabWriter)
+		written[path] = true
+	}
+	return tabWriter.Flush()
+}
+
+// writePorcelainStageStatus writes one line for the Stage definition, unless
+// its status was skipped, and one line for each of its Artifacts not already
+// in written. Each line is a two-character code followed by a space and the
+// path. See artifact.Status.PorcelainCode for the Artifact codes. Stage
+// definitions use "  " when up-to-date, " M" when modified, and "??" when not
+// checksummed.
+func writePorcelainStageStatus(
+	writer io.Writer,
+	stagePath string,
+	status stage.Status,
+	written map[string]bool,
+) {
+	if !status.Skipped {
+		code := "  "
+		if !status.HasChecksum {
+			code = "??"
+		} else if !status.ChecksumMatches {
+			code = " M"
+		}
+		fmt.Fprintf(writer, "%s %s\n", code, stagePath)
+	}
+	written[stagePath] = true
+	artPaths := make([]string, 0, len(status.ArtifactStatus))
+	for path := range status.ArtifactStatus {
+		artPaths = append(artPaths, path)
+	}
+	sort.Strings(artPaths)
+	for _, path := range artPaths {
+		if written[path] {
+			continue
+		}
+		fmt.Fprintf(writer, "%s %s\n", status.ArtifactStatus[path].PorcelainCode(), path)
+		written[path] = true
+	}
+}
+
+// streamIndexStatus writes the status of the given stages to writer. Unless
+// the format is JSON, the status of each stage is written as soon as it is
+// known, rather than after the status of all stages is known. See
+// getIndexStatus for the handling of errs. In the NDJSON
+// format, the Artifact statuses of each stage are also discarded once written
+// to keep memory use flat, so the returned Status only records which stages
+// were visited. Malformed checksums are reported before they're discarded.
+// With --deps-only, the statuses are kept, because a Stage reports the
+// statuses of its inputs from the Stages that own them.
+func streamIndexStatus(
+	writer io.Writer,
+	idx index.Index,
+	ch cache.Cache,
+	rootDir string,
+	paths []string,
+	format string,
+	errs map[string]error,
+) (index.Status, error) {
+	if format == statusFormatJSON {
+		indexStatus, err := getIndexStatus(idx, ch, rootDir, paths, errs)
+		if err != nil {
+			return indexStatus, err
+		}
+		return indexStatus, writeIndexStatus(writer, indexStatus, format)
+	}
+	indexStatus := make(index.Status)
+	written := make(map[string]bool)
+	for _, path := range paths {
+		if err := stageIndexStatus(idx, ch, rootDir, path, indexStatus, errs); err != nil {
+			return indexStatus, err
+		}
+		if format == statusFormatNDJSON {
+			warnCorruptArtifacts(indexStatus)
+		}
+		if err := writeStagesStatus(writer, indexStatus, written, format); err != nil {
+			return indexStatus, err
+		}
+		if format == statusFormatNDJSON && !depsOnly {
+			for stagePath, stageStatus := range indexStatus {
+				// Index.Status only checks for the presence of a Stage to
+				// avoid visiting it twice.
+				stageStatus.ArtifactStatus = nil
+				indexStatus[stagePath] = stageStatus
+			}
+		}
+	}
+	return indexStatus, nil
+}
+
+// getStatusFormat returns the output format selected by the command-line
+// flags.
+func getStatusFormat(formatChanged bool) (string, error) {
+	if formatChanged {
+		switch statusFormat {
+		case statusFormatHuman, statusFormatTree, statusFormatJSON, statusFormatNDJSON, statusFormatPorcelain:
+			return statusFormat, nil
+		}
+		return "", fmt.Errorf("unknown status format %#v", statusFormat)
+	}
+	if debugStatus || filepath.Ext(statusOutput) == ".json" {
+		return statusFormatJSON, nil
+	}
+	return statusFormatHuman, nil
+}
+
+// writeStatusFile writes the status of the given stages to the file at
+// outputPath, replacing any existing file. Results are written to a separate
+// file (outputPath with a ".partial" suffix) as they become available, and
+// that file is renamed to outputPath once all results are written. If Dud
+// exits early, the partial results are left in place.
+func writeStatusFile(
+	outputPath string,
+	idx index.Index,
+	ch cache.Cache,
+	rootDir string,
+	paths []string,
+	format string,
+	errs map[string]error,
+) (index.Status, error) {
+	partialPath := outputPath + ".partial"
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	indexStatus, err := streamIndexStatus(file, idx, ch, rootDir, paths, format, errs)
+	if err != nil {
+		return indexStatus, err
+	}
+	if err := file.Close(); err != nil {
+		return indexStatus, err
+	}
+	return indexStatus, os.Rename(partialPath, outputPath)
+}
+
+// warnCorruptArtifacts logs an error for every Artifact with a malformed
+// checksum or a corrupt directory manifest. Unlike an absent checksum, these
+// mean a stage file or the cache was corrupted, so they shouldn't be buried in
+// the status output.
+func warnCorruptArtifacts(indexStatus index.Status) {
+	var malformed, corrupt []string
+	var collect func(parentPath string, artStatus artifact.Status)
+	collect = func(parentPath string, artStatus artifact.Status) {
+		artPath := filepath.Join(parentPath, artStatus.Path)
+		if artStatus.ChecksumMalformed {
+			malformed = append(malformed, artPath)
+		}
+		if artStatus.ManifestCorrupt {
+			corrupt = append(corrupt, artPath)
+		}
+		for _, childStatus := range artStatus.ChildrenStatus {
+			collect(artPath, *childStatus)
+		}
+	}
+	for _, stageStatus := range indexStatus {
+		for _, artStatus := range stageStatus.ArtifactStatus {
+			collect("", artStatus)
+		}
+	}
+	sort.Strings(malformed)
+	for _, artPath := range malformed {
+		logger.Error.Printf(
+			"artifact %s has a malformed checksum; its stage file or directory manifest may be corrupted\n",
+			artPath,
+		)
+	}
+	sort.Strings(corrupt)
+	for _, artPath := range corrupt {
+		logger.Error.Printf(
+			"artifact %s has a corrupt directory manifest in the cache; re-commit it to repair the manifest\n",
+			artPath,
+		)
+	}
+}
+
+// getIndexStatus returns the status of the given stages. If errs is not nil,
+// the error for a stage is recorded in errs and the remaining stages are still
+// processed; otherwise the first error is returned.
+func getIndexStatus(
+	idx index.Index,
+	ch cache.Cache,
+	rootDir string,
+	paths []string,
+	errs map[string]error,
+) (index.Status, error) {
+	indexStatus := make(index.Status)
+	for _, path := range paths {
+		if err := stageIndexStatus(idx, ch, rootDir, path, indexStatus, errs); err != nil {
+			return indexStatus, err
+		}
+	}
+	return indexStatus, nil
+}
+
+// stageIndexStatus adds the status of the given stage and its upstream stages
+// to indexStatus. If errs is not nil, any error is recorded in errs instead of
+// being returned.
+func stageIndexStatus(
+	idx index.Index,
+	ch cache.Cache,
+	rootDir string,
+	path string,
+	indexStatus index.Status,
+	errs map[string]error,
+) error {
+	inProgress := make(map[string]bool)
+	err := idx.Status(path, ch, rootDir, !noLockCheck, indexStatus, inProgress)
+	if err != nil && errs != nil {
+		errs[path] = err
+		return nil
+	}
+	return err
+}
+
 var (
-	debugStatus bool
+	debugStatus, noLockCheck, watchStatus  bool
+	outputsOnly, depsOnly, reportCorrupt   bool
+	onlyCached, notCached, staleOnly       bool
+	shallowStatus                          bool
+	statusOutput, statusFormat, statusLock string
 
 	statusCmd = &cobra.Command{
 		Use:     "status [flags] [stage_file]...",
@@ -46,50 +556,413 @@ var (
 For each stage file passed in, status will print the current state of the
 stage. If no stage files are passed in, status will act on all stages in the
 index. By default, status will act recursively on all stages upstream of the
-given stage(s).`,
-		Run: func(_ *cobra.Command, paths []string) {
+given stage(s).
+
+Status reports the state of each stage's definition separately from the state
+of its artifacts. A stage definition is "modified" if it changed since the
+stage was last committed. Use --no-lock-check to skip this check and only
+report the state of artifacts. Use --stale to only report stages whose
+definitions are modified or not checksummed, which answers which stages need
+to be run or committed again. The definitions of frozen stages, which commit
+skips, are marked "(frozen)".
+
+With --lock, status compares the workspace to the checksums recorded in the
+given stage file instead of the current one, such as an earlier version of the
+stage file taken from source control. Exactly one stage must be passed in, and
+its status is reported on its own, as recorded in the given file. Inputs are
+compared to the checksums in the given file, even if they're produced by other
+stages. Stage definitions aren't checked.
+
+With --watch, status keeps running and prints the updated state whenever the
+stage files or artifacts change. The project is only locked while the status
+is being refreshed, so other Dud commands can be run in the meantime.
+
+With --output, status writes to the given file instead of standard output. If
+the file name ends in .json, the output is JSON, as with --debug. While status
+is running, results are written to a file with the ".partial" suffix, which
+replaces the output file once status finishes.
+
+Use --format to choose the output format. The default "human" format may
+change between versions of Dud. The "tree" format is like "human", but draws
+the contents of each directory artifact as an indented tree below it, like the
+tree command, with the status of every file and sub-directory. The "json"
+format is the same as --debug. The "ndjson" format prints one JSON object per
+line for each stage as soon as its status is known, which suits very large
+projects and streaming consumers. The "porcelain" format is meant for scripts
+and is guaranteed not to change. It prints one line per stage definition and
+artifact: a two-character status code, a space, and the path relative to the
+project root. Artifacts shared by multiple stages are printed once. The status
+codes are:
+
+  "  " up-to-date
+  " M" modified
+  "??" not committed (or for stage definitions, not checksummed)
+  "!!" missing from the workspace
+  " C" committed, but missing from the cache
+  " T" incorrect file type
+  "XX" malformed checksum or corrupt directory manifest
+
+Stage definitions are omitted with --no-lock-check.
+
+Use --outputs-only to only report the state of each stage's outputs, which
+answers whether the stage needs to be committed. Use --deps-only to only report
+the state of each stage's inputs, which answers whether the stage needs to be
+run. An input produced by another stage is reported with the state of that
+stage's output artifact.
+
+Use --only-cached to only report artifacts that are committed and match the
+cache, which can be deleted from the workspace and restored later with
+checkout. Use --not-cached to only report artifacts whose workspace contents
+would be lost if deleted: artifacts that aren't committed, are modified, are
+missing from the cache, or skip the cache. Directories are only reported by
+--only-cached if none of their contents are modified or untracked.
+
+With --threads, status hashes up to the given number of chunks of a chunked
+file artifact at once. If the flag isn't set, 'checksum-threads' from the
+config is used.
+
+With --report-corrupt, a directory artifact whose manifest in the cache can't
+be read is reported as "manifest corrupt" (porcelain code "XX") instead of
+stopping status with an error, so the rest of the project is still reported.
+Re-commit each such directory to repair its manifest.
+
+With --shallow, status only compares the names and file types of the entries
+at the top level of each directory artifact with those in its manifest,
+without reading any files or descending into sub-directories. This answers
+whether a directory's set of files changed, even for directories too large to
+verify in full. The result is approximate: files modified in place, and any
+changes inside sub-directories, go unnoticed. Shallow directories are labeled
+"(shallow, approximate)" in the human format, and have "Shallow" set in JSON.
+Directories that aren't committed, or whose manifests aren't in the cache, get
+a full status. --shallow can't be used with --only-cached or --not-cached.
+
+With --relative-to, status looks for each artifact under the given directory
+instead of the project root. Artifact paths in stage files are relative to the
+project root, so this checks a copy of the workspace that was generated
+elsewhere (e.g. into a scratch directory) against the committed checksums.
+Stage files and the index are still read from the project. --relative-to can't
+be used with --watch.
+
+With --keep-going, a stage whose status can't be determined doesn't stop
+status from reporting the remaining stages. All errors are printed at the end,
+and status exits with a non-zero code.`,
+		Run: func(cmd *cobra.Command, paths []string) {
+			format, err := getStatusFormat(cmd.Flags().Changed("format"))
+			if err != nil {
+				fatal(err)
+			}
+			if outputsOnly && depsOnly {
+				fatal(errors.New("cannot use --outputs-only with --deps-only"))
+			}
+			if onlyCached && notCached {
+				fatal(errors.New("cannot use --only-cached with --not-cached"))
+			}
+			if staleOnly && noLockCheck {
+				fatal(errors.New("cannot use --stale with --no-lock-check"))
+			}
+			if shallowStatus && (onlyCached || notCached) {
+				fatal(errors.New("cannot use --shallow with --only-cached or --not-cached"))
+			}
+
+			// prepare() changes the working directory, so resolve the output
+			// and lock paths first.
+			if statusOutput != "" {
+				if statusOutput, err = filepath.Abs(statusOutput); err != nil {
+					fatal(err)
+				}
+			}
+			if statusLock != "" {
+				if len(paths) != 1 {
+					fatal(errors.New("--lock requires exactly one stage"))
+				}
+				if watchStatus {
+					fatal(errors.New("cannot use --lock with --watch"))
+				}
+				if statusLock, err = filepath.Abs(statusLock); err != nil {
+					fatal(err)
+				}
+			}
+
 			rootDir, ch, idx, err := prepare(paths)
 			if err != nil {
 				fatal(err)
 			}
 
-			if len(idx) == 0 {
-				fatal(emptyIndexError{})
+			if err := setChecksumThreads(&ch); err != nil {
+				fatal(err)
 			}
 
-			if len(paths) == 0 { // By default, check status of everything in the Index.
-				for path := range idx {
-					paths = append(paths, path)
-				}
+			if reportCorrupt {
+				ch.EnableCorruptManifestStatus()
 			}
 
-			sort.Strings(paths)
+			if shallowStatus {
+				ch.EnableShallowStatus()
+			}
 
-			indexStatus := make(index.Status)
-			for _, path := range paths {
-				inProgress := make(map[string]bool)
-				err := idx.Status(path, ch, rootDir, indexStatus, inProgress)
-				if err != nil {
+			if len(idx) == 0 {
+				fatal(emptyIndexError{})
+			}
+
+			if statusLock != "" {
+				if idx, err = lockedIndex(idx, paths[0], statusLock); err != nil {
 					fatal(err)
 				}
+				noLockCheck = true
 			}
 
-			if debugStatus {
-				encoder := json.NewEncoder(os.Stdout)
-				if err := encoder.Encode(indexStatus); err != nil {
+			if watchStatus {
+				if statusOutput != "" {
+					fatal(errors.New("cannot use --output with --watch"))
+				}
+				if relativeTo != "" {
+					fatal(errors.New("cannot use --relative-to with --watch"))
+				}
+				if err := watchIndexStatus(rootDir, ch, idx, paths, format); err != nil {
 					fatal(err)
 				}
 				return
 			}
 
-			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-			for path, stageStatus := range indexStatus {
-				if err := writeStageStatus(writer, path, stageStatus); err != nil {
-					fatal(err)
-				}
-				fmt.Fprintln(writer)
+			if len(paths) == 0 { // By default, check status of everything in the Index.
+				paths = idx.SortStagePaths()
+			}
+
+			sort.Strings(paths)
+
+			var errs map[string]error
+			if keepGoing {
+				errs = make(map[string]error)
+			}
+
+			var indexStatus index.Status
+			if statusOutput == "" {
+				indexStatus, err = streamIndexStatus(os.Stdout, idx, ch, workspaceDir(rootDir), paths, format, errs)
+			} else {
+				indexStatus, err = writeStatusFile(statusOutput, idx, ch, workspaceDir(rootDir), paths, format, errs)
 			}
-			writer.Flush()
+			if err != nil {
+				fatal(err)
+			}
+			warnCorruptArtifacts(indexStatus)
+			reportStageErrors(errs)
 		},
 	}
 )
+
+// lockedIndex returns an Index holding only the Stage at stagePath, as recorded
+// in the stage file at lockPath. Because the Stage is alone in the Index, the
+// status of its inputs is also checked against the checksums in lockPath.
+func lockedIndex(idx index.Index, stagePath, lockPath string) (index.Index, error) {
+	if _, ok := idx[stagePath]; !ok {
+		return nil, fmt.Errorf("stage %s is not in the index", stagePath)
+	}
+	lockStage, err := stage.FromFile(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	return index.Index{stagePath: &lockStage}, nil
+}
+
+// watchIndexStatus prints the status of the given stages every time their
+// stage files or artifacts change, until interrupted. If no stage paths are
+// given, it acts on all stages in the Index. The caller must hold the project
+// lock, which is released while waiting for changes.
+func watchIndexStatus(
+	rootDir string,
+	ch cache.Cache,
+	idx index.Index,
+	paths []string,
+	format string,
+) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error.Printf("filesystem notifications unavailable (%v); polling instead\n", err)
+		watcher = nil
+	} else {
+		defer watcher.Close()
+	}
+
+	clearScreen := isatty.IsTerminal(os.Stdout.Fd())
+	var lastOutput []byte
+	for {
+		indexStatus, output, err := refreshWatchedStatus(rootDir, ch, &idx, paths, format)
+		if err != nil {
+			return err
+		}
+		// A nil output means the project was locked by someone else, so we
+		// couldn't refresh the status.
+		projectBusy := output == nil
+		if !projectBusy && !bytes.Equal(output, lastOutput) {
+			if clearScreen {
+				fmt.Print("\033[H\033[2J")
+			}
+			fmt.Printf("%s\n\n", time.Now().Format(time.RFC1123))
+			os.Stdout.Write(output)
+			lastOutput = output
+		}
+
+		if watcher != nil && !projectBusy {
+			if err := addStatusWatches(watcher, idx, indexStatus); err != nil {
+				logger.Error.Printf("failed to watch files (%v); polling instead\n", err)
+				watcher.Close()
+				watcher = nil
+			}
+		}
+
+		if watcher == nil || projectBusy {
+			select {
+			case <-interrupt:
+				return nil
+			case <-time.After(watchPollInterval):
+			}
+			continue
+		}
+
+		select {
+		case <-interrupt:
+			return nil
+		case err := <-watcher.Errors:
+			return err
+		case event := <-watcher.Events:
+			logger.Debug.Println(event)
+		}
+		// Wait for events to settle before refreshing.
+		debounce := time.NewTimer(watchDebounce)
+	settle:
+		for {
+			select {
+			case <-interrupt:
+				debounce.Stop()
+				return nil
+			case err := <-watcher.Errors:
+				debounce.Stop()
+				return err
+			case event := <-watcher.Events:
+				logger.Debug.Println(event)
+				if !debounce.Stop() {
+					<-debounce.C
+				}
+				debounce.Reset(watchDebounce)
+			case <-debounce.C:
+				break settle
+			}
+		}
+	}
+}
+
+// refreshWatchedStatus returns the rendered status of the given stages. If the
+// project is already locked, the returned output is nil. Otherwise, the Index
+// is reloaded to pick up changes to stage files. The project lock is always
+// released before returning.
+func refreshWatchedStatus(
+	rootDir string,
+	ch cache.Cache,
+	idx *index.Index,
+	paths []string,
+	format string,
+) (indexStatus index.Status, output []byte, err error) {
+	if !projectLocked {
+		locked, err := tryLockProject(rootDir)
+		if err != nil || !locked {
+			return nil, nil, err
+		}
+		if *idx, err = loadIndex(); err != nil {
+			return nil, nil, err
+		}
+	}
+	defer func() {
+		if unlockErr := unlockProject(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	if len(paths) == 0 {
+		paths = idx.SortStagePaths()
+	}
+	indexStatus, err = getIndexStatus(*idx, ch, rootDir, paths, nil)
+	if err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err = writeIndexStatus(buf, indexStatus, format); err != nil {
+		return
+	}
+	return indexStatus, buf.Bytes(), nil
+}
+
+// addStatusWatches watches the stage files and artifacts of all stages in
+// indexStatus. For artifacts that don't exist yet, the nearest existing parent
+// directory is watched instead.
+func addStatusWatches(watcher *fsnotify.Watcher, idx index.Index, indexStatus index.Status) error {
+	watchPaths := make(map[string]bool)
+	for stagePath := range indexStatus {
+		if err := collectWatchPaths(stagePath, false, watchPaths); err != nil {
+			return err
+		}
+		stg, ok := idx[stagePath]
+		if !ok {
+			continue
+		}
+		for _, arts := range [2]map[string]*artifact.Artifact{stg.Inputs, stg.Outputs} {
+			for _, art := range arts {
+				if err := collectWatchPaths(art.Path, art.IsDir && !art.DisableRecursion, watchPaths); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for path := range watchPaths {
+		if err := watcher.Add(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectWatchPaths(path string, recursive bool, watchPaths map[string]bool) error {
+	// Find the nearest existing path. Watching a parent directory is enough to
+	// learn when the path is created.
+	for {
+		exists, err := fsutil.Exists(path, false)
+		if err != nil {
+			return err
+		}
+		if exists {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+	status, err := fsutil.FileStatusFromPath(path)
+	if err != nil {
+		return err
+	}
+	if status != fsutil.StatusDirectory {
+		// Watch the parent directory instead of the file itself. This catches
+		// modifications to the file as well as the file being replaced (e.g.
+		// by an editor or by a link on checkout).
+		watchPaths[filepath.Dir(path)] = true
+		return nil
+	}
+	watchPaths[path] = true
+	if !recursive {
+		return nil
+	}
+	return filepath.WalkDir(path, func(subPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			watchPaths[subPath] = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(verifySignaturesCmd)
+	verifySignaturesCmd.Flags().StringVar(
+		&publicKeyPath,
+		"public-key",
+		"",
+		"verify with this public key instead of 'signing-public-key'",
+	)
+}
+
+var publicKeyPath string
+
+var verifySignaturesCmd = &cobra.Command{
+	Use:   "verify-signatures [flags] [stage_file]...",
+	Short: "Check the signatures of stage files",
+	Long: `Verify-signatures checks that stage files are signed by a trusted key.
+
+If 'signing-key' is set in the config to the path of an Ed25519 private key,
+every command that records checksums in stage files signs each stage it
+writes: commit, commit-archive, import, refresh, run, and stage set-checksum.
+The signature covers the checksum of the stage's definition and the combined
+checksum of its outputs, and so every output checksum recorded in the stage
+file. It is stored in the stage file's 'signature' field. Keys are PEM files in
+the format written by OpenSSL:
+
+  openssl genpkey -algorithm ed25519 -out dud.key
+  openssl pkey -in dud.key -pubout -out dud.pub
+
+For each stage file passed in, verify-signatures checks the stage's signature
+against the public key at 'signing-public-key' in the config, or the key given
+with --public-key. If no stage files are passed in, verify-signatures checks
+all stages in the index. It reports each stage that is unsigned, whose
+signature doesn't match the key, or whose recorded checksums were changed
+after it was signed, and then exits with a non-zero code. Use it, e.g. in CI,
+to detect tampering with stage files.
+
+Stages committed, refreshed, or run without a signing key keep their old
+signatures, which then fail to verify. Stage files created by 'dud stage new'
+hold no checksums and are unsigned until they're first committed. Relative key
+paths are relative to the project root.`,
+	Run: func(cmd *cobra.Command, paths []string) {
+		_, _, idx, err := prepare(paths)
+		if err != nil {
+			fatal(err)
+		}
+
+		keyPath := publicKeyPath
+		if keyPath == "" {
+			keyPath = viper.GetString("signing-public-key")
+		}
+		if keyPath == "" {
+			fatal(errors.New("no public key; set 'signing-public-key' in the config or use --public-key"))
+		}
+		key, err := loadPublicKey(keyPath)
+		if err != nil {
+			fatal(err)
+		}
+
+		if len(paths) == 0 {
+			for path := range idx {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) == 0 {
+			fatal(emptyIndexError{})
+		}
+		sort.Strings(paths)
+
+		errs := make(map[string]error)
+		for _, path := range paths {
+			stg, ok := idx[path]
+			if !ok {
+				errs[path] = fmt.Errorf("stage %s is not in the index", path)
+				continue
+			}
+			if err := stg.VerifySignature(key); err != nil {
+				errs[path] = err
+				continue
+			}
+			logger.Debug.Printf("%s: signature ok\n", path)
+		}
+		reportStageErrors(errs)
+		logger.Info.Printf("verified %d stages\n", len(paths))
+	},
+}
+
+// readPEM returns the bytes of the single PEM block in the file at path.
+func readPEM(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block.Bytes, nil
+}
+
+// loadSigningKey returns the Ed25519 private key at 'signing-key' in the
+// config, or nil if the field isn't set.
+func loadSigningKey() (ed25519.PrivateKey, error) {
+	path := viper.GetString("signing-key")
+	if path == "" {
+		return nil, nil
+	}
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load signing key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load signing key %s", path)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("load signing key %s: not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// loadPublicKey returns the Ed25519 public key in the file at path.
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load public key %s", path)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("load public key %s: not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	versionCmd.Flags().BoolVar(
+		&versionJSON,
+		"json",
+		false,
+		"print build information as JSON",
+	)
+	rootCmd.AddCommand(versionCmd)
+}
+
+var versionJSON bool
+
+// buildInfo describes how the binary was built and which file formats it
+// reads and writes.
+type buildInfo struct {
+	Version            string `json:"version"`
+	Commit             string `json:"commit"`
+	BuildDate          string `json:"build-date"`
+	GoVersion          string `json:"go-version"`
+	CacheFormatVersion int    `json:"cache-format-version"`
+	StageSchemaVersion int    `json:"stage-schema-version"`
+}
+
+// getBuildInfo returns the buildInfo of the running binary. If the commit
+// wasn't set when the binary was built, it falls back to the commit recorded
+// by the Go toolchain, if any.
+func getBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:            Version,
+		Commit:             Commit,
+		BuildDate:          BuildDate,
+		GoVersion:          runtime.Version(),
+		CacheFormatVersion: cache.FormatVersion,
+		StageSchemaVersion: stage.SchemaVersion,
+	}
+	if info.Commit != "" {
+		return info
+	}
+	goInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range goInfo.Settings {
+		if setting.Key == "vcs.revision" {
+			info.Commit = setting.Value
+		}
+	}
+	return info
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version number and exit",
+	Long: `Version prints the version number and exits.
+
+With --json, version prints a JSON object describing the build instead: the
+version number, the git commit, the build date, and the Go version, as well as
+the cache format version and the stage file schema version. Caches and remotes
+can only be shared between versions of Dud with the same cache format version.
+Fields that weren't recorded when Dud was built are empty. Include this output
+in bug reports.`,
+	Example: "dud version --json",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !versionJSON {
+			fmt.Println(Version)
+			return
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(getBuildInfo()); err != nil {
+			fatal(err)
+		}
+	},
+}
@@ -0,0 +1,101 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ExtractArchive extracts a gzipped tar archive that holds a single file or
+// directory, such as one written by 'dud export', to dst. Whatever the file
+// or directory is named in the archive, it is extracted as dst, which must not
+// exist. Only regular files and directories are supported. Entries that would
+// be extracted outside dst are rejected, and nothing is left at dst if
+// extraction fails.
+func ExtractArchive(r io.Reader, dst string) (err error) {
+	errPrefix := "extract archive to " + dst
+	exists, err := Exists(dst, false)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	if exists {
+		return errors.Errorf("%s: %s already exists", errPrefix, dst)
+	}
+	// Don't leave a partial extraction behind.
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dst)
+		}
+	}()
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, errPrefix)
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	// root is the name of the file or directory at the top of the archive.
+	var root string
+	rootIsDir := false
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, errPrefix)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." || name == ".." || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			return errors.Errorf("%s: invalid path %#v in archive", errPrefix, header.Name)
+		}
+		top, rest, _ := strings.Cut(name, "/")
+		if root == "" {
+			root = top
+			rootIsDir = rest != "" || header.Typeflag == tar.TypeDir
+		} else if top != root || !rootIsDir {
+			return errors.Errorf("%s: archive holds more than a single file or directory", errPrefix)
+		}
+		target := filepath.Join(dst, filepath.FromSlash(rest))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return errors.Wrap(err, errPrefix)
+			}
+		case tar.TypeReg:
+			if rootIsDir && rest == "" {
+				return errors.Errorf("%s: archive holds more than a single file or directory", errPrefix)
+			}
+			if err := extractFile(tarReader, target, header.FileInfo().Mode().Perm()); err != nil {
+				return errors.Wrap(err, errPrefix)
+			}
+		default:
+			return errors.Errorf("%s: unsupported file type for %#v in archive", errPrefix, header.Name)
+		}
+	}
+	if root == "" {
+		return errors.Errorf("%s: archive is empty", errPrefix)
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
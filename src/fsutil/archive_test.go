@@ -0,0 +1,109 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractArchive(t *testing.T) {
+	type entry struct {
+		name, contents string
+		isDir          bool
+	}
+	archive := func(t *testing.T, entries ...entry) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		gzipWriter := gzip.NewWriter(buf)
+		tarWriter := tar.NewWriter(gzipWriter)
+		for _, e := range entries {
+			header := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.contents))}
+			header.Typeflag = tar.TypeReg
+			if e.isDir {
+				header.Typeflag = tar.TypeDir
+				header.Mode = 0o755
+			}
+			if err := tarWriter.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tarWriter.Write([]byte(e.contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tarWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzipWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	assertContents := func(t *testing.T, path, want string) {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s contains %#v, want %#v", path, string(got), want)
+		}
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "out")
+		buf := archive(t,
+			entry{name: "data/", isDir: true},
+			entry{name: "data/foo.txt", contents: "foo"},
+			entry{name: "data/sub/bar.txt", contents: "bar"},
+		)
+		if err := ExtractArchive(buf, dst); err != nil {
+			t.Fatal(err)
+		}
+		assertContents(t, filepath.Join(dst, "foo.txt"), "foo")
+		assertContents(t, filepath.Join(dst, "sub", "bar.txt"), "bar")
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "out.txt")
+		if err := ExtractArchive(archive(t, entry{name: "foo.txt", contents: "foo"}), dst); err != nil {
+			t.Fatal(err)
+		}
+		assertContents(t, dst, "foo")
+	})
+
+	badArchives := map[string][]entry{
+		"escaping path":  {{name: "data/", isDir: true}, {name: "data/../../evil.txt"}},
+		"absolute path":  {{name: "/evil.txt"}},
+		"multiple roots": {{name: "foo.txt"}, {name: "bar.txt"}},
+		"empty":          {},
+	}
+	for name, entries := range badArchives {
+		entries := entries
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			dst := filepath.Join(dir, "out")
+			if err := ExtractArchive(archive(t, entries...), dst); err == nil {
+				t.Fatal("expected error")
+			}
+			leftovers, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leftovers) != 0 {
+				t.Fatalf("expected nothing to be extracted, got %v", leftovers)
+			}
+		})
+	}
+
+	t.Run("existing destination", func(t *testing.T) {
+		dst := t.TempDir()
+		if err := ExtractArchive(archive(t, entry{name: "foo.txt"}), dst); err == nil {
+			t.Fatal("expected error")
+		}
+		if _, err := os.Stat(dst); err != nil {
+			t.Fatal("expected existing destination to be left alone")
+		}
+	})
+}
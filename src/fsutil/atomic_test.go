@@ -0,0 +1,70 @@
+package fsutil
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.yaml")
+	writeString := func(s string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, s)
+			return err
+		}
+	}
+
+	if err := WriteFileAtomic(path, 0o600, writeString("foo")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile := func(t *testing.T, want string, wantPerm os.FileMode) {
+		t.Helper()
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("file contents = %#v, want %#v", string(got), want)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != wantPerm {
+			t.Fatalf("file perms = %v, want %v", info.Mode().Perm(), wantPerm)
+		}
+	}
+	assertFile(t, "foo", 0o600)
+
+	t.Run("keeps permissions of replaced file", func(t *testing.T) {
+		if err := WriteFileAtomic(path, 0o644, writeString("bar")); err != nil {
+			t.Fatal(err)
+		}
+		assertFile(t, "bar", 0o600)
+	})
+
+	t.Run("leaves file untouched on error", func(t *testing.T) {
+		writeErr := errors.New("write failed")
+		err := WriteFileAtomic(path, 0o644, func(w io.Writer) error {
+			if _, err := io.WriteString(w, "partial"); err != nil {
+				return err
+			}
+			return writeErr
+		})
+		if !errors.Is(err, writeErr) {
+			t.Fatalf("got error %v, want %v", err, writeErr)
+		}
+		assertFile(t, "bar", 0o600)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("got %d files in directory, want 1", len(entries))
+		}
+	})
+}
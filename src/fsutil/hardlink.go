@@ -0,0 +1,67 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// HardlinkGroups returns the names of the regular files in dir that are hard
+// links to the same file, with one group for each file that has two or more
+// of the given names. Names are sorted within each group, and groups are
+// sorted by their first name. Symlinks are not followed.
+func HardlinkGroups(dir string, names []string) ([][]string, error) {
+	type fileID struct{ dev, ino uint64 }
+	byID := make(map[fileID][]string)
+	for _, name := range names {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || !info.Mode().IsRegular() || stat.Nlink < 2 {
+			continue
+		}
+		id := fileID{uint64(stat.Dev), uint64(stat.Ino)}
+		byID[id] = append(byID[id], name)
+	}
+	groups := [][]string{}
+	for _, group := range byID {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Strings(group)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups, nil
+}
+
+// ReplaceWithLink makes newPath a hard link to the file at oldPath, replacing
+// any file at newPath. The link is created under a temporary name and then
+// renamed over newPath, so newPath is never missing. If newPath is already a
+// link to the same file, ReplaceWithLink does nothing.
+func ReplaceWithLink(oldPath, newPath string) error {
+	oldInfo, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	if newInfo, err := os.Lstat(newPath); err == nil && os.SameFile(oldInfo, newInfo) {
+		return nil
+	}
+	tempPath := filepath.Join(filepath.Dir(newPath), "."+filepath.Base(newPath)+".dud-link")
+	if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(oldPath, tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, newPath); err != nil {
+		os.Remove(tempPath)
+		return errors.Wrapf(err, "link %s", newPath)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHardlinkGroups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "c", "lonely"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for newName, oldName := range map[string]string{"b": "c", "d": "a", "z": "a"} {
+		if err := os.Link(filepath.Join(dir, oldName), filepath.Join(dir, newName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	// A file linked from outside of the given names isn't in a group.
+	if err := os.Link(filepath.Join(dir, "lonely"), filepath.Join(t.TempDir(), "lonely")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := HardlinkGroups(dir, []string{"a", "b", "c", "d", "lonely", "symlink"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"a", "d"}, {"b", "c"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("HardlinkGroups -want +got:\n%s", diff)
+	}
+}
+
+func TestReplaceWithLink(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	if err := os.WriteFile(oldPath, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	assertLinked := func(t *testing.T) {
+		oldInfo, err := os.Stat(oldPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newInfo, err := os.Stat(newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(oldInfo, newInfo) {
+			t.Fatalf("%s is not a hard link to %s", newPath, oldPath)
+		}
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := ReplaceWithLink(oldPath, newPath); err != nil {
+			t.Fatal(err)
+		}
+		assertLinked(t)
+	})
+
+	t.Run("already linked", func(t *testing.T) {
+		if err := ReplaceWithLink(oldPath, newPath); err != nil {
+			t.Fatal(err)
+		}
+		assertLinked(t)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("expected only two files in %s, got %d", dir, len(entries))
+		}
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		if err := os.Remove(newPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(newPath, []byte("new"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ReplaceWithLink(oldPath, newPath); err != nil {
+			t.Fatal(err)
+		}
+		assertLinked(t)
+	})
+}
@@ -0,0 +1,72 @@
+package fsutil
+
+import (
+	"bytes"
+	"os"
+)
+
+// sparseBlockSize is the granularity at which SparseWriter detects zeros. It
+// matches the block size of most file systems, which is the smallest hole a
+// file system can create.
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// A SparseWriter writes to a file, skipping over blocks of zeros instead of
+// writing them. On file systems that support sparse files, the skipped blocks
+// become holes that take up no space on disk. The logical contents of the file
+// are the same as if every byte were written, so checksums are unaffected.
+// Finish must be called after the last Write to set the size of the file.
+type SparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+// NewSparseWriter returns a SparseWriter that writes to the start of the given
+// file. The file must not be opened with os.O_APPEND.
+func NewSparseWriter(file *os.File) *SparseWriter {
+	return &SparseWriter{file: file}
+}
+
+// Write writes p to the file, skipping any blocks of p that are all zeros.
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	// Accumulate consecutive non-zero blocks to limit the number of syscalls.
+	dataStart := -1
+	flush := func(end int) error {
+		if dataStart < 0 {
+			return nil
+		}
+		n, err := w.file.WriteAt(p[dataStart:end], w.offset+int64(dataStart))
+		written += n
+		dataStart = -1
+		return err
+	}
+	for start := 0; start < len(p); start += sparseBlockSize {
+		end := start + sparseBlockSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if bytes.Equal(p[start:end], zeroBlock[:end-start]) {
+			if err := flush(start); err != nil {
+				w.offset += int64(written)
+				return written, err
+			}
+			written += end - start
+			continue
+		}
+		if dataStart < 0 {
+			dataStart = start
+		}
+	}
+	err := flush(len(p))
+	w.offset += int64(written)
+	return written, err
+}
+
+// Finish sets the size of the file to the number of bytes written. This is
+// needed when the file ends with a block of zeros, because skipping the block
+// doesn't extend the file. Finish does not close the file.
+func (w *SparseWriter) Finish() error {
+	return w.file.Truncate(w.offset)
+}
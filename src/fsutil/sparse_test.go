@@ -0,0 +1,60 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparseWriter(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	var contents []byte
+	contents = append(contents, bytes.Repeat([]byte{'a'}, 100)...)
+	contents = append(contents, make([]byte, 3*sparseBlockSize)...)
+	contents = append(contents, bytes.Repeat([]byte{'b'}, sparseBlockSize+1)...)
+	// Zeros that don't fill a whole block must still be written.
+	contents = append(contents, make([]byte, 10)...)
+	contents = append(contents, 'c')
+	// Files ending in zeros need to be extended by Finish.
+	contents = append(contents, make([]byte, 2*sparseBlockSize+7)...)
+
+	for _, bufSize := range []int{1, 1000, sparseBlockSize, 3*sparseBlockSize + 5, len(contents)} {
+		path := filepath.Join(t.TempDir(), "sparse")
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := NewSparseWriter(file)
+		n, err := io.CopyBuffer(
+			writer,
+			// Hide bytes.Reader.WriteTo so the buffer size is respected.
+			struct{ io.Reader }{bytes.NewReader(contents)},
+			make([]byte, bufSize),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(contents)) {
+			t.Fatalf("buffer size %d: wrote %d bytes, want %d", bufSize, n, len(contents))
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, got) {
+			t.Fatalf("buffer size %d: file contents differ from input", bufSize)
+		}
+	}
+}
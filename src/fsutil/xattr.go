@@ -0,0 +1,88 @@
+package fsutil
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// privateXattrPrefixes are the namespaces of extended attributes that belong
+// to the host rather than to a file's contents, such as SELinux labels. They
+// are never read or written by ReadXattrs and WriteXattrs.
+var privateXattrPrefixes = []string{"security.", "trusted."}
+
+// ReadXattrs returns the extended attributes of the file at path, including
+// POSIX ACLs, mapped to their values. Attributes in the "security" and
+// "trusted" namespaces are left out. If the filesystem doesn't support
+// extended attributes, ReadXattrs returns an empty map.
+func ReadXattrs(path string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	size, err := unix.Listxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "list xattrs of %#v failed", path)
+	}
+	if size == 0 {
+		return attrs, nil
+	}
+	names := make([]byte, size)
+	size, err = unix.Listxattr(path, names)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list xattrs of %#v failed", path)
+	}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 || isPrivateXattr(string(name)) {
+			continue
+		}
+		value, err := readXattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+func readXattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get xattr %s of %#v failed", name, path)
+	}
+	value := make([]byte, size)
+	if size == 0 {
+		return value, nil
+	}
+	size, err = unix.Getxattr(path, name, value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get xattr %s of %#v failed", name, path)
+	}
+	return value[:size], nil
+}
+
+// WriteXattrs sets the given extended attributes on the file at path.
+// Attributes on the file that aren't in attrs are left alone, as are
+// attributes in the "security" and "trusted" namespaces.
+func WriteXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if isPrivateXattr(name) {
+			continue
+		}
+		if err := unix.Setxattr(path, name, value, 0); err != nil {
+			return errors.Wrapf(err, "set xattr %s of %#v failed", name, path)
+		}
+	}
+	return nil
+}
+
+func isPrivateXattr(name string) bool {
+	for _, prefix := range privateXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestXattrs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.WriteFile(path, []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]byte{
+		"user.origin": []byte("https://example.com/foo"),
+		"user.empty":  {},
+	}
+	if err := WriteXattrs(src, want); err != nil {
+		t.Skipf("filesystem doesn't support user xattrs: %v", err)
+	}
+	got, err := ReadXattrs(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("ReadXattrs -want +got:\n%s", diff)
+	}
+
+	if err := WriteXattrs(dst, got); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ReadXattrs(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("ReadXattrs after copy -want +got:\n%s", diff)
+	}
+}
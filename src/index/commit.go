@@ -9,12 +9,14 @@ import (
 )
 
 // Commit commits the given Stage's Outputs and recursively acts on all
-// upstream Stages.
+// upstream Stages. Frozen Stages are left as they are, and neither added to
+// committed nor recursed into, unless thaw is true.
 func (idx Index) Commit(
 	stagePath string,
 	ch cache.Cache,
 	rootDir string,
 	strat strategy.CheckoutStrategy,
+	thaw bool,
 	committed map[string]bool,
 	inProgress map[string]bool,
 	logger *agglog.AggLogger,
@@ -34,6 +36,13 @@ func (idx Index) Commit(
 	if !ok {
 		return unknownStageError{stagePath}
 	}
+	if stg.Frozen && !thaw {
+		// Downstream Stages use the recorded checksums of the frozen Stage's
+		// outputs.
+		logger.Info.Printf("skipping frozen stage %s\n", stagePath)
+		delete(inProgress, stagePath)
+		return nil
+	}
 
 	nonStageInputs := []*artifact.Artifact{}
 
@@ -56,6 +65,7 @@ func (idx Index) Commit(
 				ch,
 				rootDir,
 				strat,
+				thaw,
 				committed,
 				inProgress,
 				logger,
@@ -72,14 +82,16 @@ func (idx Index) Commit(
 		// create Stages to test against. To be safe, it's best to force
 		// SkipCache to true here.
 		art.SkipCache = true
-		if err := ch.Commit(rootDir, art, strat, logger); err != nil {
+		if _, err := ch.Commit(rootDir, art, strat, logger); err != nil {
 			return err
 		}
 	}
 	for _, art := range stg.Outputs {
-		if err := ch.Commit(rootDir, art, strat, logger); err != nil {
+		result, err := ch.Commit(rootDir, art, strat, logger)
+		if err != nil {
 			return err
 		}
+		logCommitResult(logger, art.Path, result)
 	}
 	var err error
 	stg.Checksum, err = stg.CalculateChecksum()
@@ -90,3 +102,23 @@ func (idx Index) Commit(
 	delete(inProgress, stagePath)
 	return nil
 }
+
+func logCommitResult(logger *agglog.AggLogger, artPath string, result cache.CommitResult) {
+	for _, paths := range result.Duplicates {
+		logger.Info.Printf("  %s: identical files:\n", artPath)
+		for _, path := range paths {
+			logger.Info.Printf("    %s\n", path)
+		}
+	}
+	if !result.Changed {
+		logger.Debug.Printf("  %s: up-to-date\n", artPath)
+		return
+	}
+	logger.Debug.Printf(
+		"  %s: committed %s, added %d bytes to the cache, %d files already in the cache\n",
+		artPath,
+		result.Checksum,
+		result.BytesWritten,
+		result.FilesDeduplicated,
+	)
+}
@@ -6,15 +6,16 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/kevin-hanselman/dud/src/agglog"
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
 	"github.com/kevin-hanselman/dud/src/mocks"
 	"github.com/kevin-hanselman/dud/src/stage"
 	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/stretchr/testify/mock"
 )
 
-func mockCommit(_ string, art *artifact.Artifact, _ strategy.CheckoutStrategy, _ *agglog.AggLogger) error {
+func mockCommit(_ string, art *artifact.Artifact, _ strategy.CheckoutStrategy, _ *agglog.AggLogger) cache.CommitResult {
 	art.Checksum = "committed"
-	return nil
+	return cache.CommitResult{Changed: true, Checksum: art.Checksum}
 }
 
 func expectOutputsCommitted(
@@ -24,7 +25,7 @@ func expectOutputsCommitted(
 	strat strategy.CheckoutStrategy,
 ) {
 	for _, art := range stg.Outputs {
-		mockCache.On("Commit", rootDir, art, strat, mock.AnythingOfType("*agglog.AggLogger")).Return(mockCommit).Once()
+		mockCache.On("Commit", rootDir, art, strat, mock.AnythingOfType("*agglog.AggLogger")).Return(mockCommit, nil).Once()
 	}
 }
 
@@ -64,7 +65,7 @@ func TestCommit(t *testing.T) {
 
 		orphanCopy := orphanArt
 		orphanCopy.SkipCache = true
-		mockCache.On("Commit", rootDir, &orphanCopy, strat, mock.AnythingOfType("*agglog.AggLogger")).Return(mockCommit).Once()
+		mockCache.On("Commit", rootDir, &orphanCopy, strat, mock.AnythingOfType("*agglog.AggLogger")).Return(mockCommit, nil).Once()
 
 		committed := make(map[string]bool)
 		inProgress := make(map[string]bool)
@@ -73,6 +74,7 @@ func TestCommit(t *testing.T) {
 			&mockCache,
 			rootDir,
 			strat,
+			false,
 			committed,
 			inProgress,
 			logger,
@@ -136,6 +138,7 @@ func TestCommit(t *testing.T) {
 			&mockCache,
 			rootDir,
 			strat,
+			false,
 			committed,
 			inProgress,
 			logger,
@@ -174,6 +177,92 @@ func TestCommit(t *testing.T) {
 		}
 	})
 
+	t.Run("frozen stages are skipped", func(t *testing.T) {
+		frozenArtifact := artifact.Artifact{Path: "foo.bin", Checksum: "frozen"}
+		linkedArtifact := artifact.Artifact{Path: "foo.bin"}
+		stgA := stage.Stage{
+			Frozen:   true,
+			Checksum: "original",
+			Outputs: map[string]*artifact.Artifact{
+				"foo.bin": &frozenArtifact,
+			},
+		}
+		stgB := stage.Stage{
+			Inputs: map[string]*artifact.Artifact{
+				"foo.bin": &linkedArtifact,
+			},
+			Outputs: map[string]*artifact.Artifact{
+				"bar.bin": {Path: "bar.bin"},
+			},
+		}
+		idx := Index{
+			"foo.yaml": &stgA,
+			"bar.yaml": &stgB,
+		}
+
+		mockCache := mocks.Cache{}
+
+		expectOutputsCommitted(&stgB, &mockCache, rootDir, strat)
+
+		committed := make(map[string]bool)
+		inProgress := make(map[string]bool)
+		if err := idx.Commit(
+			"bar.yaml",
+			&mockCache,
+			rootDir,
+			strat,
+			false,
+			committed,
+			inProgress,
+			logger,
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		mockCache.AssertExpectations(t)
+
+		if diff := cmp.Diff(map[string]bool{"bar.yaml": true}, committed); diff != "" {
+			t.Fatalf("committed -want +got:\n%s", diff)
+		}
+		if stgA.Checksum != "original" {
+			t.Fatalf("frozen stage Checksum = %#v, want unchanged", stgA.Checksum)
+		}
+		// Downstream Stages should pick up the frozen Stage's recorded outputs.
+		if linkedArtifact.Checksum != "frozen" {
+			t.Fatalf("linked artifact Checksum = %#v, want %#v", linkedArtifact.Checksum, "frozen")
+		}
+
+		t.Run("unless thawed", func(t *testing.T) {
+			mockCache := mocks.Cache{}
+
+			expectOutputsCommitted(&stgA, &mockCache, rootDir, strat)
+
+			committed := make(map[string]bool)
+			inProgress := make(map[string]bool)
+			if err := idx.Commit(
+				"foo.yaml",
+				&mockCache,
+				rootDir,
+				strat,
+				true,
+				committed,
+				inProgress,
+				logger,
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			mockCache.AssertExpectations(t)
+
+			if !committed["foo.yaml"] {
+				t.Fatal("expected thawed stage to be committed")
+			}
+			if frozenArtifact.Checksum != "committed" {
+				t.Fatalf("output Checksum = %#v, want %#v", frozenArtifact.Checksum, "committed")
+			}
+		})
+	})
+
 	t.Run("stages aren't repeated", func(t *testing.T) {
 		// stgA <-- stgB <-- stgC
 		//    ^---------------|
@@ -218,6 +307,7 @@ func TestCommit(t *testing.T) {
 			&mockCache,
 			rootDir,
 			strat,
+			false,
 			committed,
 			inProgress,
 			logger,
@@ -290,6 +380,7 @@ func TestCommit(t *testing.T) {
 			&mockCache,
 			rootDir,
 			strat,
+			false,
 			committed,
 			inProgress,
 			logger,
@@ -0,0 +1,117 @@
+package index
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Dependents returns the paths of all Stages that depend on path, directly or
+// transitively, in topological order: every Stage comes after the Stages it
+// depends on. If path is a Stage in the Index, its dependents are the Stages
+// with inputs owned by it. Otherwise path is an Artifact, and its dependents
+// are the Stages with an input that is the Artifact, is inside it, or contains
+// it. These are the Stages that would need to re-run if path changed.
+func (idx Index) Dependents(path string) ([]string, error) {
+	var queue []string
+	if _, ok := idx[path]; ok {
+		queue = idx.directDependents(path)
+	} else {
+		for stagePath, stg := range idx {
+			for inputPath := range stg.Inputs {
+				if pathsOverlap(inputPath, path) {
+					queue = append(queue, stagePath)
+					break
+				}
+			}
+		}
+	}
+	dependents := make(map[string]bool)
+	for len(queue) > 0 {
+		stagePath := queue[0]
+		queue = queue[1:]
+		if dependents[stagePath] {
+			continue
+		}
+		if stagePath == path {
+			return nil, errors.Errorf("dependents of %s: cycle detected", path)
+		}
+		dependents[stagePath] = true
+		queue = append(queue, idx.directDependents(stagePath)...)
+	}
+	order, err := idx.sortTopologically(dependents)
+	return order, errors.Wrapf(err, "dependents of %s", path)
+}
+
+// directDependents returns the paths of the Stages with an input owned by the
+// Stage at stagePath.
+func (idx Index) directDependents(stagePath string) (dependents []string) {
+	for otherPath, stg := range idx {
+		for inputPath := range stg.Inputs {
+			if owner, _ := idx.findOwner(inputPath); owner == stagePath {
+				dependents = append(dependents, otherPath)
+				break
+			}
+		}
+	}
+	return
+}
+
+// sortTopologically orders the given Stages so every Stage comes after the
+// Stages it depends on. Stages that don't depend on each other are sorted by
+// path, so the order is deterministic.
+func (idx Index) sortTopologically(stagePaths map[string]bool) ([]string, error) {
+	order := make([]string, 0, len(stagePaths))
+	visited := make(map[string]bool, len(stagePaths))
+	inProgress := make(map[string]bool)
+	var visit func(stagePath string) error
+	visit = func(stagePath string) error {
+		if visited[stagePath] {
+			return nil
+		}
+		if inProgress[stagePath] {
+			return errors.New("cycle detected")
+		}
+		inProgress[stagePath] = true
+		stg := idx[stagePath]
+		inputPaths := make([]string, 0, len(stg.Inputs))
+		for inputPath := range stg.Inputs {
+			inputPaths = append(inputPaths, inputPath)
+		}
+		sort.Strings(inputPaths)
+		for _, inputPath := range inputPaths {
+			owner, _ := idx.findOwner(inputPath)
+			if !stagePaths[owner] {
+				continue
+			}
+			if err := visit(owner); err != nil {
+				return err
+			}
+		}
+		delete(inProgress, stagePath)
+		visited[stagePath] = true
+		order = append(order, stagePath)
+		return nil
+	}
+	sorted := make([]string, 0, len(stagePaths))
+	for stagePath := range stagePaths {
+		sorted = append(sorted, stagePath)
+	}
+	sort.Strings(sorted)
+	for _, stagePath := range sorted {
+		if err := visit(stagePath); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// pathsOverlap returns true if the two paths are the same, or if either path
+// is inside the other.
+func pathsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
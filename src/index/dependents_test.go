@@ -0,0 +1,93 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/stage"
+)
+
+func TestDependents(t *testing.T) {
+	// raw.yaml -> clean.yaml -> train.yaml -> report.yaml
+	//                        \-------------/
+	// other.yaml is unrelated.
+	idx := Index{
+		"raw.yaml": &stage.Stage{
+			Outputs: map[string]*artifact.Artifact{
+				"raw": {Path: "raw", IsDir: true},
+			},
+		},
+		"clean.yaml": &stage.Stage{
+			Inputs: map[string]*artifact.Artifact{
+				"raw/data.csv": {Path: "raw/data.csv"},
+			},
+			Outputs: map[string]*artifact.Artifact{
+				"clean.csv": {Path: "clean.csv"},
+			},
+		},
+		"train.yaml": &stage.Stage{
+			Inputs: map[string]*artifact.Artifact{
+				"clean.csv": {Path: "clean.csv"},
+			},
+			Outputs: map[string]*artifact.Artifact{
+				"model.pkl": {Path: "model.pkl"},
+			},
+		},
+		"report.yaml": &stage.Stage{
+			Inputs: map[string]*artifact.Artifact{
+				"clean.csv": {Path: "clean.csv"},
+				"model.pkl": {Path: "model.pkl"},
+			},
+			Outputs: map[string]*artifact.Artifact{
+				"report.html": {Path: "report.html"},
+			},
+		},
+		"other.yaml": &stage.Stage{
+			Inputs: map[string]*artifact.Artifact{
+				"config.json": {Path: "config.json"},
+			},
+			Outputs: map[string]*artifact.Artifact{
+				"other.txt": {Path: "other.txt"},
+			},
+		},
+	}
+
+	tests := map[string][]string{
+		"raw.yaml":     {"clean.yaml", "train.yaml", "report.yaml"},
+		"raw":          {"clean.yaml", "train.yaml", "report.yaml"},
+		"raw/data.csv": {"clean.yaml", "train.yaml", "report.yaml"},
+		"clean.csv":    {"train.yaml", "report.yaml"},
+		"model.pkl":    {"report.yaml"},
+		"config.json":  {"other.yaml"},
+		"report.yaml":  {},
+		"unknown.txt":  {},
+	}
+	for path, want := range tests {
+		t.Run(path, func(t *testing.T) {
+			got, err := idx.Dependents(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("Dependents(%#v) -want +got:\n%s", path, diff)
+			}
+		})
+	}
+
+	t.Run("cycle", func(t *testing.T) {
+		idx := Index{
+			"foo.yaml": &stage.Stage{
+				Inputs:  map[string]*artifact.Artifact{"bar.txt": {Path: "bar.txt"}},
+				Outputs: map[string]*artifact.Artifact{"foo.txt": {Path: "foo.txt"}},
+			},
+			"bar.yaml": &stage.Stage{
+				Inputs:  map[string]*artifact.Artifact{"foo.txt": {Path: "foo.txt"}},
+				Outputs: map[string]*artifact.Artifact{"bar.txt": {Path: "bar.txt"}},
+			},
+		}
+		if _, err := idx.Dependents("foo.txt"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package index
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/pkg/errors"
+)
+
+// Directories that are never searched for Stage files.
+var skipDiscoveryDirs = map[string]bool{
+	".dud": true,
+	".git": true,
+}
+
+// FromGlobs builds an Index from all Stage files in the current directory
+// tree that match any of the given glob patterns. In addition to the syntax
+// supported by path.Match, a "**" path component matches zero or more
+// directories.
+//
+// To keep discovery cheap on large data trees, FromGlobs never searches
+// skipPaths (e.g. the cache directory) or directories wholly owned by a
+// directory artifact of a Stage discovered before them. The files of each
+// directory are visited before its sub-directories, so a Stage file is always
+// found before the directory outputs beside it. Stages are added to the Index
+// in this (deterministic) order, so ownership conflicts are reported
+// deterministically.
+func FromGlobs(patterns []string, skipPaths ...string) (Index, error) {
+	errPrefix := "discover stages"
+	for _, pattern := range patterns {
+		if err := validateGlob(pattern); err != nil {
+			return nil, errors.Wrapf(err, "%s: pattern %#v", errPrefix, pattern)
+		}
+	}
+	d := discoverer{
+		patterns: patterns,
+		idx:      make(Index),
+		skip:     make(map[string]bool, len(skipPaths)),
+	}
+	for _, skipPath := range skipPaths {
+		d.skip[filepath.Clean(skipPath)] = true
+	}
+	return d.idx, errors.Wrap(d.walk("."), errPrefix)
+}
+
+type discoverer struct {
+	patterns []string
+	idx      Index
+	// skip holds the directories that must not be searched.
+	skip map[string]bool
+}
+
+func (d discoverer) walk(dir string) error {
+	// ReadDir returns entries sorted by name.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var subDirs []string
+	for _, entry := range entries {
+		entryPath := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			subDirs = append(subDirs, entryPath)
+			continue
+		}
+		if err := d.addIfMatched(entryPath); err != nil {
+			return err
+		}
+	}
+	for _, subDir := range subDirs {
+		if skipDiscoveryDirs[filepath.Base(subDir)] || d.skip[subDir] {
+			continue
+		}
+		if err := d.walk(subDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d discoverer) addIfMatched(stagePath string) error {
+	for _, pattern := range d.patterns {
+		// Errors were checked in FromGlobs.
+		if ok, _ := matchGlob(pattern, filepath.ToSlash(stagePath)); ok {
+			stg, err := stage.FromFile(stagePath)
+			if err != nil {
+				return err
+			}
+			if err := d.idx.AddStage(stg, stagePath); err != nil {
+				return err
+			}
+			for artPath, art := range stg.Outputs {
+				// Only skip directories the artifact owns in full; others may
+				// hold files owned by other Stages, including Stage files.
+				if art.IsDir && !art.DisableRecursion && len(art.Include) == 0 && len(art.Exclude) == 0 {
+					d.skip[artPath] = true
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func validateGlob(pattern string) error {
+	for _, part := range strings.Split(pattern, "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether the slash-separated name matches the pattern.
+// See FromGlobs for the supported syntax.
+func matchGlob(pattern, name string) (bool, error) {
+	return matchParts(
+		strings.Split(path.Clean(pattern), "/"),
+		strings.Split(path.Clean(name), "/"),
+	)
+}
+
+func matchParts(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try to match the rest of the pattern against every suffix of
+			// the name, including the empty suffix.
+			for i := 0; i <= len(name); i++ {
+				ok, err := matchParts(pattern[1:], name[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
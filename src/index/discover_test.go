@@ -0,0 +1,133 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.dud", "foo.dud", true},
+		{"*.dud", "sub/foo.dud", false},
+		{"**/*.dud", "foo.dud", true},
+		{"**/*.dud", "sub/foo.dud", true},
+		{"**/*.dud", "sub/dir/foo.dud", true},
+		{"**/*.dud", "sub/foo.yaml", false},
+		{"sub/**/*.dud", "sub/foo.dud", true},
+		{"sub/**/*.dud", "sub/a/b/foo.dud", true},
+		{"sub/**/*.dud", "other/foo.dud", false},
+		{"sub/**", "sub/a/b/foo.dud", true},
+		{"sub/*", "sub/a/foo.dud", false},
+	}
+	for _, test := range tests {
+		got, err := matchGlob(test.pattern, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("matchGlob(%#v, %#v) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestFromGlobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	setup := func(t *testing.T, files map[string]string) {
+		origDir, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootDir := t.TempDir()
+		for path, contents := range files {
+			path = filepath.Join(rootDir, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chdir(rootDir); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chdir(origDir) })
+	}
+
+	t.Run("discover nested stage files", func(t *testing.T) {
+		setup(t, map[string]string{
+			"foo.dud":           "outputs:\n  foo.bin:\n",
+			"sub/bar.dud":       "outputs:\n  sub/bar.bin:\n",
+			"sub/ignored.yaml":  "outputs:\n  sub/other.bin:\n",
+			".dud/cache/ab.dud": "not a stage",
+		})
+
+		idx, err := FromGlobs([]string{"**/*.dud"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"foo.dud", "sub/bar.dud"}
+		if diff := cmp.Diff(want, idx.SortStagePaths()); diff != "" {
+			t.Fatalf("stage paths -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("skip cache and owned directories", func(t *testing.T) {
+		setup(t, map[string]string{
+			"data.dud":           "outputs:\n  data:\n    is-dir: true\n",
+			"data/nested.dud":    "outputs:\n  other.bin:\n",
+			"cache/ab.dud":       "not a stage",
+			"flat.dud":           "outputs:\n  flat:\n    is-dir: true\n    disable-recursion: true\n",
+			"flat/sub/found.dud": "outputs:\n  found.bin:\n",
+		})
+
+		idx, err := FromGlobs([]string{"**/*.dud"}, "cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"data.dud", "flat.dud", "flat/sub/found.dud"}
+		if diff := cmp.Diff(want, idx.SortStagePaths()); diff != "" {
+			t.Fatalf("stage paths -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("detect ownership conflicts", func(t *testing.T) {
+		setup(t, map[string]string{
+			"a.dud":     "outputs:\n  foo.bin:\n",
+			"sub/b.dud": "outputs:\n  foo.bin:\n",
+		})
+
+		_, err := FromGlobs([]string{"**/*.dud"})
+		var conflict OwnershipConflictError
+		if !errors.As(err, &conflict) {
+			t.Fatalf("expected OwnershipConflictError, got %v", err)
+		}
+		want := OwnershipConflictError{
+			Artifact:   "foo.bin",
+			OwnerStage: "a.dud",
+			NewStage:   filepath.Join("sub", "b.dud"),
+		}
+		if conflict != want {
+			t.Fatalf("error want: %#v, got: %#v", want, conflict)
+		}
+	})
+
+	t.Run("reject bad patterns", func(t *testing.T) {
+		setup(t, map[string]string{})
+
+		if _, err := FromGlobs([]string{"[.dud"}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -128,3 +128,33 @@ func TestFindOwner(t *testing.T) {
 		}
 	})
 }
+
+func TestFindOutput(t *testing.T) {
+	targetArt := artifact.Artifact{Path: "foo", IsDir: true}
+	idx := Index{
+		"foo.yaml": &stage.Stage{
+			Outputs: map[string]*artifact.Artifact{"foo": &targetArt},
+		},
+		"bar.yaml": &stage.Stage{
+			Inputs:  map[string]*artifact.Artifact{"baz.bin": {Path: "baz.bin"}},
+			Outputs: map[string]*artifact.Artifact{"bar.bin": {Path: "bar.bin"}},
+		},
+	}
+
+	stagePath, foundArt, ok := idx.FindOutput("foo")
+	if !ok {
+		t.Fatal("expected to find foo")
+	}
+	if stagePath != "foo.yaml" {
+		t.Fatalf("got stage path = %#v, want foo.yaml", stagePath)
+	}
+	if diff := cmp.Diff(&targetArt, foundArt); diff != "" {
+		t.Fatalf("artifact -want +got:\n%s", diff)
+	}
+
+	for _, artPath := range []string{"foo/bar.bin", "baz.bin", "other.bin"} {
+		if _, _, ok := idx.FindOutput(artPath); ok {
+			t.Fatalf("unexpectedly found %s", artPath)
+		}
+	}
+}
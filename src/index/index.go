@@ -3,11 +3,14 @@ package index
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"strings"
 
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/checksum"
+	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/stage"
 	"github.com/pkg/errors"
 )
@@ -24,6 +27,26 @@ func (e unknownStageError) Error() string {
 	return fmt.Sprintf("unknown stage %#v", e.stagePath)
 }
 
+// OwnershipConflictError is an error case where a Stage declares an output
+// Artifact that is already owned by another Stage in the Index.
+type OwnershipConflictError struct {
+	// Artifact is the path of the contested Artifact.
+	Artifact string
+	// OwnerStage is the path of the Stage that already owns the Artifact.
+	OwnerStage string
+	// NewStage is the path of the Stage that attempted to claim the Artifact.
+	NewStage string
+}
+
+func (e OwnershipConflictError) Error() string {
+	return fmt.Sprintf(
+		"%s: artifact %s already owned by %s",
+		e.NewStage,
+		e.Artifact,
+		e.OwnerStage,
+	)
+}
+
 // AddStage adds the given Stage to the Index, with the given path as the key.
 func (idx *Index) AddStage(stg stage.Stage, path string) error {
 	if _, ok := (*idx)[path]; ok {
@@ -32,12 +55,11 @@ func (idx *Index) AddStage(stg stage.Stage, path string) error {
 	for artPath := range stg.Outputs {
 		ownerPath, _ := idx.findOwner(artPath)
 		if ownerPath != "" {
-			return fmt.Errorf(
-				"%s: artifact %s already owned by %s",
-				path,
-				artPath,
-				ownerPath,
-			)
+			return OwnershipConflictError{
+				Artifact:   artPath,
+				OwnerStage: ownerPath,
+				NewStage:   path,
+			}
 		}
 	}
 	(*idx)[path] = &stg
@@ -60,19 +82,54 @@ func (idx Index) ToFile(indexPath string) error {
 	errPrefix := fmt.Sprintf("writing index to %s", indexPath)
 	// TODO: If we stop relying on the project-wide lock file, this should be
 	// flocked.
-	file, err := os.Create(indexPath)
+	err := fsutil.WriteFileAtomic(indexPath, 0o644, func(w io.Writer) error {
+		// Sort the stage paths so the index file is written deterministically.
+		for _, stagePath := range idx.SortStagePaths() {
+			if _, err := fmt.Fprintln(w, stagePath); err != nil {
+				return errors.Wrapf(err, "write %s", stagePath)
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, errPrefix)
+}
+
+// ExternalModificationError is an error case where the index file changed on
+// disk after it was read.
+type ExternalModificationError struct {
+	Path string
+}
+
+func (e ExternalModificationError) Error() string {
+	return fmt.Sprintf("index %s modified externally; re-run", e.Path)
+}
+
+// FileChecksum returns the checksum of the contents of the index file at
+// indexPath.
+func FileChecksum(indexPath string) (string, error) {
+	file, err := os.Open(indexPath)
 	if err != nil {
-		return errors.Wrap(err, errPrefix)
+		return "", errors.Wrapf(err, "checksum index %s", indexPath)
 	}
 	defer file.Close()
+	cksum, err := checksum.Checksum(file)
+	return cksum, errors.Wrapf(err, "checksum index %s", indexPath)
+}
 
-	// Sort the stage paths so the index file is written deterministically.
-	for _, stagePath := range idx.SortStagePaths() {
-		if _, err := fmt.Fprintln(file, stagePath); err != nil {
-			return errors.Wrapf(err, "%s: write %s", errPrefix, stagePath)
-		}
+// ToFileIfUnchanged writes the Index to the specified file path like ToFile,
+// but only if the checksum of the file still matches expectedChecksum, as
+// returned by FileChecksum when the Index was read. Otherwise it returns an
+// ExternalModificationError and leaves the file untouched, so edits made to
+// the file in the meantime aren't lost.
+func (idx Index) ToFileIfUnchanged(indexPath, expectedChecksum string) error {
+	cksum, err := FileChecksum(indexPath)
+	if err != nil {
+		return err
 	}
-	return nil
+	if cksum != expectedChecksum {
+		return ExternalModificationError{indexPath}
+	}
+	return idx.ToFile(indexPath)
 }
 
 // SortStagePaths returns a sorted slice of Stage paths stored in the Index.
@@ -85,36 +142,87 @@ func (idx Index) SortStagePaths() []string {
 	return paths
 }
 
-// FromFile reads and returns an Index from the specified file path.
-// See ToFile docs for more context.
-// TODO no tests
-func FromFile(path string) (Index, error) {
-	errPrefix := fmt.Sprintf("load index from %s", path)
-	var idx Index
+// StagePathsFromFile returns the Stage paths listed in the index file at the
+// specified path, in the order they're listed, without loading the Stages.
+func StagePathsFromFile(path string) ([]string, error) {
+	errPrefix := fmt.Sprintf("read index %s", path)
 	file, err := os.Open(path)
 	if err != nil {
-		return idx, errors.Wrap(err, errPrefix)
+		return nil, errors.Wrap(err, errPrefix)
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
-	idx = make(Index)
+	paths := []string{}
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
 			continue
 		}
-		stg, err := stage.FromFile(line)
+		paths = append(paths, line)
+	}
+	return paths, errors.Wrap(scanner.Err(), errPrefix)
+}
+
+// FromFile reads and returns an Index from the specified file path.
+// See ToFile docs for more context.
+// TODO no tests
+func FromFile(path string) (Index, error) {
+	idx, _, err := fromFile(path, false)
+	return idx, err
+}
+
+// FromFileSkipMissing reads an Index from the specified file path like
+// FromFile, but skips Stages whose files don't exist rather than failing. It
+// returns the paths of the skipped Stages, in the order they're listed in the
+// index file.
+func FromFileSkipMissing(path string) (Index, []string, error) {
+	return fromFile(path, true)
+}
+
+func fromFile(path string, skipMissing bool) (idx Index, missing []string, err error) {
+	errPrefix := fmt.Sprintf("load index from %s", path)
+	stagePaths, err := StagePathsFromFile(path)
+	if err != nil {
+		return idx, missing, errors.Wrap(err, errPrefix)
+	}
+	idx = make(Index)
+	for _, stagePath := range stagePaths {
+		if skipMissing {
+			if _, err := os.Lstat(stagePath); os.IsNotExist(err) {
+				missing = append(missing, stagePath)
+				continue
+			}
+		}
+		stg, err := stage.FromFile(stagePath)
 		if err != nil {
-			return idx, errors.Wrap(err, errPrefix)
+			return idx, missing, errors.Wrap(err, errPrefix)
 		}
-		if err := idx.AddStage(stg, line); err != nil {
-			return idx, errors.Wrap(err, errPrefix)
+		if err := idx.AddStage(stg, stagePath); err != nil {
+			return idx, missing, errors.Wrap(err, errPrefix)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return idx, errors.Wrap(err, errPrefix)
+	return idx, missing, nil
+}
+
+// FindOutput returns the path of the Stage that outputs the Artifact at
+// artPath, along with the Artifact itself. Only exact matches are found; files
+// within a directory Artifact are not.
+func (idx Index) FindOutput(artPath string) (string, *artifact.Artifact, bool) {
+	for stagePath, stg := range idx {
+		if art, ok := stg.Outputs[artPath]; ok {
+			return stagePath, art, true
+		}
 	}
-	return idx, nil
+	return "", nil, false
+}
+
+// FindOwner returns the path of the Stage that owns the Artifact at artPath,
+// along with the owning Artifact. Unlike FindOutput, files and directories
+// within a directory Artifact are found as well, in which case the directory
+// Artifact is returned.
+func (idx Index) FindOwner(artPath string) (string, *artifact.Artifact, bool) {
+	stagePath, art := idx.findOwner(artPath)
+	return stagePath, art, art != nil
 }
 
 func (idx Index) findOwner(artPath string) (string, *artifact.Artifact) {
@@ -1,8 +1,12 @@
 package index
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/kevin-hanselman/dud/src/artifact"
 	"github.com/kevin-hanselman/dud/src/stage"
 )
@@ -56,6 +60,18 @@ func TestAdd(t *testing.T) {
 		if err.Error() != expectedError {
 			t.Fatalf("\nerror want: %s\nerror got: %s", expectedError, err.Error())
 		}
+		var conflict OwnershipConflictError
+		if !errors.As(err, &conflict) {
+			t.Fatalf("expected OwnershipConflictError, got %T", err)
+		}
+		expectedConflict := OwnershipConflictError{
+			Artifact:   "subDir/foo.bin",
+			OwnerStage: "foo.yaml",
+			NewStage:   "bar.yaml",
+		}
+		if conflict != expectedConflict {
+			t.Fatalf("\nerror want: %#v\nerror got: %#v", expectedConflict, conflict)
+		}
 	})
 
 	t.Run("working dir should have no effect on artifact paths", func(t *testing.T) {
@@ -78,3 +94,111 @@ func TestAdd(t *testing.T) {
 		}
 	})
 }
+
+func TestToFileIfUnchanged(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		indexPath := filepath.Join(t.TempDir(), "index")
+		if err := os.WriteFile(indexPath, []byte("foo.yaml\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cksum, err := FileChecksum(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return indexPath, cksum
+	}
+
+	t.Run("writes unchanged index", func(t *testing.T) {
+		indexPath, cksum := setup(t)
+		idx := Index{"foo.yaml": {}, "bar.yaml": {}}
+
+		if err := idx.ToFileIfUnchanged(indexPath, cksum); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "bar.yaml\nfoo.yaml\n"; string(got) != want {
+			t.Fatalf("index file = %#v, want %#v", string(got), want)
+		}
+	})
+
+	t.Run("refuses to overwrite external edits", func(t *testing.T) {
+		indexPath, cksum := setup(t)
+		edited := "foo.yaml\nbish.yaml\n"
+		if err := os.WriteFile(indexPath, []byte(edited), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		idx := Index{"foo.yaml": {}, "bar.yaml": {}}
+
+		err := idx.ToFileIfUnchanged(indexPath, cksum)
+
+		var modErr ExternalModificationError
+		if !errors.As(err, &modErr) {
+			t.Fatalf("expected ExternalModificationError, got %v", err)
+		}
+		got, err := os.ReadFile(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != edited {
+			t.Fatalf("index file = %#v, want %#v", string(got), edited)
+		}
+	})
+}
+
+func TestStagePathsFromFile(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "index")
+	if err := os.WriteFile(indexPath, []byte("foo.yaml\n\n  bar.yaml\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := StagePathsFromFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"foo.yaml", "bar.yaml"}, got); diff != "" {
+		t.Fatalf("StagePathsFromFile() -want +got:\n%s", diff)
+	}
+}
+
+func TestFromFileSkipMissing(t *testing.T) {
+	dir := t.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(origDir)
+
+	stg := stage.Stage{
+		WorkingDir: ".",
+		Outputs:    map[string]*artifact.Artifact{"foo.txt": {Path: "foo.txt"}},
+	}
+	if err := stg.ToFile("foo.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("index", []byte("gone.yaml\nfoo.yaml\nalso_gone.yaml\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := FromFile("index"); err == nil {
+		t.Fatal("expected FromFile to fail on missing stage files")
+	}
+
+	idx, missing, err := FromFileSkipMissing("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"gone.yaml", "also_gone.yaml"}, missing); diff != "" {
+		t.Fatalf("missing stages -want +got:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"foo.yaml"}, idx.SortStagePaths()); diff != "" {
+		t.Fatalf("loaded stages -want +got:\n%s", diff)
+	}
+}
@@ -1,10 +1,13 @@
 package index
 
 import (
+	"io"
 	"os/exec"
 
 	"github.com/kevin-hanselman/dud/src/agglog"
+	"github.com/kevin-hanselman/dud/src/artifact"
 	"github.com/kevin-hanselman/dud/src/cache"
+	"github.com/kevin-hanselman/dud/src/strategy"
 	"github.com/pkg/errors"
 )
 
@@ -102,10 +105,17 @@ func (idx Index) Run(
 	if doRun {
 		if hasCommand {
 			logger.Info.Printf("running stage %s (%s)\n", stagePath, runReason)
-			cmd := stg.CreateCommand()
+			cmd, err := stg.CreateCommand()
+			if err != nil {
+				return err
+			}
 			// Avoid cmd.Command here because it will include "sh -c ...".
 			logger.Debug.Printf("(in %s) %s\n", cmd.Dir, stg.Command)
-			if err := runCommand(cmd); err != nil {
+			if art, ok := stg.CapturedOutput(); ok {
+				if err := runCapturingStdout(cmd, ch, rootDir, art); err != nil {
+					return err
+				}
+			} else if err := runCommand(cmd); err != nil {
 				return err
 			}
 		} else {
@@ -118,3 +128,34 @@ func (idx Index) Run(
 	delete(inProgress, stagePath)
 	return nil
 }
+
+// runCapturingStdout runs cmd and commits its standard output to the Cache as
+// art, streaming it through the checksum. If the command fails, art is left
+// unchanged.
+func runCapturingStdout(
+	cmd *exec.Cmd,
+	ch cache.Cache,
+	rootDir string,
+	art *artifact.Artifact,
+) error {
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	commitErr := make(chan error, 1)
+	go func() {
+		err := ch.CommitStream(rootDir, art, reader, strategy.LinkStrategy)
+		// Keep the command from blocking on a full pipe if the commit failed
+		// early.
+		if err != nil {
+			io.Copy(io.Discard, reader)
+		}
+		commitErr <- err
+	}()
+	runErr := runCommand(cmd)
+	// A nil error closes the pipe normally, which ends the commit.
+	writer.CloseWithError(runErr)
+	err := <-commitErr
+	if runErr != nil {
+		return runErr
+	}
+	return err
+}
@@ -1,7 +1,9 @@
 package index
 
 import (
+	"io"
 	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -10,9 +12,11 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/kevin-hanselman/dud/src/agglog"
 	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/kevin-hanselman/dud/src/cache"
 	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/kevin-hanselman/dud/src/mocks"
 	"github.com/kevin-hanselman/dud/src/stage"
+	"github.com/kevin-hanselman/dud/src/strategy"
 )
 
 func assertCorrectCommand(stg stage.Stage, commands map[string]*exec.Cmd, t *testing.T) {
@@ -29,6 +33,22 @@ func assertCorrectCommand(stg stage.Stage, commands map[string]*exec.Cmd, t *tes
 	}
 }
 
+// streamCache is a cache.Cache that only implements CommitStream. Calling any
+// other method panics.
+type streamCache struct {
+	cache.Cache
+	commitStream func(workDir string, art *artifact.Artifact, r io.Reader, s strategy.CheckoutStrategy) error
+}
+
+func (c streamCache) CommitStream(
+	workDir string,
+	art *artifact.Artifact,
+	r io.Reader,
+	s strategy.CheckoutStrategy,
+) error {
+	return c.commitStream(workDir, art, r, s)
+}
+
 func TestRun(t *testing.T) {
 	upToDate := func() artifact.Status {
 		return artifact.Status{
@@ -712,4 +732,62 @@ func TestRun(t *testing.T) {
 			t.Fatalf("log -want +got:\n%s", diff)
 		}
 	})
+
+	t.Run("captured stdout is committed while the command runs", func(t *testing.T) {
+		resetTestHarness()
+		stgA := stage.Stage{
+			Command: "echo hello",
+			Outputs: map[string]*artifact.Artifact{
+				"out.txt": {Path: "out.txt", Capture: artifact.CaptureStdout},
+			},
+		}
+		updateChecksum(&stgA, t)
+		idx := Index{"foo.yaml": &stgA}
+
+		// A hand-written fake, because mocks.Cache would format the pipe
+		// reader while the command goroutine closes it (a data race).
+		var streamed bool
+		fakeCache := streamCache{
+			commitStream: func(
+				workDir string,
+				art *artifact.Artifact,
+				r io.Reader,
+				s strategy.CheckoutStrategy,
+			) error {
+				if workDir != rootDir || s != strategy.LinkStrategy {
+					t.Errorf("CommitStream(%#v, %v), want (%#v, %v)", workDir, s, rootDir, strategy.LinkStrategy)
+				}
+				if art != stgA.Outputs["out.txt"] {
+					t.Error("CommitStream called with the wrong artifact")
+				}
+				if _, err := io.ReadAll(r); err != nil {
+					t.Error(err)
+				}
+				art.Checksum = "abc"
+				streamed = true
+				return nil
+			},
+		}
+
+		ran := make(map[string]bool)
+		inProgress := make(map[string]bool)
+		if err := idx.Run("foo.yaml", fakeCache, rootDir, true, ran, inProgress, logger); err != nil {
+			t.Fatal(err)
+		}
+
+		if !streamed {
+			t.Fatal("CommitStream not called")
+		}
+
+		cmd, ok := commands[stgA.Command]
+		if !ok {
+			t.Fatal("runCommand not called")
+		}
+		if cmd.Stdout == os.Stdout {
+			t.Fatal("command stdout wasn't captured")
+		}
+		if got := stgA.Outputs["out.txt"].Checksum; got != "abc" {
+			t.Fatalf("output checksum = %#v, want %#v", got, "abc")
+		}
+	})
 }
@@ -1,6 +1,10 @@
 package index
 
 import (
+	"context"
+	"sort"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
 	"github.com/kevin-hanselman/dud/src/cache"
 	"github.com/kevin-hanselman/dud/src/stage"
 	"github.com/pkg/errors"
@@ -9,11 +13,14 @@ import (
 // Status is a map of Stage paths to Stage Statuses
 type Status map[string]stage.Status
 
-// Status returns the status for the given Stage and all upstream Stages.
+// Status returns the status for the given Stage and all upstream Stages. If
+// checkDefinitions is false, Stage definitions are not checked for
+// modifications, and only the status of Artifacts is reported.
 func (idx Index) Status(
 	stagePath string,
 	ch cache.Cache,
 	rootDir string,
+	checkDefinitions bool,
 	out Status,
 	inProgress map[string]bool,
 ) error {
@@ -34,7 +41,10 @@ func (idx Index) Status(
 	}
 
 	stageStatus := stage.NewStatus()
-	if stg.Checksum != "" {
+	stageStatus.Frozen = stg.Frozen
+	if !checkDefinitions {
+		stageStatus.Skipped = true
+	} else if stg.Checksum != "" {
 		stageStatus.HasChecksum = true
 		realChecksum, err := stg.CalculateChecksum()
 		if err != nil {
@@ -43,16 +53,20 @@ func (idx Index) Status(
 		stageStatus.ChecksumMatches = realChecksum == stg.Checksum
 	}
 
+	if len(stg.Inputs) > 0 {
+		stageStatus.Inputs = make(map[string]string, len(stg.Inputs))
+	}
 	for artPath, art := range stg.Inputs {
 		var err error
 		ownerPath, _ := idx.findOwner(artPath)
+		stageStatus.Inputs[artPath] = ownerPath
 		if ownerPath == "" {
 			stageStatus.ArtifactStatus[artPath], err = ch.Status(rootDir, *art, false)
 			if err != nil {
 				return err
 			}
 		} else {
-			if err := idx.Status(ownerPath, ch, rootDir, out, inProgress); err != nil {
+			if err := idx.Status(ownerPath, ch, rootDir, checkDefinitions, out, inProgress); err != nil {
 				return err
 			}
 		}
@@ -70,3 +84,148 @@ func (idx Index) Status(
 	delete(inProgress, stagePath)
 	return nil
 }
+
+// A StageResult is the status of a single Stage, as emitted by StatusStream.
+type StageResult struct {
+	// Path is the path of the Stage file.
+	Path string
+	// Status is the Stage's status. It is only valid if Err is nil.
+	Status stage.Status
+	// Err is the error encountered while determining the Stage's status, if
+	// any.
+	Err error
+}
+
+// StatusStream determines the status of every Stage in the Index in the
+// background, and sends each Stage's result on the returned channel as soon as
+// it's known. Stages are sent after the Stages upstream of them, so consumers
+// can accumulate results in a Status and look up the owners of inputs (e.g.
+// with Status.InputStatus). A Stage whose status can't be determined is sent
+// with its error, and the remaining Stages are still checked. The channel is
+// closed once all Stages are sent, or once ctx is done. See Status for the
+// meaning of checkDefinitions.
+func (idx Index) StatusStream(
+	ctx context.Context,
+	ch cache.Cache,
+	rootDir string,
+	checkDefinitions bool,
+) <-chan StageResult {
+	results := make(chan StageResult)
+	go func() {
+		defer close(results)
+		send := func(result StageResult) bool {
+			select {
+			case results <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		out := make(Status)
+		sent := make(map[string]bool)
+		for _, stagePath := range idx.SortStagePaths() {
+			if ctx.Err() != nil {
+				return
+			}
+			if sent[stagePath] {
+				continue
+			}
+			inProgress := make(map[string]bool)
+			err := idx.Status(stagePath, ch, rootDir, checkDefinitions, out, inProgress)
+			// Index.Status records upstream Stages before the Stages that
+			// depend on them, but a map has no order, so send the new results
+			// in dependency order.
+			for _, path := range idx.unsentInDependencyOrder(stagePath, out, sent) {
+				sent[path] = true
+				if !send(StageResult{Path: path, Status: out[path]}) {
+					return
+				}
+			}
+			if err != nil {
+				sent[stagePath] = true
+				if !send(StageResult{Path: stagePath, Err: err}) {
+					return
+				}
+			}
+		}
+	}()
+	return results
+}
+
+// unsentInDependencyOrder returns the Stages in out that haven't been sent
+// yet, ordered so that every Stage comes after the Stages upstream of it. Only
+// stagePath and the Stages upstream of it are considered.
+func (idx Index) unsentInDependencyOrder(
+	stagePath string,
+	out Status,
+	sent map[string]bool,
+) (ordered []string) {
+	visited := make(map[string]bool)
+	var visit func(path string)
+	visit = func(path string) {
+		if visited[path] {
+			return
+		}
+		visited[path] = true
+		stg, ok := idx[path]
+		if !ok {
+			return
+		}
+		upstream := make([]string, 0, len(stg.Inputs))
+		for artPath := range stg.Inputs {
+			if ownerPath, _ := idx.findOwner(artPath); ownerPath != "" {
+				upstream = append(upstream, ownerPath)
+			}
+		}
+		sort.Strings(upstream)
+		for _, ownerPath := range upstream {
+			visit(ownerPath)
+		}
+		if _, ok := out[path]; ok && !sent[path] {
+			ordered = append(ordered, path)
+		}
+	}
+	visit(stagePath)
+	return
+}
+
+// OutputStatus returns the statuses of the outputs of the Stage at stagePath.
+func (status Status) OutputStatus(stagePath string) map[string]artifact.Status {
+	stageStatus := status[stagePath]
+	out := make(map[string]artifact.Status, len(stageStatus.ArtifactStatus))
+	for artPath, artStatus := range stageStatus.ArtifactStatus {
+		if _, isInput := stageStatus.Inputs[artPath]; !isInput {
+			out[artPath] = artStatus
+		}
+	}
+	return out
+}
+
+// InputStatus returns the statuses of the inputs of the Stage at stagePath.
+// For an input owned by another Stage, the status of the owner's Artifact is
+// returned, keyed by the owner Artifact's path. This may be a directory
+// Artifact containing the input. Inputs whose owner's status isn't in the
+// Status are omitted.
+func (status Status) InputStatus(stagePath string) map[string]artifact.Status {
+	stageStatus := status[stagePath]
+	out := make(map[string]artifact.Status, len(stageStatus.Inputs))
+	for inputPath, ownerPath := range stageStatus.Inputs {
+		artStatuses := stageStatus.ArtifactStatus
+		if ownerPath != "" {
+			artStatuses = status[ownerPath].ArtifactStatus
+		}
+		if artStatus, ok := artStatuses[inputPath]; ok {
+			out[inputPath] = artStatus
+			continue
+		}
+		arts := make(map[string]*artifact.Artifact, len(artStatuses))
+		for artPath, artStatus := range artStatuses {
+			art := artStatus.Artifact
+			arts[artPath] = &art
+		}
+		if owner, ok := stage.FindDirArtifactOwnerForPath(inputPath, arts); ok {
+			out[owner.Path] = artStatuses[owner.Path]
+		}
+	}
+	return out
+}
@@ -1,6 +1,8 @@
 package index
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -54,7 +56,7 @@ func TestStatus(t *testing.T) {
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err := idx.Status("foo.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err := idx.Status("foo.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -89,7 +91,35 @@ func TestStatus(t *testing.T) {
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err = idx.Status("foo.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err = idx.Status("foo.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mockCache.AssertExpectations(t)
+		if diff := cmp.Diff(expectedStatus, outputStatus); diff != "" {
+			t.Fatalf("Stage -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("skip checking stage definitions", func(t *testing.T) {
+		stgA := stage.Stage{
+			Checksum: "abcd",
+			Outputs: map[string]*artifact.Artifact{
+				"foo.bin": {Path: "foo.bin"},
+			},
+		}
+		idx := Index{"foo.yaml": &stgA}
+
+		mockCache := mocks.Cache{}
+
+		expectedStageStatus := expectStageStatusCalled(&stgA, &mockCache, rootDir, upToDate, false)
+		expectedStageStatus.Skipped = true
+		expectedStatus := Status{"foo.yaml": expectedStageStatus}
+
+		outputStatus := make(Status)
+		inProgress := make(map[string]bool)
+		err := idx.Status("foo.yaml", &mockCache, rootDir, false, outputStatus, inProgress)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -124,7 +154,7 @@ func TestStatus(t *testing.T) {
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err := idx.Status("foo.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err := idx.Status("foo.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -156,6 +186,9 @@ func TestStatus(t *testing.T) {
 			"foo.yaml": expectStageStatusCalled(&stgA, &mockCache, rootDir, upToDate, false),
 			"bar.yaml": expectStageStatusCalled(&stgB, &mockCache, rootDir, upToDate, false),
 		}
+		barStatus := expectedStatus["bar.yaml"]
+		barStatus.Inputs = map[string]string{"foo.bin": "foo.yaml"}
+		expectedStatus["bar.yaml"] = barStatus
 
 		idx := Index{
 			"foo.yaml": &stgA,
@@ -164,7 +197,7 @@ func TestStatus(t *testing.T) {
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err := idx.Status("bar.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err := idx.Status("bar.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -213,10 +246,16 @@ func TestStatus(t *testing.T) {
 			"b.yaml": expectStageStatusCalled(&stgB, &mockCache, rootDir, upToDate, false),
 			"c.yaml": expectStageStatusCalled(&stgC, &mockCache, rootDir, upToDate, false),
 		}
+		bStatus := expectedStatus["b.yaml"]
+		bStatus.Inputs = map[string]string{"a.bin": "a.yaml"}
+		expectedStatus["b.yaml"] = bStatus
+		cStatus := expectedStatus["c.yaml"]
+		cStatus.Inputs = map[string]string{"a.bin": "a.yaml", "b.bin": "b.yaml"}
+		expectedStatus["c.yaml"] = cStatus
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err := idx.Status("c.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err := idx.Status("c.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -275,7 +314,7 @@ func TestStatus(t *testing.T) {
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err := idx.Status("c.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err := idx.Status("c.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
 		if err == nil {
 			t.Fatal("expected error")
 		}
@@ -315,13 +354,14 @@ func TestStatus(t *testing.T) {
 		orphanArtStatus.Artifact = orphanArt
 
 		expectedStageStatus.ArtifactStatus["bish.bin"] = orphanArtStatus
+		expectedStageStatus.Inputs = map[string]string{"bish.bin": ""}
 		expectedStatus := Status{"foo.yaml": expectedStageStatus}
 
 		mockCache.On("Status", rootDir, orphanArt, false).Return(orphanArtStatus, nil).Once()
 
 		outputStatus := make(Status)
 		inProgress := make(map[string]bool)
-		err := idx.Status("foo.yaml", &mockCache, rootDir, outputStatus, inProgress)
+		err := idx.Status("foo.yaml", &mockCache, rootDir, true, outputStatus, inProgress)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -332,3 +372,135 @@ func TestStatus(t *testing.T) {
 		}
 	})
 }
+
+func TestStatusScope(t *testing.T) {
+	status := Status{
+		"foo.yaml": stage.Status{
+			ArtifactStatus: map[string]artifact.Status{
+				"data": {Artifact: artifact.Artifact{Path: "data", IsDir: true}},
+			},
+		},
+		"bar.yaml": stage.Status{
+			ArtifactStatus: map[string]artifact.Status{
+				"bish.bin": {Artifact: artifact.Artifact{Path: "bish.bin"}},
+				"bar.bin":  {Artifact: artifact.Artifact{Path: "bar.bin"}},
+			},
+			Inputs: map[string]string{
+				"bish.bin":     "",
+				"data/foo.bin": "foo.yaml",
+				"gone.bin":     "gone.yaml",
+			},
+		},
+	}
+
+	t.Run("OutputStatus", func(t *testing.T) {
+		want := map[string]artifact.Status{
+			"bar.bin": status["bar.yaml"].ArtifactStatus["bar.bin"],
+		}
+		if diff := cmp.Diff(want, status.OutputStatus("bar.yaml")); diff != "" {
+			t.Fatalf("OutputStatus -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("InputStatus", func(t *testing.T) {
+		want := map[string]artifact.Status{
+			"bish.bin": status["bar.yaml"].ArtifactStatus["bish.bin"],
+			"data":     status["foo.yaml"].ArtifactStatus["data"],
+		}
+		if diff := cmp.Diff(want, status.InputStatus("bar.yaml")); diff != "" {
+			t.Fatalf("InputStatus -want +got:\n%s", diff)
+		}
+	})
+}
+
+func TestStatusStream(t *testing.T) {
+	upToDate := artifact.Status{
+		WorkspaceFileStatus: fsutil.StatusLink,
+		HasChecksum:         true,
+		ChecksumInCache:     true,
+		ContentsMatch:       true,
+	}
+
+	rootDir := "project/root"
+
+	// a.yaml sorts first, but it depends on z.yaml.
+	newIndex := func() Index {
+		return Index{
+			"a.yaml": &stage.Stage{
+				Inputs: map[string]*artifact.Artifact{
+					"z.bin": {Path: "z.bin", SkipCache: true},
+				},
+				Outputs: map[string]*artifact.Artifact{
+					"a.bin": {Path: "a.bin"},
+				},
+			},
+			"z.yaml": &stage.Stage{
+				Outputs: map[string]*artifact.Artifact{
+					"z.bin": {Path: "z.bin"},
+				},
+			},
+		}
+	}
+
+	t.Run("sends upstream stages first", func(t *testing.T) {
+		idx := newIndex()
+		mockCache := mocks.Cache{}
+		zStatus := expectStageStatusCalled(idx["z.yaml"], &mockCache, rootDir, upToDate, false)
+		zStatus.Skipped = true
+		aStatus := expectStageStatusCalled(idx["a.yaml"], &mockCache, rootDir, upToDate, false)
+		aStatus.Skipped = true
+		aStatus.Inputs = map[string]string{"z.bin": "z.yaml"}
+
+		var got []StageResult
+		for result := range idx.StatusStream(context.Background(), &mockCache, rootDir, false) {
+			got = append(got, result)
+		}
+
+		want := []StageResult{
+			{Path: "z.yaml", Status: zStatus},
+			{Path: "a.yaml", Status: aStatus},
+		}
+		mockCache.AssertExpectations(t)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("StatusStream -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("sends errors and continues", func(t *testing.T) {
+		idx := newIndex()
+		delete(idx["a.yaml"].Inputs, "z.bin")
+		mockCache := mocks.Cache{}
+		mockCache.On("Status", rootDir, *idx["a.yaml"].Outputs["a.bin"], false).
+			Return(artifact.Status{}, errors.New("mock error")).Once()
+		zStatus := expectStageStatusCalled(idx["z.yaml"], &mockCache, rootDir, upToDate, false)
+		zStatus.Skipped = true
+
+		var got []StageResult
+		for result := range idx.StatusStream(context.Background(), &mockCache, rootDir, false) {
+			got = append(got, result)
+		}
+
+		mockCache.AssertExpectations(t)
+		if len(got) != 2 {
+			t.Fatalf("got %d results, want 2", len(got))
+		}
+		if got[0].Path != "a.yaml" || got[0].Err == nil {
+			t.Fatalf("expected error for a.yaml, got %+v", got[0])
+		}
+		if diff := cmp.Diff(StageResult{Path: "z.yaml", Status: zStatus}, got[1]); diff != "" {
+			t.Fatalf("StageResult -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		idx := newIndex()
+		mockCache := mocks.Cache{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for result := range idx.StatusStream(ctx, &mockCache, rootDir, false) {
+			t.Fatalf("unexpected result %+v", result)
+		}
+		mockCache.AssertExpectations(t)
+	})
+}
@@ -6,11 +6,15 @@ import (
 	agglog "github.com/kevin-hanselman/dud/src/agglog"
 	artifact "github.com/kevin-hanselman/dud/src/artifact"
 
+	io "io"
+
 	mock "github.com/stretchr/testify/mock"
 
 	pb "github.com/cheggaaa/pb/v3"
 
 	strategy "github.com/kevin-hanselman/dud/src/strategy"
+
+	cache "github.com/kevin-hanselman/dud/src/cache"
 )
 
 // Cache is an autogenerated mock type for the Cache type
@@ -33,12 +37,33 @@ func (_m *Cache) Checkout(workDir string, art artifact.Artifact, s strategy.Chec
 }
 
 // Commit provides a mock function with given fields: workDir, art, s, l
-func (_m *Cache) Commit(workDir string, art *artifact.Artifact, s strategy.CheckoutStrategy, l *agglog.AggLogger) error {
+func (_m *Cache) Commit(workDir string, art *artifact.Artifact, s strategy.CheckoutStrategy, l *agglog.AggLogger) (cache.CommitResult, error) {
 	ret := _m.Called(workDir, art, s, l)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(string, *artifact.Artifact, strategy.CheckoutStrategy, *agglog.AggLogger) error); ok {
+	var r0 cache.CommitResult
+	if rf, ok := ret.Get(0).(func(string, *artifact.Artifact, strategy.CheckoutStrategy, *agglog.AggLogger) cache.CommitResult); ok {
 		r0 = rf(workDir, art, s, l)
+	} else {
+		r0 = ret.Get(0).(cache.CommitResult)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, *artifact.Artifact, strategy.CheckoutStrategy, *agglog.AggLogger) error); ok {
+		r1 = rf(workDir, art, s, l)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CommitStream provides a mock function with given fields: workDir, art, r, s
+func (_m *Cache) CommitStream(workDir string, art *artifact.Artifact, r io.Reader, s strategy.CheckoutStrategy) error {
+	ret := _m.Called(workDir, art, r, s)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, *artifact.Artifact, io.Reader, strategy.CheckoutStrategy) error); ok {
+		r0 = rf(workDir, art, r, s)
 	} else {
 		r0 = ret.Error(0)
 	}
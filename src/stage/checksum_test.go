@@ -133,6 +133,43 @@ func TestCalculateChecksum(t *testing.T) {
 		}
 	})
 
+	t.Run("output artifact fingerprints should not affect checksum", func(t *testing.T) {
+		stg := newStage()
+		originalChecksum, err := stg.CalculateChecksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stg.Outputs["foo.txt"].Fingerprint = "3-123456789"
+
+		newChecksum, err := stg.CalculateChecksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(originalChecksum, newChecksum); diff != "" {
+			t.Fatalf("CalculateChecksum -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("artifact content types should not affect checksum", func(t *testing.T) {
+		stg := newStage()
+		originalChecksum, err := stg.CalculateChecksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stg.Outputs["foo.txt"].ContentType = "text/plain; charset=utf-8"
+		stg.Inputs["b"].ContentType = "text/csv"
+
+		newChecksum, err := stg.CalculateChecksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(originalChecksum, newChecksum); diff != "" {
+			t.Fatalf("CalculateChecksum -want +got:\n%s", diff)
+		}
+	})
+
 	t.Run("artifact flags should affect checksum", func(t *testing.T) {
 		stg := newStage()
 		originalChecksum, err := stg.CalculateChecksum()
@@ -0,0 +1,107 @@
+package stage
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// fileFormat is the encoding of a stage file.
+type fileFormat int
+
+const (
+	yamlFormat fileFormat = iota
+	jsonFormat
+	tomlFormat
+)
+
+// formatForPath returns the encoding of the stage file at path, according to
+// its extension. Files with an extension other than .json or .toml are YAML.
+func formatForPath(path string) fileFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return jsonFormat
+	case ".toml":
+		return tomlFormat
+	}
+	return yamlFormat
+}
+
+// stageFile holds a Stage as it is written to JSON and TOML stage files, with
+// the same field names as YAML stage files. Stage itself can't have JSON
+// struct tags, because its checksum is calculated from its JSON encoding.
+type stageFile struct {
+	Checksum   string                        `json:"checksum,omitempty" toml:"checksum,omitempty"`
+	Signature  string                        `json:"signature,omitempty" toml:"signature,omitempty"`
+	Command    string                        `json:"command,omitempty" toml:"command,omitempty"`
+	WorkingDir string                        `json:"working-dir,omitempty" toml:"working-dir,omitempty"`
+	Env        map[string]string             `json:"env,omitempty" toml:"env,omitempty"`
+	Frozen     bool                          `json:"frozen,omitempty" toml:"frozen,omitempty"`
+	Inputs     map[string]*artifact.Artifact `json:"inputs,omitempty" toml:"inputs,omitempty"`
+	Outputs    map[string]*artifact.Artifact `json:"outputs" toml:"outputs"`
+}
+
+// fromStageFile decodes the stage file at path into stg, in the encoding
+// given by the file's extension.
+func fromStageFile(path string, stg *Stage) error {
+	switch formatForPath(path) {
+	case jsonFormat:
+		return fromJSONFile(path, stg)
+	case tomlFormat:
+		return fromTOMLFile(path, stg)
+	}
+	return fromYamlFile(path, stg)
+}
+
+func fromJSONFile(path string, stg *Stage) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	var sf stageFile
+	if err := decoder.Decode(&sf); err != nil {
+		return errors.Wrap(err, path)
+	}
+	*stg = Stage(sf)
+	return nil
+}
+
+func fromTOMLFile(path string, stg *Stage) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := toml.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	var sf stageFile
+	if err := decoder.Decode(&sf); err != nil {
+		return errors.Wrap(err, path)
+	}
+	*stg = Stage(sf)
+	return nil
+}
+
+// serializeAs writes a Stage to the given writer in the given encoding.
+func (stg *Stage) serializeAs(writer io.Writer, format fileFormat) error {
+	out := stageFile(stg.toFileFormat())
+	switch format {
+	case jsonFormat:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(out)
+	case tomlFormat:
+		return toml.NewEncoder(writer).Encode(out)
+	}
+	return yaml.NewEncoder(writer).Encode(Stage(out))
+}
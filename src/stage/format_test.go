@@ -0,0 +1,110 @@
+package stage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kevin-hanselman/dud/src/artifact"
+)
+
+func TestFileFormats(t *testing.T) {
+	newStage := func() Stage {
+		return Stage{
+			Checksum:   "abc",
+			Signature:  "jkl",
+			Command:    "python train.py",
+			WorkingDir: "src",
+			Env:        map[string]string{"DATA_ROOT": "${HOME}/data"},
+			Frozen:     true,
+			Inputs: map[string]*artifact.Artifact{
+				"data": {Path: "data", IsDir: true, SkipCache: true},
+			},
+			Outputs: map[string]*artifact.Artifact{
+				"model.bin": {Path: "model.bin", Checksum: "def"},
+				"metrics":   {Path: "metrics", IsDir: true, Include: []string{"*.json"}},
+			},
+		}
+	}
+
+	for _, ext := range []string{".yaml", ".json", ".toml"} {
+		t.Run("round trip "+ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "train"+ext)
+			stg := newStage()
+			if err := stg.ToFile(path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := FromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(newStage(), got); diff != "" {
+				t.Fatalf("FromFile -want +got:\n%s", diff)
+			}
+		})
+	}
+
+	handWritten := map[string]string{
+		"stage.json": `{
+  "command": "python train.py",
+  "working-dir": "src",
+  "env": {"DATA_ROOT": "${HOME}/data"},
+  "frozen": true,
+  "inputs": {"data": {"is-dir": true}},
+  "outputs": {"model.bin": {"checksum": "def"}, "metrics": {"is-dir": true, "include": ["*.json"]}}
+}`,
+		"stage.toml": `command = "python train.py"
+working-dir = "src"
+frozen = true
+
+[env]
+DATA_ROOT = "${HOME}/data"
+
+[inputs.data]
+is-dir = true
+
+[outputs."model.bin"]
+checksum = "def"
+
+[outputs.metrics]
+is-dir = true
+include = ["*.json"]
+`,
+	}
+	for name, contents := range handWritten {
+		t.Run("read "+name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := FromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := newStage()
+			want.Checksum = ""
+			want.Signature = ""
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("FromFile -want +got:\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("unknown fields are rejected", func(t *testing.T) {
+		for name, contents := range map[string]string{
+			"stage.json": `{"outputs": {"foo.txt": {}}, "cmd": "echo"}`,
+			"stage.toml": "cmd = \"echo\"\n[outputs.\"foo.txt\"]\n",
+		} {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := FromFile(path)
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("%s: expected decode error, got %v", name, err)
+			}
+		}
+	})
+}
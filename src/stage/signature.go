@@ -0,0 +1,70 @@
+package stage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/kevin-hanselman/dud/src/checksum"
+	"github.com/pkg/errors"
+)
+
+// signaturePrefix separates Stage signatures from signatures the same key may
+// make for other purposes.
+const signaturePrefix = "dud stage signature v1\x00"
+
+// signedMessage returns the bytes covered by the Stage's signature.
+func (stg Stage) signedMessage() []byte {
+	buf := bytes.NewBufferString(signaturePrefix)
+	fmt.Fprintf(buf, "%s\x00%s", stg.Checksum, stg.outputsChecksum())
+	return buf.Bytes()
+}
+
+// outputsChecksum returns the checksum of the paths and checksums of all the
+// Stage's outputs. The outputs are sorted by path, so the checksum doesn't
+// depend on their order. Stages without outputs have no such checksum, so an
+// empty string is returned.
+func (stg Stage) outputsChecksum() string {
+	if len(stg.Outputs) == 0 {
+		return ""
+	}
+	paths := make([]string, 0, len(stg.Outputs))
+	for path := range stg.Outputs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	buf := new(bytes.Buffer)
+	for _, path := range paths {
+		fmt.Fprintf(buf, "%s\x00%s\n", path, stg.Outputs[path].Checksum)
+	}
+	// Reading from a bytes.Buffer never fails.
+	cksum, _ := checksum.Checksum(buf)
+	return cksum
+}
+
+// Sign sets the Stage's Signature to a signature of its Checksum and the paths
+// and checksums of all its outputs made with key, so the signature vouches for
+// every output checksum recorded in the Stage.
+func (stg *Stage) Sign(key ed25519.PrivateKey) {
+	sig := ed25519.Sign(key, stg.signedMessage())
+	stg.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+// VerifySignature returns an error if the Stage's Signature isn't a valid
+// signature of its Checksum and output checksums made with the private half of
+// key.
+func (stg Stage) VerifySignature(key ed25519.PublicKey) error {
+	if stg.Signature == "" {
+		return errors.New("stage is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(stg.Signature)
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+	if !ed25519.Verify(key, stg.signedMessage(), sig) {
+		return errors.New("signature is invalid")
+	}
+	return nil
+}
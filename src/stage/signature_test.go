@@ -0,0 +1,147 @@
+package stage
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/kevin-hanselman/dud/src/artifact"
+)
+
+func TestSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSignedStage := func(t *testing.T) Stage {
+		stg := Stage{
+			Checksum: "abc",
+			Outputs: map[string]*artifact.Artifact{
+				"foo.txt": {Path: "foo.txt", Checksum: "def"},
+				"bar":     {Path: "bar", Checksum: "ghi", IsDir: true},
+			},
+		}
+		stg.Sign(priv)
+		return stg
+	}
+
+	expectError := func(t *testing.T, stg Stage, key ed25519.PublicKey, want string) {
+		t.Helper()
+		err := stg.VerifySignature(key)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q doesn't contain %q", err, want)
+		}
+	}
+
+	t.Run("valid signature", func(t *testing.T) {
+		stg := newSignedStage(t)
+		if err := stg.VerifySignature(pub); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("signing is deterministic", func(t *testing.T) {
+		if a, b := newSignedStage(t), newSignedStage(t); a.Signature != b.Signature {
+			t.Fatalf("signatures differ: %q != %q", a.Signature, b.Signature)
+		}
+	})
+
+	t.Run("unsigned stage", func(t *testing.T) {
+		stg := newSignedStage(t)
+		stg.Signature = ""
+		expectError(t, stg, pub, "not signed")
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		otherPub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectError(t, newSignedStage(t), otherPub, "invalid")
+	})
+
+	t.Run("modified definition checksum", func(t *testing.T) {
+		stg := newSignedStage(t)
+		stg.Checksum = "xyz"
+		expectError(t, stg, pub, "invalid")
+	})
+
+	t.Run("modified output checksum", func(t *testing.T) {
+		stg := newSignedStage(t)
+		stg.Outputs["foo.txt"].Checksum = "xyz"
+		expectError(t, stg, pub, "invalid")
+	})
+
+	t.Run("malformed signature", func(t *testing.T) {
+		stg := newSignedStage(t)
+		stg.Signature = "not base64!"
+		expectError(t, stg, pub, "decode signature")
+	})
+}
+
+func TestOutputsChecksum(t *testing.T) {
+	newStage := func() Stage {
+		return Stage{
+			Command: "echo",
+			Outputs: map[string]*artifact.Artifact{
+				"foo.txt": {Checksum: "bish", Path: "foo.txt"},
+				"bar.txt": {Checksum: "bash", Path: "bar.txt"},
+			},
+			Inputs: map[string]*artifact.Artifact{
+				"b": {Checksum: "bosh", Path: "b", IsDir: true},
+			},
+		}
+	}
+	want := newStage().outputsChecksum()
+	if want == "" {
+		t.Fatal("outputsChecksum returned empty string")
+	}
+
+	t.Run("ignores everything but outputs", func(t *testing.T) {
+		stg := newStage()
+		stg.Command = "echo changed"
+		stg.Inputs["b"].Checksum = "changed"
+		got := stg.outputsChecksum()
+		if got != want {
+			t.Fatalf("got checksum %#v, want %#v", got, want)
+		}
+	})
+
+	changes := map[string]func(*Stage){
+		"output checksum": func(stg *Stage) {
+			stg.Outputs["foo.txt"].Checksum = "changed"
+		},
+		"output path": func(stg *Stage) {
+			art := stg.Outputs["foo.txt"]
+			delete(stg.Outputs, "foo.txt")
+			art.Path = "fizz.txt"
+			stg.Outputs[art.Path] = art
+		},
+		"new output": func(stg *Stage) {
+			stg.Outputs["fizz.txt"] = &artifact.Artifact{Path: "fizz.txt"}
+		},
+	}
+	for name, change := range changes {
+		t.Run("changes with "+name, func(t *testing.T) {
+			stg := newStage()
+			change(&stg)
+			got := stg.outputsChecksum()
+			if got == want {
+				t.Fatalf("expected checksum to change from %#v", want)
+			}
+		})
+	}
+
+	t.Run("no outputs", func(t *testing.T) {
+		stg := newStage()
+		stg.Outputs = nil
+		got := stg.outputsChecksum()
+		if got != "" {
+			t.Fatalf("got checksum %#v, want none", got)
+		}
+	})
+}
@@ -8,15 +8,23 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/kevin-hanselman/dud/src/artifact"
 	"github.com/kevin-hanselman/dud/src/checksum"
+	"github.com/kevin-hanselman/dud/src/fsutil"
 	"github.com/pkg/errors"
 
 	"gopkg.in/yaml.v2"
 )
 
+// SchemaVersion is the version of the stage file schema. Stage files double as
+// Dud's lock files, because they record the checksums of committed Artifacts.
+// It changes whenever a stage file written by Dud can't be read by older
+// versions.
+const SchemaVersion = 1
+
 // A Stage holds all information required to reproduce data. It is the primary
 // building block of Dud pipelines.
 type Stage struct {
@@ -24,6 +32,11 @@ type Stage struct {
 	// checksums. This checksum is used to determine when a Stage definition
 	// has been modified by the user.
 	Checksum string `yaml:",omitempty"`
+	// Signature is a base64-encoded Ed25519 signature of Checksum and the
+	// Stage's output checksums, written during commit if a signing key is
+	// configured. See Sign and VerifySignature. It is left out of the Stage's
+	// JSON encoding, so it doesn't affect Checksum.
+	Signature string `yaml:",omitempty" json:"-"`
 	// Command is the string to be evaluated and executed by a shell.
 	Command string `yaml:",omitempty"`
 	// WorkingDir is the directory in which the Stage's command is executed. It
@@ -32,6 +45,17 @@ type Stage struct {
 	// directory. WorkingDir only affects the Stage's command; all inputs and
 	// outputs of the Stage should have paths relative to the project root.
 	WorkingDir string `yaml:"working-dir,omitempty"`
+	// Env holds environment variables set for the Stage's command, on top of
+	// those Dud itself was run with. A value can reference other variables as
+	// $VAR or ${VAR}. A reference to a variable the Stage sets expands to the
+	// Stage's value, except that a variable referencing itself (e.g. a PATH
+	// of "${PATH}:bin") expands to the inherited value.
+	Env map[string]string `yaml:",omitempty" json:",omitempty"`
+	// If Frozen is true then commit leaves the Stage's recorded checksums as
+	// they are, unless told to thaw it. This protects reference data from
+	// being overwritten by accidental local modifications. It is left out of
+	// the Stage's JSON encoding, so freezing a Stage doesn't affect Checksum.
+	Frozen bool `yaml:",omitempty" json:"-"`
 	// Inputs is a set of Artifacts which the Stage's Command needs to
 	// operate. The Artifacts are keyed by their Path for faster lookup.
 	Inputs map[string]*artifact.Artifact `yaml:",omitempty"`
@@ -40,14 +64,33 @@ type Stage struct {
 	Outputs map[string]*artifact.Artifact
 }
 
-// Status holds everything necessary to qualify the state of a Stage.
-type Status struct {
+// DefinitionStatus qualifies the state of a Stage's definition, independent
+// of the state of the Stage's Artifacts.
+type DefinitionStatus struct {
+	// Skipped is true if the Stage definition was not checked, in which case
+	// all other fields are false.
+	Skipped bool
 	// HasChecksum is true if the Stage had a non-empty Checksum field.
 	HasChecksum bool
 	// ChecksumMatches is true if the checksum of the Stage's definition
 	// matches its Checksum field.
 	ChecksumMatches bool
-	ArtifactStatus  map[string]artifact.Status
+}
+
+// Status holds everything necessary to qualify the state of a Stage.
+type Status struct {
+	// DefinitionStatus is embedded for convenience, but it is serialized as
+	// a separate object to keep it distinct from the Artifact statuses.
+	DefinitionStatus `json:"Definition"`
+	ArtifactStatus   map[string]artifact.Status
+	// Inputs maps the path of each of the Stage's inputs to the path of the
+	// Stage that owns it, or to an empty string if no Stage owns it. The
+	// statuses of unowned inputs are in ArtifactStatus, and the statuses of
+	// owned inputs are in their owner's Status. All other Artifacts in
+	// ArtifactStatus are outputs.
+	Inputs map[string]string `json:",omitempty"`
+	// Frozen is true if the Stage is frozen. See Stage.Frozen.
+	Frozen bool `json:",omitempty"`
 }
 
 // NewStatus initializes a new Status object.
@@ -59,8 +102,11 @@ func NewStatus() Status {
 
 func (stg Stage) toFileFormat() (out Stage) {
 	out.Checksum = stg.Checksum
+	out.Signature = stg.Signature
 	out.Command = stg.Command
 	out.WorkingDir = stg.WorkingDir
+	out.Env = stg.Env
+	out.Frozen = stg.Frozen
 
 	if len(stg.Inputs) > 0 {
 		out.Inputs = make(map[string]*artifact.Artifact, len(stg.Inputs))
@@ -102,14 +148,18 @@ var fromYamlFile = func(path string, stg *Stage) error {
 	return nil
 }
 
-// FromFile loads a Stage from a file.
+// FromFile loads a Stage from a file. Files ending in .json or .toml are
+// decoded as JSON or TOML respectively. All other files are decoded as YAML.
 func FromFile(stagePath string) (stg Stage, err error) {
 	var tempStage Stage
-	if err = fromYamlFile(stagePath, &tempStage); err != nil {
+	if err = fromStageFile(stagePath, &tempStage); err != nil {
 		return
 	}
 	stg.Checksum = tempStage.Checksum
+	stg.Signature = tempStage.Signature
 	stg.Command = strings.TrimSpace(tempStage.Command)
+	stg.Env = tempStage.Env
+	stg.Frozen = tempStage.Frozen
 	stg.Inputs = make(map[string]*artifact.Artifact, len(stg.Inputs))
 	stg.Outputs = make(map[string]*artifact.Artifact, len(stg.Outputs))
 
@@ -162,6 +212,14 @@ func (stg Stage) Validate(stagePath string) error {
 		return errors.New("declared no outputs and no command")
 	}
 
+	if err := stg.validateCaptures(); err != nil {
+		return err
+	}
+
+	if _, err := stg.expandEnv(func(string) (string, bool) { return "", false }); err != nil {
+		return err
+	}
+
 	// First, check for direct overlap between Outputs and Inputs.
 	// Consolidate all Artifacts into a single map to facilitate the next step.
 	// TODO: Only consolidate Artifacts with IsDir = true?
@@ -194,6 +252,22 @@ func (stg Stage) Validate(stagePath string) error {
 		if filepath.IsAbs(artPath) {
 			return fmt.Errorf("artifact %s is an absolute path", artPath)
 		}
+		if allArtifacts[artPath].Ordered && !allArtifacts[artPath].IsDir {
+			return fmt.Errorf("artifact %s is ordered but not a directory", artPath)
+		}
+		if allArtifacts[artPath].PreserveHardlinks && !allArtifacts[artPath].IsDir {
+			return fmt.Errorf("artifact %s preserves hard links but is not a directory", artPath)
+		}
+		if allArtifacts[artPath].Chunked && allArtifacts[artPath].IsDir {
+			return fmt.Errorf("artifact %s is chunked but is a directory", artPath)
+		}
+		hasPatterns := len(allArtifacts[artPath].Include)+len(allArtifacts[artPath].Exclude) > 0
+		if hasPatterns && !allArtifacts[artPath].IsDir {
+			return fmt.Errorf("artifact %s has include/exclude patterns but is not a directory", artPath)
+		}
+		if err := allArtifacts[artPath].ValidatePatterns(); err != nil {
+			return errors.Wrapf(err, "artifact %s", artPath)
+		}
 		parentArt, ok := FindDirArtifactOwnerForPath(artPath, allArtifacts)
 		if ok {
 			return fmt.Errorf(
@@ -206,25 +280,68 @@ func (stg Stage) Validate(stagePath string) error {
 	return nil
 }
 
-// Serialize writes a Stage to the given writer.
+// validateCaptures checks that only outputs capture the Stage's command
+// output, and that at most one does.
+func (stg Stage) validateCaptures() error {
+	for artPath, art := range stg.Inputs {
+		if art.Capture != "" {
+			return fmt.Errorf("artifact %s is an input but captures %s", artPath, art.Capture)
+		}
+	}
+	capturedBy := ""
+	for artPath, art := range stg.Outputs {
+		if art.Capture == "" {
+			continue
+		}
+		if art.Capture != artifact.CaptureStdout {
+			return fmt.Errorf("artifact %s captures unknown stream %#v", artPath, art.Capture)
+		}
+		if art.IsDir || art.SkipCache || art.Chunked {
+			return fmt.Errorf(
+				"artifact %s captures %s but is a directory, chunked, or skips the cache",
+				artPath,
+				art.Capture,
+			)
+		}
+		if capturedBy != "" {
+			return fmt.Errorf("artifacts %s and %s both capture %s", capturedBy, artPath, art.Capture)
+		}
+		capturedBy = artPath
+	}
+	if capturedBy != "" && stg.Command == "" {
+		return fmt.Errorf("artifact %s captures stdout but the stage has no command", capturedBy)
+	}
+	return nil
+}
+
+// CapturedOutput returns the output Artifact that captures the standard output
+// of the Stage's command, if any.
+func (stg Stage) CapturedOutput() (*artifact.Artifact, bool) {
+	for _, art := range stg.Outputs {
+		if art.Capture == artifact.CaptureStdout {
+			return art, true
+		}
+	}
+	return nil, false
+}
+
+// Serialize writes a Stage to the given writer as YAML.
 func (stg *Stage) Serialize(writer io.Writer) error {
-	return yaml.NewEncoder(writer).Encode(stg.toFileFormat())
+	return stg.serializeAs(writer, yamlFormat)
 }
 
-// ToFile writes a Stage to the given file path.
+// ToFile writes a Stage to the given file path, in the encoding given by the
+// path's extension. See FromFile.
 func (stg *Stage) ToFile(path string) error {
 	errPrefix := "writing stage " + path
 	// TODO: If we stop relying on the project-wide lock file, this should be
 	// flocked.
-	stageFile, err := os.Create(path)
-	if err != nil {
-		return errors.Wrap(err, errPrefix)
-	}
-	defer stageFile.Close()
-	if err := stg.Serialize(stageFile); err != nil {
-		return errors.Wrap(err, errPrefix)
-	}
-	return nil
+	// The stage file is replaced atomically, so an interrupted write never
+	// leaves a stage that references only some of its new checksums.
+	err := fsutil.WriteFileAtomic(path, 0o644, func(w io.Writer) error {
+		return stg.serializeAs(w, formatForPath(path))
+	})
+	return errors.Wrap(err, errPrefix)
 }
 
 // CalculateChecksum returns the checksum of the Stage as it would be set in
@@ -233,17 +350,24 @@ func (stg Stage) CalculateChecksum() (string, error) {
 	cleanStage := Stage{
 		Command:    stg.Command,
 		WorkingDir: stg.WorkingDir,
+		Env:        stg.Env,
 	}
 	cleanStage.Inputs = make(map[string]*artifact.Artifact, len(stg.Inputs))
 	for _, art := range stg.Inputs {
 		newArt := *art
 		newArt.Checksum = ""
+		newArt.Fingerprint = ""
+		newArt.Xattrs = nil
+		newArt.ContentType = ""
 		cleanStage.Inputs[art.Path] = &newArt
 	}
 	cleanStage.Outputs = make(map[string]*artifact.Artifact, len(stg.Outputs))
 	for _, art := range stg.Outputs {
 		newArt := *art
 		newArt.Checksum = ""
+		newArt.Fingerprint = ""
+		newArt.Xattrs = nil
+		newArt.ContentType = ""
 		cleanStage.Outputs[art.Path] = &newArt
 	}
 	// We can't use encoding/gob here because maps aren't serialized in
@@ -256,13 +380,96 @@ func (stg Stage) CalculateChecksum() (string, error) {
 	return checksum.Checksum(buf)
 }
 
-// CreateCommand return an exec.Cmd for the Stage.
-func (stg Stage) CreateCommand() *exec.Cmd {
+// CreateCommand return an exec.Cmd for the Stage. The command's environment
+// is Dud's own environment with the Stage's Env applied on top.
+func (stg Stage) CreateCommand() (*exec.Cmd, error) {
 	cmd := exec.Command("sh", "-c", stg.Command)
 	cmd.Dir = filepath.Clean(stg.WorkingDir)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd
+	if len(stg.Env) > 0 {
+		env, err := stg.Environ(os.Environ())
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = env
+	}
+	return cmd, nil
+}
+
+// Environ returns the environment for the Stage's command, in the form of
+// os.Environ, given the environment it inherits. Variables in inherited that
+// the Stage sets are replaced by the Stage's values.
+func (stg Stage) Environ(inherited []string) ([]string, error) {
+	inheritedVars := make(map[string]string, len(inherited))
+	env := make([]string, 0, len(inherited)+len(stg.Env))
+	for _, keyValue := range inherited {
+		name, value, _ := strings.Cut(keyValue, "=")
+		inheritedVars[name] = value
+		if _, ok := stg.Env[name]; !ok {
+			env = append(env, keyValue)
+		}
+	}
+	expanded, err := stg.expandEnv(func(name string) (string, bool) {
+		value, ok := inheritedVars[name]
+		return value, ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(expanded))
+	for name := range expanded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+expanded[name])
+	}
+	return env, nil
+}
+
+// expandEnv returns the Stage's Env with all references to variables
+// expanded. References to variables the Stage doesn't set, including a
+// variable's reference to itself, are resolved with lookupInherited.
+func (stg Stage) expandEnv(lookupInherited func(string) (string, bool)) (map[string]string, error) {
+	expanded := make(map[string]string, len(stg.Env))
+	expanding := make(map[string]bool)
+	var expand func(name string) (string, error)
+	expand = func(name string) (string, error) {
+		if value, ok := expanded[name]; ok {
+			return value, nil
+		}
+		if expanding[name] {
+			return "", fmt.Errorf("environment variable %s references itself through other variables", name)
+		}
+		expanding[name] = true
+		var err error
+		value := os.Expand(stg.Env[name], func(ref string) string {
+			if _, ok := stg.Env[ref]; ok && ref != name {
+				refValue, refErr := expand(ref)
+				if refErr != nil && err == nil {
+					err = refErr
+				}
+				return refValue
+			}
+			refValue, _ := lookupInherited(ref)
+			return refValue
+		})
+		if err != nil {
+			return "", err
+		}
+		expanded[name] = value
+		return value, nil
+	}
+	for name := range stg.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return nil, fmt.Errorf("invalid environment variable name %#v", name)
+		}
+		if _, err := expand(name); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
 }
 
 // FindDirArtifactOwnerForPath searches the given map for a directory Artifact
@@ -90,6 +90,48 @@ func TestFromFile(t *testing.T) {
 		}
 	})
 
+	t.Run("fail if file artifact is ordered", func(t *testing.T) {
+		defer resetFromYamlFileMock()
+		stageFile := Stage{
+			Outputs: map[string]*artifact.Artifact{
+				"foo.txt": {Ordered: true},
+			},
+		}
+		fromYamlFile = func(path string, output *Stage) error {
+			if path == "stage.yaml" {
+				*output = stageFile
+				return nil
+			}
+			return os.ErrNotExist
+		}
+
+		err := fromFileErr("stage.yaml")
+		if err == nil {
+			t.Fatal("expected FromFile to return error")
+		}
+	})
+
+	t.Run("fail if file artifact preserves hard links", func(t *testing.T) {
+		defer resetFromYamlFileMock()
+		stageFile := Stage{
+			Outputs: map[string]*artifact.Artifact{
+				"foo.txt": {PreserveHardlinks: true},
+			},
+		}
+		fromYamlFile = func(path string, output *Stage) error {
+			if path == "stage.yaml" {
+				*output = stageFile
+				return nil
+			}
+			return os.ErrNotExist
+		}
+
+		err := fromFileErr("stage.yaml")
+		if err == nil {
+			t.Fatal("expected FromFile to return error")
+		}
+	})
+
 	t.Run("fail if output dir artifact would contain a input", func(t *testing.T) {
 		defer resetFromYamlFileMock()
 		stageFile := Stage{
@@ -415,4 +457,129 @@ func TestFromFile(t *testing.T) {
 			t.Fatalf("error -want +got:\n%s", diff)
 		}
 	})
+
+	t.Run("validate captured outputs", func(t *testing.T) {
+		defer resetFromYamlFileMock()
+		var stageFile Stage
+		fromYamlFile = func(path string, output *Stage) error {
+			if path == "stage.yaml" {
+				*output = stageFile
+				return nil
+			}
+			return os.ErrNotExist
+		}
+
+		stageFile = Stage{
+			Command: "echo hello",
+			Outputs: map[string]*artifact.Artifact{
+				"foo.txt": {Capture: "stdout"},
+				"bar.txt": {},
+			},
+		}
+		stg, err := FromFile("stage.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		art, ok := stg.CapturedOutput()
+		if !ok || art.Path != "foo.txt" {
+			t.Fatalf("CapturedOutput() = %v, %v, want foo.txt", art, ok)
+		}
+
+		tests := map[string]struct {
+			stg  Stage
+			want string
+		}{
+			"unknown stream": {
+				stg: Stage{
+					Command: "echo hello",
+					Outputs: map[string]*artifact.Artifact{"foo.txt": {Capture: "stderr"}},
+				},
+				want: `artifact foo.txt captures unknown stream "stderr"`,
+			},
+			"no command": {
+				stg: Stage{
+					Outputs: map[string]*artifact.Artifact{"foo.txt": {Capture: "stdout"}},
+				},
+				want: "artifact foo.txt captures stdout but the stage has no command",
+			},
+			"input": {
+				stg: Stage{
+					Command: "echo hello",
+					Inputs:  map[string]*artifact.Artifact{"foo.txt": {Capture: "stdout"}},
+				},
+				want: "artifact foo.txt is an input but captures stdout",
+			},
+			"directory": {
+				stg: Stage{
+					Command: "echo hello",
+					Outputs: map[string]*artifact.Artifact{"foo": {IsDir: true, Capture: "stdout"}},
+				},
+				want: "artifact foo captures stdout but is a directory, chunked, or skips the cache",
+			},
+		}
+		for name, test := range tests {
+			t.Run(name, func(t *testing.T) {
+				stageFile = test.stg
+				err := fromFileErr("stage.yaml")
+				if err == nil {
+					t.Fatal("expected FromFile to return error")
+				}
+				if diff := cmp.Diff(test.want, err.Error()); diff != "" {
+					t.Fatalf("error -want +got:\n%s", diff)
+				}
+			})
+		}
+	})
+}
+
+func TestEnviron(t *testing.T) {
+	inherited := []string{"PATH=/usr/bin", "HOME=/home/user", "DATA_ROOT=/old"}
+
+	t.Run("stage variables replace inherited variables", func(t *testing.T) {
+		stg := Stage{Env: map[string]string{
+			"DATA_ROOT": "${HOME}/data",
+			"PATH":      "${PATH}:bin",
+			"RAW":       "$DATA_ROOT/raw",
+			"MISSING":   "x${NOT_SET}x",
+		}}
+		got, err := stg.Environ(inherited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"HOME=/home/user",
+			"DATA_ROOT=/home/user/data",
+			"MISSING=xx",
+			"PATH=/usr/bin:bin",
+			"RAW=/home/user/data/raw",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Environ -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("no stage variables", func(t *testing.T) {
+		got, err := Stage{}.Environ(inherited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(inherited, got); diff != "" {
+			t.Fatalf("Environ -want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("error on reference cycle", func(t *testing.T) {
+		stg := Stage{
+			Env: map[string]string{"A": "${B}", "B": "${A}"},
+			Outputs: map[string]*artifact.Artifact{
+				"foo.txt": {Path: "foo.txt"},
+			},
+		}
+		if _, err := stg.Environ(inherited); err == nil {
+			t.Fatal("Environ: expected error")
+		}
+		if err := stg.Validate(""); err == nil {
+			t.Fatal("Validate: expected error")
+		}
+	})
 }
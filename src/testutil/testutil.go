@@ -107,6 +107,17 @@ func AllFileTestCases() (out []artifact.Status) {
 		)
 	}
 
+	// The checksum may be set before the file is committed.
+	out = append(
+		out,
+		artifact.Status{
+			WorkspaceFileStatus: fsutil.StatusRegularFile,
+			HasChecksum:         true,
+			ChecksumInCache:     false,
+			ContentsMatch:       true,
+		},
+	)
+
 	// Add Artifacts.
 	for i := range out {
 		out[i].Artifact = artifact.Artifact{SkipCache: false}